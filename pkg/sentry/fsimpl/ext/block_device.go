@@ -0,0 +1,125 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"container/list"
+	"io"
+
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// DefaultMetadataCacheBlocks is the number of metadata blocks (inode table
+// blocks, extent tree nodes and indirect blocks) cached per filesystem unless
+// configured otherwise. See FilesystemOptions.MetadataCacheBlocks.
+const DefaultMetadataCacheBlocks = 256
+
+// BlockDevice reads whole blocks of an ext filesystem. Its ReadBlock method
+// can be used as a disklayout.BlockReader.
+type BlockDevice interface {
+	// ReadBlock returns the contents of the block with the given physical block
+	// number. The returned slice may be shared with other callers and must not
+	// be modified. Returns EIO if the block cannot be read in full.
+	ReadBlock(blockNum uint64) ([]byte, error)
+
+	// BlockSize returns the size of the blocks returned by ReadBlock.
+	BlockSize() uint64
+}
+
+// blockDevice implements BlockDevice over an io.ReaderAt, caching the most
+// recently read blocks.
+type blockDevice struct {
+	// dev is the underlying device. It permits concurrent reads.
+	dev io.ReaderAt
+
+	// blockSize is the filesystem block size. Immutable.
+	blockSize uint64
+
+	// cacheBlocks is the maximum number of cached blocks. Immutable.
+	cacheBlocks int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// cache maps block numbers to their element in lru.
+	cache map[uint64]*list.Element
+
+	// lru holds the cached blocks as *cachedBlock, most recently used first.
+	lru list.List
+}
+
+// cachedBlock is a block held by blockDevice.lru.
+type cachedBlock struct {
+	blockNum uint64
+	data     []byte
+}
+
+// Compiles only if blockDevice implements BlockDevice.
+var _ BlockDevice = (*blockDevice)(nil)
+
+// NewBlockDevice returns a BlockDevice reading blocks of blockSize bytes from
+// dev. Up to cacheBlocks of the most recently read blocks are kept in memory;
+// no blocks are cached if it is 0. The BlockDevice is safe for concurrent use
+// if dev is.
+func NewBlockDevice(dev io.ReaderAt, blockSize uint64, cacheBlocks int) BlockDevice {
+	return &blockDevice{
+		dev:         dev,
+		blockSize:   blockSize,
+		cacheBlocks: cacheBlocks,
+		cache:       make(map[uint64]*list.Element),
+	}
+}
+
+// ReadBlock implements BlockDevice.ReadBlock.
+func (d *blockDevice) ReadBlock(blockNum uint64) ([]byte, error) {
+	d.mu.Lock()
+	if e, ok := d.cache[blockNum]; ok {
+		d.lru.MoveToFront(e)
+		data := e.Value.(*cachedBlock).data
+		d.mu.Unlock()
+		return data, nil
+	}
+	d.mu.Unlock()
+
+	// Read without holding mu so that misses do not serialize. Concurrent
+	// misses on the same block read it more than once, which is harmless.
+	data := make([]byte, d.blockSize)
+	if n, _ := d.dev.ReadAt(data, int64(blockNum*d.blockSize)); n < len(data) {
+		return nil, syserror.EIO
+	}
+	if d.cacheBlocks == 0 {
+		return data, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.cache[blockNum]; ok {
+		d.lru.MoveToFront(e)
+		return e.Value.(*cachedBlock).data, nil
+	}
+	d.cache[blockNum] = d.lru.PushFront(&cachedBlock{blockNum: blockNum, data: data})
+	if d.lru.Len() > d.cacheBlocks {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.cache, oldest.Value.(*cachedBlock).blockNum)
+	}
+	return data, nil
+}
+
+// BlockSize implements BlockDevice.BlockSize.
+func (d *blockDevice) BlockSize() uint64 {
+	return d.blockSize
+}
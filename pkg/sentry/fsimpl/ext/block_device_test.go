@@ -0,0 +1,205 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// countingReader is an io.ReaderAt counting the reads from the wrapped
+// io.ReaderAt.
+type countingReader struct {
+	r     io.ReaderAt
+	reads int64
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.r.ReadAt(p, off)
+}
+
+// mockBlocks returns a mock disk of n blocks of blkSize bytes, each of which
+// is filled with its block number.
+func mockBlocks(n, blkSize int) []byte {
+	disk := make([]byte, n*blkSize)
+	for i := range disk {
+		disk[i] = byte(i / blkSize)
+	}
+	return disk
+}
+
+// TestBlockDevice tests that blocks are read in full, that the most recently
+// used blocks are cached and that the least recently used one is evicted.
+func TestBlockDevice(t *testing.T) {
+	const blkSize = 16
+	disk := mockBlocks(4, blkSize)
+	dev := &countingReader{r: bytes.NewReader(disk)}
+	blocks := NewBlockDevice(dev, blkSize, 2)
+
+	for _, step := range []struct {
+		blk       uint64
+		wantReads int64
+	}{
+		{blk: 0, wantReads: 1},
+		{blk: 0, wantReads: 1},
+		{blk: 1, wantReads: 2},
+		{blk: 0, wantReads: 2},
+		// Evicts block 1, which was used least recently.
+		{blk: 2, wantReads: 3},
+		{blk: 0, wantReads: 3},
+		{blk: 1, wantReads: 4},
+	} {
+		data, err := blocks.ReadBlock(step.blk)
+		if err != nil {
+			t.Fatalf("ReadBlock(%d) failed: %v", step.blk, err)
+		}
+		if want := disk[step.blk*blkSize : (step.blk+1)*blkSize]; !bytes.Equal(data, want) {
+			t.Errorf("ReadBlock(%d) = %v, want %v", step.blk, data, want)
+		}
+		if dev.reads != step.wantReads {
+			t.Errorf("after ReadBlock(%d): %d device reads, want %d", step.blk, dev.reads, step.wantReads)
+		}
+	}
+
+	if _, err := blocks.ReadBlock(4); err != syserror.EIO {
+		t.Errorf("ReadBlock() past the end of the device = %v, want %v", err, syserror.EIO)
+	}
+
+	// Without a cache, every block is read from the device.
+	dev.reads = 0
+	blocks = NewBlockDevice(dev, blkSize, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := blocks.ReadBlock(0); err != nil {
+			t.Fatalf("ReadBlock(0) failed: %v", err)
+		}
+	}
+	if dev.reads != 3 {
+		t.Errorf("uncached: %d device reads, want 3", dev.reads)
+	}
+}
+
+// TestBlockDeviceConcurrent tests that concurrent reads through a cache
+// smaller than the working set return the right blocks.
+func TestBlockDeviceConcurrent(t *testing.T) {
+	const (
+		blkSize = 16
+		nBlocks = 32
+	)
+	disk := mockBlocks(nBlocks, blkSize)
+	blocks := NewBlockDevice(bytes.NewReader(disk), blkSize, nBlocks/4)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < cap(errs); g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				blk := uint64((g*7 + i) % nBlocks)
+				data, err := blocks.ReadBlock(blk)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := disk[blk*blkSize : (blk+1)*blkSize]; !bytes.Equal(data, want) {
+					errs <- fmt.Errorf("ReadBlock(%d) = %v, want %v", blk, data, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestMetadataCacheBlocks tests that the number of cached metadata blocks is
+// set by the filesystem options and mount options.
+func TestMetadataCacheBlocks(t *testing.T) {
+	image := readImageData(t, ext4ImagePath)
+	for _, cacheBlocks := range []int{0, 1} {
+		dev := &countingReader{r: bytes.NewReader(image)}
+		fs, err := NewFilesystemWithOptions(dev, FilesystemOptions{MetadataCacheBlocks: cacheBlocks})
+		if err != nil {
+			t.Fatalf("NewFilesystemWithOptions(%d cached blocks) failed: %v", cacheBlocks, err)
+		}
+		atomic.StoreInt64(&dev.reads, 0)
+		for i := 0; i < 2; i++ {
+			if _, err := newInode(&fs.fs, 12); err != nil {
+				t.Fatalf("newInode(12) failed: %v", err)
+			}
+		}
+		if got, want := atomic.LoadInt64(&dev.reads), int64(2-cacheBlocks); got != want {
+			t.Errorf("reading an inode twice with %d cached blocks made %d device reads, want %d", cacheBlocks, got, want)
+		}
+	}
+	if _, err := NewFilesystemWithOptions(bytes.NewReader(image), FilesystemOptions{MetadataCacheBlocks: -1}); err != syserror.EINVAL {
+		t.Errorf("NewFilesystemWithOptions() with a negative cache size = %v, want %v", err, syserror.EINVAL)
+	}
+
+	for _, test := range []struct {
+		data    string
+		want    int
+		wantErr error
+	}{
+		{data: "", want: DefaultMetadataCacheBlocks},
+		{data: "metadata_cache_blocks=0", want: 0},
+		{data: "ro,metadata_cache_blocks=16", want: 16},
+		{data: "metadata_cache_blocks=-1", wantErr: syserror.EINVAL},
+		{data: "metadata_cache_blocks=lots", wantErr: syserror.EINVAL},
+	} {
+		if got, err := metadataCacheBlocksOption(test.data); got != test.want || err != test.wantErr {
+			t.Errorf("metadataCacheBlocksOption(%q) = (%d, %v), want (%d, %v)", test.data, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// BenchmarkInodeTableReads reads the same few inodes over and over, with and
+// without caching inode table blocks, and reports the resulting number of
+// device reads per inode.
+func BenchmarkInodeTableReads(b *testing.B) {
+	image := readImageData(b, ext4ImagePath)
+	// Directories are left out as building them reads their data blocks.
+	inodes := []uint32{12, 13, 14}
+
+	for _, cacheBlocks := range []int{0, DefaultMetadataCacheBlocks} {
+		b.Run(fmt.Sprintf("cache=%d", cacheBlocks), func(b *testing.B) {
+			dev := &countingReader{r: bytes.NewReader(image)}
+			fs := &filesystem{dev: dev, cacheBlocks: cacheBlocks}
+			if err := fs.readMetadata(); err != nil {
+				b.Fatalf("readMetadata() failed: %v", err)
+			}
+			atomic.StoreInt64(&dev.reads, 0)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := newInode(fs, inodes[i%len(inodes)]); err != nil {
+					b.Fatalf("newInode(%d) failed: %v", inodes[i%len(inodes)], err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&dev.reads))/float64(b.N), "devreads/op")
+		})
+	}
+}
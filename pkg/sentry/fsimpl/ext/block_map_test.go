@@ -16,6 +16,7 @@ package ext
 
 import (
 	"bytes"
+	"math"
 	"math/rand"
 	"testing"
 
@@ -49,6 +50,43 @@ func TestBlockMapReader(t *testing.T) {
 	}
 }
 
+// TestBlockMapHoles tests that holes in a block map file read as zeros.
+func TestBlockMapHoles(t *testing.T) {
+	mockDisk := make([]byte, 4*mockBMBlkSize)
+	rand.Read(mockDisk)
+	regFile := regularFile{
+		inode: inode{
+			fs: &filesystem{
+				dev:    bytes.NewReader(mockDisk),
+				blocks: NewBlockDevice(bytes.NewReader(mockDisk), uint64(mockBMBlkSize), 0),
+			},
+			diskInode: &disklayout.InodeNew{
+				InodeOld: disklayout.InodeOld{
+					SizeLo: 3 * mockBMBlkSize,
+				},
+			},
+			blkSize: uint64(mockBMBlkSize),
+		},
+	}
+	// File block 1 is a hole.
+	copy(regFile.inode.diskInode.Data(), binary.Marshal(nil, binary.LittleEndian, []uint32{2, 0, 3}))
+	mockFile, err := newBlockMapFile(regFile)
+	if err != nil {
+		t.Fatalf("newBlockMapFile failed: %v", err)
+	}
+
+	want := make([]byte, 3*mockBMBlkSize)
+	copy(want, mockDisk[2*mockBMBlkSize:3*mockBMBlkSize])
+	copy(want[2*mockBMBlkSize:], mockDisk[3*mockBMBlkSize:])
+	got := make([]byte, len(want))
+	if n, err := mockFile.ReadAt(got, 0); n != len(want) || err != nil {
+		t.Fatalf("ReadAt = (%d, %v), want (%d, nil)", n, err, len(want))
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("file data mismatched (-want +got):\n%s", diff)
+	}
+}
+
 // blkNumGen is a number generator which gives block numbers for building the
 // block map file on disk. It gives unique numbers in a random order which
 // facilitates in creating an extremely fragmented filesystem.
@@ -56,13 +94,14 @@ type blkNumGen struct {
 	nums []uint32
 }
 
-// newBlkNumGen is the blkNumGen constructor.
+// newBlkNumGen is the blkNumGen constructor. Block 0 is never handed out
+// because a block number of 0 in the block map indicates a hole.
 func newBlkNumGen() *blkNumGen {
 	blkNums := &blkNumGen{}
-	lim := mockBMDiskSize / mockBMBlkSize
+	lim := mockBMDiskSize/mockBMBlkSize - 1
 	blkNums.nums = make([]uint32, lim)
 	for i := uint32(0); i < lim; i++ {
-		blkNums.nums[i] = i
+		blkNums.nums[i] = i + 1
 	}
 
 	rand.Shuffle(int(lim), func(i, j int) {
@@ -88,7 +127,8 @@ func blockMapSetUp(t *testing.T) (*blockMapFile, []byte) {
 	regFile := regularFile{
 		inode: inode{
 			fs: &filesystem{
-				dev: bytes.NewReader(mockDisk),
+				dev:    bytes.NewReader(mockDisk),
+				blocks: NewBlockDevice(bytes.NewReader(mockDisk), uint64(mockBMBlkSize), 0),
 			},
 			diskInode: &disklayout.InodeNew{
 				InodeOld: disklayout.InodeOld{
@@ -104,7 +144,7 @@ func blockMapSetUp(t *testing.T) (*blockMapFile, []byte) {
 	var data []byte
 
 	// Write the direct blocks.
-	for i := 0; i < numDirectBlks; i++ {
+	for i := 0; i < disklayout.NumDirectBlocks; i++ {
 		curBlkNum := blkNums.next()
 		data = binary.Marshal(data, binary.LittleEndian, curBlkNum)
 		fileData = append(fileData, writeFileDataToBlock(mockDisk, curBlkNum, 0, blkNums)...)
@@ -155,5 +195,13 @@ func writeFileDataToBlock(disk []byte, blkNum uint32, height uint, blkNums *blkN
 // getMockBMFileFize gets the size of the mock block map file which is used for
 // testing.
 func getMockBMFileFize() uint32 {
-	return uint32(numDirectBlks*getCoverage(uint64(mockBMBlkSize), 0) + getCoverage(uint64(mockBMBlkSize), 1) + getCoverage(uint64(mockBMBlkSize), 2) + getCoverage(uint64(mockBMBlkSize), 3))
+	return uint32(disklayout.NumDirectBlocks*getCoverage(uint64(mockBMBlkSize), 0) + getCoverage(uint64(mockBMBlkSize), 1) + getCoverage(uint64(mockBMBlkSize), 2) + getCoverage(uint64(mockBMBlkSize), 3))
+}
+
+// getCoverage returns the number of bytes a node at the given height covers.
+// Height 0 is the file data block itself. Height 1 is the indirect block.
+//
+// Formula: blkSize * ((blkSize / 4)^height)
+func getCoverage(blkSize uint64, height uint) uint64 {
+	return blkSize * uint64(math.Pow(float64(blkSize/4), float64(height)))
 }
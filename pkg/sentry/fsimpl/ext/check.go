@@ -0,0 +1,212 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// ProblemKind is the kind of a Problem.
+type ProblemKind int
+
+// Kinds of problems found by CheckFilesystem.
+const (
+	// ProblemSuperBlockChecksum indicates that the superblock does not match
+	// its checksum.
+	ProblemSuperBlockChecksum ProblemKind = iota
+
+	// ProblemGroupDescriptorChecksum indicates that a block group descriptor
+	// does not match its checksum.
+	ProblemGroupDescriptorChecksum
+
+	// ProblemFreeBlocksCount indicates that the free blocks count of the
+	// superblock is not the sum of the free counts of the block groups.
+	ProblemFreeBlocksCount
+
+	// ProblemFreeInodesCount indicates that the free inodes count of the
+	// superblock is not the sum of the free counts of the block groups.
+	ProblemFreeInodesCount
+
+	// ProblemInodeBitmap indicates that an inode bitmap could not be read or
+	// does not match its checksum, so its inodes were not spot-checked.
+	ProblemInodeBitmap
+
+	// ProblemInodeChecksum indicates that an allocated inode could not be read
+	// or does not match its checksum.
+	ProblemInodeChecksum
+)
+
+// problemKindNames maps problem kinds to the names printed by
+// ProblemKind.String.
+var problemKindNames = map[ProblemKind]string{
+	ProblemSuperBlockChecksum:      "superblock checksum",
+	ProblemGroupDescriptorChecksum: "group descriptor checksum",
+	ProblemFreeBlocksCount:         "free blocks count",
+	ProblemFreeInodesCount:         "free inodes count",
+	ProblemInodeBitmap:             "inode bitmap",
+	ProblemInodeChecksum:           "inode checksum",
+}
+
+// String implements fmt.Stringer.String.
+func (k ProblemKind) String() string {
+	if name, ok := problemKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", int(k))
+}
+
+// Problem is an inconsistency found by CheckFilesystem.
+type Problem struct {
+	// Kind is the kind of the problem.
+	Kind ProblemKind
+
+	// Group is the number of the block group the problem was found in, or -1
+	// if it is not specific to a group.
+	Group int64
+
+	// Inode is the number of the inode the problem was found in, or 0 if it
+	// is not specific to an inode.
+	Inode uint32
+
+	// Reason describes the problem.
+	Reason string
+}
+
+// String implements fmt.Stringer.String.
+func (p Problem) String() string {
+	var b strings.Builder
+	b.WriteString(p.Kind.String())
+	if p.Group >= 0 {
+		fmt.Fprintf(&b, ": block group %d", p.Group)
+	}
+	if p.Inode != 0 {
+		fmt.Fprintf(&b, ": inode %d", p.Inode)
+	}
+	fmt.Fprintf(&b, ": %s", p.Reason)
+	return b.String()
+}
+
+// CheckOptions holds the options of CheckFilesystem.
+type CheckOptions struct {
+	// InodeStride enables spot-checking inode checksums: every InodeStride-th
+	// allocated inode of each group, starting with its first one, is read and
+	// verified. Inodes are not checked if it is 0 or if the filesystem does
+	// not have metadata checksums.
+	InodeStride uint32
+}
+
+// CheckFilesystem audits the metadata of fs as currently stored in its image
+// and returns the problems found, in the order they were found: the superblock
+// checksum, the checksum of each block group descriptor, the agreement of the
+// free counts of the superblock and the descriptors and, if enabled by opts,
+// inode checksums. Checksums are only verified if the filesystem has them.
+// Nothing is repaired and fs itself, which was loaded when it was created, is
+// not affected.
+//
+// Like e2fsck, the free counts of the superblock are expected to match the
+// descriptors, although Linux only updates them lazily and recomputes them on
+// mount, so a mismatch is harmless on filesystems which were not cleanly
+// unmounted. Errors are only returned if the image cannot be read.
+func CheckFilesystem(fs *Filesystem, opts CheckOptions) ([]Problem, error) {
+	var problems []Problem
+	report := func(kind ProblemKind, group int64, inode uint32, format string, args ...interface{}) {
+		problems = append(problems, Problem{Kind: kind, Group: group, Inode: inode, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	dev := fs.fs.dev
+	sb := fs.fs.sb
+	raw := make([]byte, disklayout.SbSize)
+	if read, _ := dev.ReadAt(raw, disklayout.SbOffset); read < len(raw) {
+		return nil, syserror.EIO
+	}
+	switch ok, err := disklayout.VerifyChecksum(raw); {
+	case err == disklayout.ErrNoMetadataCsum:
+	case err != nil:
+		report(ProblemSuperBlockChecksum, -1, 0, "%v", err)
+	case !ok:
+		report(ProblemSuperBlockChecksum, -1, 0, "checksum mismatch")
+	}
+
+	audit := &filesystem{dev: dev, sb: sb, blocks: NewBlockDevice(dev, sb.BlockSize(), fs.fs.cacheBlocks), cacheBlocks: fs.fs.cacheBlocks}
+	bgs, err := LoadGroupDescriptors(sb, audit.blocks)
+	if bgErr, ok := err.(*GroupDescriptorError); ok {
+		groups := make([]uint32, 0, len(bgErr.Errs))
+		for g := range bgErr.Errs {
+			groups = append(groups, g)
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+		for _, g := range groups {
+			report(ProblemGroupDescriptorChecksum, int64(g), 0, "%v", bgErr.Errs[g])
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	audit.bgs = bgs
+
+	var freeClusters uint64
+	var freeInodes uint32
+	for _, bg := range bgs {
+		freeClusters += uint64(bg.FreeBlocksCount())
+		freeInodes += bg.FreeInodesCount()
+	}
+	// The superblock counts blocks while the descriptors count clusters.
+	if got, want := sb.FreeBlocksCount(), disklayout.ClusterToBlock(sb, freeClusters); got != want {
+		report(ProblemFreeBlocksCount, -1, 0, "superblock has %d free blocks, block groups have %d", got, want)
+	}
+	if got, want := sb.FreeInodesCount(), freeInodes; got != want {
+		report(ProblemFreeInodesCount, -1, 0, "superblock has %d free inodes, block groups have %d", got, want)
+	}
+
+	if opts.InodeStride == 0 || !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return problems, nil
+	}
+	perGroup := sb.InodesPerGroup()
+	for bgNum, bg := range bgs {
+		if bg.Flags().InodeUninit {
+			continue
+		}
+		bitmap, err := readInodeBitmap(dev, sb, uint32(bgNum), bg)
+		if err == syserror.EIO {
+			report(ProblemInodeBitmap, int64(bgNum), 0, "cannot read or verify inode bitmap")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		allocated := uint32(0)
+		for i := uint32(0); i < perGroup; i++ {
+			if !bitmap.Test(i) {
+				continue
+			}
+			if allocated++; (allocated-1)%opts.InodeStride != 0 {
+				continue
+			}
+			ino := uint32(bgNum)*perGroup + i + 1
+			if ino > sb.InodesCount() {
+				break
+			}
+			if _, _, err := readDiskInode(audit, ino); err == syserror.EIO {
+				report(ProblemInodeChecksum, int64(bgNum), ino, "cannot read or verify inode")
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+)
+
+// TestCheckFilesystemClean tests that no problems are found in clean images.
+func TestCheckFilesystemClean(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath, bigallocImagePath, flexBGImagePath, uninitBGImagePath, noFileTypeImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, _ := readImage(t, image)
+			problems, err := CheckFilesystem(fs, CheckOptions{InodeStride: 1})
+			if err != nil {
+				t.Fatalf("CheckFilesystem failed: %v", err)
+			}
+			if len(problems) != 0 {
+				t.Errorf("CheckFilesystem() = %v, want no problems", problems)
+			}
+		})
+	}
+}
+
+// TestCheckFilesystemTampered tests that tampering with the image after it
+// was opened is reported.
+func TestCheckFilesystemTampered(t *testing.T) {
+	fs, data := readImage(t, ext4ImagePath)
+	sb := fs.fs.sb
+
+	// Change bg_itable_unused of group 0, which only breaks its checksum.
+	blk, _ := disklayout.GroupDescriptorLocation(sb, 0)
+	data[blk*sb.BlockSize()+0x1c]++
+	problems, err := CheckFilesystem(fs, CheckOptions{})
+	if err != nil {
+		t.Fatalf("CheckFilesystem failed: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemGroupDescriptorChecksum || problems[0].Group != 0 {
+		t.Fatalf("CheckFilesystem() with tampered descriptor = %v, want a group descriptor checksum problem in group 0", problems)
+	}
+	data[blk*sb.BlockSize()+0x1c]--
+
+	// Change the mode of the root inode, which is only noticed by inode
+	// spot-checks.
+	off, err := disklayout.InodeOffset(sb, fs.fs.bgs, disklayout.RootDirInode)
+	if err != nil {
+		t.Fatalf("InodeOffset failed: %v", err)
+	}
+	data[off] ^= 1
+	if problems, err := CheckFilesystem(fs, CheckOptions{}); err != nil || len(problems) != 0 {
+		t.Errorf("CheckFilesystem() with tampered inode and no spot-checks = (%v, %v), want no problems", problems, err)
+	}
+	problems, err = CheckFilesystem(fs, CheckOptions{InodeStride: 1})
+	if err != nil {
+		t.Fatalf("CheckFilesystem failed: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemInodeChecksum || problems[0].Inode != disklayout.RootDirInode {
+		t.Errorf("CheckFilesystem() with tampered inode = %v, want an inode checksum problem in inode %d", problems, disklayout.RootDirInode)
+	}
+}
@@ -16,7 +16,6 @@ package ext
 
 import (
 	"gvisor.dev/gvisor/pkg/abi/linux"
-	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sentry/fs"
@@ -56,12 +55,17 @@ func newDirectroy(inode inode, newDirent bool) (*directory, error) {
 	file.inode.impl = file
 
 	// Initialize childList by reading dirents from the underlying file.
-	if inode.diskInode.Flags().Index {
-		// TODO(b/134676337): Support hash tree directories. Currently only the '.'
-		// and '..' entries are read in.
-
-		// Users cannot navigate this hash tree directory yet.
-		log.Warningf("hash tree directory being used which is unsupported")
+	if inode.diskInode.Flags().Inline {
+		dirents, err := disklayout.ParseInlineDir(inode.inodeNum, inode.inlineData, newDirent)
+		if err != nil {
+			log.Warningf("ext fs: inode %d: %v", inode.inodeNum, err)
+			return nil, syserror.EIO
+		}
+		for _, d := range dirents {
+			curDirent := &dirent{diskDirent: d}
+			file.childList.PushBack(curDirent)
+			file.childMap[d.FileName()] = curDirent
+		}
 		return file, nil
 	}
 
@@ -72,36 +76,43 @@ func newDirectroy(inode inode, newDirent bool) (*directory, error) {
 		return nil, err
 	}
 
-	// buf is used as scratch space for reading in dirents from disk and
-	// unmarshalling them into dirent structs.
-	buf := make([]byte, disklayout.DirentSize)
-	size := inode.diskInode.Size()
-	for off, inc := uint64(0), uint64(0); off < size; off += inc {
+	// Directory data is a series of blocks, each holding a linear array of
+	// dirents which ends exactly at the end of the block. The htree index of
+	// hash tree directories is stored in blocks which look like empty linear
+	// blocks, so all names can be read without using the index.
+	buf := make([]byte, inode.blkSize)
+	size := disklayout.InodeFileSize(inode.fs.sb, inode.diskInode)
+	for off := uint64(0); off < size; off += inode.blkSize {
 		toRead := size - off
-		if toRead > disklayout.DirentSize {
-			toRead = disklayout.DirentSize
+		if toRead > inode.blkSize {
+			toRead = inode.blkSize
 		}
 		if n, err := regFile.impl.ReadAt(buf[:toRead], int64(off)); uint64(n) < toRead {
 			return nil, err
 		}
 
-		var curDirent dirent
-		if newDirent {
-			curDirent.diskDirent = &disklayout.DirentNew{}
-		} else {
-			curDirent.diskDirent = &disklayout.DirentOld{}
+		switch ok, err := disklayout.VerifyDirBlockChecksum(inode.fs.sb, inode.inodeNum, inode.diskInode, buf[:toRead]); {
+		case err == disklayout.ErrNoMetadataCsum:
+		case err == disklayout.ErrNoDirTail && inode.diskInode.Flags().Index:
+			// htree index blocks carry a dx_tail instead.
+		case err != nil:
+			log.Warningf("ext fs: inode %d: directory block %d: %v", inode.inodeNum, off/inode.blkSize, err)
+			return nil, syserror.EIO
+		case !ok:
+			log.Warningf("ext fs: inode %d: directory block %d checksum mismatch", inode.inodeNum, off/inode.blkSize)
+			return nil, syserror.EIO
 		}
-		binary.Unmarshal(buf, binary.LittleEndian, curDirent.diskDirent)
 
-		if curDirent.diskDirent.Inode() != 0 && len(curDirent.diskDirent.FileName()) != 0 {
-			// Inode number and name length fields being set to 0 is used to indicate
-			// an unused dirent.
-			file.childList.PushBack(&curDirent)
-			file.childMap[curDirent.diskDirent.FileName()] = &curDirent
+		dirents, err := disklayout.ParseDirBlock(buf[:toRead], newDirent)
+		if err != nil {
+			log.Warningf("ext fs: inode %d: directory block %d: %v", inode.inodeNum, off/inode.blkSize, err)
+			return nil, syserror.EIO
+		}
+		for _, d := range dirents {
+			curDirent := &dirent{diskDirent: d}
+			file.childList.PushBack(curDirent)
+			file.childMap[d.FileName()] = curDirent
 		}
-
-		// The next dirent is placed exactly after this dirent record on disk.
-		inc = uint64(curDirent.diskDirent.RecordSize())
 	}
 
 	return file, nil
@@ -151,6 +162,10 @@ func (fd *directoryFD) Release() {
 func (fd *directoryFD) IterDirents(ctx context.Context, cb vfs.IterDirentsCallback) error {
 	extfs := fd.filesystem()
 	dir := fd.inode().impl.(*directory)
+	// The names in encrypted directories are ciphertext.
+	if fd.inode().diskInode.IsEncrypted() {
+		return ErrEncrypted
+	}
 
 	dir.mu.Lock()
 	defer dir.mu.Unlock()
@@ -0,0 +1,193 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import "gvisor.dev/gvisor/pkg/binary"
+
+// POSIX ACLs are stored as the values of the system.posix_acl_access and
+// system.posix_acl_default extended attributes (XattrIndexPosixACLAccess and
+// XattrIndexPosixACLDefault). A 4 byte version header is followed by the
+// entries, ordered by tag.
+//
+// The values returned by getxattr(2) use the posix_acl_xattr format, where
+// every entry is 8 bytes. ext4 stores ACLs on disk in its own, more compact
+// ext4_acl format instead, where only named user and group entries hold an
+// id. ParsePosixACL accepts both.
+
+const (
+	// PosixACLXattrVersion is the version of ACLs in the posix_acl_xattr
+	// format.
+	PosixACLXattrVersion = 0x0002
+
+	// ext4ACLVersion is the version of ACLs in the on-disk ext4_acl format.
+	ext4ACLVersion = 0x0001
+
+	// aclHeaderSize is the size of the version header of both formats.
+	aclHeaderSize = 4
+
+	// aclEntrySize is the size of posix_acl_xattr entries and of ext4_acl
+	// entries with an id.
+	aclEntrySize = 8
+
+	// aclShortEntrySize is the size of ext4_acl entries without an id.
+	aclShortEntrySize = 4
+)
+
+// ACL entry tags, in the order entries must appear in.
+const (
+	ACLUserObj  = 0x01
+	ACLUser     = 0x02
+	ACLGroupObj = 0x04
+	ACLGroup    = 0x08
+	ACLMask     = 0x10
+	ACLOther    = 0x20
+)
+
+// ACLPerm is the permission triple of an ACL entry.
+type ACLPerm uint16
+
+// ACL permission bits.
+const (
+	ACLExecute ACLPerm = 0x1
+	ACLWrite   ACLPerm = 0x2
+	ACLRead    ACLPerm = 0x4
+)
+
+// String returns the permissions in the "rwx" form used by getfacl(1).
+func (p ACLPerm) String() string {
+	b := []byte("---")
+	if p&ACLRead != 0 {
+		b[0] = 'r'
+	}
+	if p&ACLWrite != 0 {
+		b[1] = 'w'
+	}
+	if p&ACLExecute != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// ACLEntry is a named user or group entry of an ACL.
+type ACLEntry struct {
+	// ID is the user or group id.
+	ID uint32
+
+	// Perm holds the permissions granted to ID.
+	Perm ACLPerm
+}
+
+// ACL is a decoded POSIX ACL.
+type ACL struct {
+	// UserObj holds the permissions of the file owner.
+	UserObj ACLPerm
+
+	// Users holds the named user entries, in increasing ID order.
+	Users []ACLEntry
+
+	// GroupObj holds the permissions of the file group.
+	GroupObj ACLPerm
+
+	// Groups holds the named group entries, in increasing ID order.
+	Groups []ACLEntry
+
+	// Mask limits the permissions granted by all entries but UserObj and
+	// Other. It is only valid if HasMask is true, which it always is if there
+	// are named entries.
+	Mask    ACLPerm
+	HasMask bool
+
+	// Other holds the permissions of everyone else.
+	Other ACLPerm
+}
+
+// ParsePosixACL parses value, the value of a system.posix_acl_access or
+// system.posix_acl_default extended attribute in either the posix_acl_xattr
+// format (PosixACLXattrVersion) or the on-disk ext4_acl format. Like Linux
+// posix_acl_valid, entries must be ordered by tag, named user and group entries
+// must be ordered by strictly increasing id, the owner, group and other
+// entries must appear exactly once and the mask at most once, and ACLs with
+// named entries must have a mask.
+func ParsePosixACL(value []byte) (ACL, error) {
+	if len(value) < aclHeaderSize {
+		return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL is only %d bytes", len(value))
+	}
+	version := binary.LittleEndian.Uint32(value)
+	if version != PosixACLXattrVersion && version != ext4ACLVersion {
+		return ACL{}, newDiskErrorf(ErrUnsupportedFeature, "POSIX ACL has version %d, want %d or %d", version, PosixACLXattrVersion, ext4ACLVersion)
+	}
+
+	var acl ACL
+	var seen uint16
+	for off := aclHeaderSize; off < len(value); {
+		if off+aclShortEntrySize > len(value) {
+			return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL entry at offset %d is truncated", off)
+		}
+		tag := binary.LittleEndian.Uint16(value[off:])
+		perm := ACLPerm(binary.LittleEndian.Uint16(value[off+2:]))
+		size := aclShortEntrySize
+		if version == PosixACLXattrVersion || tag == ACLUser || tag == ACLGroup {
+			size = aclEntrySize
+		}
+		if off+size > len(value) {
+			return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL entry at offset %d is truncated", off)
+		}
+		if perm&^(ACLRead|ACLWrite|ACLExecute) != 0 {
+			return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL entry at offset %d has invalid permissions %#x", off, perm)
+		}
+		if tag == 0 || tag&(tag-1) != 0 || tag > ACLOther {
+			return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL entry at offset %d has unknown tag %#x", off, tag)
+		}
+		// Tags are increasing powers of two, so in-order entries never have a
+		// tag below one already seen.
+		if seen >= tag<<1 || (seen&tag != 0 && tag != ACLUser && tag != ACLGroup) {
+			return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL entry at offset %d with tag %#x is out of order", off, tag)
+		}
+		seen |= tag
+
+		switch tag {
+		case ACLUserObj:
+			acl.UserObj = perm
+		case ACLUser:
+			id := binary.LittleEndian.Uint32(value[off+4:])
+			if n := len(acl.Users); n > 0 && id <= acl.Users[n-1].ID {
+				return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL user entry at offset %d has id %d, not above the previous one %d", off, id, acl.Users[n-1].ID)
+			}
+			acl.Users = append(acl.Users, ACLEntry{ID: id, Perm: perm})
+		case ACLGroupObj:
+			acl.GroupObj = perm
+		case ACLGroup:
+			id := binary.LittleEndian.Uint32(value[off+4:])
+			if n := len(acl.Groups); n > 0 && id <= acl.Groups[n-1].ID {
+				return ACL{}, newDiskErrorf(ErrInvalidACL, "POSIX ACL group entry at offset %d has id %d, not above the previous one %d", off, id, acl.Groups[n-1].ID)
+			}
+			acl.Groups = append(acl.Groups, ACLEntry{ID: id, Perm: perm})
+		case ACLMask:
+			acl.Mask = perm
+			acl.HasMask = true
+		case ACLOther:
+			acl.Other = perm
+		}
+		off += size
+	}
+
+	if required := uint16(ACLUserObj | ACLGroupObj | ACLOther); seen&required != required {
+		return ACL{}, NewDiskError(ErrInvalidACL, "POSIX ACL lacks owner, group or other entries")
+	}
+	if (len(acl.Users) != 0 || len(acl.Groups) != 0) && !acl.HasMask {
+		return ACL{}, NewDiskError(ErrInvalidACL, "POSIX ACL has named entries but no mask")
+	}
+	return acl, nil
+}
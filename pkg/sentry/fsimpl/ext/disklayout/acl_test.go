@@ -0,0 +1,128 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// aclEntry is a (tag, perm, id) triple passed to aclValue.
+type aclEntry [3]uint32
+
+// aclValue builds an ACL value of the given version from entries. Ids are only
+// stored if the format has them.
+func aclValue(version uint32, entries ...aclEntry) []byte {
+	b := binary.AppendUint32(nil, binary.LittleEndian, version)
+	for _, e := range entries {
+		b = binary.AppendUint16(b, binary.LittleEndian, uint16(e[0]))
+		b = binary.AppendUint16(b, binary.LittleEndian, uint16(e[1]))
+		if version == PosixACLXattrVersion || e[0] == ACLUser || e[0] == ACLGroup {
+			b = binary.AppendUint32(b, binary.LittleEndian, e[2])
+		}
+	}
+	return b
+}
+
+// TestParsePosixACL tests decoding ACLs as set by setfacl(1).
+func TestParsePosixACL(t *testing.T) {
+	// setfacl -m u:1000:rw-,u:1001:r--,g:100:r-x,m::rwx file
+	access := []aclEntry{
+		{ACLUserObj, 6, 0xffffffff},
+		{ACLUser, 6, 1000},
+		{ACLUser, 4, 1001},
+		{ACLGroupObj, 4, 0xffffffff},
+		{ACLGroup, 5, 100},
+		{ACLMask, 7, 0xffffffff},
+		{ACLOther, 4, 0xffffffff},
+	}
+	wantAccess := ACL{
+		UserObj:  ACLRead | ACLWrite,
+		Users:    []ACLEntry{{ID: 1000, Perm: ACLRead | ACLWrite}, {ID: 1001, Perm: ACLRead}},
+		GroupObj: ACLRead,
+		Groups:   []ACLEntry{{ID: 100, Perm: ACLRead | ACLExecute}},
+		Mask:     ACLRead | ACLWrite | ACLExecute,
+		HasMask:  true,
+		Other:    ACLRead,
+	}
+	// setfacl -d -m u::rwx,g::r-x,o::--- dir
+	def := []aclEntry{
+		{ACLUserObj, 7, 0xffffffff},
+		{ACLGroupObj, 5, 0xffffffff},
+		{ACLOther, 0, 0xffffffff},
+	}
+	wantDefault := ACL{
+		UserObj:  ACLRead | ACLWrite | ACLExecute,
+		GroupObj: ACLRead | ACLExecute,
+	}
+
+	for _, test := range []struct {
+		name    string
+		entries []aclEntry
+		want    ACL
+	}{
+		{name: "access", entries: access, want: wantAccess},
+		{name: "default", entries: def, want: wantDefault},
+	} {
+		for _, version := range []uint32{PosixACLXattrVersion, ext4ACLVersion} {
+			got, err := ParsePosixACL(aclValue(version, test.entries...))
+			if err != nil {
+				t.Errorf("%s: ParsePosixACL() of version %d failed: %v", test.name, version, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: ParsePosixACL() of version %d = %+v, want %+v", test.name, version, got, test.want)
+			}
+		}
+	}
+
+	if got, want := wantAccess.Users[0].Perm.String(), "rw-"; got != want {
+		t.Errorf("ACLPerm.String() = %q, want %q", got, want)
+	}
+}
+
+// TestParsePosixACLErrors tests that malformed ACLs are rejected.
+func TestParsePosixACLErrors(t *testing.T) {
+	const none = 0xffffffff
+	for _, test := range []struct {
+		name  string
+		value []byte
+	}{
+		{name: "short header", value: []byte{2, 0}},
+		{name: "truncated entry", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none})[:10]},
+		{name: "truncated named entry", value: aclValue(ext4ACLVersion, aclEntry{ACLUserObj, 7, 0}, aclEntry{ACLUser, 7, 1000})[:10]},
+		{name: "unknown tag", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{0x40, 7, none})},
+		{name: "bad permissions", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 8, none}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "out of order", value: aclValue(PosixACLXattrVersion, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "duplicate owner", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "no other", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLGroupObj, 7, none})},
+		{name: "unsorted users", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLUser, 7, 1001}, aclEntry{ACLUser, 7, 1000}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLMask, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "duplicate user", value: aclValue(ext4ACLVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLUser, 7, 1000}, aclEntry{ACLUser, 4, 1000}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLMask, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "unsorted groups", value: aclValue(ext4ACLVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLGroup, 7, 101}, aclEntry{ACLGroup, 7, 100}, aclEntry{ACLMask, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "no mask", value: aclValue(PosixACLXattrVersion, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLUser, 7, 1000}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLOther, 7, none})},
+		{name: "empty", value: aclValue(PosixACLXattrVersion)},
+	} {
+		if _, err := ParsePosixACL(test.value); !errors.Is(err, ErrInvalidACL) {
+			t.Errorf("%s: ParsePosixACL() = %v, want %v", test.name, err, ErrInvalidACL)
+		}
+	}
+
+	if _, err := ParsePosixACL(aclValue(3, aclEntry{ACLUserObj, 7, none}, aclEntry{ACLGroupObj, 7, none}, aclEntry{ACLOther, 7, none})); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Errorf("ParsePosixACL() of version 3 = %v, want %v", err, ErrUnsupportedFeature)
+	}
+}
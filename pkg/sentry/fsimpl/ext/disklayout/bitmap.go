@@ -0,0 +1,67 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import "math/bits"
+
+// Bitmap is the block or inode allocation bitmap of a block group. Bit n
+// (bit n%8 of byte n/8) is set if the n-th unit of the group is in use.
+//
+// The unit of a block bitmap is a cluster, which is one block unless the
+// bigalloc feature is enabled; a block bitmap holds sb.ClustersPerGroup()
+// bits. The unit of an inode bitmap is an inode; it holds
+// sb.InodesPerGroup() bits. Both are multiples of 8, so the bitmap has no
+// partial bytes.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/bitmaps.html.
+type Bitmap []byte
+
+// Len returns the number of units tracked by the bitmap.
+func (b Bitmap) Len() uint32 {
+	return uint32(len(b)) * 8
+}
+
+// Test returns true if unit n is in use. Units past the end of the bitmap are
+// reported as in use.
+func (b Bitmap) Test(n uint32) bool {
+	if n >= b.Len() {
+		return true
+	}
+	return b[n/8]&(1<<(n%8)) != 0
+}
+
+// NextFree returns the first free unit at or after start. The second return
+// value is false if there is none.
+func (b Bitmap) NextFree(start uint32) (uint32, bool) {
+	for n := start; n < b.Len(); {
+		byt := b[n/8] | byte(1<<(n%8)-1)
+		if byt == 0xff {
+			// Skip to the next byte.
+			n = n&^7 + 8
+			continue
+		}
+		return n&^7 + uint32(bits.TrailingZeros8(^byt)), true
+	}
+	return 0, false
+}
+
+// CountFree returns the number of free units.
+func (b Bitmap) CountFree() uint32 {
+	var used int
+	for _, byt := range b {
+		used += bits.OnesCount8(byt)
+	}
+	return b.Len() - uint32(used)
+}
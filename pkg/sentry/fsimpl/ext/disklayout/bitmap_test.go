@@ -0,0 +1,67 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"testing"
+)
+
+// TestBitmap tests a partially allocated bitmap.
+func TestBitmap(t *testing.T) {
+	// Units 0-9, 12 and 16-23 are in use.
+	b := Bitmap{0xff, 0x13, 0xff, 0x00}
+
+	if got := b.Len(); got != 32 {
+		t.Errorf("Len() = %d, want 32", got)
+	}
+	if got := b.CountFree(); got != 13 {
+		t.Errorf("CountFree() = %d, want 13", got)
+	}
+
+	for n, want := range map[uint32]bool{0: true, 7: true, 8: true, 9: true, 10: false, 12: true, 15: false, 23: true, 24: false, 31: false, 32: true} {
+		if got := b.Test(n); got != want {
+			t.Errorf("Test(%d) = %t, want %t", n, got, want)
+		}
+	}
+
+	for _, test := range []struct {
+		start uint32
+		want  uint32
+		ok    bool
+	}{
+		{start: 0, want: 10, ok: true},
+		{start: 10, want: 10, ok: true},
+		{start: 11, want: 11, ok: true},
+		{start: 12, want: 13, ok: true},
+		{start: 16, want: 24, ok: true},
+		{start: 31, want: 31, ok: true},
+		{start: 32, ok: false},
+	} {
+		if got, ok := b.NextFree(test.start); got != test.want || ok != test.ok {
+			t.Errorf("NextFree(%d) = (%d, %t), want (%d, %t)", test.start, got, ok, test.want, test.ok)
+		}
+	}
+
+	full := Bitmap{0xff, 0xff}
+	if _, ok := full.NextFree(0); ok {
+		t.Errorf("NextFree() of full bitmap succeeded")
+	}
+	if got := full.CountFree(); got != 0 {
+		t.Errorf("CountFree() of full bitmap = %d, want 0", got)
+	}
+	if got := (Bitmap{}).CountFree(); got != 0 {
+		t.Errorf("CountFree() of empty bitmap = %d, want 0", got)
+	}
+}
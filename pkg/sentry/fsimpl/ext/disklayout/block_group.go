@@ -19,10 +19,13 @@ package disklayout
 // information needed to access and use a block group.
 //
 // Location:
-//   - The block group descriptor table is always placed in the blocks
-//     immediately after the block containing the superblock.
-//   - The 1st block group descriptor in the original table is in the
-//      (sb.FirstDataBlock() + 1)th block.
+//   - The block group descriptor table is placed in the blocks immediately
+//     after the block containing the superblock, unless meta block groups
+//     are used. See GroupDescriptorBlock.
+//   - The 1st block group descriptor in the original table is in the block
+//     after the one holding the superblock at SbOffset. This is the
+//     (sb.FirstDataBlock() + 1)th block unless bigalloc is enabled, which
+//     makes the first data block 0 even with 1k blocks.
 //   - See SuperBlock docs to see where the block group descriptor table is
 //     replicated.
 //   - sb.BgDescSize() must be used as the block group descriptor entry size
@@ -50,7 +53,8 @@ type BlockGroup interface {
 	// bitmap.
 	ExclusionBitmap() uint64
 
-	// FreeBlocksCount returns the number of free blocks in the group.
+	// FreeBlocksCount returns the number of free clusters in the group. Clusters
+	// are blocks unless the bigalloc feature is enabled.
 	FreeBlocksCount() uint32
 
 	// FreeInodesCount returns the number of free inodes in the group.
@@ -66,11 +70,11 @@ type BlockGroup interface {
 	UnusedInodeCount() uint32
 
 	// BlockBitmapChecksum returns the block bitmap checksum. This is calculated
-	// using crc32c(FS UUID + group number + entire bitmap).
+	// using crc32c(checksum seed + entire bitmap).
 	BlockBitmapChecksum() uint32
 
 	// InodeBitmapChecksum returns the inode bitmap checksum. This is calculated
-	// using crc32c(FS UUID + group number + entire bitmap).
+	// using crc32c(checksum seed + entire bitmap).
 	InodeBitmapChecksum() uint32
 
 	// Checksum returns this block group's checksum.
@@ -91,6 +95,55 @@ type BlockGroup interface {
 	Flags() BGFlags
 }
 
+// NewBlockGroup returns an empty block group descriptor struct of the correct
+// version for the given superblock, to be read from disk. The 64-bit version
+// is used if the 64-bit feature is set and the descriptors are large enough
+// to hold it.
+func NewBlockGroup(sb SuperBlock) BlockGroup {
+	if sb.IncompatibleFeatures().Is64Bit && sb.BgDescSize() >= MinBgDescSize64Bit {
+		return &BlockGroup64Bit{}
+	}
+	return &BlockGroup32Bit{}
+}
+
+// GroupDescriptorBlock returns the block holding the nr-th block of group
+// descriptors, which holds the descriptors of groups
+// [nr * descPerBlock, (nr+1) * descPerBlock) where descPerBlock is
+// sb.BlockSize() / sb.BgDescSize().
+//
+// The blocks holding the descriptors of the groups before sb.FirstMetaBG()
+// immediately follow the block holding the superblock. Each remaining block
+// belongs to a meta block group of descPerBlock groups and is stored in its
+// first group, after the superblock backup if the group has one. Backups are
+// kept in the second and last groups of the meta block group.
+func GroupDescriptorBlock(sb SuperBlock, nr uint64) uint64 {
+	sbBlock := SbOffset / sb.BlockSize()
+	if !sb.IncompatibleFeatures().MetaBG || nr < uint64(sb.FirstMetaBG()) {
+		return sbBlock + nr + 1
+	}
+
+	group := nr * (sb.BlockSize() / uint64(sb.BgDescSize()))
+	blk := uint64(sb.FirstDataBlock()) + group*uint64(sb.BlocksPerGroup())
+	if GroupHasSuperBlock(sb, group) {
+		blk++
+	}
+	if nr == 0 && sbBlock > uint64(sb.FirstDataBlock()) {
+		// The superblock is in block 1 with 1k blocks, even if the first data
+		// block is 0 because of bigalloc.
+		blk++
+	}
+	return blk
+}
+
+// GroupDescriptorLocation returns the block holding the primary copy of the
+// descriptor of group groupNum, at offset
+// (groupNum % descPerBlock) * sb.BgDescSize() in it, and whether groupNum
+// holds the superblock (group 0) or a backup of it. See GroupDescriptorBlock.
+func GroupDescriptorLocation(sb SuperBlock, groupNum uint32) (block uint64, hasSuperBlockBackup bool) {
+	descPerBlock := sb.BlockSize() / uint64(sb.BgDescSize())
+	return GroupDescriptorBlock(sb, uint64(groupNum)/descPerBlock), GroupHasSuperBlock(sb, uint64(groupNum))
+}
+
 // These are the different block group flags.
 const (
 	// BgInodeUninit indicates that inode table and bitmap are not initialized.
@@ -24,3 +24,187 @@ func TestBlockGroupSize(t *testing.T) {
 	assertSize(t, BlockGroup32Bit{}, 32)
 	assertSize(t, BlockGroup64Bit{}, 64)
 }
+
+// TestNewBlockGroup tests that the block group descriptor version is selected
+// based on the 64-bit feature.
+func TestNewBlockGroup(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.BgDescSizeRaw = 64
+	if _, ok := NewBlockGroup(&sb).(*BlockGroup32Bit); !ok {
+		t.Errorf("NewBlockGroup() without 64-bit feature = %T, want *BlockGroup32Bit", NewBlockGroup(&sb))
+	}
+
+	sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+	if _, ok := NewBlockGroup(&sb).(*BlockGroup64Bit); !ok {
+		t.Errorf("NewBlockGroup() with 64-bit feature = %T, want *BlockGroup64Bit", NewBlockGroup(&sb))
+	}
+}
+
+// TestBlockGroup64BitFields tests that the 64-bit block group descriptor
+// combines the low and high halves of its fields.
+func TestBlockGroup64BitFields(t *testing.T) {
+	bg := BlockGroup64Bit{}
+	bg.InodeTableLo = 0x23
+	bg.InodeTableHi = 0x1
+	bg.FreeInodesCountLo = 0x5
+	bg.FreeInodesCountHi = 0x1
+	bg.ItableUnusedLo = 0x7
+	bg.ItableUnusedHi = 0x2
+	bg.UsedDirsCountLo = 0x3
+
+	if got, want := bg.InodeTable(), uint64(0x100000023); got != want {
+		t.Errorf("InodeTable() = %#x, want %#x", got, want)
+	}
+	if got, want := bg.FreeInodesCount(), uint32(0x10005); got != want {
+		t.Errorf("FreeInodesCount() = %#x, want %#x", got, want)
+	}
+	if got, want := bg.UnusedInodeCount(), uint32(0x20007); got != want {
+		t.Errorf("UnusedInodeCount() = %#x, want %#x", got, want)
+	}
+	if got, want := bg.DirectoryCount(), uint32(0x3); got != want {
+		t.Errorf("DirectoryCount() = %#x, want %#x", got, want)
+	}
+}
+
+// TestGroupDescriptorBlock tests the location of the group descriptor blocks
+// with and without meta block groups.
+func TestGroupDescriptorBlock(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		logBlockSize  uint32
+		firstDataBlk  uint32
+		firstMetaBG   uint32
+		incompat      IncompatFeatures
+		roCompat      RoCompatFeatures
+		wantDescBlock map[uint64]uint64
+	}{
+		{
+			name:          "contiguous 1k",
+			firstDataBlk:  1,
+			roCompat:      RoCompatFeatures{Sparse: true},
+			wantDescBlock: map[uint64]uint64{0: 2, 3: 5},
+		},
+		{
+			name:          "contiguous 4k",
+			logBlockSize:  2,
+			roCompat:      RoCompatFeatures{Sparse: true},
+			wantDescBlock: map[uint64]uint64{0: 1, 3: 4},
+		},
+		{
+			// 16 descriptors per block, so meta block group 1 starts at group 16
+			// which has no superblock backup.
+			name:          "meta_bg",
+			firstDataBlk:  1,
+			incompat:      IncompatFeatures{MetaBG: true, Is64Bit: true},
+			roCompat:      RoCompatFeatures{Sparse: true},
+			wantDescBlock: map[uint64]uint64{0: 2, 1: 1 + 16*256, 2: 1 + 32*256},
+		},
+		{
+			name:          "meta_bg without sparse superblocks",
+			firstDataBlk:  1,
+			incompat:      IncompatFeatures{MetaBG: true, Is64Bit: true},
+			wantDescBlock: map[uint64]uint64{0: 2, 1: 2 + 16*256},
+		},
+		{
+			name:          "meta_bg after the first meta block groups",
+			firstDataBlk:  1,
+			firstMetaBG:   2,
+			incompat:      IncompatFeatures{MetaBG: true, Is64Bit: true},
+			roCompat:      RoCompatFeatures{Sparse: true},
+			wantDescBlock: map[uint64]uint64{0: 2, 1: 3, 2: 1 + 32*256},
+		},
+		{
+			// Bigalloc makes the first data block 0, but the superblock and the
+			// first descriptor block still follow the boot block.
+			name:          "meta_bg with bigalloc",
+			incompat:      IncompatFeatures{MetaBG: true, Is64Bit: true, Extents: true},
+			roCompat:      RoCompatFeatures{Sparse: true, Bigalloc: true},
+			wantDescBlock: map[uint64]uint64{0: 2, 1: 16 * 256},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.LogBlockSize = test.logBlockSize
+			sb.FirstDataBlockRaw = test.firstDataBlk
+			sb.BlocksPerGroupRaw = 256
+			sb.BlocksCountLo = 64 * 256
+			sb.BgDescSizeRaw = 64
+			sb.FirstMetaBg = test.firstMetaBG
+			sb.FeatureIncompat = test.incompat.ToInt()
+			sb.FeatureRoCompat = test.roCompat.ToInt()
+			for nr, want := range test.wantDescBlock {
+				if got := GroupDescriptorBlock(&sb, nr); got != want {
+					t.Errorf("GroupDescriptorBlock(%d) = %d, want %d", nr, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestGroupDescriptorLocation tests the location of the descriptors of single
+// groups and whether the groups hold a superblock backup.
+func TestGroupDescriptorLocation(t *testing.T) {
+	type location struct {
+		block     uint64
+		hasBackup bool
+	}
+	for _, test := range []struct {
+		name     string
+		incompat IncompatFeatures
+		roCompat RoCompatFeatures
+		want     map[uint32]location
+	}{
+		{
+			// 16 descriptors per block.
+			name:     "sparse",
+			roCompat: RoCompatFeatures{Sparse: true},
+			want: map[uint32]location{
+				0:  {block: 2, hasBackup: true},
+				5:  {block: 2, hasBackup: true},
+				6:  {block: 2},
+				20: {block: 3},
+				25: {block: 3, hasBackup: true},
+				49: {block: 5, hasBackup: true},
+			},
+		},
+		{
+			name: "not sparse",
+			want: map[uint32]location{
+				0:  {block: 2, hasBackup: true},
+				6:  {block: 2, hasBackup: true},
+				20: {block: 3, hasBackup: true},
+			},
+		},
+		{
+			name:     "meta_bg",
+			incompat: IncompatFeatures{MetaBG: true, Is64Bit: true},
+			roCompat: RoCompatFeatures{Sparse: true},
+			want: map[uint32]location{
+				0:  {block: 2, hasBackup: true},
+				15: {block: 2},
+				17: {block: 1 + 16*256},
+				25: {block: 1 + 16*256, hasBackup: true},
+				49: {block: 1 + 48*256, hasBackup: true},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.FirstDataBlockRaw = 1
+			sb.BlocksPerGroupRaw = 256
+			sb.BlocksCountLo = 64 * 256
+			sb.BgDescSizeRaw = 64
+			sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt() | test.incompat.ToInt()
+			sb.FeatureRoCompat = test.roCompat.ToInt()
+			for group, want := range test.want {
+				block, hasBackup := GroupDescriptorLocation(&sb, group)
+				if got := (location{block, hasBackup}); got != want {
+					t.Errorf("GroupDescriptorLocation(%d) = (%d, %t), want (%d, %t)", group, got.block, got.hasBackup, want.block, want.hasBackup)
+				}
+			}
+		})
+	}
+}
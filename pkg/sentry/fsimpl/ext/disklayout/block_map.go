@@ -0,0 +1,114 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// Inodes which do not use extents address their data with the classic ext2
+// block map stored in i_block:
+//   - i_block[0:12] are direct blocks holding file blocks 0 to 11.
+//   - i_block[12] is the indirect block which holds (blkSize/4) direct block
+//     numbers.
+//   - i_block[13] is the doubly indirect block which holds (blkSize/4)
+//     indirect block numbers.
+//   - i_block[14] is the triply indirect block which holds (blkSize/4) doubly
+//     indirect block numbers.
+//
+// A block number of 0 at any level indicates a hole.
+
+const (
+	// NumDirectBlocks is the number of direct blocks in the block map.
+	NumDirectBlocks = 12
+
+	// numBlockMapLevels is the number of indirection levels in the block map.
+	numBlockMapLevels = 3
+)
+
+// IndirectMapper maps file blocks to physical blocks for inodes which use the
+// block map.
+//
+// Note: This struct itself does not represent an on-disk struct.
+type IndirectMapper struct {
+	// blocks is the i_block array: the direct blocks followed by the indirect,
+	// doubly indirect and triply indirect blocks.
+	blocks [NumDirectBlocks + numBlockMapLevels]uint32
+
+	// blkSize is the filesystem block size.
+	blkSize uint64
+
+	// readBlock loads indirect blocks.
+	readBlock BlockReader
+}
+
+// NewIndirectMapper is the IndirectMapper constructor. iBlock is the inode's
+// i_block (Inode.Data()) and indirect blocks are loaded with readBlock.
+func NewIndirectMapper(iBlock []byte, blkSize uint64, readBlock BlockReader) *IndirectMapper {
+	m := &IndirectMapper{blkSize: blkSize, readBlock: readBlock}
+	binary.Unmarshal(iBlock[:len(m.blocks)*4], binary.LittleEndian, &m.blocks)
+	return m
+}
+
+// MapBlock maps fileBlock to the physical block storing it. found is false if
+// fileBlock is in a hole or beyond what the block map can address.
+func (m *IndirectMapper) MapBlock(fileBlock uint64) (physical uint64, found bool, err error) {
+	if fileBlock < NumDirectBlocks {
+		phyBlk := m.blocks[fileBlock]
+		return uint64(phyBlk), phyBlk != 0, nil
+	}
+	fileBlock -= NumDirectBlocks
+
+	// span is the number of file blocks covered by the top level block at each
+	// level of indirection.
+	ptrsPerBlk := m.blkSize / 4
+	span := ptrsPerBlk
+	for level := 1; level <= numBlockMapLevels; level++ {
+		if fileBlock < span {
+			return m.walk(m.blocks[NumDirectBlocks+level-1], fileBlock, span/ptrsPerBlk)
+		}
+		fileBlock -= span
+		span *= ptrsPerBlk
+	}
+	return 0, false, nil
+}
+
+// walk descends from the indirect block phyBlk, each of whose entries covers
+// childSpan file blocks, to the data block holding index relative to phyBlk.
+func (m *IndirectMapper) walk(phyBlk uint32, index, childSpan uint64) (uint64, bool, error) {
+	ptrsPerBlk := m.blkSize / 4
+	for {
+		if phyBlk == 0 {
+			return 0, false, nil
+		}
+		buf, err := m.readBlock(uint64(phyBlk))
+		if err != nil {
+			return 0, false, err
+		}
+		if uint64(len(buf)) < m.blkSize {
+			return 0, false, fmt.Errorf("indirect block %d is %d bytes, want %d", phyBlk, len(buf), m.blkSize)
+		}
+
+		i := index / childSpan
+		phyBlk = binary.LittleEndian.Uint32(buf[i*4:])
+		if childSpan == 1 {
+			return uint64(phyBlk), phyBlk != 0, nil
+		}
+		index %= childSpan
+		childSpan /= ptrsPerBlk
+	}
+}
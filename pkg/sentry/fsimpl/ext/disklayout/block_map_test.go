@@ -0,0 +1,110 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// TestIndirectMapper tests the block map level boundaries and holes with 16
+// byte blocks, i.e. 4 block numbers per indirect block.
+func TestIndirectMapper(t *testing.T) {
+	const blkSize = 16
+	blocks := make(map[uint64][]byte)
+	putBlock := func(phyBlk uint64, ptrs ...uint32) {
+		blocks[phyBlk] = binary.Marshal(nil, binary.LittleEndian, ptrs)
+	}
+
+	// File blocks 0 to 11 are direct; 3 is a hole.
+	var iBlock [NumDirectBlocks + numBlockMapLevels]uint32
+	for i := uint32(0); i < NumDirectBlocks; i++ {
+		iBlock[i] = 100 + i
+	}
+	iBlock[3] = 0
+
+	// File blocks 12 to 15 are under the indirect block; 14 is a hole.
+	iBlock[12] = 10
+	putBlock(10, 200, 201, 0, 203)
+
+	// File blocks 16 to 31 are under the doubly indirect block. Only its first
+	// and last indirect blocks are allocated.
+	iBlock[13] = 20
+	putBlock(20, 21, 0, 0, 22)
+	putBlock(21, 300, 301, 302, 303)
+	putBlock(22, 0, 0, 0, 315)
+
+	// File blocks 32 to 95 are under the triply indirect block. Only the last
+	// file block is allocated.
+	iBlock[14] = 30
+	putBlock(30, 0, 0, 0, 31)
+	putBlock(31, 0, 0, 0, 32)
+	putBlock(32, 0, 0, 0, 463)
+
+	readBlock := func(phyBlk uint64) ([]byte, error) {
+		buf, ok := blocks[phyBlk]
+		if !ok {
+			t.Fatalf("read of unexpected block %d", phyBlk)
+		}
+		return buf, nil
+	}
+	m := NewIndirectMapper(binary.Marshal(nil, binary.LittleEndian, iBlock), blkSize, readBlock)
+
+	for _, test := range []struct {
+		fileBlock uint64
+		physical  uint64
+		found     bool
+	}{
+		{fileBlock: 0, physical: 100, found: true},
+		{fileBlock: 3},
+		{fileBlock: 11, physical: 111, found: true},
+		{fileBlock: 12, physical: 200, found: true},
+		{fileBlock: 14},
+		{fileBlock: 15, physical: 203, found: true},
+		{fileBlock: 16, physical: 300, found: true},
+		{fileBlock: 19, physical: 303, found: true},
+		{fileBlock: 20},
+		{fileBlock: 27},
+		{fileBlock: 31, physical: 315, found: true},
+		{fileBlock: 32},
+		{fileBlock: 94},
+		{fileBlock: 95, physical: 463, found: true},
+		{fileBlock: 96},
+	} {
+		physical, found, err := m.MapBlock(test.fileBlock)
+		if err != nil {
+			t.Errorf("MapBlock(%d) failed: %v", test.fileBlock, err)
+			continue
+		}
+		if physical != test.physical || found != test.found {
+			t.Errorf("MapBlock(%d) = (%d, %t), want (%d, %t)", test.fileBlock, physical, found, test.physical, test.found)
+		}
+	}
+}
+
+// TestIndirectMapperHoles tests that unallocated indirect blocks are not read.
+func TestIndirectMapperHoles(t *testing.T) {
+	readBlock := func(phyBlk uint64) ([]byte, error) {
+		t.Fatalf("read of block %d in a sparse file", phyBlk)
+		return nil, nil
+	}
+	m := NewIndirectMapper(make([]byte, 60), 1024, readBlock)
+	for _, fileBlock := range []uint64{0, 11, 12, 12 + 256, 12 + 256 + 256*256, 12 + 256 + 256*256 + 256*256*256} {
+		if _, found, err := m.MapBlock(fileBlock); found || err != nil {
+			t.Errorf("MapBlock(%d) = (%t, %v), want (false, nil)", fileBlock, found, err)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+var (
+	// ErrNoMetadataCsum is returned when a checksum could not be verified
+	// because the filesystem does not have the SbMetadataCsum feature.
+	ErrNoMetadataCsum = errors.New("ext metadata_csum feature is not enabled")
+
+	// ErrNoGroupCsum is returned when a block group descriptor checksum could
+	// not be verified because the filesystem has neither the SbMetadataCsum
+	// nor the SbGdtCsum feature.
+	ErrNoGroupCsum = errors.New("ext group descriptor checksums are not enabled")
+
+	// ErrNoExtentTail is returned when an extent tree node checksum could not
+	// be verified because the node has no ext4_extent_tail. This is the case
+	// for the root node stored in the inode's i_block.
+	ErrNoExtentTail = errors.New("ext extent tree node has no checksum tail")
+
+	// ErrNoDirTail is returned when a directory block checksum could not be
+	// verified because the block does not end with an ext4_dir_entry_tail.
+	ErrNoDirTail = errors.New("ext directory block has no checksum tail")
+
+	// ErrNoJournalCsum is returned when a journal checksum could not be
+	// verified because the journal has neither the JournalCsumV2 nor the
+	// JournalCsumV3 feature.
+	ErrNoJournalCsum = errors.New("jbd2 journal checksums are not enabled")
+)
+
+const (
+	// bgChecksumOff is the offset of bg.bg_checksum in the block group
+	// descriptor.
+	bgChecksumOff = 0x1e
+
+	// SbSize is the size of the on-disk superblock.
+	SbSize = 1024
+
+	// sbChecksumOff is the offset of sb.s_checksum, which covers all bytes
+	// before it.
+	sbChecksumOff = SbSize - 4
+
+	// DirTailSize is the size of ext4_dir_entry_tail, the fake dirent at the
+	// end of each linear directory block on metadata_csum filesystems.
+	DirTailSize = 12
+
+	// dirTailFileType is the file type byte which marks ext4_dir_entry_tail.
+	dirTailFileType = 0xde
+
+	// inodeChecksumLoOff is the offset of osd2.l_i_checksum_lo in the inode.
+	inodeChecksumLoOff = 0x7c
+
+	// inodeExtraIsizeOff is the offset of i_extra_isize in the inode.
+	inodeExtraIsizeOff = 0x80
+
+	// inodeChecksumHiOff is the offset of i_checksum_hi in the inode, which is
+	// only present if i_extra_isize covers it.
+	inodeChecksumHiOff = 0x82
+)
+
+var (
+	// crc32cTable is the table for the Castagnoli polynomial used by ext4
+	// metadata checksums.
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// crc16Table is the table for the reflected 0x8005 polynomial used by ext4
+// group descriptor checksums (lib/crc16.c).
+var crc16Table = makeCrc16Table(0xa001)
+
+// makeCrc16Table builds the lookup table for the given reflected polynomial.
+func makeCrc16Table(poly uint16) *[256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}
+
+// crc16 emulates Linux's crc16(crc, data).
+func crc16(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc = (crc >> 8) ^ crc16Table[byte(crc)^b]
+	}
+	return crc
+}
+
+// Crc32c emulates Linux's crc32c_le(crc, data), which is used by all ext4
+// metadata and jbd2 checksums. Unlike hash/crc32, Linux does not invert the
+// crc before and after the update, so the seed of a checksum is passed as ~0
+// where Linux does so. Checksums are chained by passing the result from one
+// call as the crc of the next. hash/crc32 uses the SSE4.2 and ARMv8 crc32
+// instructions for the Castagnoli polynomial when they are available.
+func Crc32c(crc uint32, data []byte) uint32 {
+	return ^crc32.Update(^crc, crc32cTable, data)
+}
+
+// VerifyChecksum verifies sb.s_checksum of the raw on-disk superblock, which
+// must be exactly SbSize bytes. Returns ErrNoMetadataCsum if the superblock
+// does not have metadata checksums, in which case nothing was verified.
+func VerifyChecksum(raw []byte) (bool, error) {
+	if len(raw) != SbSize {
+		return false, fmt.Errorf("raw superblock is %d bytes, want %d", len(raw), SbSize)
+	}
+
+	var sb SuperBlock64Bit
+	binary.Unmarshal(raw, binary.LittleEndian, &sb)
+	if sb.Revision() == OldRev || !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return false, ErrNoMetadataCsum
+	}
+	if sb.ChecksumType() != SbCrc32c {
+		return false, newDiskErrorf(ErrUnsupportedFeature, "unknown ext metadata checksum type %d", sb.ChecksumType())
+	}
+
+	return Crc32c(^uint32(0), raw[:sbChecksumOff]) == sb.Checksum, nil
+}
+
+// UpdateChecksum recomputes sb.s_checksum of the raw on-disk superblock, which
+// must be exactly SbSize bytes, after it was modified. Returns
+// ErrNoMetadataCsum if the superblock does not have metadata checksums, in
+// which case raw is left unchanged.
+func UpdateChecksum(raw []byte) error {
+	if _, err := VerifyChecksum(raw); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(raw[sbChecksumOff:], Crc32c(^uint32(0), raw[:sbChecksumOff]))
+	return nil
+}
+
+// VerifyBlockGroupChecksum verifies bg.bg_checksum of the raw on-disk block
+// group descriptor for group groupNum, which must be exactly sb.BgDescSize()
+// bytes. See BlockGroup.Checksum for how the checksum is computed. Returns
+// ErrNoGroupCsum if the filesystem does not have group descriptor checksums,
+// in which case nothing was verified.
+func VerifyBlockGroupChecksum(sb SuperBlock, groupNum uint32, raw []byte) (bool, error) {
+	if len(raw) != int(sb.BgDescSize()) {
+		return false, fmt.Errorf("raw block group descriptor is %d bytes, want %d", len(raw), sb.BgDescSize())
+	}
+
+	var group [4]byte
+	binary.LittleEndian.PutUint32(group[:], groupNum)
+	want := binary.LittleEndian.Uint16(raw[bgChecksumOff:])
+
+	// The checksum field itself is excluded (treated as zero) in both cases.
+	roCompat := sb.ReadOnlyCompatibleFeatures()
+	switch {
+	case roCompat.MetadataCsum:
+		csum := Crc32c(sb.ChecksumSeed(), group[:])
+		csum = Crc32c(csum, raw[:bgChecksumOff])
+		csum = Crc32c(csum, []byte{0, 0})
+		csum = Crc32c(csum, raw[bgChecksumOff+2:])
+		return uint16(csum) == want, nil
+	case roCompat.GdtCsum:
+		uuid := sb.UUID()
+		csum := crc16(^uint16(0), uuid[:])
+		csum = crc16(csum, group[:])
+		csum = crc16(csum, raw[:bgChecksumOff])
+		if sb.IncompatibleFeatures().Is64Bit {
+			csum = crc16(csum, raw[bgChecksumOff+2:])
+		}
+		return csum == want, nil
+	default:
+		return false, ErrNoGroupCsum
+	}
+}
+
+// inodeChecksumSeed returns the crc32c seed for metadata belonging to inode
+// number inodeNum: the filesystem seed chained with the inode number and
+// generation (ei->i_csum_seed in Linux).
+func inodeChecksumSeed(sb SuperBlock, inodeNum uint32, in Inode) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], inodeNum)
+	csum := Crc32c(sb.ChecksumSeed(), buf[:])
+	binary.LittleEndian.PutUint32(buf[:], in.Generation())
+	return Crc32c(csum, buf[:])
+}
+
+// verifyInodeChecksum verifies the checksum of the raw inode record of in,
+// inode number inodeNum. See Inode.VerifyChecksum.
+func verifyInodeChecksum(sb SuperBlock, inodeNum uint32, in Inode, raw []byte) (bool, error) {
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum || sb.CreatorOS() != OSLinux {
+		return false, ErrNoMetadataCsum
+	}
+	if len(raw) != int(sb.InodeSize()) {
+		return false, fmt.Errorf("raw inode record is %d bytes, want %d", len(raw), sb.InodeSize())
+	}
+
+	// Both checksum halves are treated as zero.
+	zero := []byte{0, 0}
+	want := uint32(binary.LittleEndian.Uint16(raw[inodeChecksumLoOff:]))
+	csum := Crc32c(inodeChecksumSeed(sb, inodeNum, in), raw[:inodeChecksumLoOff])
+	csum = Crc32c(csum, zero)
+	csum = Crc32c(csum, raw[inodeChecksumLoOff+2:OldInodeSize])
+	hasHi := false
+	if len(raw) > OldInodeSize {
+		extraIsize := int(binary.LittleEndian.Uint16(raw[inodeExtraIsizeOff:]))
+		hasHi = OldInodeSize+extraIsize >= inodeChecksumHiOff+2 && len(raw) >= inodeChecksumHiOff+2
+		csum = Crc32c(csum, raw[OldInodeSize:inodeChecksumHiOff])
+		off := inodeChecksumHiOff
+		if hasHi {
+			want |= uint32(binary.LittleEndian.Uint16(raw[inodeChecksumHiOff:])) << 16
+			csum = Crc32c(csum, zero)
+			off += 2
+		}
+		csum = Crc32c(csum, raw[off:])
+	}
+	if !hasHi {
+		// Only the low half is stored.
+		csum &= 0xffff
+	}
+	return csum == want, nil
+}
+
+// VerifyExtentChecksum verifies the ext4_extent_tail checksum of an extent
+// tree node block belonging to inode number inodeNum. The tail follows the
+// last possible entry of the node and covers everything before it. Returns
+// ErrNoMetadataCsum if the filesystem does not have metadata checksums and
+// ErrNoExtentTail if block is the in-inode root node; nothing was verified in
+// either case.
+func VerifyExtentChecksum(sb SuperBlock, inodeNum uint32, in Inode, block []byte) (bool, error) {
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return false, ErrNoMetadataCsum
+	}
+	if len(block) <= ExtentRootSize {
+		return false, ErrNoExtentTail
+	}
+
+	var hdr ExtentHeader
+	binary.Unmarshal(block[:ExtentHeaderSize], binary.LittleEndian, &hdr)
+	tailOff := ExtentHeaderSize + int(hdr.MaxEntries)*ExtentEntrySize
+	if tailOff+4 > len(block) {
+		return false, &ExtentNodeError{Reason: fmt.Sprintf("%d max entries leave no room for the tail in %d bytes", hdr.MaxEntries, len(block))}
+	}
+
+	csum := Crc32c(inodeChecksumSeed(sb, inodeNum, in), block[:tailOff])
+	return csum == binary.LittleEndian.Uint32(block[tailOff:]), nil
+}
+
+// VerifyDirBlockChecksum verifies the ext4_dir_entry_tail checksum of a linear
+// directory block belonging to directory inode number inodeNum. The tail
+// occupies the last DirTailSize bytes of the block and covers everything
+// before it. Returns ErrNoMetadataCsum if the filesystem does not have
+// metadata checksums and ErrNoDirTail if the block does not end with a tail;
+// nothing was verified in either case.
+func VerifyDirBlockChecksum(sb SuperBlock, inodeNum uint32, dirInode Inode, block []byte) (bool, error) {
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return false, ErrNoMetadataCsum
+	}
+	if len(block) < DirTailSize {
+		return false, ErrNoDirTail
+	}
+
+	// The tail looks like an unused dirent with an empty name: inode 0,
+	// rec_len 12, name_len 0 and the reserved file type 0xde.
+	tailOff := len(block) - DirTailSize
+	tail := block[tailOff:]
+	if binary.LittleEndian.Uint32(tail) != 0 ||
+		binary.LittleEndian.Uint16(tail[4:]) != DirTailSize ||
+		tail[6] != 0 || tail[7] != dirTailFileType {
+		return false, ErrNoDirTail
+	}
+
+	csum := Crc32c(inodeChecksumSeed(sb, inodeNum, dirInode), block[:tailOff])
+	return csum == binary.LittleEndian.Uint32(tail[8:]), nil
+}
+
+// VerifyXattrBlockChecksum verifies h_checksum of the xattr block with block
+// number blockNum. The checksum covers the block number and the whole block
+// with the checksum field treated as zero; it is seeded with the filesystem
+// seed rather than an inode seed since xattr blocks may be shared. Returns
+// ErrNoMetadataCsum if the filesystem does not have metadata checksums, in
+// which case nothing was verified.
+func VerifyXattrBlockChecksum(sb SuperBlock, blockNum uint64, block []byte) (bool, error) {
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return false, ErrNoMetadataCsum
+	}
+	if len(block) < XattrBlockHeaderSize {
+		return false, fmt.Errorf("xattr block is only %d bytes", len(block))
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], blockNum)
+	csum := Crc32c(sb.ChecksumSeed(), buf[:])
+	csum = Crc32c(csum, block[:xattrBlockChecksumOff])
+	csum = Crc32c(csum, []byte{0, 0, 0, 0})
+	csum = Crc32c(csum, block[xattrBlockChecksumOff+4:])
+	return csum == binary.LittleEndian.Uint32(block[xattrBlockChecksumOff:]), nil
+}
+
+// VerifyMMPChecksum verifies mmp_checksum of the raw on-disk MMP block, which
+// is crc32c(checksum seed + MMP block up to the checksum). Returns
+// ErrNoMetadataCsum if the filesystem does not have metadata checksums.
+func VerifyMMPChecksum(sb SuperBlock, block []byte) (bool, error) {
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return false, ErrNoMetadataCsum
+	}
+	if len(block) < MMPSize {
+		return false, fmt.Errorf("MMP block is only %d bytes, want %d", len(block), MMPSize)
+	}
+	csum := Crc32c(sb.ChecksumSeed(), block[:mmpChecksumOff])
+	return csum == binary.LittleEndian.Uint32(block[mmpChecksumOff:]), nil
+}
+
+// BitmapCsum is how the block and inode bitmaps of a filesystem are
+// checksummed. See BitmapChecksumMode.
+type BitmapCsum uint8
+
+const (
+	// BitmapCsumNone indicates that bitmaps have no checksums.
+	BitmapCsumNone BitmapCsum = iota
+
+	// BitmapCsumCrc32cTail indicates that the crc32c of each bitmap, seeded
+	// with the checksum seed, is stored in its block group descriptor. Only
+	// the low 16 bits are stored unless the descriptors are 64 bytes long.
+	BitmapCsumCrc32cTail
+)
+
+// BitmapChecksumMode returns how the bitmaps of sb are checksummed. Bitmaps
+// only have checksums with metadata_csum; SbGdtCsum (uninit_bg) filesystems
+// checksum their group descriptors with crc16 but not their bitmaps, whose
+// checksum fields are left zero.
+func BitmapChecksumMode(sb SuperBlock) BitmapCsum {
+	if sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return BitmapCsumCrc32cTail
+	}
+	return BitmapCsumNone
+}
+
+// verifyBitmapChecksum verifies the checksum of bitmap, of which want holds
+// the low 16 bits unless the block group descriptor bg is 64 bytes long.
+func verifyBitmapChecksum(sb SuperBlock, bg BlockGroup, bitmap Bitmap, want uint32) (bool, error) {
+	if BitmapChecksumMode(sb) != BitmapCsumCrc32cTail {
+		return false, ErrNoMetadataCsum
+	}
+	csum := Crc32c(sb.ChecksumSeed(), bitmap)
+	if _, ok := bg.(*BlockGroup64Bit); !ok {
+		csum &= 0xffff
+	}
+	return csum == want, nil
+}
+
+// VerifyBlockBitmapChecksum verifies the block bitmap checksum of block group
+// bg against its block bitmap. bitmap must hold sb.ClustersPerGroup() bits.
+// Returns ErrNoMetadataCsum if the filesystem does not have metadata
+// checksums, in which case nothing was verified.
+func VerifyBlockBitmapChecksum(sb SuperBlock, bg BlockGroup, bitmap Bitmap) (bool, error) {
+	return verifyBitmapChecksum(sb, bg, bitmap, bg.BlockBitmapChecksum())
+}
+
+// VerifyInodeBitmapChecksum verifies the inode bitmap checksum of block group
+// bg against its inode bitmap. bitmap must hold sb.InodesPerGroup() bits.
+// Returns ErrNoMetadataCsum if the filesystem does not have metadata
+// checksums, in which case nothing was verified.
+func VerifyInodeBitmapChecksum(sb SuperBlock, bg BlockGroup, bitmap Bitmap) (bool, error) {
+	return verifyBitmapChecksum(sb, bg, bitmap, bg.InodeBitmapChecksum())
+}
+
+const (
+	// journalSbChecksumOff is the offset of s_checksum in the journal
+	// superblock.
+	journalSbChecksumOff = 0xfc
+
+	// journalCommitChecksumOff is the offset of h_chksum[0] in commit blocks.
+	journalCommitChecksumOff = 0x10
+)
+
+// journalChecksumSeed returns the seed of the checksums of the journal
+// described by j (j_csum_seed in Linux), which is the crc32c of its UUID.
+// Returns ErrNoJournalCsum if the journal has no checksums.
+func journalChecksumSeed(j *JournalSuperBlock) (uint32, error) {
+	if !j.hasBlockTail() {
+		return 0, ErrNoJournalCsum
+	}
+	if j.ChecksumType() != JournalCrc32cChecksum {
+		return 0, newDiskErrorf(ErrUnsupportedFeature, "unknown jbd2 journal checksum type %d", j.ChecksumType())
+	}
+	return Crc32c(^uint32(0), j.UUID[:]), nil
+}
+
+// VerifyJournalBlockChecksum verifies the checksum of a metadata block of the
+// journal described by j, which must be a whole journal block: the journal
+// superblock, or a descriptor, revoke or commit block as identified by its
+// header. The JournalCsumV2 and JournalCsumV3 features use the same checksums
+// for these blocks: the crc32c of the journal UUID and the block, with the
+// checksum itself treated as zero. The superblock checksum is instead seeded
+// with ~0 and only covers the JournalSuperBlock struct. Returns
+// ErrNoJournalCsum if the journal has no such checksums, in which case nothing
+// was verified; the crc32 checksums of commit blocks of the JournalChecksum
+// feature are not verified.
+func VerifyJournalBlockChecksum(j *JournalSuperBlock, block []byte) (bool, error) {
+	seed, err := journalChecksumSeed(j)
+	if err != nil {
+		return false, err
+	}
+	if len(block) != int(j.BlockSize()) {
+		return false, fmt.Errorf("journal block is %d bytes, want %d", len(block), j.BlockSize())
+	}
+
+	var off int
+	switch hdr := ParseJournalHeader(block); hdr.BlockType {
+	case JournalSuperBlockV1Type, JournalSuperBlockV2Type:
+		seed = ^uint32(0)
+		block = block[:JournalSuperBlockSize]
+		off = journalSbChecksumOff
+	case JournalDescriptorBlockType, JournalRevokeBlockType:
+		off = len(block) - JournalBlockTailSize
+	case JournalCommitBlockType:
+		off = journalCommitChecksumOff
+	default:
+		return false, fmt.Errorf("journal block has unknown block type %d", hdr.BlockType)
+	}
+	csum := Crc32c(seed, block[:off])
+	csum = Crc32c(csum, []byte{0, 0, 0, 0})
+	csum = Crc32c(csum, block[off+4:])
+	return csum == binary.BigEndian.Uint32(block[off:]), nil
+}
+
+// VerifyJournalTagChecksum verifies the checksum in the descriptor block tag
+// of block, which is the journal block logging tag.BlockNum in transaction
+// seq as stored in the log (before JournalFlagEscape is undone). The checksum
+// is the crc32c of the journal UUID, the big-endian sequence number and block;
+// JournalCsumV2 tags only hold its low 16 bits. Returns ErrNoJournalCsum if
+// the journal has no checksums, in which case nothing was verified.
+func VerifyJournalTagChecksum(j *JournalSuperBlock, tag JournalBlockTag, seq uint32, block []byte) (bool, error) {
+	seed, err := journalChecksumSeed(j)
+	if err != nil {
+		return false, err
+	}
+
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], seq)
+	csum := Crc32c(seed, buf[:])
+	csum = Crc32c(csum, block)
+	if !j.IncompatibleFeatures().CsumV3 {
+		csum &= 0xffff
+	}
+	return csum == tag.Checksum, nil
+}
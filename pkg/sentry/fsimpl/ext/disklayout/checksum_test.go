@@ -0,0 +1,639 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"math/rand"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// crc32cNaive computes Crc32c one byte at a time, like the generic crc32c_le of
+// Linux.
+func crc32cNaive(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc32cTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// TestCrc32c tests that Crc32c matches the kernel's crc32c_le.
+func TestCrc32c(t *testing.T) {
+	incrementing := make([]byte, 32)
+	decrementing := make([]byte, 32)
+	ones := make([]byte, 32)
+	for i := range incrementing {
+		incrementing[i] = byte(i)
+		decrementing[i] = byte(31 - i)
+		ones[i] = 0xff
+	}
+	for _, test := range []struct {
+		name string
+		crc  uint32
+		data []byte
+		want uint32
+	}{
+		{
+			// The checksum seed of a filesystem with this UUID as computed by
+			// e2fsprogs.
+			name: "uuid",
+			crc:  ^uint32(0),
+			data: testUUID[:],
+			want: 0xf57d6eee,
+		},
+		{
+			name: "empty",
+			crc:  0x12345678,
+			want: 0x12345678,
+		},
+		// The check value of CRC-32C and the iSCSI test vectors of RFC 3720
+		// B.4, which invert the result.
+		{
+			name: "check",
+			crc:  ^uint32(0),
+			data: []byte("123456789"),
+			want: ^uint32(0xe3069283),
+		},
+		{
+			name: "zeros",
+			crc:  ^uint32(0),
+			data: make([]byte, 32),
+			want: ^uint32(0x8a9136aa),
+		},
+		{
+			name: "ones",
+			crc:  ^uint32(0),
+			data: ones,
+			want: ^uint32(0x62a8ab43),
+		},
+		{
+			name: "incrementing",
+			crc:  ^uint32(0),
+			data: incrementing,
+			want: ^uint32(0x46dd794e),
+		},
+		{
+			name: "decrementing",
+			crc:  ^uint32(0),
+			data: decrementing,
+			want: ^uint32(0x113fdb5c),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Crc32c(test.crc, test.data); got != test.want {
+				t.Errorf("Crc32c(%#x, data) = %#x, want %#x", test.crc, got, test.want)
+			}
+			if got := crc32cNaive(test.crc, test.data); got != test.want {
+				t.Errorf("crc32cNaive(%#x, data) = %#x, want %#x", test.crc, got, test.want)
+			}
+			// Checksums can be computed incrementally.
+			for i := range test.data {
+				if got := Crc32c(Crc32c(test.crc, test.data[:i]), test.data[i:]); got != test.want {
+					t.Errorf("Crc32c chained at %d = %#x, want %#x", i, got, test.want)
+				}
+			}
+		})
+	}
+
+	// The accelerated implementation matches the generic one for all lengths
+	// and alignments.
+	data := make([]byte, 4096+7)
+	rand.Read(data)
+	for _, n := range []int{1, 7, 8, 63, 64, 255, 256, 4096} {
+		for off := 0; off < 8; off++ {
+			if got, want := Crc32c(^uint32(0), data[off:off+n]), crc32cNaive(^uint32(0), data[off:off+n]); got != want {
+				t.Errorf("Crc32c of %d bytes at %d = %#x, want %#x", n, off, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkCrc32c compares Crc32c to the generic implementation on the 4096
+// byte blocks checksummed by metadata_csum filesystems.
+func BenchmarkCrc32c(b *testing.B) {
+	block := make([]byte, 4096)
+	rand.Read(block)
+	for _, bench := range []struct {
+		name string
+		fn   func(uint32, []byte) uint32
+	}{
+		{name: "hash/crc32", fn: Crc32c},
+		{name: "naive", fn: crc32cNaive},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(block)))
+			for i := 0; i < b.N; i++ {
+				bench.fn(^uint32(0), block)
+			}
+		})
+	}
+}
+
+// TestVerifyChecksum tests superblock checksum verification.
+func TestVerifyChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+	sb.ChecksumTypeRaw = SbCrc32c
+	sb.BlocksCountLo = 64
+	raw := binary.Marshal(nil, binary.LittleEndian, sb)
+	binary.LittleEndian.PutUint32(raw[sbChecksumOff:], Crc32c(^uint32(0), raw[:sbChecksumOff]))
+
+	if ok, err := VerifyChecksum(raw); !ok || err != nil {
+		t.Errorf("VerifyChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	raw[4] ^= 0x1
+	if ok, err := VerifyChecksum(raw); ok || err != nil {
+		t.Errorf("VerifyChecksum() of corrupted superblock = (%t, %v), want (false, nil)", ok, err)
+	}
+	if err := UpdateChecksum(raw); err != nil {
+		t.Errorf("UpdateChecksum() failed: %v", err)
+	}
+	if ok, err := VerifyChecksum(raw); !ok || err != nil {
+		t.Errorf("VerifyChecksum() after UpdateChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	if _, err := VerifyChecksum(raw[:SbSize-1]); err == nil {
+		t.Errorf("VerifyChecksum() of short superblock succeeded, want error")
+	}
+
+	sb.FeatureRoCompat = 0
+	raw = binary.Marshal(nil, binary.LittleEndian, sb)
+	if _, err := VerifyChecksum(raw); err != ErrNoMetadataCsum {
+		t.Errorf("VerifyChecksum() without metadata_csum = %v, want %v", err, ErrNoMetadataCsum)
+	}
+	if err := UpdateChecksum(raw); err != ErrNoMetadataCsum {
+		t.Errorf("UpdateChecksum() without metadata_csum = %v, want %v", err, ErrNoMetadataCsum)
+	}
+}
+
+// TestVerifyBlockGroupChecksum tests block group descriptor checksums against
+// descriptors created by mke2fs.
+func TestVerifyBlockGroupChecksum(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		uuid     [16]byte
+		incompat IncompatFeatures
+		roCompat RoCompatFeatures
+		descSize uint16
+		raw      []byte
+	}{
+		{
+			name:     "crc16",
+			uuid:     [16]byte{0xa8, 0x0a, 0xdc, 0xb9, 0x3d, 0xe9, 0x4f, 0x14, 0xa2, 0x37, 0x3d, 0x1f, 0x3c, 0xf3, 0x5e, 0xcd},
+			roCompat: RoCompatFeatures{GdtCsum: true},
+			raw: []byte{
+				0x03, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00, 0x23, 0x00, 0x00, 0x00, 0x69, 0x00, 0x05, 0x00,
+				0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x1a, 0x77,
+			},
+		},
+		{
+			name:     "crc32c",
+			uuid:     testUUID,
+			incompat: IncompatFeatures{Is64Bit: true},
+			roCompat: RoCompatFeatures{MetadataCsum: true},
+			descSize: 64,
+			raw: []byte{
+				0x03, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00, 0x23, 0x00, 0x00, 0x00, 0x1d, 0x00, 0x02, 0x00,
+				0x02, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x07, 0x5b, 0xc5, 0x02, 0x00, 0x7b, 0xa0,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3a, 0x6b, 0x29, 0x8f, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.UUIDRaw = test.uuid
+			sb.FeatureIncompat = test.incompat.ToInt()
+			sb.FeatureRoCompat = test.roCompat.ToInt()
+			sb.BgDescSizeRaw = test.descSize
+
+			if ok, err := VerifyBlockGroupChecksum(&sb, 0, test.raw); !ok || err != nil {
+				t.Errorf("VerifyBlockGroupChecksum() = (%t, %v), want (true, nil)", ok, err)
+			}
+			if ok, err := VerifyBlockGroupChecksum(&sb, 1, test.raw); ok || err != nil {
+				t.Errorf("VerifyBlockGroupChecksum() for wrong group = (%t, %v), want (false, nil)", ok, err)
+			}
+
+			sb.FeatureRoCompat = 0
+			if _, err := VerifyBlockGroupChecksum(&sb, 0, test.raw); err != ErrNoGroupCsum {
+				t.Errorf("VerifyBlockGroupChecksum() without checksums = %v, want %v", err, ErrNoGroupCsum)
+			}
+		})
+	}
+}
+
+// TestVerifyExtentChecksum tests extent tree node tail checksum verification.
+// The block is the depth 0 extent block of a sparse file (inode 12,
+// generation 0) created by mke2fs -d.
+func TestVerifyExtentChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.FeatureIncompat = IncompatFeatures{Extents: true, Is64Bit: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+
+	block := binary.Marshal(nil, binary.LittleEndian, ExtentHeader{Magic: ExtentMagic, NumEntries: 8, MaxEntries: 84})
+	for i, phy := range []uint32{19, 21, 22, 23, 24, 26, 27, 28} {
+		block = binary.Marshal(block, binary.LittleEndian, &Extent{FirstFileBlock: 2 * uint32(i), Length: 1, StartBlockLo: phy})
+	}
+	block = append(block, make([]byte, 1024-len(block))...)
+	binary.LittleEndian.PutUint32(block[1020:], 0xb23a32cd)
+
+	in := &InodeNew{}
+	if ok, err := VerifyExtentChecksum(&sb, 12, in, block); !ok || err != nil {
+		t.Errorf("VerifyExtentChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// The checksum is seeded with the inode number and generation.
+	if ok, err := VerifyExtentChecksum(&sb, 13, in, block); ok || err != nil {
+		t.Errorf("VerifyExtentChecksum() for wrong inode = (%t, %v), want (false, nil)", ok, err)
+	}
+	in.GenerationRaw = 1
+	if ok, err := VerifyExtentChecksum(&sb, 12, in, block); ok || err != nil {
+		t.Errorf("VerifyExtentChecksum() for wrong generation = (%t, %v), want (false, nil)", ok, err)
+	}
+	in.GenerationRaw = 0
+
+	// Corrupting a leaf entry is detected.
+	corrupt := append([]byte(nil), block...)
+	corrupt[ExtentHeaderSize+8]++
+	if ok, err := VerifyExtentChecksum(&sb, 12, in, corrupt); ok || err != nil {
+		t.Errorf("VerifyExtentChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// The in-inode root node has no tail.
+	if _, err := VerifyExtentChecksum(&sb, 12, in, block[:ExtentRootSize]); err != ErrNoExtentTail {
+		t.Errorf("VerifyExtentChecksum() of root node = %v, want %v", err, ErrNoExtentTail)
+	}
+
+	sb.FeatureRoCompat = 0
+	if _, err := VerifyExtentChecksum(&sb, 12, in, block); err != ErrNoMetadataCsum {
+		t.Errorf("VerifyExtentChecksum() without checksums = %v, want %v", err, ErrNoMetadataCsum)
+	}
+}
+
+// TestVerifyInodeChecksum tests inode checksum verification. The inodes are
+// the root directory inode (inode 2, generation 0) created by mke2fs for
+// 256 and 128 byte inodes, the latter of which only hold the low half of the
+// checksum.
+func TestVerifyInodeChecksum(t *testing.T) {
+	// The first 144 bytes of the 256 byte inode; the rest are zeros.
+	root := []byte{
+		0xed, 0x41, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0xe1, 0x0b, 0x5e, 0x00, 0xe1, 0x0b, 0x5e,
+		0x00, 0xe1, 0x0b, 0x5e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xf3, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x19, 0xae, 0x00, 0x00,
+		0x20, 0x00, 0xc7, 0xa2, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0xe1, 0x0b, 0x5e,
+	}
+	raw256 := make([]byte, 256)
+	copy(raw256, root)
+	// The 128 byte inode only differs in its checksum.
+	raw128 := append([]byte(nil), root[:OldInodeSize]...)
+	binary.LittleEndian.PutUint16(raw128[inodeChecksumLoOff:], 0x8f6b)
+
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		in   Inode
+	}{
+		{name: "256 byte inode", raw: raw256, in: &InodeNew{}},
+		{name: "128 byte inode", raw: raw128, in: &InodeOld{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.UUIDRaw = testUUID
+			sb.InodeSizeRaw = uint16(len(test.raw))
+			sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+			binary.Unmarshal(test.raw[:binary.Size(test.in)], binary.LittleEndian, test.in)
+
+			if ok, err := test.in.VerifyChecksum(&sb, RootDirInode, test.raw); !ok || err != nil {
+				t.Errorf("VerifyChecksum() = (%t, %v), want (true, nil)", ok, err)
+			}
+			if ok, err := test.in.VerifyChecksum(&sb, RootDirInode+1, test.raw); ok || err != nil {
+				t.Errorf("VerifyChecksum() for wrong inode number = (%t, %v), want (false, nil)", ok, err)
+			}
+			// The seed chains the generation returned by Generation(), so the
+			// same record does not verify for another generation.
+			var gen *uint32
+			switch in := test.in.(type) {
+			case *InodeNew:
+				gen = &in.GenerationRaw
+			case *InodeOld:
+				gen = &in.GenerationRaw
+			}
+			*gen = 1
+			if ok, err := test.in.VerifyChecksum(&sb, RootDirInode, test.raw); ok || err != nil {
+				t.Errorf("VerifyChecksum() for wrong generation = (%t, %v), want (false, nil)", ok, err)
+			}
+			*gen = 0
+			// Flip a bit of i_size_lo.
+			corrupted := append([]byte(nil), test.raw...)
+			corrupted[4] ^= 0x1
+			if ok, err := test.in.VerifyChecksum(&sb, RootDirInode, corrupted); ok || err != nil {
+				t.Errorf("VerifyChecksum() of corrupted inode = (%t, %v), want (false, nil)", ok, err)
+			}
+			if _, err := test.in.VerifyChecksum(&sb, RootDirInode, test.raw[:len(test.raw)-1]); err == nil {
+				t.Errorf("VerifyChecksum() of truncated inode succeeded, want error")
+			}
+
+			sb.FeatureRoCompat = 0
+			if _, err := test.in.VerifyChecksum(&sb, RootDirInode, test.raw); err != ErrNoMetadataCsum {
+				t.Errorf("VerifyChecksum() without checksums = %v, want %v", err, ErrNoMetadataCsum)
+			}
+		})
+	}
+}
+
+// TestVerifyDirBlockChecksum tests directory block tail checksum
+// verification. The block is the directory block of a directory (inode 12,
+// generation 0) holding files "a" and "bb" created by mke2fs -d.
+func TestVerifyDirBlockChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.FeatureIncompat = IncompatFeatures{DirentFileType: true, Extents: true, Is64Bit: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+
+	block := make([]byte, 1024)
+	copy(block, []byte{
+		0x0c, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x01, 0x02, 0x2e, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0x0c, 0x00, 0x02, 0x02, 0x2e, 0x2e, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x01, 0x01,
+		0x61, 0x00, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00, 0xd0, 0x03, 0x02, 0x01, 0x62, 0x62, 0x00, 0x00,
+	})
+	copy(block[1024-DirTailSize:], []byte{0x00, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0xde, 0xdb, 0x03, 0x51, 0x80})
+
+	in := &InodeNew{}
+	if ok, err := VerifyDirBlockChecksum(&sb, 12, in, block); !ok || err != nil {
+		t.Errorf("VerifyDirBlockChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// The checksum is seeded with the inode number and generation.
+	if ok, err := VerifyDirBlockChecksum(&sb, 2, in, block); ok || err != nil {
+		t.Errorf("VerifyDirBlockChecksum() for wrong inode = (%t, %v), want (false, nil)", ok, err)
+	}
+	in.GenerationRaw = 1
+	if ok, err := VerifyDirBlockChecksum(&sb, 12, in, block); ok || err != nil {
+		t.Errorf("VerifyDirBlockChecksum() for wrong generation = (%t, %v), want (false, nil)", ok, err)
+	}
+	in.GenerationRaw = 0
+
+	// Corrupting a dirent's inode number is detected.
+	corrupt := append([]byte(nil), block...)
+	corrupt[24]++
+	if ok, err := VerifyDirBlockChecksum(&sb, 12, in, corrupt); ok || err != nil {
+		t.Errorf("VerifyDirBlockChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// A block whose last dirent is a real entry has no tail.
+	noTail := append([]byte(nil), block...)
+	binary.LittleEndian.PutUint16(noTail[40:], 1024-36)
+	copy(noTail[1024-DirTailSize:], make([]byte, DirTailSize))
+	if _, err := VerifyDirBlockChecksum(&sb, 12, in, noTail); err != ErrNoDirTail {
+		t.Errorf("VerifyDirBlockChecksum() without tail = %v, want %v", err, ErrNoDirTail)
+	}
+
+	sb.FeatureRoCompat = 0
+	if _, err := VerifyDirBlockChecksum(&sb, 12, in, block); err != ErrNoMetadataCsum {
+		t.Errorf("VerifyDirBlockChecksum() without checksums = %v, want %v", err, ErrNoMetadataCsum)
+	}
+}
+
+// TestVerifyXattrBlockChecksum tests xattr block checksum verification with
+// the block from xattrBlock.
+func TestVerifyXattrBlockChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.FeatureIncompat = IncompatFeatures{DirentFileType: true, Extents: true, Is64Bit: true, ExtAttrInode: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+
+	block := xattrBlock()
+	if ok, err := VerifyXattrBlockChecksum(&sb, 1203, block); !ok || err != nil {
+		t.Errorf("VerifyXattrBlockChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// The checksum is seeded with the block number.
+	if ok, err := VerifyXattrBlockChecksum(&sb, 1204, block); ok || err != nil {
+		t.Errorf("VerifyXattrBlockChecksum() for wrong block = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// Corrupting a value is detected.
+	block[0x3c8]++
+	if ok, err := VerifyXattrBlockChecksum(&sb, 1203, block); ok || err != nil {
+		t.Errorf("VerifyXattrBlockChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	sb.FeatureRoCompat = 0
+	if _, err := VerifyXattrBlockChecksum(&sb, 1203, block); err != ErrNoMetadataCsum {
+		t.Errorf("VerifyXattrBlockChecksum() without checksums = %v, want %v", err, ErrNoMetadataCsum)
+	}
+}
+
+// TestVerifyMMPChecksum tests MMP block checksums against the MMP block of
+// assets/mmp.ext4.
+func TestVerifyMMPChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+
+	block := mmpBlock()
+	if ok, err := VerifyMMPChecksum(&sb, block); !ok || err != nil {
+		t.Errorf("VerifyMMPChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// Updating the sequence number without the checksum is detected.
+	block[4]++
+	if ok, err := VerifyMMPChecksum(&sb, block); ok || err != nil {
+		t.Errorf("VerifyMMPChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	sb.FeatureRoCompat = 0
+	if _, err := VerifyMMPChecksum(&sb, block); err != ErrNoMetadataCsum {
+		t.Errorf("VerifyMMPChecksum() without checksums = %v, want %v", err, ErrNoMetadataCsum)
+	}
+}
+
+// TestVerifyBitmapChecksum tests block and inode bitmap checksum verification.
+// The bitmaps are those of the only group of a 256 block filesystem with 128
+// inodes, of which blocks 1-118 and inodes 1-126 are in use, created by mke2fs.
+func TestVerifyBitmapChecksum(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.FeatureIncompat = IncompatFeatures{DirentFileType: true, Extents: true, Is64Bit: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+
+	// Block 1 is the first data block, so bit n tracks block n+1. The bits
+	// past the end of the filesystem are set.
+	blockBitmap := make(Bitmap, 8192/8)
+	for n := 0; n < len(blockBitmap)*8; n++ {
+		if n < 118 || n >= 255 {
+			blockBitmap[n/8] |= 1 << (n % 8)
+		}
+	}
+	inodeBitmap := Bitmap{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f}
+
+	bg := &BlockGroup64Bit{}
+	bg.BlockBitmapChecksumLo, bg.BlockBitmapChecksumHi = 0xe4e1, 0x114b
+	bg.InodeBitmapChecksumLo, bg.InodeBitmapChecksumHi = 0x492b, 0xce34
+	if ok, err := VerifyBlockBitmapChecksum(&sb, bg, blockBitmap); !ok || err != nil {
+		t.Errorf("VerifyBlockBitmapChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := VerifyInodeBitmapChecksum(&sb, bg, inodeBitmap); !ok || err != nil {
+		t.Errorf("VerifyInodeBitmapChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// 32-bit descriptors only hold the low 16 bits.
+	bg32 := &bg.BlockGroup32Bit
+	if ok, err := VerifyInodeBitmapChecksum(&sb, bg32, inodeBitmap); !ok || err != nil {
+		t.Errorf("VerifyInodeBitmapChecksum() with 32-bit descriptor = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// Allocating another inode is detected.
+	inodeBitmap[15] |= 0x40
+	if ok, err := VerifyInodeBitmapChecksum(&sb, bg, inodeBitmap); ok || err != nil {
+		t.Errorf("VerifyInodeBitmapChecksum() of changed bitmap = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	if got := BitmapChecksumMode(&sb); got != BitmapCsumCrc32cTail {
+		t.Errorf("BitmapChecksumMode() = %d, want BitmapCsumCrc32cTail", got)
+	}
+
+	// gdt_csum does not checksum bitmaps.
+	for _, roCompat := range []uint32{0, SbGdtCsum} {
+		sb.FeatureRoCompat = roCompat
+		if got := BitmapChecksumMode(&sb); got != BitmapCsumNone {
+			t.Errorf("BitmapChecksumMode() with ro_compat %#x = %d, want BitmapCsumNone", roCompat, got)
+		}
+		if _, err := VerifyBlockBitmapChecksum(&sb, bg, blockBitmap); err != ErrNoMetadataCsum {
+			t.Errorf("VerifyBlockBitmapChecksum() with ro_compat %#x = %v, want %v", roCompat, err, ErrNoMetadataCsum)
+		}
+	}
+}
+
+// journalTransaction returns the descriptor, data and commit blocks of the
+// transaction written by debugfs "jw -b 1046" to the journal of
+// journalSuperBlock(JournalIs64Bit | JournalCsumV3).
+func journalTransaction() (descriptor, data, commit []byte) {
+	descriptor = make([]byte, 1024)
+	binary.BigEndian.PutUint32(descriptor[0x0:], JournalMagic)
+	binary.BigEndian.PutUint32(descriptor[0x4:], JournalDescriptorBlockType)
+	binary.BigEndian.PutUint32(descriptor[0x8:], 1)
+	binary.BigEndian.PutUint32(descriptor[0xc:], 1046)
+	binary.BigEndian.PutUint32(descriptor[0x10:], JournalFlagLastTag)
+	binary.BigEndian.PutUint32(descriptor[0x18:], 0x7693fdf4)
+	copy(descriptor[0xcc:], testUUID[:])
+	binary.BigEndian.PutUint32(descriptor[0x3fc:], 0x124d5e15)
+
+	data = make([]byte, 1024)
+	copy(data, "hello replay\n")
+
+	commit = make([]byte, 1024)
+	binary.BigEndian.PutUint32(commit[0x0:], JournalMagic)
+	binary.BigEndian.PutUint32(commit[0x4:], JournalCommitBlockType)
+	binary.BigEndian.PutUint32(commit[0x8:], 1)
+	binary.BigEndian.PutUint32(commit[0x10:], 0x18cd685f)
+	binary.BigEndian.PutUint32(commit[0x30:], 0x6acfabe5)
+	binary.BigEndian.PutUint32(commit[0x38:], 0x23e18430)
+	return descriptor, data, commit
+}
+
+// TestVerifyJournalBlockChecksum tests journal metadata block checksums
+// against blocks written by mke2fs and debugfs.
+func TestVerifyJournalBlockChecksum(t *testing.T) {
+	j, err := ParseJournalSuperBlock(journalSuperBlock(JournalIs64Bit | JournalCsumV3))
+	if err != nil {
+		t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+	}
+	descriptor, _, commit := journalTransaction()
+	for _, test := range []struct {
+		name  string
+		block []byte
+	}{
+		{name: "superblock", block: journalSuperBlock(JournalIs64Bit | JournalCsumV3)},
+		{name: "descriptor", block: descriptor},
+		{name: "commit", block: commit},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if ok, err := VerifyJournalBlockChecksum(j, test.block); !ok || err != nil {
+				t.Errorf("VerifyJournalBlockChecksum() = (%t, %v), want (true, nil)", ok, err)
+			}
+			test.block[0x3f0]++
+			if ok, err := VerifyJournalBlockChecksum(j, test.block); ok || err != nil {
+				t.Errorf("VerifyJournalBlockChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+			}
+		})
+	}
+
+	noCsum, err := ParseJournalSuperBlock(journalSuperBlock(JournalIs64Bit))
+	if err != nil {
+		t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+	}
+	if _, err := VerifyJournalBlockChecksum(noCsum, commit); err != ErrNoJournalCsum {
+		t.Errorf("VerifyJournalBlockChecksum() without checksums = %v, want %v", err, ErrNoJournalCsum)
+	}
+}
+
+// TestVerifyJournalTagChecksum tests the checksums of logged blocks, which
+// are held by their descriptor block tag.
+func TestVerifyJournalTagChecksum(t *testing.T) {
+	j, err := ParseJournalSuperBlock(journalSuperBlock(JournalIs64Bit | JournalCsumV3))
+	if err != nil {
+		t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+	}
+	descriptor, data, _ := journalTransaction()
+	tags, err := ParseJournalDescriptor(j, descriptor)
+	if err != nil {
+		t.Fatalf("ParseJournalDescriptor() failed: %v", err)
+	}
+	if ok, err := VerifyJournalTagChecksum(j, tags[0], 1, data); !ok || err != nil {
+		t.Errorf("VerifyJournalTagChecksum() = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// The checksum is seeded with the transaction sequence number.
+	if ok, err := VerifyJournalTagChecksum(j, tags[0], 2, data); ok || err != nil {
+		t.Errorf("VerifyJournalTagChecksum() for wrong transaction = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// csum_v2 tags only hold the low 16 bits.
+	j.FeatureIncompat = JournalIs64Bit | JournalCsumV2
+	tag := tags[0]
+	tag.Checksum &= 0xffff
+	if ok, err := VerifyJournalTagChecksum(j, tag, 1, data); !ok || err != nil {
+		t.Errorf("VerifyJournalTagChecksum() of csum_v2 tag = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	// Corrupting the data or the tag checksum is detected.
+	tag.Checksum ^= 0x1
+	if ok, err := VerifyJournalTagChecksum(j, tag, 1, data); ok || err != nil {
+		t.Errorf("VerifyJournalTagChecksum() with corrupted tag = (%t, %v), want (false, nil)", ok, err)
+	}
+	j.FeatureIncompat = JournalIs64Bit | JournalCsumV3
+	data[0]++
+	if ok, err := VerifyJournalTagChecksum(j, tags[0], 1, data); ok || err != nil {
+		t.Errorf("VerifyJournalTagChecksum() of corrupted block = (%t, %v), want (false, nil)", ok, err)
+	}
+}
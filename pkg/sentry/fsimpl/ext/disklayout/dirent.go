@@ -15,6 +15,10 @@
 package disklayout
 
 import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/sentry/fs"
 )
 
@@ -24,24 +28,77 @@ const (
 
 	// DirentSize is the size of ext dirent structures.
 	DirentSize = 263
+
+	// direntHeaderSize is the size of the dirent fields preceding the name.
+	direntHeaderSize = 8
+)
+
+// DirentType is the type of the inode a dirent points to, as stored in the
+// file type byte of dirents if the SbDirentFileType feature is set.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#ftype.
+type DirentType uint8
+
+// Dirent types. These are the EXT4_FT_* values of Linux.
+const (
+	// DirentTypeUnknown is the type of dirents which do not record the type
+	// of their inode. The inode mode must be read to find it.
+	DirentTypeUnknown DirentType = 0
+
+	DirentTypeRegular     DirentType = 1
+	DirentTypeDirectory   DirentType = 2
+	DirentTypeCharDevice  DirentType = 3
+	DirentTypeBlockDevice DirentType = 4
+	DirentTypeFIFO        DirentType = 5
+	DirentTypeSocket      DirentType = 6
+	DirentTypeSymlink     DirentType = 7
 )
 
 var (
 	// inodeTypeByFileType maps ext4 file types to vfs inode types.
-	//
-	// See https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#ftype.
-	inodeTypeByFileType = map[uint8]fs.InodeType{
-		0: fs.Anonymous,
-		1: fs.RegularFile,
-		2: fs.Directory,
-		3: fs.CharacterDevice,
-		4: fs.BlockDevice,
-		5: fs.Pipe,
-		6: fs.Socket,
-		7: fs.Symlink,
+	inodeTypeByFileType = map[DirentType]fs.InodeType{
+		DirentTypeUnknown:     fs.Anonymous,
+		DirentTypeRegular:     fs.RegularFile,
+		DirentTypeDirectory:   fs.Directory,
+		DirentTypeCharDevice:  fs.CharacterDevice,
+		DirentTypeBlockDevice: fs.BlockDevice,
+		DirentTypeFIFO:        fs.Pipe,
+		DirentTypeSocket:      fs.Socket,
+		DirentTypeSymlink:     fs.Symlink,
+	}
+
+	// direntTypeByFileMode maps inode file types to dirent types.
+	direntTypeByFileMode = map[linux.FileMode]DirentType{
+		linux.ModeRegular:         DirentTypeRegular,
+		linux.ModeDirectory:       DirentTypeDirectory,
+		linux.ModeCharacterDevice: DirentTypeCharDevice,
+		linux.ModeBlockDevice:     DirentTypeBlockDevice,
+		linux.ModeNamedPipe:       DirentTypeFIFO,
+		linux.ModeSocket:          DirentTypeSocket,
+		linux.ModeSymlink:         DirentTypeSymlink,
 	}
 )
 
+// DirentTypeFromMode returns the dirent type of an inode with the given mode,
+// like Linux's fs_umode_to_ftype. Returns DirentTypeUnknown if the file type
+// of mode is invalid.
+func DirentTypeFromMode(mode linux.FileMode) DirentType {
+	return direntTypeByFileMode[mode.FileType()]
+}
+
+// CheckDirentInode returns an *InodeNumberError if ino, the inode number of a
+// used directory entry, may not be linked from directories of the filesystem
+// described by sb. Like e2fsck, entries may only refer to the root directory
+// (as ".." does in top-level directories) or to inodes in
+// [sb.FirstInode(), sb.InodesCount()]; the other reserved inodes are never
+// linked.
+func CheckDirentInode(sb SuperBlock, ino uint32) error {
+	if ino == RootDirInode || (ino >= sb.FirstInode() && ino <= sb.InodesCount()) {
+		return nil
+	}
+	return &InodeNumberError{Ino: ino, InodesCount: sb.InodesCount()}
+}
+
 // The Dirent interface should be implemented by structs representing ext
 // directory entries. These are for the linear classical directories which
 // just store a list of dirent structs. A directory is a series of data blocks
@@ -69,4 +126,99 @@ type Dirent interface {
 	// feature is set. If not, the second returned value will be false indicating
 	// that user code has to use the inode mode to extract the file type.
 	FileType() (fs.InodeType, bool)
+
+	// Type returns the dirent type recorded in the dirent. It is
+	// DirentTypeUnknown if the SbDirentFileType feature is not set, in which
+	// case DirentTypeFromMode must be used on the mode of the underlying inode.
+	Type() DirentType
+}
+
+// direntRecLen returns the minimum record length of a dirent with a name of
+// nameLen bytes.
+func direntRecLen(nameLen int) uint16 {
+	return uint16(direntHeaderSize+nameLen+3) &^ 3
+}
+
+// newDirent builds an in-memory dirent. The file type is only recorded if
+// hasFileType is set, in which case a DirentNew is returned.
+func newDirent(ino uint32, recLen uint16, name string, fileType uint8, hasFileType bool) Dirent {
+	if hasFileType {
+		d := &DirentNew{InodeNumber: ino, RecordLength: recLen, NameLength: uint8(len(name)), FileTypeRaw: fileType}
+		copy(d.FileNameRaw[:], name)
+		return d
+	}
+	d := DirentOld{InodeNumber: ino, RecordLength: recLen, NameLength: uint16(len(name))}
+	copy(d.FileNameRaw[:], name)
+	if len(name) > MaxFileName {
+		return &direntOldLong{DirentOld: d, name: name}
+	}
+	return &d
+}
+
+// DecodeDirentName decodes the name and file type of the dirent record rec,
+// which holds the dirent header followed by the rest of its record.
+//
+// If hasFileType is set, which should be the case if the SbDirentFileType
+// feature is enabled, rec is an ext4_dir_entry_2: the name length is 8 bits
+// and the byte following it is the file type. Otherwise rec is an
+// ext4_dir_entry whose name length is 16 bits, so that names may be longer
+// than MaxFileName, and the file type is DirentTypeUnknown. Returns an error
+// if the name does not fit in rec.
+func DecodeDirentName(rec []byte, hasFileType bool) (string, DirentType, error) {
+	if len(rec) < direntHeaderSize {
+		return "", DirentTypeUnknown, fmt.Errorf("dirent record of %d bytes is smaller than its header", len(rec))
+	}
+	nameLen := int(binary.LittleEndian.Uint16(rec[6:]))
+	fileType := DirentTypeUnknown
+	if hasFileType {
+		nameLen = int(rec[6])
+		fileType = DirentType(rec[7])
+	}
+	if direntHeaderSize+nameLen > len(rec) {
+		return "", DirentTypeUnknown, fmt.Errorf("dirent name length %d exceeds record length %d", nameLen, len(rec))
+	}
+	return string(rec[direntHeaderSize : direntHeaderSize+nameLen]), fileType, nil
+}
+
+// ParseDirBlock parses the dirents in a block of a linear directory. The
+// ext4_dir_entry_2 format (DirentNew) is used if hasFileType is set, which
+// should be the case if the SbDirentFileType feature is enabled; otherwise
+// ext4_dir_entry (DirentOld) is. See DecodeDirentName. Unused dirents,
+// including the ext4_dir_entry_tail holding the block checksum, are omitted.
+// Returns an error if a dirent runs past the end of the block.
+//
+// Inline directories store dirents in regions smaller than a block, which are
+// parsed the same way.
+func ParseDirBlock(block []byte, hasFileType bool) ([]Dirent, error) {
+	var dirents []Dirent
+	for off := 0; off < len(block); {
+		if off+direntHeaderSize > len(block) {
+			return nil, fmt.Errorf("dirent at %d runs past the end of the %d byte block", off, len(block))
+		}
+		ino := binary.LittleEndian.Uint32(block[off:])
+		recLen := int(binary.LittleEndian.Uint16(block[off+4:]))
+		if recLen < direntHeaderSize || recLen%4 != 0 || off+recLen > len(block) {
+			return nil, fmt.Errorf("dirent at %d has bad record length %d in a %d byte block", off, recLen, len(block))
+		}
+		if ino == 0 {
+			// Unused dirent. Its name length is meaningless; for the
+			// ext4_dir_entry_tail the file type byte is 0xde.
+			off += recLen
+			continue
+		}
+		name, fileType, err := DecodeDirentName(block[off:off+recLen], hasFileType)
+		if err != nil {
+			return nil, fmt.Errorf("dirent at %d: %v", off, err)
+		}
+
+		if _, ok := inodeTypeByFileType[fileType]; !ok {
+			return nil, fmt.Errorf("dirent at %d has unknown file type %d", off, fileType)
+		}
+
+		if name != "" {
+			dirents = append(dirents, newDirent(ino, uint16(recLen), name, uint8(fileType), hasFileType))
+		}
+		off += recLen
+	}
+	return dirents, nil
 }
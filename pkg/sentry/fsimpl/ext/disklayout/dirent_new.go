@@ -53,9 +53,14 @@ func (d *DirentNew) FileName() string {
 
 // FileType implements Dirent.FileType.
 func (d *DirentNew) FileType() (fs.InodeType, bool) {
-	if inodeType, ok := inodeTypeByFileType[d.FileTypeRaw]; ok {
+	if inodeType, ok := inodeTypeByFileType[DirentType(d.FileTypeRaw)]; ok {
 		return inodeType, true
 	}
 
 	panic(fmt.Sprintf("unknown file type %v", d.FileTypeRaw))
 }
+
+// Type implements Dirent.Type.
+func (d *DirentNew) Type() DirentType {
+	return DirentType(d.FileTypeRaw)
+}
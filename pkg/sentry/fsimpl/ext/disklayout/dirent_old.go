@@ -21,7 +21,8 @@ import "gvisor.dev/gvisor/pkg/sentry/fs"
 //
 // Note: This struct can be of variable size on disk. The one described below
 // is of maximum size and the FileName beyond NameLength bytes might contain
-// garbage.
+// garbage. The 16-bit NameLength allows names longer than MaxFileName, whose
+// FileNameRaw only holds the first MaxFileName bytes.
 type DirentOld struct {
 	InodeNumber  uint32
 	RecordLength uint16
@@ -40,6 +41,9 @@ func (d *DirentOld) RecordSize() uint16 { return d.RecordLength }
 
 // FileName implements Dirent.FileName.
 func (d *DirentOld) FileName() string {
+	if int(d.NameLength) > len(d.FileNameRaw) {
+		return string(d.FileNameRaw[:])
+	}
 	return string(d.FileNameRaw[:d.NameLength])
 }
 
@@ -47,3 +51,19 @@ func (d *DirentOld) FileName() string {
 func (d *DirentOld) FileType() (fs.InodeType, bool) {
 	return fs.Anonymous, false
 }
+
+// Type implements Dirent.Type.
+func (d *DirentOld) Type() DirentType {
+	return DirentTypeUnknown
+}
+
+// direntOldLong is a DirentOld with a name longer than MaxFileName.
+type direntOldLong struct {
+	DirentOld
+
+	// name is the full name of the file.
+	name string
+}
+
+// FileName implements Dirent.FileName.
+func (d *direntOldLong) FileName() string { return d.name }
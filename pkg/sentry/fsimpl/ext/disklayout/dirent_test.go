@@ -15,7 +15,13 @@
 package disklayout
 
 import (
+	"errors"
+	"strings"
 	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/sentry/fs"
 )
 
 // TestDirentSize tests that the dirent structs are of the correct
@@ -24,3 +30,222 @@ func TestDirentSize(t *testing.T) {
 	assertSize(t, DirentOld{}, uintptr(DirentSize))
 	assertSize(t, DirentNew{}, uintptr(DirentSize))
 }
+
+// putDirent writes a dirent at off in block. fileType is only written if
+// hasFileType is set.
+func putDirent(block []byte, off int, ino uint32, recLen uint16, name string, fileType uint8, hasFileType bool) {
+	binary.LittleEndian.PutUint32(block[off:], ino)
+	binary.LittleEndian.PutUint16(block[off+4:], recLen)
+	if hasFileType {
+		block[off+6] = uint8(len(name))
+		block[off+7] = fileType
+	} else {
+		binary.LittleEndian.PutUint16(block[off+6:], uint16(len(name)))
+	}
+	copy(block[off+direntHeaderSize:], name)
+}
+
+// TestParseDirBlock tests parsing a directory block with an unused dirent and
+// a checksum tail, with and without the file type feature.
+func TestParseDirBlock(t *testing.T) {
+	for _, hasFileType := range []bool{true, false} {
+		block := make([]byte, 64)
+		putDirent(block, 0, 2, 12, ".", 2, hasFileType)
+		putDirent(block, 12, 2, 12, "..", 2, hasFileType)
+		putDirent(block, 24, 0, 12, "gone", 1, hasFileType)
+		putDirent(block, 36, 12, 16, "file.txt", 1, hasFileType)
+		// ext4_dir_entry_tail: inode 0, rec_len 12, name_len 0, file type 0xde.
+		putDirent(block, 52, 0, 12, "", 0, true)
+		block[52+7] = 0xde
+
+		dirents, err := ParseDirBlock(block, hasFileType)
+		if err != nil {
+			t.Fatalf("ParseDirBlock(hasFileType=%t) failed: %v", hasFileType, err)
+		}
+		want := []struct {
+			ino      uint32
+			recLen   uint16
+			name     string
+			fileType fs.InodeType
+			typ      DirentType
+		}{
+			{2, 12, ".", fs.Directory, DirentTypeDirectory},
+			{2, 12, "..", fs.Directory, DirentTypeDirectory},
+			{12, 16, "file.txt", fs.RegularFile, DirentTypeRegular},
+		}
+		if len(dirents) != len(want) {
+			t.Fatalf("ParseDirBlock(hasFileType=%t) returned %d dirents, want %d", hasFileType, len(dirents), len(want))
+		}
+		for i, d := range dirents {
+			if d.Inode() != want[i].ino || d.RecordSize() != want[i].recLen || d.FileName() != want[i].name {
+				t.Errorf("dirent %d = (%d, %d, %q), want (%d, %d, %q)", i, d.Inode(), d.RecordSize(), d.FileName(), want[i].ino, want[i].recLen, want[i].name)
+			}
+			fileType, ok := d.FileType()
+			if ok != hasFileType || (ok && fileType != want[i].fileType) {
+				t.Errorf("dirent %d FileType() = (%v, %t), want (%v, %t)", i, fileType, ok, want[i].fileType, hasFileType)
+			}
+			wantType := DirentTypeUnknown
+			if hasFileType {
+				wantType = want[i].typ
+			}
+			if got := d.Type(); got != wantType {
+				t.Errorf("dirent %d Type() = %d, want %d", i, got, wantType)
+			}
+		}
+	}
+}
+
+// TestDirentTypeFromMode tests that inode modes are mapped to the dirent type
+// Linux records for them.
+func TestDirentTypeFromMode(t *testing.T) {
+	for _, test := range []struct {
+		mode linux.FileMode
+		want DirentType
+	}{
+		{mode: linux.S_IFDIR | 0755, want: DirentTypeDirectory},
+		{mode: linux.S_IFREG | 0644, want: DirentTypeRegular},
+		{mode: linux.S_IFLNK | 0777, want: DirentTypeSymlink},
+		{mode: linux.S_IFCHR | 0600, want: DirentTypeCharDevice},
+		{mode: linux.S_IFBLK | 0600, want: DirentTypeBlockDevice},
+		{mode: linux.S_IFIFO | 0600, want: DirentTypeFIFO},
+		{mode: linux.S_IFSOCK | 0600, want: DirentTypeSocket},
+		{mode: 0644, want: DirentTypeUnknown},
+	} {
+		if got := DirentTypeFromMode(test.mode); got != test.want {
+			t.Errorf("DirentTypeFromMode(%#o) = %d, want %d", test.mode, got, test.want)
+		}
+	}
+}
+
+// TestCheckDirentInode tests that only the root directory and non-reserved
+// inodes in range may be linked from directories.
+func TestCheckDirentInode(t *testing.T) {
+	sb := &SuperBlockOld{InodesCountRaw: 64}
+	for _, test := range []struct {
+		ino    uint32
+		wantOK bool
+	}{
+		{ino: 0},
+		{ino: RootDirInode, wantOK: true},
+		{ino: 5},
+		{ino: OldFirstInode - 1},
+		{ino: OldFirstInode, wantOK: true},
+		{ino: 64, wantOK: true},
+		{ino: 65},
+		{ino: 0xffffffff},
+	} {
+		err := CheckDirentInode(sb, test.ino)
+		if test.wantOK {
+			if err != nil {
+				t.Errorf("CheckDirentInode(%d) = %v, want nil", test.ino, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInodeOutOfRange) {
+			t.Errorf("CheckDirentInode(%d) = %v, want %v", test.ino, err, ErrInodeOutOfRange)
+		}
+	}
+}
+
+// TestParseDirBlockErrors tests that malformed dirents are rejected.
+func TestParseDirBlockErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		recLen uint16
+		dirent string
+		ft     uint8
+	}{
+		{name: "record past block end", recLen: 36, dirent: "a", ft: 1},
+		{name: "record too short", recLen: 4, dirent: "a", ft: 1},
+		{name: "unaligned record", recLen: 18, dirent: "a", ft: 1},
+		{name: "name past record", recLen: 12, dirent: "longname", ft: 1},
+		{name: "unknown file type", recLen: 32, dirent: "a", ft: 9},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			block := make([]byte, 32)
+			putDirent(block, 0, 11, test.recLen, test.dirent, test.ft, true)
+			if _, err := ParseDirBlock(block, true); err == nil {
+				t.Errorf("ParseDirBlock succeeded, want error")
+			}
+		})
+	}
+}
+
+// TestDecodeDirentName tests that the name length of dirents is 16 bits
+// without the file type feature and 8 bits followed by the file type with it.
+func TestDecodeDirentName(t *testing.T) {
+	longName := strings.Repeat("x", 300)
+	for _, test := range []struct {
+		name        string
+		dirent      string
+		ft          uint8
+		hasFileType bool
+		parseAs     bool
+		want        string
+		wantType    DirentType
+		wantErr     bool
+	}{
+		{
+			name:   "long name without file type",
+			dirent: longName,
+			want:   longName,
+		},
+		{
+			// The upper byte of the 16-bit name length of 300 is read as
+			// the regular file type.
+			name:     "long name read with file type",
+			dirent:   longName,
+			parseAs:  true,
+			want:     longName[:300&0xff],
+			wantType: DirentTypeRegular,
+		},
+		{
+			name:        "name with file type",
+			dirent:      "file.txt",
+			ft:          uint8(DirentTypeRegular),
+			hasFileType: true,
+			parseAs:     true,
+			want:        "file.txt",
+			wantType:    DirentTypeRegular,
+		},
+		{
+			// The file type is read as the upper byte of the name length.
+			name:        "name with file type read without file type",
+			dirent:      "file.txt",
+			ft:          uint8(DirentTypeRegular),
+			hasFileType: true,
+			wantErr:     true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recLen := direntRecLen(len(test.dirent))
+			block := make([]byte, recLen)
+			putDirent(block, 0, 11, recLen, test.dirent, test.ft, test.hasFileType)
+
+			name, ft, err := DecodeDirentName(block, test.parseAs)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("DecodeDirentName() = (%q, %d), want error", name, ft)
+				}
+				if _, err := ParseDirBlock(block, test.parseAs); err == nil {
+					t.Errorf("ParseDirBlock() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeDirentName() failed: %v", err)
+			}
+			if name != test.want || ft != test.wantType {
+				t.Errorf("DecodeDirentName() = (%q, %d), want (%q, %d)", name, ft, test.want, test.wantType)
+			}
+
+			dirents, err := ParseDirBlock(block, test.parseAs)
+			if err != nil {
+				t.Fatalf("ParseDirBlock() failed: %v", err)
+			}
+			if len(dirents) != 1 || dirents[0].FileName() != test.want || dirents[0].Type() != test.wantType {
+				t.Fatalf("ParseDirBlock() = %+v, want one dirent named %q of type %d", dirents, test.want, test.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of errors found in on-disk structures. They are wrapped by the errors
+// returned by this package, which hold more context, so they must be tested
+// for with errors.Is.
+var (
+	// ErrBadMagic is the kind of errors returned for structures which do not
+	// start with their magic number.
+	ErrBadMagic = errors.New("ext bad magic number")
+
+	// ErrUnsupportedFeature is the kind of errors returned for structures
+	// which use a feature or algorithm that is not supported.
+	ErrUnsupportedFeature = errors.New("ext unsupported feature")
+
+	// ErrChecksumMismatch is the kind of errors returned for structures which
+	// do not match their checksum. The Verify* functions of this package
+	// report mismatches with their boolean result instead, which callers may
+	// turn into such errors.
+	ErrChecksumMismatch = errors.New("ext checksum mismatch")
+
+	// ErrCorrupt is the kind of errors returned for structures whose fields
+	// are inconsistent with each other or with the rest of the filesystem.
+	ErrCorrupt = errors.New("ext corrupt structure")
+
+	// ErrCorruptExtent is the kind of *ExtentNodeError.
+	ErrCorruptExtent = errors.New("ext corrupt extent tree")
+
+	// ErrInodeOutOfRange is the kind of *InodeNumberError.
+	ErrInodeOutOfRange = errors.New("ext inode number out of range")
+
+	// ErrInvalidACL is the kind of errors returned for POSIX ACLs which Linux
+	// rejects with EINVAL.
+	ErrInvalidACL = errors.New("ext invalid POSIX ACL")
+)
+
+// DiskError is an error found in an on-disk structure. It wraps the kind of
+// the error, one of the Err* variables of this package, with the location of
+// the structure when it is known.
+type DiskError struct {
+	// Err is the kind of the error.
+	Err error
+
+	// Group is the number of the block group the structure belongs to, or -1
+	// if unknown.
+	Group int64
+
+	// Inode is the number of the inode the structure belongs to, or 0 if
+	// unknown.
+	Inode uint32
+
+	// Offset is the byte offset of the structure on the device, or -1 if
+	// unknown.
+	Offset int64
+
+	// Reason describes the error. Err describes it if Reason is empty.
+	Reason string
+}
+
+// NewDiskError returns a *DiskError of kind err at an unknown location.
+func NewDiskError(err error, reason string) *DiskError {
+	return &DiskError{Err: err, Group: -1, Offset: -1, Reason: reason}
+}
+
+// newDiskErrorf is NewDiskError with a formatted reason.
+func newDiskErrorf(err error, format string, args ...interface{}) *DiskError {
+	return NewDiskError(err, fmt.Sprintf(format, args...))
+}
+
+// Error implements error.Error.
+func (e *DiskError) Error() string {
+	var b strings.Builder
+	if e.Group >= 0 {
+		fmt.Fprintf(&b, "block group %d: ", e.Group)
+	}
+	if e.Inode != 0 {
+		fmt.Fprintf(&b, "inode %d: ", e.Inode)
+	}
+	if e.Offset >= 0 {
+		fmt.Fprintf(&b, "offset %#x: ", e.Offset)
+	}
+	if e.Reason != "" {
+		b.WriteString(e.Reason)
+	} else {
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the kind of the error, for errors.Is.
+func (e *DiskError) Unwrap() error {
+	return e.Err
+}
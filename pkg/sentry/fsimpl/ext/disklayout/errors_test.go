@@ -0,0 +1,107 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// TestErrorKinds tests that the errors returned by the parsers of this package
+// are of the expected kind, including when wrapped further by callers.
+func TestErrorKinds(t *testing.T) {
+	sb := &SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.InodesCountRaw = 16
+	sb.InodesPerGroupRaw = 16
+	_, inodeErr := InodeOffset(sb, nil, 17)
+	_, extentErr := ParseExtentNode(make([]byte, ExtentRootSize))
+	_, mmpErr := ParseMMPBlock(make([]byte, MMPSize))
+	_, journalErr := ParseJournalSuperBlock(make([]byte, JournalSuperBlockSize))
+	_, _, hashErr := DirHash("name", 0xff, [4]uint32{})
+	journalBlock := make([]byte, JournalSuperBlockSize)
+	binary.BigEndian.PutUint32(journalBlock, JournalMagic)
+	_, journalTypeErr := ParseJournalSuperBlock(journalBlock)
+	xattrBlock := make([]byte, XattrBlockHeaderSize)
+	binary.LittleEndian.PutUint32(xattrBlock, XattrMagic)
+	binary.LittleEndian.PutUint32(xattrBlock[8:], 2)
+	_, xattrErr := ParseXattrBlock(xattrBlock)
+	resizeSB := &SuperBlock32Bit{}
+	resizeSB.RevLevel = uint32(DynamicRev)
+	resizeSB.FeatureCompat = SbResizeInode
+	resizeSB.ReservedGdtBlocksRaw = 1
+	_, resizeErr := NewResizeInodeReader(resizeSB, &InodeOld{}, nil)
+	_, aclErr := ParsePosixACL([]byte{2, 0})
+
+	for _, test := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "inode out of range", err: inodeErr, want: ErrInodeOutOfRange},
+		{name: "extent node", err: extentErr, want: ErrCorruptExtent},
+		{name: "superblock magic", err: ValidateSuperBlock(sb), want: ErrBadMagic},
+		{name: "MMP magic", err: mmpErr, want: ErrBadMagic},
+		{name: "journal magic", err: journalErr, want: ErrBadMagic},
+		{name: "journal block type", err: journalTypeErr, want: ErrUnsupportedFeature},
+		{name: "xattr block count", err: xattrErr, want: ErrCorrupt},
+		{name: "resize inode", err: resizeErr, want: ErrCorrupt},
+		{name: "POSIX ACL", err: aclErr, want: ErrInvalidACL},
+		{name: "hash version", err: hashErr, want: ErrUnsupportedFeature},
+		{name: "checksum", err: NewDiskError(ErrChecksumMismatch, "bad checksum"), want: ErrChecksumMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.err == nil {
+				t.Fatalf("got no error, want %v", test.want)
+			}
+			if !errors.Is(test.err, test.want) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", test.err, test.want)
+			}
+			if wrapped := fmt.Errorf("mount: %w", test.err); !errors.Is(wrapped, test.want) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", wrapped, test.want)
+			}
+			for _, other := range []error{ErrBadMagic, ErrUnsupportedFeature, ErrChecksumMismatch, ErrCorrupt, ErrCorruptExtent, ErrInodeOutOfRange, ErrInvalidACL} {
+				if other != test.want && errors.Is(test.err, other) {
+					t.Errorf("errors.Is(%v, %v) = true, want false", test.err, other)
+				}
+			}
+		})
+	}
+}
+
+// TestDiskError tests that the location of a *DiskError is reported and
+// survives wrapping.
+func TestDiskError(t *testing.T) {
+	e := NewDiskError(ErrChecksumMismatch, "")
+	if got, want := e.Error(), ErrChecksumMismatch.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	e = NewDiskError(ErrChecksumMismatch, "directory block checksum mismatch")
+	e.Group = 0
+	e.Inode = 12
+	e.Offset = 0x400
+	if got, want := e.Error(), "block group 0: inode 12: offset 0x400: directory block checksum mismatch"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	var got *DiskError
+	if !errors.As(fmt.Errorf("mount: %w", e), &got) || got.Inode != 12 {
+		t.Errorf("errors.As() = %v, want %v", got, e)
+	}
+}
@@ -14,6 +14,13 @@
 
 package disklayout
 
+import (
+	"fmt"
+	"sort"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
 // Extents were introduced in ext4 and provide huge performance gains in terms
 // data locality and reduced metadata block usage. Extents are organized in
 // extent trees. The root node is contained in inode.BlocksRaw.
@@ -38,8 +45,72 @@ const (
 
 	// ExtentMagic is the magic number which must be present in the header.
 	ExtentMagic = 0xf30a
+
+	// ExtentMaxInitLength is the maximum length of an initialized extent. Extents
+	// with a Length greater than this are uninitialized (unwritten) and cover
+	// Length - ExtentMaxInitLength blocks.
+	ExtentMaxInitLength = 32768
+
+	// ExtentRootSize is the size of the extent tree root node which lives in
+	// the inode's i_block.
+	ExtentRootSize = 60
 )
 
+// ExtentNodeError is returned when an on-disk extent tree node is malformed.
+type ExtentNodeError struct {
+	// Reason describes what is wrong with the node.
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *ExtentNodeError) Error() string {
+	return fmt.Sprintf("invalid ext extent node: %s", e.Reason)
+}
+
+// Is returns true if target is ErrCorruptExtent, for errors.Is.
+func (e *ExtentNodeError) Is(target error) bool {
+	return target == ErrCorruptExtent
+}
+
+// ParseExtentNode parses the extent tree node stored in buf, which is either
+// the ExtentRootSize byte i_block or a full filesystem block. Only the node
+// itself is parsed; the Node fields of the returned entries are nil. Exactly
+// eh_entries entries are read after the header: the rest of the node, which
+// holds unused entry slots and possibly the extent tail, is ignored. Returns an
+// *ExtentNodeError if the header magic is wrong or the entries do not fit.
+func ParseExtentNode(buf []byte) (*ExtentNode, error) {
+	if len(buf) < ExtentHeaderSize {
+		return nil, &ExtentNodeError{Reason: fmt.Sprintf("%d bytes is too small for the header", len(buf))}
+	}
+
+	var node ExtentNode
+	binary.Unmarshal(buf[:ExtentHeaderSize], binary.LittleEndian, &node.Header)
+	if node.Header.Magic != ExtentMagic {
+		return nil, &ExtentNodeError{Reason: fmt.Sprintf("bad magic %#x", node.Header.Magic)}
+	}
+	if node.Header.NumEntries > node.Header.MaxEntries {
+		return nil, &ExtentNodeError{Reason: fmt.Sprintf("%d entries exceed max %d", node.Header.NumEntries, node.Header.MaxEntries)}
+	}
+	if ExtentHeaderSize+int(node.Header.MaxEntries)*ExtentEntrySize > len(buf) {
+		return nil, &ExtentNodeError{Reason: fmt.Sprintf("%d max entries do not fit in %d bytes", node.Header.MaxEntries, len(buf))}
+	}
+
+	node.Entries = make([]ExtentEntryPair, node.Header.NumEntries)
+	for i, off := 0, ExtentHeaderSize; i < len(node.Entries); i, off = i+1, off+ExtentEntrySize {
+		var entry ExtentEntry
+		if node.Header.Height == 0 {
+			// Leaf node.
+			entry = &Extent{}
+		} else {
+			// Internal node.
+			entry = &ExtentIdx{}
+		}
+		binary.Unmarshal(buf[off:off+ExtentEntrySize], binary.LittleEndian, entry)
+		node.Entries[i].Entry = entry
+	}
+	return &node, nil
+}
+
 // ExtentEntryPair couples an in-memory ExtendNode with the ExtentEntry that
 // points to it. We want to cache these structs in memory to avoid repeated
 // disk reads.
@@ -120,7 +191,7 @@ func (ei *ExtentIdx) PhysicalBlock() uint64 {
 // Extent represents the ext4_extent struct in ext4. Only present in leaf
 // nodes. Sorted in ascending order based on FirstFileBlock since Linux does a
 // binary search on this. This points to an array of data blocks containing the
-// file data. It covers `Length` data blocks starting from `StartBlock`.
+// file data. It covers ActualLength() data blocks starting from `StartBlock`.
 type Extent struct {
 	FirstFileBlock uint32
 	Length         uint16
@@ -141,3 +212,216 @@ func (e *Extent) FileBlock() uint32 {
 func (e *Extent) PhysicalBlock() uint64 {
 	return (uint64(e.StartBlockHi) << 32) | uint64(e.StartBlockLo)
 }
+
+// Uninitialized returns true if this extent has been allocated but not
+// written to yet. Reads from such extents must return zeros.
+func (e *Extent) Uninitialized() bool {
+	return e.Length > ExtentMaxInitLength
+}
+
+// ActualLength returns the number of blocks this extent covers, stripping the
+// uninitialized marker. Mirrors ext4_ext_get_actual_len.
+func (e *Extent) ActualLength() uint16 {
+	if e.Uninitialized() {
+		return e.Length - ExtentMaxInitLength
+	}
+	return e.Length
+}
+
+// BlockReader reads the filesystem block with the given physical block number.
+// It is used by block mappers to load extent tree nodes and indirect blocks
+// which are not in memory.
+type BlockReader func(phyBlk uint64) ([]byte, error)
+
+// MapBlock maps fileBlock to the physical block storing it by walking the
+// extent tree from root. Child nodes which are not cached in the
+// ExtentEntryPair are loaded with readBlock, and each child's header must be
+// valid and exactly one level below its parent.
+//
+// found is false if fileBlock is in a hole. unwritten is true if fileBlock is
+// mapped by an uninitialized extent, in which case its contents are zeros.
+func MapBlock(root *ExtentNode, readBlock BlockReader, fileBlock uint64) (physical uint64, unwritten, found bool, err error) {
+	if fileBlock > uint64(^uint32(0)) {
+		// File blocks are addressed with 32 bits.
+		return 0, false, false, nil
+	}
+	fileBlk := uint32(fileBlock)
+
+	node := root
+	for {
+		// Find the last entry starting at or before fileBlk.
+		i := sort.Search(len(node.Entries), func(i int) bool {
+			return node.Entries[i].Entry.FileBlock() > fileBlk
+		}) - 1
+		if i < 0 {
+			return 0, false, false, nil
+		}
+		ep := &node.Entries[i]
+
+		if node.Header.Height == 0 {
+			ex := ep.Entry.(*Extent)
+			if uint64(fileBlk) >= uint64(ex.FirstFileBlock)+uint64(ex.ActualLength()) {
+				return 0, false, false, nil
+			}
+			return ex.PhysicalBlock() + uint64(fileBlk-ex.FirstFileBlock), ex.Uninitialized(), true, nil
+		}
+
+		if node, err = childNode(node, ep, readBlock); err != nil {
+			return 0, false, false, err
+		}
+	}
+}
+
+// childNode returns the child node of internal node pointed to by its entry
+// ep, which is loaded with readBlock if it is not cached.
+func childNode(node *ExtentNode, ep *ExtentEntryPair, readBlock BlockReader) (*ExtentNode, error) {
+	child := ep.Node
+	if child == nil {
+		buf, err := readBlock(ep.Entry.PhysicalBlock())
+		if err != nil {
+			return nil, err
+		}
+		if child, err = ParseExtentNode(buf); err != nil {
+			return nil, err
+		}
+	}
+	if child.Header.Height != node.Header.Height-1 {
+		return nil, &ExtentNodeError{Reason: fmt.Sprintf("height %d under node of height %d", child.Header.Height, node.Header.Height)}
+	}
+	return child, nil
+}
+
+// ExtentRun is a run of consecutive file blocks which are either mapped to
+// consecutive physical blocks by a single extent, or in a hole.
+type ExtentRun struct {
+	// FileBlock is the first file block of the run.
+	FileBlock uint64
+
+	// Physical is the physical block storing FileBlock if Found is set.
+	Physical uint64
+
+	// Length is the number of blocks in the run.
+	Length uint64
+
+	// Found is false if the run is a hole.
+	Found bool
+
+	// Unwritten is true if the run is mapped by an uninitialized extent, in
+	// which case its contents are zeros.
+	Unwritten bool
+}
+
+// SequentialReader maps consecutive file blocks to the runs of physical
+// blocks storing them, so that each run can be read from the device at once.
+// The leaf of the extent tree holding the current run is cached, so that runs
+// within the same leaf are found without walking the tree from the root
+// again.
+//
+// Note: This struct itself does not represent an on-disk struct.
+type SequentialReader struct {
+	// root is the root of the extent tree.
+	root *ExtentNode
+
+	// readBlock loads the child nodes which are not cached in the tree.
+	readBlock BlockReader
+
+	// next is the first file block of the next run.
+	next uint64
+
+	// cached is true if leaf and leafEnd cover next.
+	cached bool
+
+	// leaf is the leaf of the extent tree covering the file blocks up to
+	// leafEnd. It is nil if those blocks are in a hole in an internal node.
+	leaf *ExtentNode
+
+	// leafEnd is the first file block after next which leaf does not cover.
+	leafEnd uint64
+
+	// idx is the number of entries of leaf starting at or before next.
+	idx int
+}
+
+// NewSequentialReader is the SequentialReader constructor. The first run
+// returned by Next starts at fileBlock.
+func NewSequentialReader(root *ExtentNode, readBlock BlockReader, fileBlock uint64) *SequentialReader {
+	return &SequentialReader{root: root, readBlock: readBlock, next: fileBlock}
+}
+
+// Next returns the largest run starting at the first file block following the
+// previous run. Runs never span multiple extents. Blocks which cannot be
+// addressed by extents are in a hole.
+func (r *SequentialReader) Next() (ExtentRun, error) {
+	run := ExtentRun{FileBlock: r.next}
+	if r.next > uint64(^uint32(0)) {
+		// File blocks are addressed with 32 bits.
+		run.Length = ^uint64(0) - r.next
+		r.next = ^uint64(0)
+		return run, nil
+	}
+	if !r.cached || r.next >= r.leafEnd {
+		if err := r.findLeaf(uint32(r.next)); err != nil {
+			return ExtentRun{}, err
+		}
+	}
+
+	end := r.leafEnd
+	if r.leaf != nil {
+		entries := r.leaf.Entries
+		for r.idx < len(entries) && uint64(entries[r.idx].Entry.FileBlock()) <= r.next {
+			r.idx++
+		}
+		if r.idx > 0 {
+			ex := entries[r.idx-1].Entry.(*Extent)
+			if exEnd := uint64(ex.FirstFileBlock) + uint64(ex.ActualLength()); r.next < exEnd {
+				run.Found = true
+				run.Unwritten = ex.Uninitialized()
+				run.Physical = ex.PhysicalBlock() + (r.next - uint64(ex.FirstFileBlock))
+				if exEnd < end {
+					end = exEnd
+				}
+			}
+		}
+		if !run.Found && r.idx < len(entries) {
+			// The hole lasts until the next extent.
+			if start := uint64(entries[r.idx].Entry.FileBlock()); start < end {
+				end = start
+			}
+		}
+	}
+	run.Length = end - r.next
+	r.next = end
+	return run, nil
+}
+
+// findLeaf walks the extent tree from the root to the leaf covering fileBlk
+// and caches it.
+func (r *SequentialReader) findLeaf(fileBlk uint32) error {
+	r.cached, r.leaf, r.leafEnd, r.idx = false, nil, 1<<32, 0
+	node := r.root
+	for {
+		i := sort.Search(len(node.Entries), func(i int) bool {
+			return node.Entries[i].Entry.FileBlock() > fileBlk
+		})
+		if node.Header.Height == 0 {
+			r.leaf = node
+			break
+		}
+		// The subtree covering fileBlk ends where the next one starts.
+		if i < len(node.Entries) {
+			if start := uint64(node.Entries[i].Entry.FileBlock()); start < r.leafEnd {
+				r.leafEnd = start
+			}
+		}
+		if i == 0 {
+			// fileBlk is in a hole before the first entry.
+			break
+		}
+		var err error
+		if node, err = childNode(node, &node.Entries[i-1], r.readBlock); err != nil {
+			return err
+		}
+	}
+	r.cached = true
+	return nil
+}
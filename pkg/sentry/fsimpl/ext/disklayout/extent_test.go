@@ -15,7 +15,10 @@
 package disklayout
 
 import (
+	"reflect"
 	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
 )
 
 // TestExtentSize tests that the extent structs are of the correct
@@ -25,3 +28,336 @@ func TestExtentSize(t *testing.T) {
 	assertSize(t, ExtentIdx{}, ExtentEntrySize)
 	assertSize(t, Extent{}, ExtentEntrySize)
 }
+
+// marshalExtentNode serializes the header and entries of node into a buffer
+// of size bytes.
+func marshalExtentNode(node *ExtentNode, size int) []byte {
+	buf := binary.Marshal(nil, binary.LittleEndian, node.Header)
+	for _, ep := range node.Entries {
+		buf = binary.Marshal(buf, binary.LittleEndian, ep.Entry)
+	}
+	return append(buf, make([]byte, size-len(buf))...)
+}
+
+// TestParseExtentNode tests parsing of leaf and internal extent nodes.
+func TestParseExtentNode(t *testing.T) {
+	leaf := &ExtentNode{
+		Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 2, MaxEntries: 4},
+		Entries: []ExtentEntryPair{
+			{Entry: &Extent{FirstFileBlock: 0, Length: 3, StartBlockHi: 0x1, StartBlockLo: 0x20}},
+			{Entry: &Extent{FirstFileBlock: 5, Length: 1, StartBlockLo: 0x30}},
+		},
+	}
+	got, err := ParseExtentNode(marshalExtentNode(leaf, ExtentRootSize))
+	if err != nil {
+		t.Fatalf("ParseExtentNode(leaf) failed: %v", err)
+	}
+	if got.Header != leaf.Header || len(got.Entries) != 2 {
+		t.Fatalf("ParseExtentNode(leaf) = %+v, want %+v", got, leaf)
+	}
+	for i, ep := range got.Entries {
+		ex, ok := ep.Entry.(*Extent)
+		if !ok || *ex != *leaf.Entries[i].Entry.(*Extent) || ep.Node != nil {
+			t.Errorf("leaf entry %d = %+v, want %+v", i, ep, leaf.Entries[i])
+		}
+	}
+	if got, want := got.Entries[0].Entry.PhysicalBlock(), uint64(0x100000020); got != want {
+		t.Errorf("PhysicalBlock() = %#x, want %#x", got, want)
+	}
+
+	// Internal nodes may be parsed out of a full block.
+	internal := &ExtentNode{
+		Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 84, Height: 1},
+		Entries: []ExtentEntryPair{
+			{Entry: &ExtentIdx{FirstFileBlock: 7, ChildBlockLo: 0x40, ChildBlockHi: 0x2}},
+		},
+	}
+	got, err = ParseExtentNode(marshalExtentNode(internal, 1024))
+	if err != nil {
+		t.Fatalf("ParseExtentNode(internal) failed: %v", err)
+	}
+	if idx, ok := got.Entries[0].Entry.(*ExtentIdx); !ok || idx.FileBlock() != 7 || idx.PhysicalBlock() != 0x200000040 {
+		t.Errorf("internal entry = %+v, want %+v", got.Entries[0].Entry, internal.Entries[0].Entry)
+	}
+}
+
+// TestParseExtentNodeTrailingBytes tests that parsing stops at eh_entries
+// entries even when the unused entry slots and the rest of the node hold
+// non-zero bytes.
+func TestParseExtentNodeTrailingBytes(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		node *ExtentNode
+	}{
+		{
+			name: "leaf",
+			node: &ExtentNode{
+				Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 2, MaxEntries: 4},
+				Entries: []ExtentEntryPair{
+					{Entry: &Extent{FirstFileBlock: 0, Length: 3, StartBlockLo: 0x20}},
+					{Entry: &Extent{FirstFileBlock: 5, Length: 1, StartBlockLo: 0x30}},
+				},
+			},
+		},
+		{
+			name: "internal",
+			node: &ExtentNode{
+				Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 84, Height: 1},
+				Entries: []ExtentEntryPair{
+					{Entry: &ExtentIdx{FirstFileBlock: 7, ChildBlockLo: 0x40}},
+				},
+			},
+		},
+	} {
+		size := ExtentHeaderSize + int(test.node.Header.MaxEntries)*ExtentEntrySize + 4
+		buf := marshalExtentNode(test.node, size)
+		// Fill the unused slots with a plausible entry, and everything after
+		// them with garbage.
+		used := ExtentHeaderSize + len(test.node.Entries)*ExtentEntrySize
+		bogus := binary.Marshal(nil, binary.LittleEndian, &Extent{FirstFileBlock: 100, Length: 1, StartBlockLo: 0x50})
+		for off := used; off+ExtentEntrySize <= size; off += ExtentEntrySize {
+			copy(buf[off:], bogus)
+		}
+		for i := size - 4; i < size; i++ {
+			buf[i] = 0xff
+		}
+
+		got, err := ParseExtentNode(buf)
+		if err != nil {
+			t.Fatalf("%s: ParseExtentNode() failed: %v", test.name, err)
+		}
+		if got.Header != test.node.Header {
+			t.Errorf("%s: header = %+v, want %+v", test.name, got.Header, test.node.Header)
+		}
+		if len(got.Entries) != len(test.node.Entries) {
+			t.Fatalf("%s: got %d entries, want %d", test.name, len(got.Entries), len(test.node.Entries))
+		}
+		for i, ep := range got.Entries {
+			if !reflect.DeepEqual(ep.Entry, test.node.Entries[i].Entry) {
+				t.Errorf("%s: entry %d = %+v, want %+v", test.name, i, ep.Entry, test.node.Entries[i].Entry)
+			}
+		}
+	}
+}
+
+// TestExtentPhysicalBlock48Bit tests that the 48-bit physical start of
+// extents is assembled from ee_start_hi and ee_start_lo of the on-disk leaf,
+// and that blocks mapped by the extent carry into the high bits.
+func TestExtentPhysicalBlock48Bit(t *testing.T) {
+	buf := make([]byte, ExtentRootSize)
+	binary.LittleEndian.PutUint16(buf[0:], ExtentMagic)
+	binary.LittleEndian.PutUint16(buf[2:], 1) // eh_entries
+	binary.LittleEndian.PutUint16(buf[4:], 4) // eh_max
+	// ee_block, ee_len, ee_start_hi and ee_start_lo of the only extent.
+	binary.LittleEndian.PutUint32(buf[12:], 100)
+	binary.LittleEndian.PutUint16(buf[16:], 8)
+	binary.LittleEndian.PutUint16(buf[18:], 0xabcd)
+	binary.LittleEndian.PutUint32(buf[20:], 0xfffffffc)
+
+	node, err := ParseExtentNode(buf)
+	if err != nil {
+		t.Fatalf("ParseExtentNode failed: %v", err)
+	}
+	if got, want := node.Entries[0].Entry.PhysicalBlock(), uint64(0xabcdfffffffc); got != want {
+		t.Errorf("PhysicalBlock() = %#x, want %#x", got, want)
+	}
+	physical, _, found, err := MapBlock(node, nil, 107)
+	if err != nil || !found {
+		t.Fatalf("MapBlock(107) = (%#x, %t, %v), want mapped block", physical, found, err)
+	}
+	if want := uint64(0xabce00000003); physical != want {
+		t.Errorf("MapBlock(107) = %#x, want %#x", physical, want)
+	}
+}
+
+// TestParseExtentNodeErrors tests that malformed extent nodes are rejected.
+func TestParseExtentNodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		header ExtentHeader
+		size   int
+	}{
+		{
+			name:   "bad magic",
+			header: ExtentHeader{Magic: 0xf30b, MaxEntries: 4},
+			size:   ExtentRootSize,
+		},
+		{
+			name:   "entries exceed max",
+			header: ExtentHeader{Magic: ExtentMagic, NumEntries: 3, MaxEntries: 2},
+			size:   ExtentRootSize,
+		},
+		{
+			name:   "max entries exceed buffer",
+			header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 5},
+			size:   ExtentRootSize,
+		},
+		{
+			name: "buffer too small",
+			size: ExtentHeaderSize - 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := binary.Marshal(nil, binary.LittleEndian, test.header)
+			buf = append(buf, make([]byte, ExtentRootSize)...)[:test.size]
+			if _, err := ParseExtentNode(buf); err == nil {
+				t.Errorf("ParseExtentNode succeeded, want error")
+			} else if _, ok := err.(*ExtentNodeError); !ok {
+				t.Errorf("ParseExtentNode = %v, want *ExtentNodeError", err)
+			}
+		})
+	}
+}
+
+// extentTestTree returns a three-level extent tree whose child nodes are
+// loaded through the returned block reader from blocks. The tree has a hole
+// over file blocks [10, 20) and an uninitialized extent over [25, 30).
+func extentTestTree(t *testing.T) (*ExtentNode, BlockReader, map[uint64][]byte) {
+	const blkSize = 1024
+	blocks := map[uint64][]byte{
+		// Internal nodes.
+		100: marshalExtentNode(&ExtentNode{
+			Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 84, Height: 1},
+			Entries: []ExtentEntryPair{
+				{Entry: &ExtentIdx{FirstFileBlock: 0, ChildBlockLo: 200}},
+			},
+		}, blkSize),
+		101: marshalExtentNode(&ExtentNode{
+			Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 84, Height: 1},
+			Entries: []ExtentEntryPair{
+				{Entry: &ExtentIdx{FirstFileBlock: 20, ChildBlockLo: 201}},
+			},
+		}, blkSize),
+		// Leaves.
+		200: marshalExtentNode(&ExtentNode{
+			Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 1, MaxEntries: 84},
+			Entries: []ExtentEntryPair{
+				{Entry: &Extent{FirstFileBlock: 0, Length: 10, StartBlockLo: 1000}},
+			},
+		}, blkSize),
+		201: marshalExtentNode(&ExtentNode{
+			Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 2, MaxEntries: 84},
+			Entries: []ExtentEntryPair{
+				{Entry: &Extent{FirstFileBlock: 20, Length: 5, StartBlockHi: 1, StartBlockLo: 2000}},
+				{Entry: &Extent{FirstFileBlock: 25, Length: ExtentMaxInitLength + 5, StartBlockLo: 3000}},
+			},
+		}, blkSize),
+	}
+	root := &ExtentNode{
+		Header: ExtentHeader{Magic: ExtentMagic, NumEntries: 2, MaxEntries: 4, Height: 2},
+		Entries: []ExtentEntryPair{
+			{Entry: &ExtentIdx{FirstFileBlock: 0, ChildBlockLo: 100}},
+			{Entry: &ExtentIdx{FirstFileBlock: 20, ChildBlockLo: 101}},
+		},
+	}
+	readBlock := func(phyBlk uint64) ([]byte, error) {
+		buf, ok := blocks[phyBlk]
+		if !ok {
+			t.Fatalf("read of unexpected block %d", phyBlk)
+		}
+		return buf, nil
+	}
+	return root, readBlock, blocks
+}
+
+// TestMapBlock tests mapping file blocks through the tree of extentTestTree.
+func TestMapBlock(t *testing.T) {
+	const blkSize = 1024
+	root, readBlock, blocks := extentTestTree(t)
+
+	for _, test := range []struct {
+		fileBlock uint64
+		physical  uint64
+		unwritten bool
+		found     bool
+	}{
+		{fileBlock: 0, physical: 1000, found: true},
+		{fileBlock: 9, physical: 1009, found: true},
+		{fileBlock: 10},
+		{fileBlock: 19},
+		{fileBlock: 20, physical: 0x100000000 + 2000, found: true},
+		{fileBlock: 24, physical: 0x100000000 + 2004, found: true},
+		{fileBlock: 25, physical: 3000, unwritten: true, found: true},
+		{fileBlock: 29, physical: 3004, unwritten: true, found: true},
+		{fileBlock: 30},
+		{fileBlock: 1 << 32},
+	} {
+		physical, unwritten, found, err := MapBlock(root, readBlock, test.fileBlock)
+		if err != nil {
+			t.Errorf("MapBlock(%d) failed: %v", test.fileBlock, err)
+			continue
+		}
+		if physical != test.physical || unwritten != test.unwritten || found != test.found {
+			t.Errorf("MapBlock(%d) = (%d, %t, %t), want (%d, %t, %t)", test.fileBlock, physical, unwritten, found, test.physical, test.unwritten, test.found)
+		}
+	}
+
+	// A child which does not sit exactly one level below its parent is
+	// rejected.
+	blocks[100] = blocks[200]
+	if _, _, _, err := MapBlock(root, readBlock, 0); err == nil {
+		t.Errorf("MapBlock with a skipped level succeeded, want error")
+	} else if _, ok := err.(*ExtentNodeError); !ok {
+		t.Errorf("MapBlock with a skipped level = %v, want *ExtentNodeError", err)
+	}
+
+	// So is a child with a bad magic.
+	blocks[100] = make([]byte, blkSize)
+	if _, _, _, err := MapBlock(root, readBlock, 0); err == nil {
+		t.Errorf("MapBlock with a bad child magic succeeded, want error")
+	}
+}
+
+// TestSequentialReader tests that the runs of the tree of extentTestTree are
+// returned in order and that each node is only loaded once.
+func TestSequentialReader(t *testing.T) {
+	root, readBlock, _ := extentTestTree(t)
+	reads := make(map[uint64]int)
+	countReads := func(phyBlk uint64) ([]byte, error) {
+		reads[phyBlk]++
+		return readBlock(phyBlk)
+	}
+
+	r := NewSequentialReader(root, countReads, 5)
+	want := []ExtentRun{
+		{FileBlock: 5, Physical: 1005, Length: 5, Found: true},
+		{FileBlock: 10, Length: 10},
+		{FileBlock: 20, Physical: 0x100000000 + 2000, Length: 5, Found: true},
+		{FileBlock: 25, Physical: 3000, Length: 5, Found: true, Unwritten: true},
+		{FileBlock: 30, Length: 1<<32 - 30},
+	}
+	for _, w := range want {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+		if got != w {
+			t.Errorf("Next() = %+v, want %+v", got, w)
+		}
+	}
+	if got, err := r.Next(); err != nil || got.Found || got.FileBlock != 1<<32 {
+		t.Errorf("Next() past the blocks addressed by extents = (%+v, %v), want hole", got, err)
+	}
+	for blk, n := range reads {
+		if n != 1 {
+			t.Errorf("block %d was read %d times, want once", blk, n)
+		}
+	}
+
+	// Runs agree with the blocks mapped by MapBlock.
+	for start := uint64(0); start < 32; start++ {
+		run, err := NewSequentialReader(root, readBlock, start).Next()
+		if err != nil {
+			t.Fatalf("Next() from block %d failed: %v", start, err)
+		}
+		for blk := run.FileBlock; blk < run.FileBlock+run.Length && blk < 32; blk++ {
+			physical, unwritten, found, err := MapBlock(root, readBlock, blk)
+			if err != nil {
+				t.Fatalf("MapBlock(%d) failed: %v", blk, err)
+			}
+			if found != run.Found || unwritten != run.Unwritten || (found && physical != run.Physical+blk-run.FileBlock) {
+				t.Errorf("run %+v from block %d does not match MapBlock(%d) = (%d, %t, %t)", run, start, blk, physical, unwritten, found)
+			}
+		}
+	}
+}
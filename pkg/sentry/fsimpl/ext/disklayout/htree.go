@@ -0,0 +1,457 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// Htree hash versions (dx_root_info.hash_version and sb.s_def_hash_version).
+// The unsigned variants are never stored in dx_root_info; they are selected
+// by SuperBlock.UnsignedDirHash instead.
+const (
+	DxHashLegacy          = 0
+	DxHashHalfMD4         = 1
+	DxHashTea             = 2
+	DxHashLegacyUnsigned  = 3
+	DxHashHalfMD4Unsigned = 4
+	DxHashTeaUnsigned     = 5
+	DxHashSiphash         = 6
+)
+
+const (
+	// DxMaxLevels is the maximum depth of an htree index, not counting the
+	// leaf blocks. indirect_levels in dx_root_info must be less than this.
+	DxMaxLevels = 2
+
+	// DxMaxLevelsLargeDir replaces DxMaxLevels on filesystems with the
+	// large_dir feature.
+	DxMaxLevelsLargeDir = 3
+
+	// dxRootInfoOff is the offset of dx_root_info in the dx_root block. It
+	// follows the "." and ".." dirents, which are 12 bytes each.
+	dxRootInfoOff = 24
+
+	// dxRootInfoSize is the minimum size of dx_root_info.
+	dxRootInfoSize = 8
+
+	// dxNodeEntriesOff is the offset of the entries in a dx_node block. They
+	// follow a fake dirent with inode 0 spanning the whole block.
+	dxNodeEntriesOff = direntHeaderSize
+
+	// dxEntrySize is the size of dx_entry. The first entry of each node holds
+	// dx_countlimit in place of the hash.
+	dxEntrySize = 8
+
+	// dxBlockMask masks the logical block number of a dx_entry.
+	dxBlockMask = 0x0fffffff
+
+	// htreeEOF32 is the end of directory marker for 32-bit hashes. Hashes
+	// are shifted left by one, so no name may hash to htreeEOF32 << 1.
+	htreeEOF32 = 0x7fffffff
+)
+
+// errDxFallback is returned by dxProbe when the htree index cannot be used
+// and the directory should be scanned linearly instead.
+var errDxFallback = errors.New("htree index unusable")
+
+// HtreeError is returned when an htree directory index is malformed.
+type HtreeError struct {
+	// Reason describes what is wrong with the index.
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *HtreeError) Error() string {
+	return fmt.Sprintf("invalid htree index: %s", e.Reason)
+}
+
+// dxEntry represents a dx_entry with its logical block number masked.
+type dxEntry struct {
+	hash  uint32
+	block uint32
+}
+
+// dxFrame is one level of an htree descent: the entries of an index node and
+// the position chosen in it.
+type dxFrame struct {
+	entries []dxEntry
+	at      int
+}
+
+// parseDxEntries parses the dx_countlimit and dx_entry array starting at off
+// in block.
+func parseDxEntries(block []byte, off int) ([]dxEntry, error) {
+	if off+4 > len(block) {
+		return nil, &HtreeError{Reason: fmt.Sprintf("entries at %d overflow the %d byte block", off, len(block))}
+	}
+	limit := int(binary.LittleEndian.Uint16(block[off:]))
+	count := int(binary.LittleEndian.Uint16(block[off+2:]))
+	if count == 0 || count > limit || off+limit*dxEntrySize > len(block) {
+		return nil, &HtreeError{Reason: fmt.Sprintf("count %d and limit %d do not fit at %d in the %d byte block", count, limit, off, len(block))}
+	}
+
+	entries := make([]dxEntry, count)
+	for i := range entries {
+		e := block[off+i*dxEntrySize:]
+		// The first entry has no hash; it covers everything below the second.
+		if i > 0 {
+			entries[i].hash = binary.LittleEndian.Uint32(e)
+		}
+		entries[i].block = binary.LittleEndian.Uint32(e[4:]) & dxBlockMask
+	}
+	return entries, nil
+}
+
+// dxProbe descends the htree index rooted in the dx_root block root towards
+// name. It returns the hash of name and the index frames, the last of which
+// points at the leaf block to search. Returns errDxFallback if the index uses
+// a format or hash version which is not supported.
+func dxProbe(sb SuperBlock, root []byte, name string, readBlock BlockReader) (uint32, []dxFrame, error) {
+	if len(root) < dxRootInfoOff+dxRootInfoSize {
+		return 0, nil, &HtreeError{Reason: fmt.Sprintf("root block is only %d bytes", len(root))}
+	}
+	info := root[dxRootInfoOff:]
+	if binary.LittleEndian.Uint32(info) != 0 {
+		return 0, nil, errDxFallback
+	}
+	version := info[4]
+	infoLen := int(info[5])
+	levels := int(info[6])
+	if infoLen < dxRootInfoSize || levels >= dxMaxLevels(sb) {
+		return 0, nil, errDxFallback
+	}
+
+	if version <= DxHashTea && sb.UnsignedDirHash() {
+		version += DxHashLegacyUnsigned
+	}
+	hash, _, err := DirHash(name, version, sb.HashSeed())
+	if err != nil {
+		return 0, nil, errDxFallback
+	}
+
+	frames := make([]dxFrame, 0, levels+1)
+	block, off := root, dxRootInfoOff+infoLen
+	for {
+		entries, err := parseDxEntries(block, off)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Find the last entry whose hash is <= hash. Entry 0 has no hash.
+		at := sort.Search(len(entries)-1, func(i int) bool { return entries[i+1].hash > hash })
+		frames = append(frames, dxFrame{entries: entries, at: at})
+		if len(frames) > levels {
+			return hash, frames, nil
+		}
+
+		if block, err = readBlock(uint64(entries[at].block)); err != nil {
+			return 0, nil, err
+		}
+		off = dxNodeEntriesOff
+	}
+}
+
+// dxMaxLevels returns the maximum depth of the htree indexes of sb, like
+// ext4_dir_htree_level in fs/ext4/ext4.h.
+func dxMaxLevels(sb SuperBlock) int {
+	if sb.IncompatibleFeatures().LargeDir {
+		return DxMaxLevelsLargeDir
+	}
+	return DxMaxLevels
+}
+
+// dxNextLeaf advances frames to the next leaf block if it may also hold
+// entries with the given hash, i.e. the next leaf starts with a hash collision
+// continued from the current one. Returns false if there is no such leaf.
+func dxNextLeaf(frames []dxFrame, hash uint32, readBlock BlockReader) (bool, error) {
+	// Find the deepest frame which is not at its last entry.
+	level := len(frames) - 1
+	for ; level >= 0 && frames[level].at == len(frames[level].entries)-1; level-- {
+	}
+	if level < 0 {
+		return false, nil
+	}
+	frames[level].at++
+	if frames[level].entries[frames[level].at].hash&^1 != hash {
+		return false, nil
+	}
+
+	// Descend along the first entries to the leaf.
+	for level++; level < len(frames); level++ {
+		block, err := readBlock(uint64(frames[level-1].entries[frames[level-1].at].block))
+		if err != nil {
+			return false, err
+		}
+		entries, err := parseDxEntries(block, dxNodeEntriesOff)
+		if err != nil {
+			return false, err
+		}
+		frames[level] = dxFrame{entries: entries}
+	}
+	return true, nil
+}
+
+// findInDirBlock looks for name in the linear directory block. It returns the
+// inode number if found.
+func findInDirBlock(block []byte, name string, hasFileType bool) (uint32, bool, error) {
+	dirents, err := ParseDirBlock(block, hasFileType)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, d := range dirents {
+		if d.FileName() == name {
+			return d.Inode(), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// DxLookup looks up name in the block-based directory dir and returns the
+// inode number it refers to. readBlock must read the directory's logical
+// blocks (not physical blocks); the directory's block size is taken from the
+// length of the returned buffers.
+//
+// If the directory has an htree index, the index is used to find the single
+// leaf block (or run of leaf blocks in case of hash collisions) which may hold
+// name. Otherwise, or if the index uses an unsupported format or hash version,
+// all blocks of the directory are scanned linearly.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#hash-tree-directories.
+func DxLookup(dir Inode, name string, sb SuperBlock, readBlock BlockReader) (ino uint32, found bool, err error) {
+	hasFileType := sb.IncompatibleFeatures().DirentFileType
+	if sb.CompatibleFeatures().DirIndex && dir.Flags().Index {
+		root, err := readBlock(0)
+		if err != nil {
+			return 0, false, err
+		}
+		hash, frames, err := dxProbe(sb, root, name, readBlock)
+		switch {
+		case err == errDxFallback:
+			// Fall through to the linear scan.
+		case err != nil:
+			return 0, false, err
+		default:
+			for {
+				leaf := frames[len(frames)-1]
+				block, err := readBlock(uint64(leaf.entries[leaf.at].block))
+				if err != nil {
+					return 0, false, err
+				}
+				if ino, found, err := findInDirBlock(block, name, hasFileType); found || err != nil {
+					return ino, found, err
+				}
+				if more, err := dxNextLeaf(frames, hash, readBlock); !more || err != nil {
+					return 0, false, err
+				}
+			}
+		}
+	}
+
+	size := InodeFileSize(sb, dir)
+	for blk, off := uint64(0), uint64(0); off < size; blk++ {
+		block, err := readBlock(blk)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(block) == 0 {
+			return 0, false, fmt.Errorf("empty directory block %d", blk)
+		}
+		if ino, found, err := findInDirBlock(block, name, hasFileType); found || err != nil {
+			return ino, found, err
+		}
+		off += uint64(len(block))
+	}
+	return 0, false, nil
+}
+
+// DirHash computes the htree hash and minor hash of name like Linux's
+// ext4fs_dirhash, with the given hash version (one of the DxHash* constants)
+// and seed (SuperBlock.HashSeed). A seed of all zeros selects the default
+// seed. The legacy hash has no minor hash.
+//
+// Linux hashes the bytes of names as chars, whose signedness depends on the
+// architecture, so filesystems record which one they were created with. Here
+// the bytes are always sign extended for DxHashLegacy, DxHashHalfMD4 and
+// DxHashTea and zero extended for their unsigned variants, whatever the
+// architecture. This only makes a difference for bytes of 0x80 and above.
+// Callers looking up names must pick the unsigned variant of the version if
+// SuperBlock.UnsignedDirHash is set. Returns an ErrUnsupportedFeature
+// *DiskError for other versions, including DxHashSiphash.
+func DirHash(name string, version uint8, seed [4]uint32) (hash, minorHash uint32, err error) {
+	buf := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	if seed != [4]uint32{} {
+		buf = seed
+	}
+
+	var in [8]uint32
+	unsigned := false
+	switch version {
+	case DxHashLegacyUnsigned:
+		unsigned = true
+		fallthrough
+	case DxHashLegacy:
+		hash = dxHackHash(name, unsigned)
+	case DxHashHalfMD4Unsigned:
+		unsigned = true
+		fallthrough
+	case DxHashHalfMD4:
+		for i := 0; i < len(name); i += 32 {
+			str2HashBuf(name[i:], in[:8], unsigned)
+			halfMD4Transform(&buf, &in)
+		}
+		hash, minorHash = buf[1], buf[2]
+	case DxHashTeaUnsigned:
+		unsigned = true
+		fallthrough
+	case DxHashTea:
+		for i := 0; i < len(name); i += 16 {
+			str2HashBuf(name[i:], in[:4], unsigned)
+			teaTransform(&buf, &in)
+		}
+		hash, minorHash = buf[0], buf[1]
+	default:
+		return 0, 0, newDiskErrorf(ErrUnsupportedFeature, "unsupported htree hash version %d", version)
+	}
+
+	hash &^= 1
+	if hash == htreeEOF32<<1 {
+		hash = (htreeEOF32 - 1) << 1
+	}
+	return hash, minorHash, nil
+}
+
+// hashChar returns the value of name byte c as used by the hash functions,
+// i.e. sign extended unless unsigned is set.
+func hashChar(c byte, unsigned bool) uint32 {
+	if unsigned {
+		return uint32(c)
+	}
+	return uint32(int32(int8(c)))
+}
+
+// dxHackHash implements the legacy htree hash (dx_hack_hash).
+func dxHackHash(name string, unsigned bool) uint32 {
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for i := 0; i < len(name); i++ {
+		hash := hash1 + (hash0 ^ (hashChar(name[i], unsigned) * 7152373))
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1, hash0 = hash0, hash
+	}
+	return hash0 << 1
+}
+
+// str2HashBuf packs up to 4*len(buf) bytes of msg into buf, padding with a
+// value derived from the length of msg (str2hashbuf).
+func str2HashBuf(msg string, buf []uint32, unsigned bool) {
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+
+	n := len(msg)
+	if n > 4*len(buf) {
+		n = 4 * len(buf)
+	}
+	val, i := pad, 0
+	for j := 0; j < n; j++ {
+		val = hashChar(msg[j], unsigned) + val<<8
+		if j%4 == 3 {
+			buf[i] = val
+			val = pad
+			i++
+		}
+	}
+	if i < len(buf) {
+		buf[i] = val
+		i++
+	}
+	for ; i < len(buf); i++ {
+		buf[i] = pad
+	}
+}
+
+// rol32 rotates x left by s bits.
+func rol32(x uint32, s uint) uint32 {
+	return x<<s | x>>(32-s)
+}
+
+// halfMD4Transform implements the cut down MD4 transform used by the
+// half_md4 htree hash (half_md4_transform).
+func halfMD4Transform(buf *[4]uint32, in *[8]uint32) {
+	const (
+		k2 = 013240474631
+		k3 = 015666365641
+	)
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+
+	// Round 1.
+	a = rol32(a+f(b, c, d)+in[0], 3)
+	d = rol32(d+f(a, b, c)+in[1], 7)
+	c = rol32(c+f(d, a, b)+in[2], 11)
+	b = rol32(b+f(c, d, a)+in[3], 19)
+	a = rol32(a+f(b, c, d)+in[4], 3)
+	d = rol32(d+f(a, b, c)+in[5], 7)
+	c = rol32(c+f(d, a, b)+in[6], 11)
+	b = rol32(b+f(c, d, a)+in[7], 19)
+
+	// Round 2.
+	a = rol32(a+g(b, c, d)+in[1]+k2, 3)
+	d = rol32(d+g(a, b, c)+in[3]+k2, 5)
+	c = rol32(c+g(d, a, b)+in[5]+k2, 9)
+	b = rol32(b+g(c, d, a)+in[7]+k2, 13)
+	a = rol32(a+g(b, c, d)+in[0]+k2, 3)
+	d = rol32(d+g(a, b, c)+in[2]+k2, 5)
+	c = rol32(c+g(d, a, b)+in[4]+k2, 9)
+	b = rol32(b+g(c, d, a)+in[6]+k2, 13)
+
+	// Round 3.
+	a = rol32(a+h(b, c, d)+in[3]+k3, 3)
+	d = rol32(d+h(a, b, c)+in[7]+k3, 9)
+	c = rol32(c+h(d, a, b)+in[2]+k3, 11)
+	b = rol32(b+h(c, d, a)+in[6]+k3, 15)
+	a = rol32(a+h(b, c, d)+in[1]+k3, 3)
+	d = rol32(d+h(a, b, c)+in[5]+k3, 9)
+	c = rol32(c+h(d, a, b)+in[0]+k3, 11)
+	b = rol32(b+h(c, d, a)+in[4]+k3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+// teaTransform implements the TEA transform used by the tea htree hash
+// (TEA_transform). Only in[:4] is used.
+func teaTransform(buf *[4]uint32, in *[8]uint32) {
+	const delta = 0x9e3779b9
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+	sum := uint32(0)
+	for n := 0; n < 16; n++ {
+		sum += delta
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+	buf[0] += b0
+	buf[1] += b1
+}
@@ -0,0 +1,418 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// testHashSeed is s_hash_seed of a filesystem created with
+// -E hash_seed=26f15451-fbf8-4e5c-86fd-3c43ce697738.
+var testHashSeed = [4]uint32{0x5154f126, 0x5c4ef8fb, 0x433cfd86, 0x387769ce}
+
+// TestDirHash tests the htree hash functions against values computed by
+// e2fsprogs (debugfs dx_hash, and htree_dump for the unsigned variants).
+func TestDirHash(t *testing.T) {
+	const long = "a_rather_long_file_name_that_spans_several_hash_rounds.txt"
+	const highBit = "file_with_a_long_name_140\xc3\xa9"
+	for _, test := range []struct {
+		name      string
+		version   uint8
+		seed      [4]uint32
+		hash      uint32
+		minorHash uint32
+	}{
+		{name: "hello", version: DxHashLegacy, seed: testHashSeed, hash: 0x32252546},
+		{name: "caf\xc3\xa9", version: DxHashLegacy, seed: testHashSeed, hash: 0x96ca5a2c},
+		{name: long, version: DxHashLegacy, seed: testHashSeed, hash: 0x03839ffc},
+		{name: highBit, version: DxHashLegacy, seed: testHashSeed, hash: 0x6a3dc9ba},
+		{name: highBit, version: DxHashLegacyUnsigned, seed: testHashSeed, hash: 0xbeb5c9c2},
+		{name: "hello", version: DxHashHalfMD4, seed: testHashSeed, hash: 0xd4eefa94, minorHash: 0x1f7978b0},
+		{name: "caf\xc3\xa9", version: DxHashHalfMD4, seed: testHashSeed, hash: 0xc35f8b3a, minorHash: 0xac71df1e},
+		{name: long, version: DxHashHalfMD4, seed: testHashSeed, hash: 0x4ce4454c, minorHash: 0x0584eeb2},
+		{name: highBit, version: DxHashHalfMD4, seed: testHashSeed, hash: 0x083c2cba, minorHash: 0x728f61cf},
+		{name: highBit, version: DxHashHalfMD4Unsigned, seed: testHashSeed, hash: 0x0178bc56, minorHash: 0xfcad9732},
+		{name: "hello", version: DxHashTea, seed: testHashSeed, hash: 0xc8107874, minorHash: 0xf7828c3a},
+		{name: "caf\xc3\xa9", version: DxHashTea, seed: testHashSeed, hash: 0x0da9fa9c, minorHash: 0x8746d643},
+		{name: long, version: DxHashTea, seed: testHashSeed, hash: 0x19f3fff8, minorHash: 0x9ec47fa6},
+		{name: highBit, version: DxHashTea, seed: testHashSeed, hash: 0x136bfade, minorHash: 0x79b7e8d6},
+		{name: highBit, version: DxHashTeaUnsigned, seed: testHashSeed, hash: 0x6c1fa6ca, minorHash: 0x1d631c05},
+		// An all zero seed selects the default seed.
+		{name: "hello", version: DxHashTea, hash: 0x6f5bb1a8, minorHash: 0x231917c2},
+	} {
+		t.Run(fmt.Sprintf("%q/%d", test.name, test.version), func(t *testing.T) {
+			hash, minorHash, err := DirHash(test.name, test.version, test.seed)
+			if err != nil {
+				t.Fatalf("DirHash failed: %v", err)
+			}
+			if hash != test.hash || minorHash != test.minorHash {
+				t.Errorf("DirHash = (%#x, %#x), want (%#x, %#x)", hash, minorHash, test.hash, test.minorHash)
+			}
+		})
+	}
+
+	if _, _, err := DirHash("hello", DxHashSiphash, testHashSeed); err == nil {
+		t.Errorf("DirHash with siphash succeeded, want error")
+	}
+
+	// The signedness of name bytes only matters past 0x7f.
+	for _, version := range []uint8{DxHashLegacy, DxHashHalfMD4, DxHashTea} {
+		signed, signedMinor, _ := DirHash("plain.txt", version, testHashSeed)
+		unsigned, unsignedMinor, _ := DirHash("plain.txt", version+DxHashLegacyUnsigned, testHashSeed)
+		if signed != unsigned || signedMinor != unsignedMinor {
+			t.Errorf("DirHash(version %d) = (%#x, %#x) differs from unsigned variant (%#x, %#x) for ASCII name", version, signed, signedMinor, unsigned, unsignedMinor)
+		}
+		signed, _, _ = DirHash("\x80", version, testHashSeed)
+		unsigned, _, _ = DirHash("\x80", version+DxHashLegacyUnsigned, testHashSeed)
+		if signed == unsigned {
+			t.Errorf("DirHash(version %d) of %q = %#x, same as unsigned variant", version, "\x80", signed)
+		}
+	}
+}
+
+// testDir is an in-memory directory whose blocks are read by logical block
+// number.
+type testDir struct {
+	blocks [][]byte
+}
+
+// readBlock implements BlockReader.
+func (d *testDir) readBlock(blk uint64) ([]byte, error) {
+	if blk >= uint64(len(d.blocks)) {
+		return nil, fmt.Errorf("block %d out of range", blk)
+	}
+	return d.blocks[blk], nil
+}
+
+// inode returns the directory inode of d.
+func (d *testDir) inode(index bool) *InodeNew {
+	in := &InodeNew{}
+	in.SizeLo = uint32(len(d.blocks) * htreeTestBlkSize)
+	in.FlagsRaw = InodeFlags{Index: index}.ToInt()
+	return in
+}
+
+// htreeTestBlkSize is the block size of testDir directories.
+const htreeTestBlkSize = 1024
+
+// newLeafBlock returns a linear directory block holding a dirent for each of
+// names starting at inode number ino.
+func newLeafBlock(names []string, ino uint32) []byte {
+	block := make([]byte, htreeTestBlkSize)
+	off := 0
+	for i, name := range names {
+		recLen := (direntHeaderSize + len(name) + 3) &^ 3
+		if i == len(names)-1 {
+			recLen = htreeTestBlkSize - off
+		}
+		putDirent(block, off, ino+uint32(i), uint16(recLen), name, 1, true)
+		off += recLen
+	}
+	return block
+}
+
+// putDxEntries writes dx_countlimit and the entries at off in block.
+func putDxEntries(block []byte, off int, entries []dxEntry) {
+	limit := (len(block) - off) / dxEntrySize
+	binary.LittleEndian.PutUint16(block[off:], uint16(limit))
+	binary.LittleEndian.PutUint16(block[off+2:], uint16(len(entries)))
+	for i, e := range entries {
+		if i > 0 {
+			binary.LittleEndian.PutUint32(block[off+i*dxEntrySize:], e.hash)
+		}
+		binary.LittleEndian.PutUint32(block[off+i*dxEntrySize+4:], e.block)
+	}
+}
+
+// newDxRoot returns a dx_root block. Only "." and ".." are real dirents.
+func newDxRoot(version uint8, levels uint8, entries []dxEntry) []byte {
+	block := make([]byte, htreeTestBlkSize)
+	putDirent(block, 0, 2, 12, ".", 2, true)
+	putDirent(block, 12, 2, htreeTestBlkSize-12, "..", 2, true)
+	block[dxRootInfoOff+4] = version
+	block[dxRootInfoOff+5] = dxRootInfoSize
+	block[dxRootInfoOff+6] = levels
+	putDxEntries(block, dxRootInfoOff+dxRootInfoSize, entries)
+	return block
+}
+
+// newDxNode returns a dx_node block.
+func newDxNode(entries []dxEntry) []byte {
+	block := make([]byte, htreeTestBlkSize)
+	putDirent(block, 0, 0, htreeTestBlkSize, "", 0, true)
+	putDxEntries(block, dxNodeEntriesOff, entries)
+	return block
+}
+
+// buildHtree builds an htree directory holding names like e2fsck -D would.
+// Each leaf block holds perLeaf names and, with levels of dx_nodes, each
+// dx_node holds perNode entries of the level below. It returns the directory
+// and the inode number of each name.
+func buildHtree(t *testing.T, names []string, version uint8, levels, perLeaf, perNode int) (*testDir, map[string]uint32) {
+	hashes := make(map[string]uint32)
+	for _, name := range names {
+		hash, _, err := DirHash(name, version, testHashSeed)
+		if err != nil {
+			t.Fatalf("DirHash(%q) failed: %v", name, err)
+		}
+		hashes[name] = hash
+	}
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return hashes[sorted[i]] < hashes[sorted[j]] })
+
+	var leaves []dxEntry
+	var leafBlocks [][]byte
+	inodes := make(map[string]uint32)
+	for i := 0; i < len(sorted); i += perLeaf {
+		end := i + perLeaf
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		leaves = append(leaves, dxEntry{hash: hashes[sorted[i]]})
+		leafBlocks = append(leafBlocks, newLeafBlock(sorted[i:end], uint32(100+i)))
+		for j, name := range sorted[i:end] {
+			inodes[name] = uint32(100 + i + j)
+		}
+	}
+
+	// Block 0 is the root, followed by the leaves and then the dx_nodes of
+	// each level from the bottom up.
+	dir := &testDir{blocks: [][]byte{nil}}
+	for i := range leaves {
+		leaves[i].block = uint32(len(dir.blocks))
+		dir.blocks = append(dir.blocks, leafBlocks[i])
+	}
+	entries := leaves
+	for level := 0; level < levels; level++ {
+		var nodes []dxEntry
+		for i := 0; i < len(entries); i += perNode {
+			end := i + perNode
+			if end > len(entries) {
+				end = len(entries)
+			}
+			nodes = append(nodes, dxEntry{hash: entries[i].hash, block: uint32(len(dir.blocks))})
+			dir.blocks = append(dir.blocks, newDxNode(entries[i:end]))
+		}
+		entries = nodes
+	}
+	dir.blocks[0] = newDxRoot(version, uint8(levels), entries)
+	return dir, inodes
+}
+
+// htreeTestSuperBlock returns a superblock with dir_index and filetype.
+func htreeTestSuperBlock() *SuperBlock64Bit {
+	sb := &SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureCompat = CompatFeatures{DirIndex: true}.ToInt()
+	sb.FeatureIncompat = IncompatFeatures{DirentFileType: true, Is64Bit: true}.ToInt()
+	sb.HashSeedRaw = testHashSeed
+	return sb
+}
+
+// TestDxLookup tests htree lookups through one and two level indexes.
+func TestDxLookup(t *testing.T) {
+	var names []string
+	for i := 0; i < 300; i++ {
+		names = append(names, fmt.Sprintf("file_%d\xc3\xa9", i))
+	}
+
+	for _, test := range []struct {
+		name     string
+		version  uint8
+		unsigned bool
+		levels   int
+	}{
+		{name: "half_md4", version: DxHashHalfMD4},
+		{name: "tea", version: DxHashTea},
+		{name: "legacy", version: DxHashLegacy},
+		{name: "half_md4 unsigned", version: DxHashHalfMD4, unsigned: true},
+		{name: "half_md4 two levels", version: DxHashHalfMD4, levels: 1},
+		{name: "tea two levels", version: DxHashTea, levels: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := htreeTestSuperBlock()
+			hashVersion := test.version
+			if test.unsigned {
+				sb.Flags = SbUnsignedHash
+				hashVersion += DxHashLegacyUnsigned
+			}
+			dir, inodes := buildHtree(t, names, hashVersion, test.levels, 20, 4)
+			// The root stores the signed version.
+			dir.blocks[0][dxRootInfoOff+4] = test.version
+
+			// Count block reads to make sure the index is used.
+			reads := 0
+			readBlock := func(blk uint64) ([]byte, error) {
+				reads++
+				return dir.readBlock(blk)
+			}
+			for _, name := range names {
+				reads = 0
+				ino, found, err := DxLookup(dir.inode(true), name, sb, readBlock)
+				if err != nil || !found || ino != inodes[name] {
+					t.Fatalf("DxLookup(%q) = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+				}
+				if want := test.levels + 2; reads > want {
+					t.Errorf("DxLookup(%q) read %d blocks, want at most %d", name, reads, want)
+				}
+			}
+
+			if _, found, err := DxLookup(dir.inode(true), "missing", sb, readBlock); found || err != nil {
+				t.Errorf("DxLookup(missing) = (%t, %v), want (false, nil)", found, err)
+			}
+
+			// The same directory can be scanned linearly without the index.
+			for _, name := range []string{names[0], names[len(names)-1]} {
+				if ino, found, err := DxLookup(dir.inode(false), name, sb, dir.readBlock); err != nil || !found || ino != inodes[name] {
+					t.Errorf("linear DxLookup(%q) = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+				}
+			}
+		})
+	}
+}
+
+// TestDxLookupLargeDir tests lookups through a three level index, which is
+// only valid with large_dir.
+func TestDxLookupLargeDir(t *testing.T) {
+	var names []string
+	for i := 0; i < 300; i++ {
+		names = append(names, fmt.Sprintf("file_%d", i))
+	}
+	// 75 leaves, 25 dx_nodes of leaves, 9 dx_nodes of dx_nodes and the root.
+	dir, inodes := buildHtree(t, names, DxHashHalfMD4, 2, 4, 3)
+
+	sb := htreeTestSuperBlock()
+	sb.FeatureIncompat |= SbLargeDir
+	reads := 0
+	readBlock := func(blk uint64) ([]byte, error) {
+		reads++
+		return dir.readBlock(blk)
+	}
+	for _, name := range names {
+		reads = 0
+		ino, found, err := DxLookup(dir.inode(true), name, sb, readBlock)
+		if err != nil || !found || ino != inodes[name] {
+			t.Fatalf("DxLookup(%q) = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+		}
+		if reads > 4 {
+			t.Errorf("DxLookup(%q) read %d blocks, want at most 4", name, reads)
+		}
+	}
+	if _, found, err := DxLookup(dir.inode(true), "missing", sb, readBlock); found || err != nil {
+		t.Errorf("DxLookup(missing) = (%t, %v), want (false, nil)", found, err)
+	}
+
+	// Without large_dir, the index is not used but the name is still found by
+	// scanning all blocks.
+	name := names[len(names)-1]
+	reads = 0
+	if ino, found, err := DxLookup(dir.inode(true), name, htreeTestSuperBlock(), readBlock); err != nil || !found || ino != inodes[name] {
+		t.Errorf("DxLookup(%q) without large_dir = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+	}
+	if reads <= 4 {
+		t.Errorf("DxLookup(%q) without large_dir read %d blocks, want a linear scan", name, reads)
+	}
+
+	// Linear scans of large_dir directories use the high 32 bits of the size.
+	in := dir.inode(false)
+	in.ModeRaw = uint16(linux.ModeDirectory | 0755)
+	in.SizeLo, in.SizeHi = 0, 1
+	if ino, found, err := DxLookup(in, name, sb, dir.readBlock); err != nil || !found || ino != inodes[name] {
+		t.Errorf("linear DxLookup(%q) of 4GiB directory = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+	}
+
+	// Even large_dir does not allow a fourth level.
+	dir.blocks[0][dxRootInfoOff+6] = DxMaxLevelsLargeDir
+	if ino, found, err := DxLookup(dir.inode(true), name, sb, dir.readBlock); err != nil || !found || ino != inodes[name] {
+		t.Errorf("DxLookup(%q) with %d levels = (%d, %t, %v), want (%d, true, nil)", name, DxMaxLevelsLargeDir+1, ino, found, err, inodes[name])
+	}
+}
+
+// TestDxLookupCollision tests that a lookup continues into the next leaf if
+// the run of names with the same hash continues there.
+func TestDxLookupCollision(t *testing.T) {
+	sb := htreeTestSuperBlock()
+	hash := func(name string) uint32 {
+		h, _, err := DirHash(name, DxHashHalfMD4, testHashSeed)
+		if err != nil {
+			t.Fatalf("DirHash(%q) failed: %v", name, err)
+		}
+		return h
+	}
+
+	// Pretend that "b" continues a hash collision which started in leaf 1,
+	// i.e. the index entry of leaf 2 has the collision bit set.
+	dir := &testDir{blocks: [][]byte{
+		newDxRoot(DxHashHalfMD4, 0, []dxEntry{{block: 1}, {hash: hash("b") | 1, block: 2}}),
+		newLeafBlock([]string{"a"}, 11),
+		newLeafBlock([]string{"b"}, 12),
+	}}
+	if ino, found, err := DxLookup(dir.inode(true), "b", sb, dir.readBlock); err != nil || !found || ino != 12 {
+		t.Errorf("DxLookup(b) = (%d, %t, %v), want (12, true, nil)", ino, found, err)
+	}
+
+	// Without the collision bit, leaf 2 only holds hashes above hash("b").
+	binary.LittleEndian.PutUint32(dir.blocks[0][dxRootInfoOff+dxRootInfoSize+dxEntrySize:], hash("b")+2)
+	if _, found, err := DxLookup(dir.inode(true), "b", sb, dir.readBlock); found || err != nil {
+		t.Errorf("DxLookup(b) without collision bit = (%t, %v), want (false, nil)", found, err)
+	}
+}
+
+// TestDxLookupFallback tests that unusable indexes fall back to a linear scan
+// and that corrupted ones are reported.
+func TestDxLookupFallback(t *testing.T) {
+	sb := htreeTestSuperBlock()
+	names := []string{"a", "b", "c"}
+
+	for _, test := range []struct {
+		name    string
+		corrupt func(root []byte)
+	}{
+		{name: "unsupported hash", corrupt: func(root []byte) { root[dxRootInfoOff+4] = DxHashSiphash }},
+		{name: "too many levels", corrupt: func(root []byte) { root[dxRootInfoOff+6] = DxMaxLevels }},
+		{name: "reserved zero", corrupt: func(root []byte) { root[dxRootInfoOff] = 1 }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, inodes := buildHtree(t, names, DxHashHalfMD4, 0, 1, 0)
+			test.corrupt(dir.blocks[0])
+			for _, name := range names {
+				if ino, found, err := DxLookup(dir.inode(true), name, sb, dir.readBlock); err != nil || !found || ino != inodes[name] {
+					t.Errorf("DxLookup(%q) = (%d, %t, %v), want (%d, true, nil)", name, ino, found, err, inodes[name])
+				}
+			}
+		})
+	}
+
+	// Without dir_index, the index flag is ignored.
+	dir, inodes := buildHtree(t, names, DxHashHalfMD4, 0, 1, 0)
+	dir.blocks[0][dxRootInfoOff+4] = DxHashSiphash
+	noIndex := htreeTestSuperBlock()
+	noIndex.FeatureCompat = 0
+	if ino, found, err := DxLookup(dir.inode(true), "c", noIndex, dir.readBlock); err != nil || !found || ino != inodes["c"] {
+		t.Errorf("DxLookup without dir_index = (%d, %t, %v), want (%d, true, nil)", ino, found, err, inodes["c"])
+	}
+
+	// A count above the limit is an error.
+	dir, _ = buildHtree(t, names, DxHashHalfMD4, 0, 1, 0)
+	binary.LittleEndian.PutUint16(dir.blocks[0][dxRootInfoOff+dxRootInfoSize+2:], 1000)
+	if _, _, err := DxLookup(dir.inode(true), "a", sb, dir.readBlock); err == nil {
+		t.Errorf("DxLookup with corrupted count succeeded, want error")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// With the inline_data feature, inodes flagged InInline store their data in
+// i_block followed by the value of the system.data extended attribute which
+// lives in the inode body after the extra inode fields. For inline
+// directories, the first 4 bytes of i_block hold the parent inode number in
+// place of the "." and ".." entries; the rest of i_block and the xattr value
+// each hold a linear array of dirents.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/inlinedata.html.
+
+const (
+	// MinInlineDataSize is the size of the inline data stored in i_block.
+	MinInlineDataSize = 60
+
+	// inlineDirParentSize is the size of the parent inode number at the start
+	// of an inline directory.
+	inlineDirParentSize = 4
+
+	// inlineDataXattr is the name of the system xattr holding inline data past
+	// MinInlineDataSize.
+	inlineDataXattr = "data"
+)
+
+// InlineData returns the inline data of inode in whose full on-disk record is
+// raw: i_block followed by the value of the system.data xattr. The result may
+// be longer than in.Size().
+//
+// Precondition: in.Flags().Inline is set.
+func InlineData(raw []byte, in Inode) ([]byte, error) {
+	val, _, err := InodeXattr(raw, in, XattrIndexSystem, inlineDataXattr)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, MinInlineDataSize+len(val))
+	data = append(data, in.Data()[:MinInlineDataSize]...)
+	return append(data, val...), nil
+}
+
+// ParseInlineDir parses the inline data of directory inode dirIno into
+// dirents. The "." and ".." entries, which are not stored on disk, are
+// synthesized so that the result looks like that of a linear directory.
+// Unused dirents are omitted.
+func ParseInlineDir(dirIno uint32, data []byte, hasFileType bool) ([]Dirent, error) {
+	if len(data) < MinInlineDataSize {
+		return nil, fmt.Errorf("inline directory data is %d bytes, want at least %d", len(data), MinInlineDataSize)
+	}
+
+	parent := binary.LittleEndian.Uint32(data)
+	dirents := []Dirent{
+		newDirent(dirIno, direntRecLen(1), ".", uint8(DirentTypeDirectory), hasFileType),
+		newDirent(parent, direntRecLen(2), "..", uint8(DirentTypeDirectory), hasFileType),
+	}
+	for _, region := range [][]byte{data[inlineDirParentSize:MinInlineDataSize], data[MinInlineDataSize:]} {
+		ds, err := ParseDirBlock(region, hasFileType)
+		if err != nil {
+			return nil, err
+		}
+		dirents = append(dirents, ds...)
+	}
+	return dirents, nil
+}
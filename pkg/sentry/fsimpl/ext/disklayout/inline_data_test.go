@@ -0,0 +1,148 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"bytes"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// inlineInodeRecord builds a 256 byte inline data inode record the way
+// mke2fs -O inline_data lays it out: the system.data xattr is the only entry
+// and its value is placed at the very end of the record.
+func inlineInodeRecord(iBlock []byte, xattrValue []byte) ([]byte, *InodeNew) {
+	in := &InodeNew{ExtraInodeSize: 32}
+	in.FlagsRaw = InInline
+	copy(in.DataRaw[:], iBlock)
+
+	raw := binary.Marshal(nil, binary.LittleEndian, in)
+	raw = binary.Marshal(raw, binary.LittleEndian, uint32(XattrMagic))
+	raw = binary.Marshal(raw, binary.LittleEndian, XattrEntry{
+		NameLength:  uint8(len(inlineDataXattr)),
+		NameIndex:   XattrIndexSystem,
+		ValueOffset: uint16(256 - len(raw) - len(xattrValue)),
+		ValueSize:   uint32(len(xattrValue)),
+	})
+	raw = append(raw, inlineDataXattr...)
+	raw = append(raw, make([]byte, 256-len(raw)-len(xattrValue))...)
+	return append(raw, xattrValue...), in
+}
+
+// TestInlineData tests reading inline file data which fits in i_block and
+// which spills into the system.data xattr.
+func TestInlineData(t *testing.T) {
+	small := []byte("This file is exactly forty bytes long!!\n")
+	raw, in := inlineInodeRecord(small, nil)
+	in.SizeLo = uint32(len(small))
+	got, err := InlineData(raw, in)
+	if err != nil {
+		t.Fatalf("InlineData failed: %v", err)
+	}
+	if len(got) != MinInlineDataSize || !bytes.Equal(got[:in.Size()], small) {
+		t.Errorf("InlineData() = %q, want %q followed by padding", got, small)
+	}
+
+	medium := bytes.Repeat([]byte{'m'}, 100)
+	raw, in = inlineInodeRecord(medium[:MinInlineDataSize], medium[MinInlineDataSize:])
+	if got, err := InlineData(raw, in); err != nil || !bytes.Equal(got, medium) {
+		t.Errorf("InlineData() = (%q, %v), want (%q, nil)", got, err, medium)
+	}
+
+	// Values stored in other inodes are not supported.
+	binary.LittleEndian.PutUint32(raw[OldInodeSize+32+4+4:], 20)
+	if _, err := InlineData(raw, in); err == nil {
+		t.Errorf("InlineData() with an xattr value inode succeeded, want error")
+	}
+}
+
+// TestInodeXattr tests in-inode xattr lookup.
+func TestInodeXattr(t *testing.T) {
+	raw, in := inlineInodeRecord(nil, []byte("value"))
+	if val, ok, err := InodeXattr(raw, in, XattrIndexSystem, "data"); !ok || err != nil || string(val) != "value" {
+		t.Errorf(`InodeXattr(system.data) = (%q, %t, %v), want ("value", true, nil)`, val, ok, err)
+	}
+	if _, ok, err := InodeXattr(raw, in, XattrIndexSystem, "other"); ok || err != nil {
+		t.Errorf("InodeXattr(system.other) = (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// There are no xattrs without the magic.
+	binary.LittleEndian.PutUint32(raw[OldInodeSize+32:], 0)
+	if _, ok, err := InodeXattr(raw, in, XattrIndexSystem, "data"); ok || err != nil {
+		t.Errorf("InodeXattr() without magic = (%t, %v), want (false, nil)", ok, err)
+	}
+}
+
+// TestParseInlineDir tests parsing an inline directory with three entries as
+// created by mke2fs.
+func TestParseInlineDir(t *testing.T) {
+	iBlock := []byte{
+		0x02, 0x00, 0x00, 0x00, // Parent inode.
+		0x0d, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x01, 0x01, 'a', 0x00, 0x00, 0x00,
+		0x0e, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x01, 0x01, 'b', 0x00, 0x00, 0x00,
+		0x0f, 0x00, 0x00, 0x00, 0x20, 0x00, 0x01, 0x01, 'c', 0x00, 0x00, 0x00,
+	}
+	for _, hasFileType := range []bool{true, false} {
+		// Without the file type feature, the file type byte is the high byte
+		// of the name length.
+		dirBlock := append([]byte(nil), iBlock...)
+		if !hasFileType {
+			for off := 4; off < len(dirBlock); off += 12 {
+				dirBlock[off+7] = 0
+			}
+		}
+		raw, in := inlineInodeRecord(dirBlock, nil)
+		data, err := InlineData(raw, in)
+		if err != nil {
+			t.Fatalf("InlineData failed: %v", err)
+		}
+
+		dirents, err := ParseInlineDir(12, data, hasFileType)
+		if err != nil {
+			t.Fatalf("ParseInlineDir(hasFileType=%t) failed: %v", hasFileType, err)
+		}
+
+		want := []struct {
+			ino  uint32
+			name string
+		}{
+			{12, "."},
+			{2, ".."},
+			{13, "a"},
+			{14, "b"},
+			{15, "c"},
+		}
+		if len(dirents) != len(want) {
+			t.Fatalf("ParseInlineDir(hasFileType=%t) returned %d dirents, want %d", hasFileType, len(dirents), len(want))
+		}
+		for i, d := range dirents {
+			if d.Inode() != want[i].ino || d.FileName() != want[i].name {
+				t.Errorf("dirent %d = (%d, %q), want (%d, %q)", i, d.Inode(), d.FileName(), want[i].ino, want[i].name)
+			}
+			if _, ok := d.FileType(); ok != hasFileType {
+				t.Errorf("dirent %d has file type %t, want %t", i, ok, hasFileType)
+			}
+		}
+	}
+
+	// Record lengths must stay within their region.
+	iBlock[4+12+12+4] = 0x24
+	raw, in := inlineInodeRecord(iBlock, nil)
+	data, _ := InlineData(raw, in)
+	if _, err := ParseInlineDir(12, data, true); err == nil {
+		t.Errorf("ParseInlineDir() with an overlong record succeeded, want error")
+	}
+}
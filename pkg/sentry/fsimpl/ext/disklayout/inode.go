@@ -15,6 +15,8 @@
 package disklayout
 
 import (
+	"fmt"
+
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/time"
@@ -24,8 +26,105 @@ import (
 const (
 	// RootDirInode is the inode number of the root directory inode.
 	RootDirInode = 2
+
+	// ResizeInode is the inode number of the resize inode, which reserves the
+	// blocks following the group descriptors if the SbResizeInode feature is
+	// set. See ResizeInodeReader.
+	ResizeInode = 7
 )
 
+// ReservedInode returns true if ino is one of the inodes reserved for
+// filesystem metadata by default, i.e. below OldFirstInode: the bad blocks
+// (1), user quota (3), group quota (4), boot loader (5), undelete directory
+// (6), resize (7), journal (8), exclude bitmap (9) and replica (10) inodes.
+// The root directory is not considered reserved. Filesystems may reserve more
+// inodes, up to SuperBlock.FirstInode().
+func ReservedInode(ino uint32) bool {
+	return ino != 0 && ino != RootDirInode && ino < OldFirstInode
+}
+
+// InodeNumberError is returned when an inode number is out of range for the
+// filesystem, or refers to a reserved inode where it may not (see
+// CheckDirentInode).
+type InodeNumberError struct {
+	// Ino is the offending inode number.
+	Ino uint32
+
+	// InodesCount is the number of inodes in the filesystem.
+	InodesCount uint32
+}
+
+// Error implements error.Error.
+func (e *InodeNumberError) Error() string {
+	if e.Ino != 0 && e.Ino <= e.InodesCount {
+		return fmt.Sprintf("ext inode number %d is reserved", e.Ino)
+	}
+	return fmt.Sprintf("ext inode number %d not in [1, %d]", e.Ino, e.InodesCount)
+}
+
+// Is returns true if target is ErrInodeOutOfRange, for errors.Is.
+func (e *InodeNumberError) Is(target error) bool {
+	return target == ErrInodeOutOfRange
+}
+
+// InodeOffset returns the absolute offset on the device at which the inode
+// record for inode number ino is stored. Inode numbers start at 1; reserved
+// inodes below sb.FirstInode() are valid too. Returns an *InodeNumberError if
+// ino is out of range.
+//
+// The inode table of a group is located through its descriptor alone. With
+// the flex_bg feature, the tables of a flex group are packed together in its
+// first group, so they often lie outside of the group they belong to; the
+// descriptors already account for this.
+func InodeOffset(sb SuperBlock, bgs []BlockGroup, ino uint32) (int64, error) {
+	if ino == 0 || ino > sb.InodesCount() {
+		return 0, &InodeNumberError{Ino: ino, InodesCount: sb.InodesCount()}
+	}
+
+	bgNum := (ino - 1) / sb.InodesPerGroup()
+	if uint64(bgNum) >= uint64(len(bgs)) {
+		return 0, &InodeNumberError{Ino: ino, InodesCount: uint32(len(bgs)) * sb.InodesPerGroup()}
+	}
+	index := uint64((ino - 1) % sb.InodesPerGroup())
+	return int64(bgs[bgNum].InodeTable()*sb.BlockSize() + index*uint64(sb.InodeSize())), nil
+}
+
+// InodeOwner returns the owner UID and GID of the inode. The high 16-bit
+// halves are stored in the OS dependent osd2 area and are only combined with
+// the low halves if the filesystem was created by Linux.
+func InodeOwner(sb SuperBlock, in Inode) (auth.KUID, auth.KGID) {
+	if sb.CreatorOS() == OSLinux {
+		return in.UID(), in.GID()
+	}
+	return in.UID() & 0xffff, in.GID() & 0xffff
+}
+
+// InodeBlocks returns the number of 512-byte sectors allocated to the inode,
+// including metadata blocks. Without the huge_file feature only the low 32
+// bits of i_blocks are valid; with it, inodes flagged InHugeFile count in
+// filesystem blocks instead of sectors.
+func InodeBlocks(sb SuperBlock, in Inode) uint64 {
+	blocks := in.BlocksCount()
+	if sb.CreatorOS() != OSLinux || !sb.ReadOnlyCompatibleFeatures().HugeFile {
+		return blocks & 0xffffffff
+	}
+	if in.Flags().HugeFile {
+		return blocks * (sb.BlockSize() / 512)
+	}
+	return blocks
+}
+
+// InodeFileSize returns the size of the inode in bytes. Like ext4_isize in
+// fs/ext4/ext4.h, directories of filesystems with the large_dir feature also
+// use the high 32 bits of i_size, since they may grow past 4GiB; elsewhere,
+// the field is ignored for directories.
+func InodeFileSize(sb SuperBlock, in Inode) uint64 {
+	if in.IsDir() && sb.IncompatibleFeatures().LargeDir {
+		return (uint64(in.SizeHigh()) << 32) | in.Size()
+	}
+	return in.Size()
+}
+
 // The Inode interface must be implemented by structs representing ext inodes.
 // The inode stores all the metadata pertaining to the file (except for the
 // file name which is held by the directory entry). It does NOT expose all
@@ -47,15 +146,40 @@ type Inode interface {
 	// Masks to extract this information are provided in pkg/abi/linux/file.go.
 	Mode() linux.FileMode
 
-	// UID returns the owner UID.
+	// IsDir, IsRegular, IsSymlink, IsFIFO, IsSocket, IsCharDevice and
+	// IsBlockDevice return true if Mode() has the respective file type.
+	IsDir() bool
+	IsRegular() bool
+	IsSymlink() bool
+	IsFIFO() bool
+	IsSocket() bool
+	IsCharDevice() bool
+	IsBlockDevice() bool
+
+	// IsFastSymlink returns true if this is a symlink whose target is stored
+	// in i_block rather than in data blocks. Like Linux, this is the case if no
+	// blocks other than an extended attribute block are allocated to it.
+	// Inline data symlinks are not fast symlinks.
+	IsFastSymlink() bool
+
+	// UID returns the owner UID assembled from the low and high 16-bit halves
+	// as laid out by Linux. The high half lives in the OS dependent osd2 area;
+	// use InodeOwner to get the UID which respects the creator OS.
 	UID() auth.KUID
 
-	// GID returns the owner GID.
+	// GID returns the owner GID assembled from the low and high 16-bit halves
+	// as laid out by Linux. Use InodeOwner to get the GID which respects the
+	// creator OS.
 	GID() auth.KGID
 
-	// Size returns the size of the file in bytes.
+	// Size returns the size of the file in bytes. The high 32 bits are only
+	// used for regular files; see InodeFileSize for directories.
 	Size() uint64
 
+	// SizeHigh returns the raw i_size_high field, which holds the high 32 bits
+	// of the size of regular files and of large_dir directories.
+	SizeHigh() uint32
+
 	// InodeSize returns the size of this inode struct in bytes.
 	// In ext2 and ext3, the inode struct and inode disk record size was fixed at
 	// 128 bytes. Ext4 makes it possible for the inode struct to be bigger.
@@ -113,6 +237,47 @@ type Inode interface {
 	// Flags returns InodeFlags which represents the inode flags.
 	Flags() InodeFlags
 
+	// IsEncrypted returns true if the contents of this inode are encrypted
+	// (InEncrypt). The data of encrypted files, the names in encrypted
+	// directories and the targets of encrypted symlinks are ciphertext.
+	IsEncrypted() bool
+
+	// Generation returns the file version (i_generation), used by NFS file
+	// handles and to seed the metadata checksums of the inode and its blocks.
+	Generation() uint32
+
+	// FileACL returns the number of the block holding this inode's extended
+	// attributes (i_file_acl), or 0 if there is no such block. The high half
+	// is only meaningful on filesystems created by Linux.
+	FileACL() uint64
+
+	// ProjectID returns the project ID of the inode used by project quotas
+	// (i_projid). It is 0 if sb does not have the SbProject feature or if the
+	// inode is too small to hold the field.
+	ProjectID(sb SuperBlock) uint32
+
+	// VerifyChecksum verifies the checksum of the raw on-disk inode record of
+	// this inode, inode number ino, which must be exactly sb.InodeSize() bytes.
+	// The crc32c is seeded with the inode number and generation and covers
+	// the whole record with the checksum fields zeroed. Its low half is
+	// stored in osd2.l_i_checksum_lo and its high half in i_checksum_hi, which
+	// only exists if i_extra_isize covers it; otherwise only the low half is
+	// verified. Returns ErrNoMetadataCsum if the filesystem does not have
+	// metadata checksums, in which case nothing was verified.
+	VerifyChecksum(sb SuperBlock, ino uint32, raw []byte) (bool, error)
+
+	// DeviceNumber returns the device number of a character or block device
+	// file. Like Linux, it is decoded from the old 8-bit major and minor
+	// encoding in i_block[0] unless that is zero, in which case the new 12-bit
+	// major and 20-bit minor encoding in i_block[1] is used. It is meaningless
+	// for other file types.
+	DeviceNumber() (major, minor uint32)
+
+	// BlocksCount returns the raw 48-bit i_blocks value assembled from the low
+	// and high halves. Its unit depends on the huge_file feature and the
+	// InHugeFile inode flag; use InodeBlocks to get it in 512-byte sectors.
+	BlocksCount() uint64
+
 	// Data returns the underlying inode.i_block array as a slice so it's
 	// modifiable. This field is special and is used to store various kinds of
 	// things depending on the filesystem version and inode type. The underlying
@@ -145,6 +310,9 @@ const (
 	// updated.
 	InNoAccessTime = 0x80
 
+	// InEncrypt indicates that this inode is encrypted.
+	InEncrypt = 0x800
+
 	// InIndex indicates that this directory has hashed indexes.
 	InIndex = 0x1000
 
@@ -165,6 +333,9 @@ const (
 	// InExtents indicates that this inode uses extents.
 	InExtents = 0x80000
 
+	// InVerity indicates that this file is protected by fs-verity.
+	InVerity = 0x100000
+
 	// InExtendedAttr indicates that this inode stores a large extended attribute
 	// value in its data blocks.
 	InExtendedAttr = 0x200000
@@ -172,8 +343,19 @@ const (
 	// InInline indicates that this inode has inline data.
 	InInline = 0x10000000
 
+	// InProjInherit indicates that children of this directory inherit its
+	// project id.
+	InProjInherit = 0x20000000
+
+	// InCasefold indicates that file names in this directory are looked up
+	// case insensitively.
+	InCasefold = 0x40000000
+
 	// InReserved indicates that this inode is reserved for the ext4 library.
 	InReserved = 0x80000000
+
+	// inKnownFlags is the set of all inode flags listed above.
+	inKnownFlags = InSync | InImmutable | InAppend | InNoDump | InNoAccessTime | InEncrypt | InIndex | InJournalData | InDirSync | InTopDir | InHugeFile | InExtents | InVerity | InExtendedAttr | InInline | InProjInherit | InCasefold | InReserved
 )
 
 // InodeFlags represents all possible combinations of inode flags. It aims to
@@ -184,15 +366,22 @@ type InodeFlags struct {
 	Append       bool
 	NoDump       bool
 	NoAccessTime bool
+	Encrypt      bool
 	Index        bool
 	JournalData  bool
 	DirSync      bool
 	TopDir       bool
 	HugeFile     bool
 	Extents      bool
+	Verity       bool
 	ExtendedAttr bool
 	Inline       bool
+	ProjInherit  bool
+	Casefold     bool
 	Reserved     bool
+
+	// Unknown holds the set bits which are not understood by this package.
+	Unknown uint32
 }
 
 // ToInt converts inode flags back to its 32-bit rep.
@@ -214,6 +403,9 @@ func (f InodeFlags) ToInt() uint32 {
 	if f.NoAccessTime {
 		res |= InNoAccessTime
 	}
+	if f.Encrypt {
+		res |= InEncrypt
+	}
 	if f.Index {
 		res |= InIndex
 	}
@@ -232,15 +424,25 @@ func (f InodeFlags) ToInt() uint32 {
 	if f.Extents {
 		res |= InExtents
 	}
+	if f.Verity {
+		res |= InVerity
+	}
 	if f.ExtendedAttr {
 		res |= InExtendedAttr
 	}
 	if f.Inline {
 		res |= InInline
 	}
+	if f.ProjInherit {
+		res |= InProjInherit
+	}
+	if f.Casefold {
+		res |= InCasefold
+	}
 	if f.Reserved {
 		res |= InReserved
 	}
+	res |= f.Unknown
 
 	return res
 }
@@ -254,18 +456,51 @@ func InodeFlagsFromInt(f uint32) InodeFlags {
 		Append:       f&InAppend > 0,
 		NoDump:       f&InNoDump > 0,
 		NoAccessTime: f&InNoAccessTime > 0,
+		Encrypt:      f&InEncrypt > 0,
 		Index:        f&InIndex > 0,
 		JournalData:  f&InJournalData > 0,
 		DirSync:      f&InDirSync > 0,
 		TopDir:       f&InTopDir > 0,
 		HugeFile:     f&InHugeFile > 0,
 		Extents:      f&InExtents > 0,
+		Verity:       f&InVerity > 0,
 		ExtendedAttr: f&InExtendedAttr > 0,
 		Inline:       f&InInline > 0,
+		ProjInherit:  f&InProjInherit > 0,
+		Casefold:     f&InCasefold > 0,
 		Reserved:     f&InReserved > 0,
+		Unknown:      f &^ inKnownFlags,
 	}
 }
 
+// inodeFlagNames maps inode flag bits to the names of the corresponding
+// EXT4_*_FL flags in Linux, in bit order.
+var inodeFlagNames = []featureName{
+	{InSync, "sync"},
+	{InImmutable, "immutable"},
+	{InAppend, "append"},
+	{InNoDump, "nodump"},
+	{InNoAccessTime, "noatime"},
+	{InEncrypt, "encrypt"},
+	{InIndex, "index"},
+	{InJournalData, "journal_data"},
+	{InDirSync, "dirsync"},
+	{InTopDir, "topdir"},
+	{InHugeFile, "huge_file"},
+	{InExtents, "extents"},
+	{InVerity, "verity"},
+	{InExtendedAttr, "ea_inode"},
+	{InInline, "inline_data"},
+	{InProjInherit, "projinherit"},
+	{InCasefold, "casefold"},
+	{InReserved, "reserved"},
+}
+
+// String implements fmt.Stringer.String. Unknown flags are not included.
+func (f InodeFlags) String() string {
+	return featuresString(f.ToInt(), inodeFlagNames)
+}
+
 // These masks define how users can view/modify inode flags. The rest of the
 // flags are for internal kernel usage only.
 const (
@@ -38,38 +38,53 @@ type InodeNew struct {
 	CreationTime          uint32
 	CreationTimeExtra     uint32
 	VersionHi             uint32
-	ProjectID             uint32
+	ProjectIDRaw          uint32
 }
 
 // Compiles only if InodeNew implements Inode.
 var _ Inode = (*InodeNew)(nil)
 
-// fromExtraTime decodes the extra time and constructs the kernel time struct
-// with nanosecond precision.
-func fromExtraTime(lo int32, extra uint32) time.Time {
+const (
+	// extraTimeEpochBits is the number of low bits of a TimeExtra field which
+	// extend the 32-bit seconds counter.
+	extraTimeEpochBits = 2
+
+	// extraTimeEpochMask masks the epoch bits of a TimeExtra field.
+	extraTimeEpochMask = (1 << extraTimeEpochBits) - 1
+)
+
+// decodeExtraTime decodes the extra time and constructs the kernel time struct
+// with nanosecond precision. This mirrors ext4_decode_extra_time in
+// fs/ext4/ext4.h: the epoch bits are added on top of the sign extended 32-bit
+// seconds, so pre-1970 timestamps keep working with zero epoch bits.
+func decodeExtraTime(seconds int32, extra uint32) time.Time {
 	// See description above InodeNew for format.
-	seconds := (int64(extra&0x3) << 32) + int64(lo)
-	nanoseconds := int64(extra >> 2)
-	return time.FromUnix(seconds, nanoseconds)
+	sec := (int64(extra&extraTimeEpochMask) << 32) + int64(seconds)
+	nsec := int64(extra >> extraTimeEpochBits)
+	return time.FromUnix(sec, nsec)
 }
 
 // Only override methods which change due to ext4 specific fields.
 
-// Size implements Inode.Size.
-func (in *InodeNew) Size() uint64 {
-	return (uint64(in.SizeHi) << 32) | uint64(in.SizeLo)
-}
-
 // InodeSize implements Inode.InodeSize.
 func (in *InodeNew) InodeSize() uint16 {
 	return OldInodeSize + in.ExtraInodeSize
 }
 
+// ProjectID implements Inode.ProjectID.
+func (in *InodeNew) ProjectID(sb SuperBlock) uint32 {
+	// i_projid ends at offset 0x20 of the extra inode fields.
+	if !sb.ReadOnlyCompatibleFeatures().Project || in.ExtraInodeSize < 0x20 {
+		return 0
+	}
+	return in.ProjectIDRaw
+}
+
 // ChangeTime implements Inode.ChangeTime.
 func (in *InodeNew) ChangeTime() time.Time {
 	// Apply new timestamp logic if inode.ChangeTimeExtra is in scope.
 	if in.ExtraInodeSize >= 8 {
-		return fromExtraTime(in.ChangeTimeRaw, in.ChangeTimeExtra)
+		return decodeExtraTime(in.ChangeTimeRaw, in.ChangeTimeExtra)
 	}
 
 	return in.InodeOld.ChangeTime()
@@ -79,7 +94,7 @@ func (in *InodeNew) ChangeTime() time.Time {
 func (in *InodeNew) ModificationTime() time.Time {
 	// Apply new timestamp logic if inode.ModificationTimeExtra is in scope.
 	if in.ExtraInodeSize >= 12 {
-		return fromExtraTime(in.ModificationTimeRaw, in.ModificationTimeExtra)
+		return decodeExtraTime(in.ModificationTimeRaw, in.ModificationTimeExtra)
 	}
 
 	return in.InodeOld.ModificationTime()
@@ -89,7 +104,7 @@ func (in *InodeNew) ModificationTime() time.Time {
 func (in *InodeNew) AccessTime() time.Time {
 	// Apply new timestamp logic if inode.AccessTimeExtra is in scope.
 	if in.ExtraInodeSize >= 16 {
-		return fromExtraTime(in.AccessTimeRaw, in.AccessTimeExtra)
+		return decodeExtraTime(in.AccessTimeRaw, in.AccessTimeExtra)
 	}
 
 	return in.InodeOld.AccessTime()
@@ -16,6 +16,7 @@ package disklayout
 
 import (
 	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/time"
 )
@@ -48,12 +49,13 @@ type InodeOld struct {
 	FlagsRaw      uint32
 	VersionLo     uint32 // This is OS dependent.
 	DataRaw       [60]byte
-	Generation    uint32
+	GenerationRaw uint32
 	FileACLLo     uint32
 	SizeHi        uint32
 	ObsoFaddr     uint32
 
-	// OS dependent fields have been inlined here.
+	// OS dependent fields have been inlined here. These follow the Linux
+	// layout of osd2 and are not meaningful for other creator OSes.
 	BlocksCountHi uint16
 	FileACLHi     uint16
 	UIDHi         uint16
@@ -68,6 +70,30 @@ var _ Inode = (*InodeOld)(nil)
 // Mode implements Inode.Mode.
 func (in *InodeOld) Mode() linux.FileMode { return linux.FileMode(in.ModeRaw) }
 
+// IsDir implements Inode.IsDir.
+func (in *InodeOld) IsDir() bool { return in.Mode().FileType() == linux.ModeDirectory }
+
+// IsRegular implements Inode.IsRegular.
+func (in *InodeOld) IsRegular() bool { return in.Mode().FileType() == linux.ModeRegular }
+
+// IsSymlink implements Inode.IsSymlink.
+func (in *InodeOld) IsSymlink() bool { return in.Mode().FileType() == linux.ModeSymlink }
+
+// IsFIFO implements Inode.IsFIFO.
+func (in *InodeOld) IsFIFO() bool { return in.Mode().FileType() == linux.ModeNamedPipe }
+
+// IsSocket implements Inode.IsSocket.
+func (in *InodeOld) IsSocket() bool { return in.Mode().FileType() == linux.ModeSocket }
+
+// IsCharDevice implements Inode.IsCharDevice.
+func (in *InodeOld) IsCharDevice() bool { return in.Mode().FileType() == linux.ModeCharacterDevice }
+
+// IsBlockDevice implements Inode.IsBlockDevice.
+func (in *InodeOld) IsBlockDevice() bool { return in.Mode().FileType() == linux.ModeBlockDevice }
+
+// IsFastSymlink implements Inode.IsFastSymlink.
+func (in *InodeOld) IsFastSymlink() bool { return in.IsSymlink() && isFastSymlink(in) }
+
 // UID implements Inode.UID.
 func (in *InodeOld) UID() auth.KUID {
 	return auth.KUID((uint32(in.UIDHi) << 16) | uint32(in.UIDLo))
@@ -80,10 +106,17 @@ func (in *InodeOld) GID() auth.KGID {
 
 // Size implements Inode.Size.
 func (in *InodeOld) Size() uint64 {
-	// In ext2/ext3, in.SizeHi did not exist, it was instead named in.DirACL.
+	// in.SizeHi was named i_dir_acl in ext2 and may hold stray bytes in
+	// directories, so like Linux it is only combined for regular files.
+	if in.IsRegular() {
+		return (uint64(in.SizeHi) << 32) | uint64(in.SizeLo)
+	}
 	return uint64(in.SizeLo)
 }
 
+// SizeHigh implements Inode.SizeHigh.
+func (in *InodeOld) SizeHigh() uint32 { return in.SizeHi }
+
 // InodeSize implements Inode.InodeSize.
 func (in *InodeOld) InodeSize() uint16 { return OldInodeSize }
 
@@ -113,5 +146,40 @@ func (in *InodeOld) LinksCount() uint16 { return in.LinksCountRaw }
 // Flags implements Inode.Flags.
 func (in *InodeOld) Flags() InodeFlags { return InodeFlagsFromInt(in.FlagsRaw) }
 
+// IsEncrypted implements Inode.IsEncrypted.
+func (in *InodeOld) IsEncrypted() bool { return in.Flags().Encrypt }
+
+// BlocksCount implements Inode.BlocksCount.
+func (in *InodeOld) BlocksCount() uint64 {
+	return (uint64(in.BlocksCountHi) << 32) | uint64(in.BlocksCountLo)
+}
+
+// Generation implements Inode.Generation.
+func (in *InodeOld) Generation() uint32 { return in.GenerationRaw }
+
+// ProjectID implements Inode.ProjectID. Old inodes cannot hold i_projid.
+func (in *InodeOld) ProjectID(sb SuperBlock) uint32 { return 0 }
+
+// VerifyChecksum implements Inode.VerifyChecksum. It also implements it for
+// InodeNew, as the whole record is read from raw.
+func (in *InodeOld) VerifyChecksum(sb SuperBlock, ino uint32, raw []byte) (bool, error) {
+	return verifyInodeChecksum(sb, ino, in, raw)
+}
+
+// FileACL implements Inode.FileACL.
+func (in *InodeOld) FileACL() uint64 {
+	return (uint64(in.FileACLHi) << 32) | uint64(in.FileACLLo)
+}
+
+// DeviceNumber implements Inode.DeviceNumber. See ext4_iget,
+// old_decode_dev and new_decode_dev in Linux.
+func (in *InodeOld) DeviceNumber() (uint32, uint32) {
+	if old := binary.LittleEndian.Uint32(in.DataRaw[:]); old != 0 {
+		return (old >> 8) & 0xff, old & 0xff
+	}
+	dev := binary.LittleEndian.Uint32(in.DataRaw[4:])
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
 // Data implements Inode.Data.
 func (in *InodeOld) Data() []byte { return in.DataRaw[:] }
@@ -19,6 +19,8 @@ import (
 	"strconv"
 	"testing"
 
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/time"
 )
 
@@ -214,9 +216,395 @@ func TestTimestampSeconds(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(getTestName(test), func(t *testing.T) {
-			if got := fromExtraTime(get32BitTime(test), test.extraBits); got != test.want {
+			if got := decodeExtraTime(get32BitTime(test), test.extraBits); got != test.want {
 				t.Errorf("Expected: %v, Got: %v", test.want, got)
 			}
 		})
 	}
 }
+
+// TestReservedInode tests that the default reserved inodes are reserved but
+// not the root directory or the first non-reserved inode.
+func TestReservedInode(t *testing.T) {
+	for _, ino := range []uint32{1, 3, 4, 5, 6, ResizeInode, 8, 9, 10} {
+		if !ReservedInode(ino) {
+			t.Errorf("ReservedInode(%d) = false, want true", ino)
+		}
+	}
+	for _, ino := range []uint32{0, RootDirInode, OldFirstInode, OldFirstInode + 1} {
+		if ReservedInode(ino) {
+			t.Errorf("ReservedInode(%d) = true, want false", ino)
+		}
+	}
+}
+
+// TestInodeOffset tests inode location arithmetic, including 64-bit inode
+// table locations and out of range inode numbers.
+func TestInodeOffset(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.InodesCountRaw = 32
+	sb.InodesPerGroupRaw = 16
+	sb.InodeSizeRaw = 256
+	sb.LogBlockSize = 2
+
+	bg1 := &BlockGroup64Bit{}
+	bg1.InodeTableLo = 0x10
+	bg1.InodeTableHi = 0x1
+	bgs := []BlockGroup{&BlockGroup32Bit{InodeTableLo: 0x23}, bg1}
+
+	for _, test := range []struct {
+		ino  uint32
+		want int64
+	}{
+		{ino: 1, want: 0x23 * 4096},
+		{ino: RootDirInode, want: 0x23*4096 + 256},
+		{ino: 16, want: 0x23*4096 + 15*256},
+		{ino: 17, want: 0x100000010 * 4096},
+		{ino: 32, want: 0x100000010*4096 + 15*256},
+	} {
+		got, err := InodeOffset(&sb, bgs, test.ino)
+		if err != nil || got != test.want {
+			t.Errorf("InodeOffset(%d) = (%#x, %v), want (%#x, nil)", test.ino, got, err, test.want)
+		}
+	}
+
+	for _, ino := range []uint32{0, 33} {
+		if _, err := InodeOffset(&sb, bgs, ino); err == nil {
+			t.Errorf("InodeOffset(%d) succeeded, want error", ino)
+		} else if _, ok := err.(*InodeNumberError); !ok {
+			t.Errorf("InodeOffset(%d) = %v, want *InodeNumberError", ino, err)
+		}
+	}
+
+	// Inodes in groups without descriptors are out of range as well.
+	if _, err := InodeOffset(&sb, bgs[:1], 17); err == nil {
+		t.Errorf("InodeOffset(17) with one group succeeded, want error")
+	}
+}
+
+// TestInodeOwner tests that the high UID/GID halves are only used on
+// filesystems created by Linux.
+func TestInodeOwner(t *testing.T) {
+	in := &InodeOld{UIDLo: 0x1234, UIDHi: 0x5, GIDLo: 0x6789, GIDHi: 0xa}
+
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.CreatorOSRaw = uint32(OSLinux)
+	if uid, gid := InodeOwner(&sb, in); uid != 0x51234 || gid != 0xa6789 {
+		t.Errorf("InodeOwner on Linux = (%#x, %#x), want (0x51234, 0xa6789)", uid, gid)
+	}
+
+	sb.CreatorOSRaw = uint32(OSFreeBSD)
+	if uid, gid := InodeOwner(&sb, in); uid != 0x1234 || gid != 0x6789 {
+		t.Errorf("InodeOwner on FreeBSD = (%#x, %#x), want (0x1234, 0x6789)", uid, gid)
+	}
+}
+
+// TestInodeBlocks tests i_blocks decoding with and without huge_file.
+func TestInodeBlocks(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.LogBlockSize = 2
+
+	in := &InodeOld{BlocksCountLo: 0x10, BlocksCountHi: 0x1}
+	if got, want := in.BlocksCount(), uint64(0x100000010); got != want {
+		t.Errorf("BlocksCount() = %#x, want %#x", got, want)
+	}
+
+	// The high half is ignored without huge_file.
+	if got, want := InodeBlocks(&sb, in), uint64(0x10); got != want {
+		t.Errorf("InodeBlocks without huge_file = %#x, want %#x", got, want)
+	}
+
+	sb.FeatureRoCompat = RoCompatFeatures{HugeFile: true}.ToInt()
+	if got, want := InodeBlocks(&sb, in), uint64(0x100000010); got != want {
+		t.Errorf("InodeBlocks with huge_file = %#x, want %#x", got, want)
+	}
+
+	// InHugeFile inodes count in filesystem blocks.
+	in.FlagsRaw = InHugeFile
+	if got, want := InodeBlocks(&sb, in), uint64(0x100000010*8); got != want {
+		t.Errorf("InodeBlocks of InHugeFile inode = %#x, want %#x", got, want)
+	}
+}
+
+// TestInodeFileSize tests that i_size_high is only combined with i_size_lo for
+// regular files and for directories of large_dir filesystems.
+func TestInodeFileSize(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	for _, test := range []struct {
+		name         string
+		mode         linux.FileMode
+		want         uint64
+		wantLargeDir uint64
+	}{
+		{name: "regular", mode: linux.ModeRegular | 0644, want: 0x200001000, wantLargeDir: 0x200001000},
+		// The stray high bytes of directories used to be i_dir_acl.
+		{name: "directory", mode: linux.ModeDirectory | 0755, want: 0x1000, wantLargeDir: 0x200001000},
+		{name: "symlink", mode: linux.ModeSymlink | 0777, want: 0x1000, wantLargeDir: 0x1000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			old := InodeOld{ModeRaw: uint16(test.mode), SizeLo: 0x1000, SizeHi: 0x2}
+			for _, in := range []Inode{&old, &InodeNew{InodeOld: old}} {
+				sb.FeatureIncompat = 0
+				if got := in.Size(); got != test.want {
+					t.Errorf("%T.Size() = %#x, want %#x", in, got, test.want)
+				}
+				if got := InodeFileSize(&sb, in); got != test.want {
+					t.Errorf("InodeFileSize(%T) = %#x, want %#x", in, got, test.want)
+				}
+				sb.FeatureIncompat = IncompatFeatures{LargeDir: true}.ToInt()
+				if got := InodeFileSize(&sb, in); got != test.wantLargeDir {
+					t.Errorf("InodeFileSize(%T) with large_dir = %#x, want %#x", in, got, test.wantLargeDir)
+				}
+			}
+		})
+	}
+}
+
+// TestInodeBlocksHugeFile tests that only InHugeFile inodes on a huge_file
+// filesystem count i_blocks in filesystem blocks.
+func TestInodeBlocksHugeFile(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.LogBlockSize = 2
+	sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{HugeFile: true}.ToInt()
+
+	for _, test := range []struct {
+		name  string
+		flags uint32
+		lo    uint32
+		hi    uint16
+		want  uint64
+	}{
+		{name: "normal", lo: 0x8, want: 0x8},
+		{name: "normal with high bits", lo: 0x8, hi: 0x2, want: 0x200000008},
+		{name: "huge", flags: InHugeFile | InExtents, lo: 0x3, want: 0x3 * 8},
+		{name: "huge with high bits", flags: InHugeFile, lo: 0x3, hi: 0x2, want: 0x200000003 * 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			in := &InodeNew{}
+			in.FlagsRaw = test.flags
+			in.BlocksCountLo = test.lo
+			in.BlocksCountHi = test.hi
+			if got := InodeBlocks(&sb, in); got != test.want {
+				t.Errorf("InodeBlocks() = %#x, want %#x", got, test.want)
+			}
+		})
+	}
+}
+
+// TestTimestampNanoseconds tests that the nanosecond part of the TimeExtra
+// fields is decoded.
+func TestTimestampNanoseconds(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		seconds int32
+		extra   uint32
+		want    time.Time
+	}{
+		{
+			// 2040-01-01T00:00:00.5Z, past the 32-bit signed overflow.
+			name:    "post-2038",
+			seconds: -2085978496, // 2208988800 truncated to 32 bits.
+			extra:   500000000<<2 | 1,
+			want:    time.FromUnix(2208988800, 500000000),
+		},
+		{
+			// 1969-12-31T23:59:59.25Z.
+			name:    "pre-1970",
+			seconds: -1,
+			extra:   250000000 << 2,
+			want:    time.FromUnix(-1, 250000000),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decodeExtraTime(test.seconds, test.extra); got != test.want {
+				t.Errorf("decodeExtraTime(%d, %#x) = %v, want %v", test.seconds, test.extra, got, test.want)
+			}
+		})
+	}
+}
+
+// TestInodeNewTimestamps tests that InodeNew only uses the TimeExtra fields
+// which are covered by ExtraInodeSize.
+func TestInodeNewTimestamps(t *testing.T) {
+	in := InodeNew{
+		ChangeTimeExtra:       1<<2 | 1,
+		ModificationTimeExtra: 2<<2 | 1,
+		AccessTimeExtra:       3<<2 | 1,
+	}
+	in.ChangeTimeRaw = 10
+	in.ModificationTimeRaw = 20
+	in.AccessTimeRaw = 30
+
+	for _, test := range []struct {
+		extraIsize          uint16
+		ctime, mtime, atime time.Time
+	}{
+		{
+			extraIsize: 0,
+			ctime:      time.FromUnix(10, 0),
+			mtime:      time.FromUnix(20, 0),
+			atime:      time.FromUnix(30, 0),
+		},
+		{
+			extraIsize: 8,
+			ctime:      time.FromUnix(10+1<<32, 1),
+			mtime:      time.FromUnix(20, 0),
+			atime:      time.FromUnix(30, 0),
+		},
+		{
+			extraIsize: 32,
+			ctime:      time.FromUnix(10+1<<32, 1),
+			mtime:      time.FromUnix(20+1<<32, 2),
+			atime:      time.FromUnix(30+1<<32, 3),
+		},
+	} {
+		in.ExtraInodeSize = test.extraIsize
+		if got := in.ChangeTime(); got != test.ctime {
+			t.Errorf("ChangeTime() with extra isize %d = %v, want %v", test.extraIsize, got, test.ctime)
+		}
+		if got := in.ModificationTime(); got != test.mtime {
+			t.Errorf("ModificationTime() with extra isize %d = %v, want %v", test.extraIsize, got, test.mtime)
+		}
+		if got := in.AccessTime(); got != test.atime {
+			t.Errorf("AccessTime() with extra isize %d = %v, want %v", test.extraIsize, got, test.atime)
+		}
+	}
+}
+
+// TestInodeProjectID tests that the project ID is read from i_projid, at
+// offset 0x1c of the extra inode fields, only if the project feature is set
+// and the extra inode fields cover it.
+func TestInodeProjectID(t *testing.T) {
+	raw := make([]byte, 256)
+	binary.LittleEndian.PutUint32(raw[0x9c:], 1234)
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+
+	for _, test := range []struct {
+		name       string
+		extraIsize uint16
+		project    bool
+		want       uint32
+	}{
+		{name: "project", extraIsize: 32, project: true, want: 1234},
+		{name: "large extra isize", extraIsize: 64, project: true, want: 1234},
+		{name: "extra isize too small", extraIsize: 28, project: true},
+		{name: "no project feature", extraIsize: 32},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			binary.LittleEndian.PutUint16(raw[0x80:], test.extraIsize)
+			var in InodeNew
+			binary.Unmarshal(raw[:binary.Size(in)], binary.LittleEndian, &in)
+			sb.FeatureRoCompat = RoCompatFeatures{Project: test.project}.ToInt()
+			if got := in.ProjectID(&sb); got != test.want {
+				t.Errorf("ProjectID() = %d, want %d", got, test.want)
+			}
+		})
+	}
+
+	var old InodeOld
+	binary.Unmarshal(raw[:OldInodeSize], binary.LittleEndian, &old)
+	if got := old.ProjectID(&sb); got != 0 {
+		t.Errorf("InodeOld.ProjectID() = %d, want 0", got)
+	}
+}
+
+// TestInodeDeviceNumber tests decoding device numbers stored with the old
+// encoding in i_block[0] and the new one in i_block[1].
+func TestInodeDeviceNumber(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		block     [2]uint32
+		wantMajor uint32
+		wantMinor uint32
+	}{
+		// mknod c 4 65 with a major and minor below 256.
+		{name: "old", block: [2]uint32{0x0441}, wantMajor: 4, wantMinor: 65},
+		// mknod b 259 300000, which does not fit the old encoding.
+		{name: "new", block: [2]uint32{0, 0x493103e0}, wantMajor: 259, wantMinor: 300000},
+		// i_block[1] is ignored if i_block[0] is set.
+		{name: "old with new set", block: [2]uint32{0x0805, 0x493103e0}, wantMajor: 8, wantMinor: 5},
+		{name: "zero", wantMajor: 0, wantMinor: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var in InodeNew
+			binary.LittleEndian.PutUint32(in.Data(), test.block[0])
+			binary.LittleEndian.PutUint32(in.Data()[4:], test.block[1])
+			if major, minor := in.DeviceNumber(); major != test.wantMajor || minor != test.wantMinor {
+				t.Errorf("DeviceNumber() = (%d, %d), want (%d, %d)", major, minor, test.wantMajor, test.wantMinor)
+			}
+		})
+	}
+}
+
+// TestInodeFileType tests the file type predicates of inodes of each type.
+func TestInodeFileType(t *testing.T) {
+	for _, test := range []struct {
+		mode linux.FileMode
+		want string
+	}{
+		{mode: linux.ModeDirectory | 0755, want: "dir"},
+		{mode: linux.ModeRegular | 0644, want: "regular"},
+		{mode: linux.ModeSymlink | 0777, want: "symlink"},
+		{mode: linux.ModeNamedPipe | 0644, want: "fifo"},
+		{mode: linux.ModeSocket | 0755, want: "socket"},
+		{mode: linux.ModeCharacterDevice | 0620, want: "char device"},
+		{mode: linux.ModeBlockDevice | 0660, want: "block device"},
+	} {
+		t.Run(test.want, func(t *testing.T) {
+			for _, in := range []Inode{&InodeOld{ModeRaw: uint16(test.mode)}, &InodeNew{InodeOld: InodeOld{ModeRaw: uint16(test.mode)}}} {
+				for _, pred := range []struct {
+					name string
+					is   func() bool
+				}{
+					{name: "dir", is: in.IsDir},
+					{name: "regular", is: in.IsRegular},
+					{name: "symlink", is: in.IsSymlink},
+					{name: "fifo", is: in.IsFIFO},
+					{name: "socket", is: in.IsSocket},
+					{name: "char device", is: in.IsCharDevice},
+					{name: "block device", is: in.IsBlockDevice},
+				} {
+					if got, want := pred.is(), pred.name == test.want; got != want {
+						t.Errorf("%T with mode %#o: %s predicate = %t, want %t", in, test.mode, pred.name, got, want)
+					}
+				}
+				// With no blocks, only symlinks are fast symlinks.
+				if got, want := in.IsFastSymlink(), test.want == "symlink"; got != want {
+					t.Errorf("%T with mode %#o: IsFastSymlink() = %t, want %t", in, test.mode, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestInodeFlags tests that inode flags round trip through their integer
+// representation and are rendered by name.
+func TestInodeFlags(t *testing.T) {
+	f := InodeFlags{Extents: true, Index: true, Immutable: true}
+	raw := f.ToInt()
+	if want := uint32(InExtents | InIndex | InImmutable); raw != want {
+		t.Errorf("ToInt() = %#x, want %#x", raw, want)
+	}
+	if got := InodeFlagsFromInt(raw); got != f {
+		t.Errorf("InodeFlagsFromInt(%#x) = %+v, want %+v", raw, got, f)
+	}
+	if got, want := f.String(), "immutable index extents"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// Bits which are not understood are preserved.
+	all := InodeFlagsFromInt(0xffffffff)
+	if got, want := all.Unknown, uint32(0x0fc0a707); got != want {
+		t.Errorf("InodeFlagsFromInt(0xffffffff).Unknown = %#x, want %#x", got, want)
+	}
+	if got := all.ToInt(); got != 0xffffffff {
+		t.Errorf("round trip of 0xffffffff = %#x", got)
+	}
+}
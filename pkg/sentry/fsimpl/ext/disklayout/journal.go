@@ -0,0 +1,449 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+const (
+	// JournalMagic is the magic number in the header of all journal metadata
+	// blocks.
+	JournalMagic = 0xc03b3998
+
+	// JournalSuperBlockSize is the size of the JournalSuperBlock struct.
+	JournalSuperBlockSize = 1024
+)
+
+// These are the journal block types (h_blocktype).
+const (
+	// JournalDescriptorBlockType marks a descriptor block, which lists the
+	// filesystem blocks whose new contents follow it in the log.
+	JournalDescriptorBlockType = 1
+
+	// JournalCommitBlockType marks a commit block, which ends a transaction.
+	JournalCommitBlockType = 2
+
+	// JournalSuperBlockV1Type marks a version 1 journal superblock, which has
+	// no features.
+	JournalSuperBlockV1Type = 3
+
+	// JournalSuperBlockV2Type marks a version 2 journal superblock.
+	JournalSuperBlockV2Type = 4
+
+	// JournalRevokeBlockType marks a revoke block, which lists the filesystem
+	// blocks whose earlier logged contents must not be replayed.
+	JournalRevokeBlockType = 5
+)
+
+// These are the journal checksum types (s_checksum_type and the
+// h_chksum_type of commit blocks).
+const (
+	JournalCrc32Checksum  = 1
+	JournalMD5Checksum    = 2
+	JournalSHA1Checksum   = 3
+	JournalCrc32cChecksum = 4
+)
+
+// JournalHeader represents the journal_header_t struct in
+// include/linux/jbd2.h, which starts all journal metadata blocks. Like all
+// journal structures, it is stored big-endian.
+type JournalHeader struct {
+	Magic     uint32
+	BlockType uint32
+	Sequence  uint32
+}
+
+// JournalSuperBlock represents the journal_superblock_t struct in
+// include/linux/jbd2.h. It is stored big-endian in the first block of the
+// journal, which is the journal inode for internal journals (see
+// SuperBlock.JournalInode).
+//
+// The journal is a circular log of transactions in its blocks starting at
+// First() and ending before MaxLen(). Start() is the block of the first
+// transaction to replay, which has sequence number Sequence().
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/journal.html.
+type JournalSuperBlock struct {
+	Header             JournalHeader
+	BlockSizeRaw       uint32
+	MaxLenRaw          uint32
+	FirstRaw           uint32
+	SequenceRaw        uint32
+	StartRaw           uint32
+	Errno              int32
+	FeatureCompat      uint32
+	FeatureIncompat    uint32
+	FeatureRoCompat    uint32
+	UUID               [16]byte
+	NrUsers            uint32
+	DynSuper           uint32
+	MaxTransaction     uint32
+	MaxTransactionData uint32
+	ChecksumTypeRaw    uint8
+	_                  [3]uint8
+	NumFastCommitBlks  uint32
+	Head               uint32
+	_                  [40]uint32
+	Checksum           uint32
+	Users              [16 * 48]byte
+}
+
+// ParseJournalSuperBlock parses the journal superblock at the start of block.
+// Returns an error if block is too small, does not have JournalMagic or is not
+// a journal superblock, or if the log does not fit in the journal.
+func ParseJournalSuperBlock(block []byte) (*JournalSuperBlock, error) {
+	if len(block) < JournalSuperBlockSize {
+		return nil, fmt.Errorf("journal superblock is only %d bytes, want %d", len(block), JournalSuperBlockSize)
+	}
+	var j JournalSuperBlock
+	binary.Unmarshal(block[:JournalSuperBlockSize], binary.BigEndian, &j)
+	if j.Header.Magic != JournalMagic {
+		return nil, newDiskErrorf(ErrBadMagic, "journal superblock has magic %#x, want %#x", j.Header.Magic, JournalMagic)
+	}
+	if j.Header.BlockType != JournalSuperBlockV1Type && j.Header.BlockType != JournalSuperBlockV2Type {
+		return nil, newDiskErrorf(ErrUnsupportedFeature, "journal superblock has block type %d, want %d or %d", j.Header.BlockType, JournalSuperBlockV1Type, JournalSuperBlockV2Type)
+	}
+	if j.FirstRaw == 0 || j.FirstRaw >= j.MaxLenRaw {
+		return nil, fmt.Errorf("journal log starts at block %d of %d", j.FirstRaw, j.MaxLenRaw)
+	}
+	return &j, nil
+}
+
+// Version returns the version of the journal superblock, 1 or 2.
+func (j *JournalSuperBlock) Version() int {
+	if j.Header.BlockType == JournalSuperBlockV1Type {
+		return 1
+	}
+	return 2
+}
+
+// BlockSize returns the journal block size, which must be the filesystem
+// block size.
+func (j *JournalSuperBlock) BlockSize() uint32 { return j.BlockSizeRaw }
+
+// MaxLen returns the number of blocks in the journal.
+func (j *JournalSuperBlock) MaxLen() uint32 { return j.MaxLenRaw }
+
+// First returns the first block of the log.
+func (j *JournalSuperBlock) First() uint32 { return j.FirstRaw }
+
+// Sequence returns the sequence number of the first transaction to replay.
+func (j *JournalSuperBlock) Sequence() uint32 { return j.SequenceRaw }
+
+// Start returns the block of the first transaction to replay. The journal is
+// empty if it is 0.
+func (j *JournalSuperBlock) Start() uint32 { return j.StartRaw }
+
+// ChecksumType returns the algorithm of the journal checksums
+// (s_checksum_type) if the CsumV2 or CsumV3 feature is set. Only
+// JournalCrc32cChecksum is used by these features.
+func (j *JournalSuperBlock) ChecksumType() uint8 { return j.ChecksumTypeRaw }
+
+// CompatibleFeatures returns the compatible features of the journal. Version
+// 1 journal superblocks have no features.
+func (j *JournalSuperBlock) CompatibleFeatures() JournalCompatFeatures {
+	if j.Version() == 1 {
+		return JournalCompatFeatures{}
+	}
+	return JournalCompatFeaturesFromInt(j.FeatureCompat)
+}
+
+// IncompatibleFeatures returns the incompatible features of the journal. The
+// journal must not be replayed if any of them is not understood. Version 1
+// journal superblocks have no features.
+func (j *JournalSuperBlock) IncompatibleFeatures() JournalIncompatFeatures {
+	if j.Version() == 1 {
+		return JournalIncompatFeatures{}
+	}
+	return JournalIncompatFeaturesFromInt(j.FeatureIncompat)
+}
+
+// These are the journal compatible features.
+const (
+	// JournalChecksum indicates that commit blocks hold a checksum of their
+	// transaction (version 1 checksums).
+	JournalChecksum = 0x1
+
+	// journalKnownCompat is the set of all compatible features listed above.
+	journalKnownCompat = JournalChecksum
+)
+
+// JournalCompatFeatures represents the compatible feature set of a journal.
+type JournalCompatFeatures struct {
+	Checksum bool
+
+	// Unknown holds the set bits which are not understood by this package.
+	Unknown uint32
+}
+
+// ToInt converts journal compatible features back to its 32-bit rep.
+func (f JournalCompatFeatures) ToInt() uint32 {
+	var res uint32
+	if f.Checksum {
+		res |= JournalChecksum
+	}
+	res |= f.Unknown
+	return res
+}
+
+// JournalCompatFeaturesFromInt converts the integer representation of journal
+// compatible features to JournalCompatFeatures struct.
+func JournalCompatFeaturesFromInt(f uint32) JournalCompatFeatures {
+	return JournalCompatFeatures{
+		Checksum: f&JournalChecksum > 0,
+		Unknown:  f &^ journalKnownCompat,
+	}
+}
+
+// These are the journal incompatible features.
+const (
+	// JournalRevoke indicates that the journal has revoke blocks.
+	JournalRevoke = 0x1
+
+	// JournalIs64Bit indicates that descriptor block tags hold 64-bit block
+	// numbers.
+	JournalIs64Bit = 0x2
+
+	// JournalAsyncCommit indicates that commit blocks may be written without
+	// waiting for the rest of the transaction, which is then protected by the
+	// commit block checksum.
+	JournalAsyncCommit = 0x4
+
+	// JournalCsumV2 indicates that journal metadata blocks and logged blocks
+	// have crc32c checksums, with 16-bit checksums in descriptor block tags.
+	JournalCsumV2 = 0x8
+
+	// JournalCsumV3 indicates that journal metadata blocks and logged blocks
+	// have crc32c checksums, with 32-bit checksums in descriptor block tags.
+	JournalCsumV3 = 0x10
+
+	// JournalFastCommit indicates that the journal has a fast commit area
+	// after its regular log.
+	JournalFastCommit = 0x20
+
+	// journalKnownIncompat is the set of all incompatible features listed
+	// above.
+	journalKnownIncompat = JournalRevoke | JournalIs64Bit | JournalAsyncCommit | JournalCsumV2 | JournalCsumV3 | JournalFastCommit
+)
+
+// JournalIncompatFeatures represents the incompatible feature set of a
+// journal.
+type JournalIncompatFeatures struct {
+	Revoke      bool
+	Is64Bit     bool
+	AsyncCommit bool
+	CsumV2      bool
+	CsumV3      bool
+	FastCommit  bool
+
+	// Unknown holds the set bits which are not understood by this package.
+	Unknown uint32
+}
+
+// ToInt converts journal incompatible features back to its 32-bit rep.
+func (f JournalIncompatFeatures) ToInt() uint32 {
+	var res uint32
+	if f.Revoke {
+		res |= JournalRevoke
+	}
+	if f.Is64Bit {
+		res |= JournalIs64Bit
+	}
+	if f.AsyncCommit {
+		res |= JournalAsyncCommit
+	}
+	if f.CsumV2 {
+		res |= JournalCsumV2
+	}
+	if f.CsumV3 {
+		res |= JournalCsumV3
+	}
+	if f.FastCommit {
+		res |= JournalFastCommit
+	}
+	res |= f.Unknown
+	return res
+}
+
+// JournalIncompatFeaturesFromInt converts the integer representation of
+// journal incompatible features to JournalIncompatFeatures struct.
+func JournalIncompatFeaturesFromInt(f uint32) JournalIncompatFeatures {
+	return JournalIncompatFeatures{
+		Revoke:      f&JournalRevoke > 0,
+		Is64Bit:     f&JournalIs64Bit > 0,
+		AsyncCommit: f&JournalAsyncCommit > 0,
+		CsumV2:      f&JournalCsumV2 > 0,
+		CsumV3:      f&JournalCsumV3 > 0,
+		FastCommit:  f&JournalFastCommit > 0,
+		Unknown:     f &^ journalKnownIncompat,
+	}
+}
+
+// JournalHeaderSize is the size of the JournalHeader struct.
+const JournalHeaderSize = 12
+
+// ParseJournalHeader parses the header at the start of the journal block,
+// which must be at least JournalHeaderSize bytes. The block is a journal
+// metadata block only if the header has JournalMagic.
+func ParseJournalHeader(block []byte) JournalHeader {
+	var h JournalHeader
+	binary.Unmarshal(block[:JournalHeaderSize], binary.BigEndian, &h)
+	return h
+}
+
+// These are the flags of descriptor block tags (t_flags).
+const (
+	// JournalFlagEscape indicates that the logged block started with
+	// JournalMagic, which was replaced by zeros in the log so that the block
+	// is not mistaken for a journal metadata block.
+	JournalFlagEscape = 0x1
+
+	// JournalFlagSameUUID indicates that the tag is not followed by a 16 byte
+	// UUID because it has the same UUID as the previous tag.
+	JournalFlagSameUUID = 0x2
+
+	// JournalFlagDeleted indicates that the block was deleted by the
+	// transaction. It is not used.
+	JournalFlagDeleted = 0x4
+
+	// JournalFlagLastTag indicates the last tag of the descriptor block.
+	JournalFlagLastTag = 0x8
+)
+
+// JournalBlockTag represents a tag of a descriptor block, one of
+// journal_block_tag_t or journal_block_tag3_t in include/linux/jbd2.h. The
+// n-th tag names the filesystem block whose new contents are logged in the
+// n-th block following the descriptor block.
+type JournalBlockTag struct {
+	// BlockNum is the filesystem block number.
+	BlockNum uint64
+
+	// Flags holds the JournalFlag* flags of the tag.
+	Flags uint16
+
+	// Checksum is the checksum of the logged block if the journal has the
+	// CsumV2 (lower 16 bits) or CsumV3 feature.
+	Checksum uint32
+}
+
+// JournalBlockTailSize is the size of jbd2_journal_block_tail, which holds the
+// checksum of descriptor and revoke blocks at their end if the journal has the
+// CsumV2 or CsumV3 feature.
+const JournalBlockTailSize = 4
+
+// TagSize returns the size of the tags of descriptor blocks, excluding the
+// UUID that may follow them (journal_tag_bytes).
+func (j *JournalSuperBlock) TagSize() int {
+	f := j.IncompatibleFeatures()
+	if f.CsumV3 {
+		return 16
+	}
+	size := 12
+	if f.CsumV2 {
+		size += 2
+	}
+	if !f.Is64Bit {
+		size -= 4
+	}
+	return size
+}
+
+// hasBlockTail returns true if descriptor and revoke blocks of the journal end
+// with a jbd2_journal_block_tail.
+func (j *JournalSuperBlock) hasBlockTail() bool {
+	f := j.IncompatibleFeatures()
+	return f.CsumV2 || f.CsumV3
+}
+
+// ParseJournalDescriptor returns the tags of the descriptor block of the
+// journal described by j, in order.
+func ParseJournalDescriptor(j *JournalSuperBlock, block []byte) ([]JournalBlockTag, error) {
+	end := len(block)
+	if j.hasBlockTail() {
+		end -= JournalBlockTailSize
+	}
+	tagSize := j.TagSize()
+	is64Bit := j.IncompatibleFeatures().Is64Bit
+
+	var tags []JournalBlockTag
+	for off := JournalHeaderSize; off+tagSize <= end; {
+		var tag JournalBlockTag
+		tag.BlockNum = uint64(binary.BigEndian.Uint32(block[off:]))
+		if j.IncompatibleFeatures().CsumV3 {
+			tag.Flags = uint16(binary.BigEndian.Uint32(block[off+4:]))
+			if is64Bit {
+				tag.BlockNum |= uint64(binary.BigEndian.Uint32(block[off+8:])) << 32
+			}
+			tag.Checksum = binary.BigEndian.Uint32(block[off+12:])
+		} else {
+			tag.Checksum = uint32(binary.BigEndian.Uint16(block[off+4:]))
+			tag.Flags = binary.BigEndian.Uint16(block[off+6:])
+			if is64Bit {
+				tag.BlockNum |= uint64(binary.BigEndian.Uint32(block[off+8:])) << 32
+			}
+		}
+		tags = append(tags, tag)
+
+		off += tagSize
+		if tag.Flags&JournalFlagSameUUID == 0 {
+			off += 16
+		}
+		if tag.Flags&JournalFlagLastTag != 0 {
+			return tags, nil
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("journal descriptor block has no tags")
+	}
+	return tags, nil
+}
+
+// journalRevokeHeaderSize is the size of jbd2_journal_revoke_header_t, which
+// is a JournalHeader followed by the number of bytes used in the block.
+const journalRevokeHeaderSize = JournalHeaderSize + 4
+
+// ParseJournalRevoke returns the filesystem block numbers listed in the revoke
+// block of the journal described by j. Blocks logged by the transaction of the
+// revoke block or earlier ones must not be replayed.
+func ParseJournalRevoke(j *JournalSuperBlock, block []byte) ([]uint64, error) {
+	end := len(block)
+	if j.hasBlockTail() {
+		end -= JournalBlockTailSize
+	}
+	if end < journalRevokeHeaderSize {
+		return nil, fmt.Errorf("journal revoke block is only %d bytes", len(block))
+	}
+	used := int(binary.BigEndian.Uint32(block[JournalHeaderSize:]))
+	if used < journalRevokeHeaderSize || used > end {
+		return nil, fmt.Errorf("journal revoke block uses %d bytes of %d", used, end)
+	}
+
+	recordSize := 4
+	if j.IncompatibleFeatures().Is64Bit {
+		recordSize = 8
+	}
+	var blocks []uint64
+	for off := journalRevokeHeaderSize; off+recordSize <= used; off += recordSize {
+		if recordSize == 8 {
+			blocks = append(blocks, binary.BigEndian.Uint64(block[off:]))
+		} else {
+			blocks = append(blocks, uint64(binary.BigEndian.Uint32(block[off:])))
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// journalSuperBlock returns a version 2 journal superblock of a 1024 block
+// journal with the given incompatible features, like the ones written by
+// mke2fs -b 1024 -J size=1.
+func journalSuperBlock(incompat uint32) []byte {
+	j := JournalSuperBlock{
+		Header: JournalHeader{
+			Magic:     JournalMagic,
+			BlockType: JournalSuperBlockV2Type,
+		},
+		BlockSizeRaw:    1024,
+		MaxLenRaw:       1024,
+		FirstRaw:        1,
+		SequenceRaw:     1,
+		FeatureIncompat: incompat,
+		NrUsers:         1,
+	}
+	copy(j.UUID[:], testUUID[:])
+	if incompat&(JournalCsumV2|JournalCsumV3) != 0 {
+		j.ChecksumTypeRaw = JournalCrc32cChecksum
+		// The checksum computed by mke2fs for the 64bit and csum_v3
+		// features.
+		j.Checksum = 0x42b2fe01
+	}
+	return binary.Marshal(nil, binary.BigEndian, j)
+}
+
+// TestJournalSuperBlockSize tests that the JournalSuperBlock struct is of the
+// correct size.
+func TestJournalSuperBlockSize(t *testing.T) {
+	assertSize(t, JournalSuperBlock{}, JournalSuperBlockSize)
+}
+
+// TestParseJournalSuperBlock tests that version 2 journal superblocks with
+// and without checksums are parsed.
+func TestParseJournalSuperBlock(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		incompat uint32
+		want     JournalIncompatFeatures
+	}{
+		{
+			name: "v2",
+		},
+		{
+			name:     "csum_v3",
+			incompat: JournalIs64Bit | JournalCsumV3,
+			want:     JournalIncompatFeatures{Is64Bit: true, CsumV3: true},
+		},
+		{
+			name:     "async_commit",
+			incompat: JournalAsyncCommit | 0x100,
+			want:     JournalIncompatFeatures{AsyncCommit: true, Unknown: 0x100},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := ParseJournalSuperBlock(journalSuperBlock(test.incompat))
+			if err != nil {
+				t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+			}
+			if got := j.Version(); got != 2 {
+				t.Errorf("Version() = %d, want 2", got)
+			}
+			if got := j.BlockSize(); got != 1024 {
+				t.Errorf("BlockSize() = %d, want 1024", got)
+			}
+			if got := j.MaxLen(); got != 1024 {
+				t.Errorf("MaxLen() = %d, want 1024", got)
+			}
+			if got := j.First(); got != 1 {
+				t.Errorf("First() = %d, want 1", got)
+			}
+			if got := j.Sequence(); got != 1 {
+				t.Errorf("Sequence() = %d, want 1", got)
+			}
+			if got := j.Start(); got != 0 {
+				t.Errorf("Start() = %d, want 0", got)
+			}
+			if got := j.IncompatibleFeatures(); got != test.want {
+				t.Errorf("IncompatibleFeatures() = %+v, want %+v", got, test.want)
+			}
+			if got := j.IncompatibleFeatures().ToInt(); got != test.incompat {
+				t.Errorf("IncompatibleFeatures().ToInt() = %#x, want %#x", got, test.incompat)
+			}
+			if test.want.CsumV3 && j.ChecksumType() != JournalCrc32cChecksum {
+				t.Errorf("ChecksumType() = %d, want %d", j.ChecksumType(), JournalCrc32cChecksum)
+			}
+		})
+	}
+}
+
+// TestParseJournalSuperBlockV1 tests that version 1 journal superblocks have
+// no features.
+func TestParseJournalSuperBlockV1(t *testing.T) {
+	block := journalSuperBlock(JournalCsumV3)
+	binary.BigEndian.PutUint32(block[4:], JournalSuperBlockV1Type)
+	j, err := ParseJournalSuperBlock(block)
+	if err != nil {
+		t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+	}
+	if got := j.Version(); got != 1 {
+		t.Errorf("Version() = %d, want 1", got)
+	}
+	if got := j.IncompatibleFeatures(); got != (JournalIncompatFeatures{}) {
+		t.Errorf("IncompatibleFeatures() = %+v, want none", got)
+	}
+}
+
+// TestParseJournalSuperBlockInvalid tests that blocks which are not journal
+// superblocks are refused.
+func TestParseJournalSuperBlockInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		modify func(block []byte) []byte
+	}{
+		{
+			name:   "truncated",
+			modify: func(block []byte) []byte { return block[:JournalSuperBlockSize-1] },
+		},
+		{
+			name: "bad magic",
+			modify: func(block []byte) []byte {
+				block[0]++
+				return block
+			},
+		},
+		{
+			name: "descriptor block",
+			modify: func(block []byte) []byte {
+				binary.BigEndian.PutUint32(block[4:], JournalDescriptorBlockType)
+				return block
+			},
+		},
+		{
+			name: "log past the end",
+			modify: func(block []byte) []byte {
+				binary.BigEndian.PutUint32(block[20:], 1024)
+				return block
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseJournalSuperBlock(test.modify(journalSuperBlock(0))); err == nil {
+				t.Errorf("ParseJournalSuperBlock() succeeded, want error")
+			}
+		})
+	}
+}
+
+// TestParseJournalDescriptor tests that the tags of descriptor blocks are
+// parsed for each tag layout.
+func TestParseJournalDescriptor(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		incompat uint32
+		tags     []byte
+		want     []JournalBlockTag
+	}{
+		{
+			name: "32-bit",
+			tags: []byte{
+				0, 0, 0, 10, 0, 0, 0, 0, // No JournalFlagSameUUID, UUID follows.
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 11, 0, 0, 0, JournalFlagSameUUID | JournalFlagEscape,
+				0, 0, 0, 12, 0, 0, 0, JournalFlagSameUUID | JournalFlagLastTag,
+				0, 0, 0, 13, 0, 0, 0, JournalFlagSameUUID, // Past the last tag.
+			},
+			want: []JournalBlockTag{
+				{BlockNum: 10},
+				{BlockNum: 11, Flags: JournalFlagSameUUID | JournalFlagEscape},
+				{BlockNum: 12, Flags: JournalFlagSameUUID | JournalFlagLastTag},
+			},
+		},
+		{
+			name:     "64-bit",
+			incompat: JournalIs64Bit,
+			tags: []byte{
+				0, 0, 0, 10, 0, 0, 0, JournalFlagSameUUID | JournalFlagLastTag, 0, 0, 0, 1,
+			},
+			want: []JournalBlockTag{
+				{BlockNum: 1<<32 | 10, Flags: JournalFlagSameUUID | JournalFlagLastTag},
+			},
+		},
+		{
+			name:     "csum_v3",
+			incompat: JournalIs64Bit | JournalCsumV3,
+			tags: []byte{
+				0, 0, 0, 10, 0, 0, 0, JournalFlagSameUUID | JournalFlagLastTag, 0, 0, 0, 1, 0xde, 0xad, 0xbe, 0xef,
+			},
+			want: []JournalBlockTag{
+				{BlockNum: 1<<32 | 10, Flags: JournalFlagSameUUID | JournalFlagLastTag, Checksum: 0xdeadbeef},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := ParseJournalSuperBlock(journalSuperBlock(test.incompat))
+			if err != nil {
+				t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+			}
+			block := make([]byte, 1024)
+			binary.BigEndian.PutUint32(block[0:], JournalMagic)
+			binary.BigEndian.PutUint32(block[4:], JournalDescriptorBlockType)
+			copy(block[JournalHeaderSize:], test.tags)
+
+			tags, err := ParseJournalDescriptor(j, block)
+			if err != nil {
+				t.Fatalf("ParseJournalDescriptor() failed: %v", err)
+			}
+			if !reflect.DeepEqual(tags, test.want) {
+				t.Errorf("ParseJournalDescriptor() = %+v, want %+v", tags, test.want)
+			}
+		})
+	}
+}
+
+// TestParseJournalRevoke tests that the records of revoke blocks are parsed
+// up to the number of bytes used.
+func TestParseJournalRevoke(t *testing.T) {
+	j, err := ParseJournalSuperBlock(journalSuperBlock(JournalIs64Bit))
+	if err != nil {
+		t.Fatalf("ParseJournalSuperBlock() failed: %v", err)
+	}
+	block := make([]byte, 1024)
+	binary.BigEndian.PutUint32(block[0:], JournalMagic)
+	binary.BigEndian.PutUint32(block[4:], JournalRevokeBlockType)
+	binary.BigEndian.PutUint32(block[12:], 16+2*8)
+	binary.BigEndian.PutUint64(block[16:], 1<<32|10)
+	binary.BigEndian.PutUint64(block[24:], 11)
+	binary.BigEndian.PutUint64(block[32:], 12)
+
+	blocks, err := ParseJournalRevoke(j, block)
+	if err != nil {
+		t.Fatalf("ParseJournalRevoke() failed: %v", err)
+	}
+	if want := []uint64{1<<32 | 10, 11}; !reflect.DeepEqual(blocks, want) {
+		t.Errorf("ParseJournalRevoke() = %v, want %v", blocks, want)
+	}
+
+	binary.BigEndian.PutUint32(block[12:], 1025)
+	if _, err := ParseJournalRevoke(j, block); err == nil {
+		t.Errorf("ParseJournalRevoke() of block using 1025 bytes succeeded")
+	}
+}
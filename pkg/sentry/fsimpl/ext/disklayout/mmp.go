@@ -0,0 +1,120 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/binary"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
+const (
+	// MMPMagic is the magic number of the MMP block.
+	MMPMagic = 0x004d4d50
+
+	// MMPSize is the size of the MMPBlock struct.
+	MMPSize = 1024
+
+	// mmpChecksumOff is the offset of mmp_checksum in MMPBlock.
+	mmpChecksumOff = 1020
+)
+
+// Special MMP sequence numbers. Sequence numbers of a filesystem in use are
+// at most MMPSeqMax.
+const (
+	// MMPSeqClean indicates that the filesystem was cleanly released.
+	MMPSeqClean = 0xff4d4d50
+
+	// MMPSeqFsck indicates that e2fsck is running on the filesystem.
+	MMPSeqFsck = 0xe24d4d50
+
+	// MMPSeqMax is the largest sequence number of a filesystem in use.
+	MMPSeqMax = 0xe24d4d4f
+)
+
+// MMPBlock represents the mmp_struct stored in block sb.s_mmp_block of
+// filesystems with SbMMP set. The node using the filesystem updates the
+// sequence number and timestamp every sb.s_mmp_update_interval seconds so that
+// other nodes can detect that the filesystem is in use.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/mmp.html.
+type MMPBlock struct {
+	Magic            uint32
+	Seq              uint32
+	TimeRaw          uint64
+	NodeNameRaw      [64]byte
+	DeviceNameRaw    [32]byte
+	CheckIntervalRaw uint16
+	_                uint16
+	_                [226]uint32
+	Checksum         uint32
+}
+
+// ParseMMPBlock parses the MMP block. Returns an error if block is too small
+// or does not have MMPMagic.
+func ParseMMPBlock(block []byte) (*MMPBlock, error) {
+	if len(block) < MMPSize {
+		return nil, fmt.Errorf("MMP block is only %d bytes, want %d", len(block), MMPSize)
+	}
+	var m MMPBlock
+	binary.Unmarshal(block[:MMPSize], binary.LittleEndian, &m)
+	if m.Magic != MMPMagic {
+		return nil, newDiskErrorf(ErrBadMagic, "MMP block has magic %#x, want %#x", m.Magic, MMPMagic)
+	}
+	return &m, nil
+}
+
+// Time returns the time of the last update of the MMP block (mmp_time).
+func (m *MMPBlock) Time() ktime.Time { return ktime.FromUnix(int64(m.TimeRaw), 0) }
+
+// NodeName returns the host name of the node which last updated the MMP block
+// (mmp_nodename).
+func (m *MMPBlock) NodeName() string { return cString(m.NodeNameRaw[:]) }
+
+// DeviceName returns the name of the block device through which the MMP block
+// was last updated (mmp_bdevname).
+func (m *MMPBlock) DeviceName() string { return cString(m.DeviceNameRaw[:]) }
+
+// CheckInterval returns the update interval in use by the node which last
+// updated the MMP block (mmp_check_interval). This may be larger than
+// sb.s_mmp_update_interval if the node could not keep up.
+func (m *MMPBlock) CheckInterval() time.Duration {
+	return time.Duration(m.CheckIntervalRaw) * time.Second
+}
+
+// CheckStale returns true if the MMP block does not indicate that another node
+// is using the filesystem at time now. This is the case if the filesystem was
+// cleanly released or if the MMP block was last updated more than interval
+// ago. It is never the case while e2fsck is running.
+func (m *MMPBlock) CheckStale(now ktime.Time, interval time.Duration) bool {
+	switch m.Seq {
+	case MMPSeqClean:
+		return true
+	case MMPSeqFsck:
+		return false
+	}
+	return now.Sub(m.Time()) > interval
+}
+
+// cString returns the NUL-terminated string held in b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/binary"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
+// mmpBlock returns the MMP block of assets/mmp.ext4.
+func mmpBlock() []byte {
+	m := MMPBlock{
+		Magic:            MMPMagic,
+		Seq:              MMPSeqClean,
+		TimeRaw:          1577836800,
+		CheckIntervalRaw: 5,
+		Checksum:         0xcb505907,
+	}
+	copy(m.NodeNameRaw[:], "localhost")
+	copy(m.DeviceNameRaw[:], "mmp.ext4")
+	return binary.Marshal(nil, binary.LittleEndian, m)
+}
+
+// TestMMPSize tests that the MMPBlock struct is of the correct size.
+func TestMMPSize(t *testing.T) {
+	assertSize(t, MMPBlock{}, MMPSize)
+}
+
+// TestParseMMPBlock tests that the MMP block is parsed and that blocks which
+// are not MMP blocks are refused.
+func TestParseMMPBlock(t *testing.T) {
+	m, err := ParseMMPBlock(mmpBlock())
+	if err != nil {
+		t.Fatalf("ParseMMPBlock() failed: %v", err)
+	}
+	if m.Seq != MMPSeqClean {
+		t.Errorf("Seq = %#x, want %#x", m.Seq, MMPSeqClean)
+	}
+	if got, want := m.Time(), ktime.FromUnix(1577836800, 0); got != want {
+		t.Errorf("Time() = %v, want %v", got, want)
+	}
+	if got, want := m.NodeName(), "localhost"; got != want {
+		t.Errorf("NodeName() = %q, want %q", got, want)
+	}
+	if got, want := m.DeviceName(), "mmp.ext4"; got != want {
+		t.Errorf("DeviceName() = %q, want %q", got, want)
+	}
+	if got, want := m.CheckInterval(), 5*time.Second; got != want {
+		t.Errorf("CheckInterval() = %v, want %v", got, want)
+	}
+
+	if _, err := ParseMMPBlock(mmpBlock()[:MMPSize-1]); err == nil {
+		t.Errorf("ParseMMPBlock() of truncated block succeeded")
+	}
+	block := mmpBlock()
+	block[0]++
+	if _, err := ParseMMPBlock(block); err == nil {
+		t.Errorf("ParseMMPBlock() of block with bad magic succeeded")
+	}
+}
+
+// TestMMPCheckStale tests that only MMP blocks which were released or not
+// updated recently are stale.
+func TestMMPCheckStale(t *testing.T) {
+	updated := ktime.FromUnix(1577836800, 0)
+	interval := 11 * time.Second
+	for _, test := range []struct {
+		name string
+		seq  uint32
+		now  ktime.Time
+		want bool
+	}{
+		{name: "fresh", seq: 42, now: updated.Add(10 * time.Second), want: false},
+		{name: "stale", seq: 42, now: updated.Add(time.Hour), want: true},
+		{name: "clean", seq: MMPSeqClean, now: updated, want: true},
+		{name: "fsck", seq: MMPSeqFsck, now: updated.Add(time.Hour), want: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := MMPBlock{Magic: MMPMagic, Seq: test.seq, TimeRaw: uint64(updated.Seconds())}
+			if got := m.CheckStale(test.now, interval); got != test.want {
+				t.Errorf("CheckStale() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
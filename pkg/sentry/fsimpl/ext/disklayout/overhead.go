@@ -0,0 +1,135 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import "sort"
+
+// clusterRange is an inclusive range of cluster numbers.
+type clusterRange struct {
+	first uint64
+	last  uint64
+}
+
+// ComputeOverhead returns the number of clusters used by filesystem metadata
+// the way Linux computes it when sb.s_overhead_clusters is 0. This counts:
+//     - the blocks before the first data block.
+//     - the superblock and group descriptor copies, along with the reserved
+//       group descriptor blocks following them.
+//     - the block and inode bitmaps and the inode table of each group, along
+//       with its exclude bitmap if sb.ExcludeBitmapPresent().
+//     - the journalBlocks blocks of the internal journal, if any.
+//
+// bgs must hold the descriptors of all groups. The journal size can only be
+// obtained from the journal inode, so the caller must pass it in. Metadata
+// blocks sharing a cluster are only counted once, except for the journal
+// which is accounted for separately like Linux does. Linux ignores exclude
+// bitmaps, but counting them keeps their blocks from being reported as free
+// since they are marked in use in the block bitmaps.
+func ComputeOverhead(sb SuperBlock, bgs []BlockGroup, journalBlocks uint64) uint64 {
+	var ranges []clusterRange
+	addBlocks := func(start, n uint64) {
+		if n > 0 {
+			ranges = append(ranges, clusterRange{BlockToCluster(sb, start), BlockToCluster(sb, start+n-1)})
+		}
+	}
+
+	inodeTableBlocks := InodeTableBlocks(sb)
+	backups := sb.BackupGroups()
+
+	for g, bg := range bgs {
+		group := uint64(g)
+		hasSuper := group == 0
+		if len(backups) > 0 && uint64(backups[0]) == group {
+			hasSuper = true
+			backups = backups[1:]
+		}
+
+		addBlocks(baseMetaBlocks(sb, uint64(len(bgs)), group, hasSuper))
+		addBlocks(bg.BlockBitmap(), 1)
+		addBlocks(bg.InodeBitmap(), 1)
+		addBlocks(bg.InodeTable(), inodeTableBlocks)
+		if sb.ExcludeBitmapPresent() {
+			addBlocks(bg.ExclusionBitmap(), 1)
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	var overhead uint64
+	var next uint64 // First cluster not yet counted.
+	for _, r := range ranges {
+		if r.first < next {
+			r.first = next
+		}
+		if r.first <= r.last {
+			overhead += r.last - r.first + 1
+			next = r.last + 1
+		}
+	}
+
+	shift := clusterBits(sb)
+	return overhead + (journalBlocks+1<<shift-1)>>shift
+}
+
+// GroupBaseMetaBlocks returns the first block and the number of blocks of the
+// superblock and group descriptor copies held at the start of block group
+// group, along with the reserved group descriptor blocks following them, like
+// ext4_num_base_meta_blocks. For group 0, the range also covers the blocks up
+// to the one holding the superblock. n is 0 if the group holds none of them.
+func GroupBaseMetaBlocks(sb SuperBlock, group uint64) (start, n uint64) {
+	return baseMetaBlocks(sb, sb.GroupsCount(), group, GroupHasSuperBlock(sb, group))
+}
+
+// baseMetaBlocks implements GroupBaseMetaBlocks for a filesystem with groups
+// block groups.
+func baseMetaBlocks(sb SuperBlock, groups, group uint64, hasSuper bool) (uint64, uint64) {
+	blockSize := sb.BlockSize()
+	descPerBlock := blockSize / uint64(sb.BgDescSize())
+	gdtBlocks := (groups + descPerBlock - 1) / descPerBlock
+	metaBGStart := groups
+	if sb.IncompatibleFeatures().MetaBG {
+		// Only the groups before the first meta block group have their
+		// descriptors in the contiguous table.
+		gdtBlocks = uint64(sb.FirstMetaBG())
+		metaBGStart = gdtBlocks * descPerBlock
+	}
+
+	var num uint64
+	if group < metaBGStart {
+		if hasSuper {
+			num = 1 + gdtBlocks + uint64(sb.ReservedGdtBlocks())
+		}
+	} else {
+		// A meta block group keeps its descriptor block in its first,
+		// second and last groups.
+		if hasSuper {
+			num = 1
+		}
+		if m := group % descPerBlock; m == 0 || m == 1 || m == descPerBlock-1 {
+			num++
+		}
+	}
+
+	if group == 0 {
+		return 0, SbOffset/blockSize + num
+	}
+	return uint64(sb.FirstDataBlock()) + group*uint64(sb.BlocksPerGroup()), num
+}
+
+// InodeTableBlocks returns the number of blocks taken by the inode table of a
+// block group.
+func InodeTableBlocks(sb SuperBlock) uint64 {
+	blockSize := sb.BlockSize()
+	return (uint64(sb.InodesPerGroup())*uint64(sb.InodeSize()) + blockSize - 1) / blockSize
+}
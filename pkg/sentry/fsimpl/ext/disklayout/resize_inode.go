@@ -0,0 +1,121 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// ReservedGdtBlock is a block reserved for a group descriptor block which the
+// filesystem may need when it grows, along with its backup copies.
+type ReservedGdtBlock struct {
+	// Primary is the block reserved in group 0.
+	Primary uint64
+
+	// Backups are the blocks reserved in the groups holding a backup copy of
+	// the group descriptors, in ascending group order.
+	Backups []uint64
+}
+
+// ResizeInodeReader reads the blocks reserved by the resize inode.
+//
+// With the SbResizeInode feature, sb.ReservedGdtBlocks() blocks are reserved
+// after the group descriptors of group 0 and of the groups holding backups, so
+// that new group descriptor blocks can be added without moving data. The
+// resize inode maps them so that they are not treated as free: its doubly
+// indirect block lists the primary reserved blocks, which in turn list their
+// backups like indirect blocks do. See Linux's fs/ext4/resize.c.
+//
+// Note: This struct itself does not represent an on-disk struct.
+type ResizeInodeReader struct {
+	// sb is the filesystem superblock.
+	sb SuperBlock
+
+	// dind is the doubly indirect block of the resize inode.
+	dind uint32
+
+	// readBlock loads the doubly indirect block and primary reserved blocks.
+	readBlock BlockReader
+}
+
+// NewResizeInodeReader is the ResizeInodeReader constructor. resize must be
+// the ResizeInode inode of a filesystem with the SbResizeInode feature, and
+// readBlock must read its physical blocks.
+func NewResizeInodeReader(sb SuperBlock, resize Inode, readBlock BlockReader) (*ResizeInodeReader, error) {
+	if !sb.CompatibleFeatures().ResizeInode {
+		return nil, NewDiskError(ErrUnsupportedFeature, "filesystem has no resize inode")
+	}
+	if sb.IncompatibleFeatures().MetaBG {
+		return nil, NewDiskError(ErrUnsupportedFeature, "resize inode cannot be used with meta block groups")
+	}
+	data := resize.Data()
+	dind := binary.LittleEndian.Uint32(data[(NumDirectBlocks+1)*4:])
+	if dind == 0 && sb.ReservedGdtBlocks() > 0 {
+		return nil, newDiskErrorf(ErrCorrupt, "resize inode has no doubly indirect block for %d reserved GDT blocks", sb.ReservedGdtBlocks())
+	}
+	return &ResizeInodeReader{sb: sb, dind: dind, readBlock: readBlock}, nil
+}
+
+// ReservedGdtBlocks returns the locations of the sb.ReservedGdtBlocks()
+// reserved group descriptor blocks. Like Linux's verify_reserved_gdb, it
+// returns an error if the resize inode does not map the blocks where they are
+// expected.
+func (r *ResizeInodeReader) ReservedGdtBlocks() ([]ReservedGdtBlock, error) {
+	reserved := uint64(r.sb.ReservedGdtBlocks())
+	if reserved == 0 {
+		return nil, nil
+	}
+	blockSize := r.sb.BlockSize()
+	addrPerBlock := blockSize / 4
+	descPerBlock := blockSize / uint64(r.sb.BgDescSize())
+	gdtBlocks := (r.sb.GroupsCount() + descPerBlock - 1) / descPerBlock
+	firstGdtBlock := uint64(r.sb.FirstDataBlock()) + 1
+	backups := r.sb.BackupGroups()
+	if uint64(len(backups)) > addrPerBlock {
+		backups = backups[:addrPerBlock]
+	}
+
+	dind, err := r.readBlock(uint64(r.dind))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ReservedGdtBlock, 0, reserved)
+	for i := uint64(0); i < reserved; i++ {
+		// The doubly indirect block is indexed by the number of the group
+		// descriptor block the reserved block is for.
+		primary := firstGdtBlock + gdtBlocks + i
+		idx := (gdtBlocks + i) % addrPerBlock
+		if got := uint64(binary.LittleEndian.Uint32(dind[idx*4:])); got != primary {
+			return nil, fmt.Errorf("resize inode maps reserved GDT block %d to block %d, want %d", i, got, primary)
+		}
+
+		ind, err := r.readBlock(primary)
+		if err != nil {
+			return nil, err
+		}
+		gdt := ReservedGdtBlock{Primary: primary, Backups: make([]uint64, 0, len(backups))}
+		for j, group := range backups {
+			backup := primary + uint64(group)*uint64(r.sb.BlocksPerGroup())
+			if got := uint64(binary.LittleEndian.Uint32(ind[j*4:])); got != backup {
+				return nil, fmt.Errorf("reserved GDT block %d maps backup %d in group %d to block %d, want %d", primary, j, group, got, backup)
+			}
+			gdt.Backups = append(gdt.Backups, backup)
+		}
+		res = append(res, gdt)
+	}
+	return res, nil
+}
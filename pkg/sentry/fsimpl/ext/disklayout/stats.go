@@ -0,0 +1,73 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import "fmt"
+
+// Stats holds the block and inode counts of a filesystem reported by statfs.
+type Stats struct {
+	// TotalBlocks is the number of blocks in the filesystem.
+	TotalBlocks uint64
+
+	// FreeBlocks is the number of free blocks.
+	FreeBlocks uint64
+
+	// AvailableBlocks is the number of free blocks available to unprivileged
+	// users, which excludes the blocks reserved for root.
+	AvailableBlocks uint64
+
+	// TotalInodes is the number of inodes in the filesystem.
+	TotalInodes uint64
+
+	// FreeInodes is the number of free inodes.
+	FreeInodes uint64
+
+	// Discrepancy is non-nil if the free counts of the superblock do not match
+	// the sums of the free counts of the groups, which indicates corruption
+	// (or a filesystem that was not cleanly unmounted, since Linux only
+	// updates the superblock counts lazily).
+	Discrepancy error
+}
+
+// FreeSpaceStats returns the block and inode counts of a filesystem. bgs must
+// hold the descriptors of all groups.
+//
+// Like Linux, the free counts are the sums of the per-group free counts and
+// the superblock counts are only used to cross-check them. Group free block
+// counts are in clusters and are converted to blocks.
+func FreeSpaceStats(sb SuperBlock, bgs []BlockGroup) Stats {
+	var freeClusters, freeInodes uint64
+	for _, bg := range bgs {
+		freeClusters += uint64(bg.FreeBlocksCount())
+		freeInodes += uint64(bg.FreeInodesCount())
+	}
+	stats := Stats{
+		TotalBlocks: sb.BlocksCount(),
+		FreeBlocks:  ClusterToBlock(sb, freeClusters),
+		TotalInodes: uint64(sb.InodesCount()),
+		FreeInodes:  freeInodes,
+	}
+	if reserved := sb.ReservedBlocksCount(); stats.FreeBlocks > reserved {
+		stats.AvailableBlocks = stats.FreeBlocks - reserved
+	}
+
+	switch {
+	case stats.FreeBlocks != sb.FreeBlocksCount():
+		stats.Discrepancy = fmt.Errorf("groups have %d free blocks but superblock records %d", stats.FreeBlocks, sb.FreeBlocksCount())
+	case stats.FreeInodes != uint64(sb.FreeInodesCount()):
+		stats.Discrepancy = fmt.Errorf("groups have %d free inodes but superblock records %d", stats.FreeInodes, sb.FreeInodesCount())
+	}
+	return stats
+}
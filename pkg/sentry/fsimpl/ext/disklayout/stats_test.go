@@ -0,0 +1,86 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import "testing"
+
+// statsTestFS returns the superblock and group descriptors of a bigalloc
+// filesystem with 4 block clusters and 2 groups whose free counts match those
+// of the superblock.
+func statsTestFS() (*SuperBlock64Bit, []BlockGroup) {
+	sb := &SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+	sb.LogClusterSize = 2
+	sb.BlocksCountLo = 1000
+	sb.ReservedBlocksCountLo = 50
+	sb.FreeBlocksCountLo = 4 * (100 + 20)
+	sb.InodesCountRaw = 64
+	sb.FreeInodesCountRaw = 30 + 20
+	bgs := []BlockGroup{
+		&BlockGroup32Bit{FreeBlocksCountLo: 100, FreeInodesCountLo: 30},
+		&BlockGroup32Bit{FreeBlocksCountLo: 20, FreeInodesCountLo: 20},
+	}
+	return sb, bgs
+}
+
+// TestFreeSpaceStats tests that the free counts of the groups are summed and
+// that the blocks reserved for root are not available.
+func TestFreeSpaceStats(t *testing.T) {
+	sb, bgs := statsTestFS()
+	want := Stats{
+		TotalBlocks:     1000,
+		FreeBlocks:      480,
+		AvailableBlocks: 430,
+		TotalInodes:     64,
+		FreeInodes:      50,
+	}
+	if got := FreeSpaceStats(sb, bgs); got != want {
+		t.Errorf("FreeSpaceStats() = %+v, want %+v", got, want)
+	}
+
+	// No blocks are available if fewer blocks than reserved are free.
+	sb.ReservedBlocksCountLo = 500
+	if got := FreeSpaceStats(sb, bgs).AvailableBlocks; got != 0 {
+		t.Errorf("FreeSpaceStats().AvailableBlocks = %d with more blocks reserved than free, want 0", got)
+	}
+}
+
+// TestFreeSpaceStatsDiscrepancy tests that group free counts which diverge
+// from those of the superblock are reported.
+func TestFreeSpaceStatsDiscrepancy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tamper func(bg *BlockGroup32Bit)
+	}{
+		{
+			name:   "free blocks",
+			tamper: func(bg *BlockGroup32Bit) { bg.FreeBlocksCountLo++ },
+		},
+		{
+			name:   "free inodes",
+			tamper: func(bg *BlockGroup32Bit) { bg.FreeInodesCountLo-- },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb, bgs := statsTestFS()
+			test.tamper(bgs[1].(*BlockGroup32Bit))
+			stats := FreeSpaceStats(sb, bgs)
+			if stats.Discrepancy == nil {
+				t.Errorf("FreeSpaceStats() = %+v, want discrepancy", stats)
+			}
+		})
+	}
+}
@@ -14,6 +14,20 @@
 
 package disklayout
 
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
 const (
 	// SbOffset is the absolute offset at which the superblock is placed.
 	SbOffset = 1024
@@ -47,6 +61,20 @@ type SuperBlock interface {
 	// FreeBlocksCount returns the number of free blocks in this filesystem.
 	FreeBlocksCount() uint64
 
+	// ReservedBlocksCount returns the number of blocks reserved for the
+	// privileged users (sb.s_r_blocks_count). Only root and the default
+	// reserved user and group may allocate the last ReservedBlocksCount()
+	// free blocks.
+	ReservedBlocksCount() uint64
+
+	// DefaultReservedUID returns the user, other than root, allowed to use the
+	// reserved blocks (sb.s_def_resuid).
+	DefaultReservedUID() auth.KUID
+
+	// DefaultReservedGID returns the group allowed to use the reserved blocks
+	// (sb.s_def_resgid).
+	DefaultReservedGID() auth.KGID
+
 	// FreeInodesCount returns the number of free inodes in this filesystem.
 	FreeInodesCount() uint32
 
@@ -57,6 +85,24 @@ type SuperBlock interface {
 	// needed.
 	MaxMountCount() uint16
 
+	// MountTime returns the time of the last mount (sb.s_mtime).
+	MountTime() ktime.Time
+
+	// WriteTime returns the time of the last write to the filesystem
+	// (sb.s_wtime).
+	WriteTime() ktime.Time
+
+	// CreationTime returns the time the filesystem was created
+	// (sb.s_mkfs_time). This is the Unix epoch for OldRev superblocks.
+	CreationTime() ktime.Time
+
+	// LastCheck returns the time of the last fsck (sb.s_lastcheck).
+	LastCheck() ktime.Time
+
+	// CheckInterval returns the maximum time allowed between two fscks
+	// (sb.s_checkinterval). 0 means that there is no limit.
+	CheckInterval() time.Duration
+
 	// FirstDataBlock returns the absolute block number of the first data block,
 	// which contains the super block itself.
 	//
@@ -85,6 +131,20 @@ type SuperBlock interface {
 	//     - BlocksPerGroup()                    otherwise.
 	ClustersPerGroup() uint32
 
+	// ClustersCount returns the number of clusters in this filesystem. This is
+	// BlocksCount() rounded up to whole clusters, which is BlocksCount() unless
+	// bigalloc is enabled.
+	ClustersCount() uint64
+
+	// OverheadClusters returns the number of clusters used by filesystem
+	// metadata (sb.s_overhead_clusters). This is 0 if mkfs did not record it,
+	// in which case ComputeOverhead can be used instead.
+	OverheadClusters() uint32
+
+	// FirstInode returns the first non-reserved inode number. This is
+	// OldFirstInode for OldRev superblocks.
+	FirstInode() uint32
+
 	// InodeSize returns the size of the inode disk record size in bytes. Use this
 	// to iterate over inode arrays on disk.
 	//
@@ -99,9 +159,39 @@ type SuperBlock interface {
 	//                         = 128 + 32 = 160 (default)
 	InodeSize() uint16
 
+	// MinExtraIsize returns the minimum number of bytes beyond OldInodeSize that
+	// all inodes in this filesystem have reserved (sb.s_min_extra_isize). This
+	// is where inode.i_extra_isize ends at the very least.
+	//
+	// Returns 0 for superblocks that predate this field.
+	MinExtraIsize() uint16
+
+	// WantExtraIsize returns the number of bytes beyond OldInodeSize that new
+	// inodes should reserve (sb.s_want_extra_isize). Extended attributes stored
+	// inside the inode begin after these extra fields.
+	//
+	// Returns 0 for superblocks that predate this field.
+	WantExtraIsize() uint16
+
 	// InodesPerGroup returns the number of inodes in a block group.
 	InodesPerGroup() uint32
 
+	// GroupsCount returns the number of block groups in this filesystem. This
+	// can be calculated by ceil((BlocksCount() - FirstDataBlock()) /
+	// BlocksPerGroup()). The last group may be partial.
+	//
+	// Returns 0 if BlocksPerGroup() is 0. ValidateSuperBlock ensures that this
+	// agrees with ceil(InodesCount() / InodesPerGroup()).
+	GroupsCount() uint64
+
+	// BackupGroups returns the block group numbers which hold a backup copy of
+	// the superblock and group descriptors, in ascending order. Group 0, which
+	// holds the primary copy, is not included. This is:
+	//     - sb.s_backup_bgs (non-zero entries)  if SbSparseV2 feature is set.
+	//     - 1 and powers of 3, 5 and 7          if SbSparse feature is set.
+	//     - all groups                          otherwise.
+	BackupGroups() []uint32
+
 	// BgDescSize returns the size of the block group descriptor struct.
 	//
 	// In ext2, ext3, ext4 (without 64-bit feature), the block group descriptor
@@ -110,6 +200,55 @@ type SuperBlock interface {
 	// 64 bytes. It might be bigger than that.
 	BgDescSize() uint16
 
+	// PreallocBlocks returns the number of blocks to try to preallocate for
+	// regular files (sb.s_prealloc_blocks). It is a hint which Linux ignores.
+	PreallocBlocks() uint8
+
+	// PreallocDirBlocks returns the number of blocks to preallocate for
+	// directories (sb.s_prealloc_dir_blocks) if SbDirPrealloc is set.
+	PreallocDirBlocks() uint8
+
+	// ReservedGdtBlocks returns the number of blocks reserved after the block
+	// group descriptor table, in each group holding a copy of it, for online
+	// growth of the table (sb.s_reserved_gdt_blocks).
+	ReservedGdtBlocks() uint16
+
+	// HashSeed returns the seed used to hash file names in htree directories
+	// (sb.s_hash_seed). If this is all zeros, the default seed used by
+	// the hash function itself should be used instead.
+	HashSeed() [4]uint32
+
+	// DefaultHashVersion returns the default hash algorithm used for htree
+	// directories (sb.s_def_hash_version).
+	DefaultHashVersion() uint8
+
+	// UnsignedDirHash returns true if htree directory hashes treat file name
+	// bytes as unsigned chars (SbUnsignedHash in sb.s_flags).
+	UnsignedDirHash() bool
+
+	// LogGroupsPerFlex returns log2 of the number of block groups in a flex
+	// group (sb.s_log_groups_per_flex) if SbFlexBg is set. Returns 0 otherwise.
+	LogGroupsPerFlex() uint8
+
+	// FlexGroupSize returns the number of block groups in a flex group. This
+	// is 1 << LogGroupsPerFlex() and hence 1 if SbFlexBg is not set.
+	FlexGroupSize() uint32
+
+	// MMPBlock returns the block holding the MMPBlock (sb.s_mmp_block) if
+	// SbMMP is set. Returns 0 otherwise.
+	MMPBlock() uint64
+
+	// MMPUpdateInterval returns the number of seconds between two updates of
+	// the MMPBlock by the node using the filesystem (sb.s_mmp_update_interval)
+	// if SbMMP is set. Returns 0 otherwise.
+	MMPUpdateInterval() uint16
+
+	// FirstMetaBG returns the first meta block group (sb.s_first_meta_bg) if
+	// SbMetaBG is set. Group descriptors of groups before this meta block group
+	// are stored contiguously after the superblock, and the remaining ones are
+	// stored in meta block group format. Returns 0 if SbMetaBG is not set.
+	FirstMetaBG() uint32
+
 	// CompatibleFeatures returns the CompatFeatures struct which holds all the
 	// compatible features this fs supports.
 	CompatibleFeatures() CompatFeatures
@@ -122,12 +261,210 @@ type SuperBlock interface {
 	// readonly compatible features this fs supports.
 	ReadOnlyCompatibleFeatures() RoCompatFeatures
 
+	// IsEncrypted returns true if this filesystem may hold encrypted inodes
+	// (SbEncrypted). See Inode.IsEncrypted.
+	IsEncrypted() bool
+
 	// Magic() returns the magic signature which must be 0xef53.
 	Magic() uint16
 
+	// CreatorOS returns the OS which created this filesystem (sb.s_creator_os).
+	CreatorOS() OSCode
+
 	// Revision returns the superblock revision. Superblock struct fields from
 	// offset 0x54 till 0x150 should only be used if superblock has DynamicRev.
 	Revision() SbRevision
+
+	// RevisionLevel returns the raw superblock revision (sb.s_rev_level). It
+	// is Revision as an integer.
+	RevisionLevel() uint32
+
+	// State returns the SbState struct which holds the filesystem state
+	// (sb.s_state).
+	State() SbState
+
+	// ErrorPolicy returns the behavior when errors are detected
+	// (sb.s_errors).
+	ErrorPolicy() SbErrorPolicy
+
+	// LastOrphan returns the inode number of the head of the orphan inode list
+	// (sb.s_last_orphan). Orphan inodes are chained through inode.i_dtime.
+	// Returns 0 if no orphans are pending.
+	LastOrphan() uint32
+
+	// KbytesWritten returns the number of KiB written to this filesystem over
+	// its lifetime (sb.s_kbytes_written).
+	//
+	// Returns 0 for superblocks that predate this field.
+	KbytesWritten() uint64
+
+	// SnapshotInode returns the inode number of the active snapshot file
+	// (sb.s_snapshot_inum), SnapshotID its sequential id (sb.s_snapshot_id)
+	// and SnapshotReservedBlocks the number of blocks reserved for it
+	// (sb.s_snapshot_r_blocks_count). Snapshots are created by the ext3
+	// snapshot patches, which Linux does not support.
+	//
+	// All three return 0 if SbHasSnapshot is not set.
+	SnapshotInode() uint32
+	SnapshotID() uint32
+	SnapshotReservedBlocks() uint64
+
+	// ErrorCount returns the number of errors detected in this filesystem
+	// (sb.s_error_count). It is not reset when the errors are fixed.
+	ErrorCount() uint32
+
+	// FirstError returns the information recorded about the first error
+	// detected in this filesystem (sb.s_first_error_*). Time is 0 if none
+	// was recorded.
+	FirstError() SbErrorInfo
+
+	// LastError returns the information recorded about the most recent error
+	// detected in this filesystem (sb.s_last_error_*). Time is 0 if none was
+	// recorded.
+	LastError() SbErrorInfo
+
+	// UUID returns the 128-bit UUID of this filesystem.
+	UUID() [16]byte
+
+	// LastMounted returns the directory where this filesystem was last
+	// mounted (sb.s_last_mounted), or "" if it was never recorded. The path
+	// ends at the first NUL byte or fills the field; bytes which are not
+	// valid UTF-8 are replaced with U+FFFD.
+	LastMounted() string
+
+	// Label returns the volume label of this filesystem (sb.s_volume_name),
+	// or "" if it has none. Like LastMounted, the label ends at the first NUL
+	// byte or fills the field and invalid UTF-8 is replaced.
+	Label() string
+
+	// DefaultMountOptions returns the DefaultMountOpts struct which holds the
+	// default mount options (sb.s_default_mount_opts). Explicit mount options
+	// take precedence over these.
+	DefaultMountOptions() DefaultMountOpts
+
+	// JournalInode returns the inode number of the journal file
+	// (sb.s_journal_inum) if SbHasJournal is set. Returns 0 if there is no
+	// journal or if SbJournalDev is set, in which case JournalDevice() should
+	// be used to locate the journal.
+	JournalInode() uint32
+
+	// ExcludeBitmapPresent returns true if SbExcludeBitmap is set, in which
+	// case every block group has a snapshot exclude bitmap taking up a block.
+	ExcludeBitmapPresent() bool
+
+	// JournalDevice returns the device number of the external journal
+	// (sb.s_journal_dev).
+	JournalDevice() uint32
+
+	// JournalBackupBlocks returns the backup of the journal inode kept in the
+	// superblock (sb.s_jnl_blocks) and whether it is valid, which it is if
+	// sb.s_jnl_backup_type is SbJnlBackupBlocks. Its first 15 words are a
+	// copy of the i_block array of the journal inode, followed by the high
+	// and low 32 bits of its size. This locates the journal if the journal
+	// inode cannot be read.
+	JournalBackupBlocks() ([17]uint32, bool)
+
+	// JournalUUID returns the UUID of the journal superblock
+	// (sb.s_journal_uuid). This can be used to match an external journal to
+	// this filesystem.
+	JournalUUID() [16]byte
+
+	// ChecksumType returns the checksum algorithm used for metadata checksums.
+	// This is only meaningful if SbMetadataCsum is set. Currently SbCrc32c is
+	// the only valid type.
+	ChecksumType() uint8
+
+	// ChecksumSeed returns the seed used for all metadata checksums. This is:
+	//     - sb.s_checksum_seed                 if SbCsumSeed feature is set.
+	//     - crc32c(~0, UUID())                 otherwise.
+	//
+	// The latter is computed on each call. The ext filesystem computes it once
+	// when reading the superblock, as every metadata checksum uses it.
+	ChecksumSeed() uint32
+}
+
+// OSCode is the type for the OS which created the filesystem.
+type OSCode uint32
+
+// Creator OS codes.
+const (
+	OSLinux   OSCode = 0
+	OSHurd    OSCode = 1
+	OSMasix   OSCode = 2
+	OSFreeBSD OSCode = 3
+	OSLites   OSCode = 4
+)
+
+// String implements fmt.Stringer.String.
+func (c OSCode) String() string {
+	switch c {
+	case OSLinux:
+		return "Linux"
+	case OSHurd:
+		return "Hurd"
+	case OSMasix:
+		return "Masix"
+	case OSFreeBSD:
+		return "FreeBSD"
+	case OSLites:
+		return "Lites"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint32(c))
+	}
+}
+
+// SbJnlBackupBlocks is the value of sb.s_jnl_backup_type when sb.s_jnl_blocks
+// holds a backup of the journal inode.
+const SbJnlBackupBlocks = 1
+
+// SbErrorPolicy is the type for the behavior of the filesystem when errors
+// are detected.
+type SbErrorPolicy uint16
+
+// Error behaviors.
+const (
+	// SbErrorsUnset indicates that no behavior was set. Linux then continues
+	// like with SbErrorsContinue unless overridden by the errors= mount option.
+	SbErrorsUnset SbErrorPolicy = 0
+
+	// SbErrorsContinue continues as if nothing happened.
+	SbErrorsContinue SbErrorPolicy = 1
+
+	// SbErrorsRemountReadOnly remounts the filesystem read-only.
+	SbErrorsRemountReadOnly SbErrorPolicy = 2
+
+	// SbErrorsPanic panics the kernel.
+	SbErrorsPanic SbErrorPolicy = 3
+)
+
+// errorPolicyNames maps the error behaviors to the names used by the errors=
+// mount option and tune2fs -e.
+var errorPolicyNames = map[SbErrorPolicy]string{
+	SbErrorsContinue:        "continue",
+	SbErrorsRemountReadOnly: "remount-ro",
+	SbErrorsPanic:           "panic",
+}
+
+// String implements fmt.Stringer.String.
+func (p SbErrorPolicy) String() string {
+	if name, ok := errorPolicyNames[p]; ok {
+		return name
+	}
+	if p == SbErrorsUnset {
+		return "unset"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint16(p))
+}
+
+// ParseErrorPolicy returns the error behavior with the given name, as used by
+// the errors= mount option. SbErrorsUnset has no name and cannot be parsed.
+func ParseErrorPolicy(name string) (SbErrorPolicy, error) {
+	for p, n := range errorPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown error behavior %q", name)
 }
 
 // SbRevision is the type for superblock revisions.
@@ -142,6 +479,253 @@ const (
 	DynamicRev SbRevision = 1
 )
 
+const (
+	// OldFirstInode is the first non-reserved inode number in OldRev
+	// filesystems. DynamicRev filesystems store it in sb.s_first_ino.
+	OldFirstInode = 11
+)
+
+// groupsCount implements SuperBlock.GroupsCount for all superblock versions.
+// It takes the interface so that the most specific BlocksCount is used.
+func groupsCount(sb SuperBlock) uint64 {
+	blocksPerGroup := uint64(sb.BlocksPerGroup())
+	firstDataBlock := uint64(sb.FirstDataBlock())
+	blocksCount := sb.BlocksCount()
+	if blocksPerGroup == 0 || blocksCount <= firstDataBlock {
+		return 0
+	}
+
+	// Round up the result. float64 can compromise precision so do it manually.
+	return (blocksCount - firstDataBlock + blocksPerGroup - 1) / blocksPerGroup
+}
+
+// clustersCount implements SuperBlock.ClustersCount for all superblock
+// versions. It takes the interface so that the most specific BlocksCount is
+// used.
+func clustersCount(sb SuperBlock) uint64 {
+	shift := clusterBits(sb)
+	return (sb.BlocksCount() + 1<<shift - 1) >> shift
+}
+
+// clusterBits returns log2 of the number of blocks per cluster. It is 0 for
+// cluster sizes not larger than the block size, which ValidateSuperBlock
+// rejects with bigalloc.
+func clusterBits(sb SuperBlock) uint {
+	blockSize, clusterSize := sb.BlockSize(), sb.ClusterSize()
+	if blockSize == 0 || clusterSize <= blockSize {
+		return 0
+	}
+	return uint(bits.Len64(clusterSize) - bits.Len64(blockSize))
+}
+
+// BlockToCluster returns the number of the cluster holding block blk. Clusters
+// are the unit of allocation tracked by block bitmaps and group free counts.
+// Unless bigalloc is enabled, clusters are blocks and blk is returned.
+//
+// Extents and block maps still map to blocks. With bigalloc, extents are laid
+// out such that block n of a file lies at offset n % (blocks per cluster) in
+// its cluster.
+func BlockToCluster(sb SuperBlock, blk uint64) uint64 {
+	return blk >> clusterBits(sb)
+}
+
+// ClusterToBlock returns the number of the first block of cluster c. It is the
+// inverse of BlockToCluster.
+func ClusterToBlock(sb SuperBlock, c uint64) uint64 {
+	return c << clusterBits(sb)
+}
+
+// featureName associates a superblock feature bit with its name.
+type featureName struct {
+	bit  uint32
+	name string
+}
+
+// featuresString renders the set bits in f as a space separated list of
+// feature names like dumpe2fs does. names must be in bit order.
+func featuresString(f uint32, names []featureName) string {
+	var set []string
+	for _, n := range names {
+		if f&n.bit != 0 {
+			set = append(set, n.name)
+		}
+	}
+	return strings.Join(set, " ")
+}
+
+// backupGroups implements SuperBlock.BackupGroups for filesystems without the
+// SbSparseV2 feature.
+func backupGroups(sb SuperBlock) []uint32 {
+	groups := sb.GroupsCount()
+	if groups <= 1 {
+		return nil
+	}
+
+	if !sb.ReadOnlyCompatibleFeatures().Sparse {
+		res := make([]uint32, 0, groups-1)
+		for g := uint64(1); g < groups; g++ {
+			res = append(res, uint32(g))
+		}
+		return res
+	}
+
+	res := []uint32{1}
+	for _, base := range []uint64{3, 5, 7} {
+		for g := base; g < groups; g *= base {
+			res = append(res, uint32(g))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// GroupHasSuperBlock returns true if block group group holds the superblock or
+// a backup copy of it (see SuperBlock.BackupGroups).
+func GroupHasSuperBlock(sb SuperBlock, group uint64) bool {
+	if group == 0 {
+		return true
+	}
+	if !sb.CompatibleFeatures().SparseV2 && !sb.ReadOnlyCompatibleFeatures().Sparse {
+		return group < sb.GroupsCount()
+	}
+	// There are only a few backups with sparse superblocks.
+	for _, g := range sb.BackupGroups() {
+		if uint64(g) == group {
+			return true
+		}
+	}
+	return false
+}
+
+// FsckRecommended returns true if a fsck is due, either because the mount
+// count reached MaxMountCount() or because more than CheckInterval() has
+// passed since LastCheck(). Like Linux, a MaxMountCount() of 0 or below (as a
+// signed 16-bit value) and a CheckInterval() of 0 disable the respective check.
+func FsckRecommended(sb SuperBlock, now ktime.Time) bool {
+	if maxMounts := int16(sb.MaxMountCount()); maxMounts > 0 && int16(sb.MountCount()) >= maxMounts {
+		return true
+	}
+	if interval := sb.CheckInterval(); interval > 0 && now.Sub(sb.LastCheck()) > interval {
+		return true
+	}
+	return false
+}
+
+// The features understood by the ext2 and ext3 drivers, which predate ext4,
+// as defined by libblkid. Filesystems using other incompatible or readonly
+// compatible features can only be mounted as ext4.
+const (
+	ext2Incompat = SbDirentFileType | SbMetaBG
+	ext3Incompat = ext2Incompat | SbRecovery
+
+	// ext3RoCompat is also understood by ext2. 0x4 is the unused
+	// EXT2_FEATURE_RO_COMPAT_BTREE_DIR.
+	ext3RoCompat = SbSparse | SbLargeFile | 0x4
+)
+
+// IsExt2 returns true if sb describes an ext2 filesystem: it has no journal
+// and only uses features understood by the ext2 driver.
+func IsExt2(sb SuperBlock) bool {
+	return !sb.CompatibleFeatures().HasJournal &&
+		sb.IncompatibleFeatures().ToInt()&^ext2Incompat == 0 &&
+		sb.ReadOnlyCompatibleFeatures().ToInt()&^ext3RoCompat == 0
+}
+
+// IsExt3 returns true if sb describes an ext3 filesystem: it has a journal but
+// only uses features understood by the ext3 driver, so no extents, 64bit or
+// flex_bg for example.
+func IsExt3(sb SuperBlock) bool {
+	return sb.CompatibleFeatures().HasJournal &&
+		sb.IncompatibleFeatures().ToInt()&^ext3Incompat == 0 &&
+		sb.ReadOnlyCompatibleFeatures().ToInt()&^ext3RoCompat == 0
+}
+
+// IsExt4 returns true if sb describes an ext4 filesystem: it uses at least one
+// feature which the ext3 driver does not understand, like extents. External
+// journal devices (SbJournalDev) are not ext4 filesystems. Like blkid's type
+// detection, at most one of IsExt2, IsExt3 and IsExt4 is true.
+func IsExt4(sb SuperBlock) bool {
+	incompat := sb.IncompatibleFeatures().ToInt()
+	if incompat&SbJournalDev != 0 {
+		return false
+	}
+	return incompat&^ext3Incompat != 0 ||
+		sb.ReadOnlyCompatibleFeatures().ToInt()&^ext3RoCompat != 0
+}
+
+// decodeTime decodes a superblock timestamp made of the 32-bit seconds since
+// the Unix epoch lo and the 8 high bits hi, which the 64-bit superblock holds
+// to extend it past 2106. This mirrors ext4_get_tstamp in fs/ext4/super.c. All
+// superblock timestamps are decoded with it.
+func decodeTime(lo uint32, hi uint8) ktime.Time {
+	return ktime.FromUnix(int64(hi)<<32|int64(lo), 0)
+}
+
+// FormatUUID formats a filesystem UUID in the canonical lowercase 8-4-4-4-12
+// form, as printed by blkid.
+func FormatUUID(uuid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// Superblock states.
+const (
+	// SbCleanlyUnmounted indicates that the filesystem was cleanly unmounted.
+	SbCleanlyUnmounted = 0x1
+
+	// SbErrorsDetected indicates that errors were detected.
+	SbErrorsDetected = 0x2
+
+	// SbOrphanRecovery indicates that orphan inodes are being recovered.
+	SbOrphanRecovery = 0x4
+)
+
+// SbState represents a superblock's filesystem state.
+type SbState struct {
+	CleanlyUnmounted bool
+	ErrorsDetected   bool
+	OrphanRecovery   bool
+}
+
+// ToInt converts the superblock state back to its 16-bit rep.
+func (s SbState) ToInt() uint16 {
+	var res uint16
+
+	if s.CleanlyUnmounted {
+		res |= SbCleanlyUnmounted
+	}
+	if s.ErrorsDetected {
+		res |= SbErrorsDetected
+	}
+	if s.OrphanRecovery {
+		res |= SbOrphanRecovery
+	}
+
+	return res
+}
+
+// SbStateFromInt converts the integer representation of superblock state to
+// SbState struct.
+func SbStateFromInt(s uint16) SbState {
+	return SbState{
+		CleanlyUnmounted: s&SbCleanlyUnmounted > 0,
+		ErrorsDetected:   s&SbErrorsDetected > 0,
+		OrphanRecovery:   s&SbOrphanRecovery > 0,
+	}
+}
+
+// Superblock flags (sb.s_flags).
+const (
+	// SbUnsignedHash indicates that htree directory hashes were computed with
+	// unsigned chars.
+	SbUnsignedHash = 0x2
+)
+
+// Superblock checksum types.
+const (
+	// SbCrc32c indicates that metadata checksums use crc32c.
+	SbCrc32c = 1
+)
+
 // Superblock compatible features.
 // This is not exhaustive, unused features are not listed.
 const (
@@ -162,6 +746,12 @@ const (
 	// SbDirIndex indicates that the fs has directory indices.
 	SbDirIndex = 0x20
 
+	// SbExcludeBitmap indicates that each block group has a snapshot exclude
+	// bitmap (see BlockGroup.ExclusionBitmap), as created by the ext3 snapshot
+	// patches. Linux does not support snapshots and ignores these bitmaps,
+	// but their blocks are in use.
+	SbExcludeBitmap = 0x100
+
 	// SbSparseV2 stands for Sparse superblock version 2.
 	SbSparseV2 = 0x200
 )
@@ -170,12 +760,13 @@ const (
 // kernel does not understand any of these feature, it can still read/write
 // to this fs.
 type CompatFeatures struct {
-	DirPrealloc bool
-	HasJournal  bool
-	ExtAttr     bool
-	ResizeInode bool
-	DirIndex    bool
-	SparseV2    bool
+	DirPrealloc   bool
+	HasJournal    bool
+	ExtAttr       bool
+	ResizeInode   bool
+	DirIndex      bool
+	ExcludeBitmap bool
+	SparseV2      bool
 }
 
 // ToInt converts superblock compatible features back to its 32-bit rep.
@@ -197,6 +788,9 @@ func (f CompatFeatures) ToInt() uint32 {
 	if f.DirIndex {
 		res |= SbDirIndex
 	}
+	if f.ExcludeBitmap {
+		res |= SbExcludeBitmap
+	}
 	if f.SparseV2 {
 		res |= SbSparseV2
 	}
@@ -208,15 +802,33 @@ func (f CompatFeatures) ToInt() uint32 {
 // compatible features to CompatFeatures struct.
 func CompatFeaturesFromInt(f uint32) CompatFeatures {
 	return CompatFeatures{
-		DirPrealloc: f&SbDirPrealloc > 0,
-		HasJournal:  f&SbHasJournal > 0,
-		ExtAttr:     f&SbExtAttr > 0,
-		ResizeInode: f&SbResizeInode > 0,
-		DirIndex:    f&SbDirIndex > 0,
-		SparseV2:    f&SbSparseV2 > 0,
+		DirPrealloc:   f&SbDirPrealloc > 0,
+		HasJournal:    f&SbHasJournal > 0,
+		ExtAttr:       f&SbExtAttr > 0,
+		ResizeInode:   f&SbResizeInode > 0,
+		DirIndex:      f&SbDirIndex > 0,
+		ExcludeBitmap: f&SbExcludeBitmap > 0,
+		SparseV2:      f&SbSparseV2 > 0,
 	}
 }
 
+// compatFeatureNames maps compatible feature bits to the names used by
+// e2fsprogs, in bit order.
+var compatFeatureNames = []featureName{
+	{SbDirPrealloc, "dir_prealloc"},
+	{SbHasJournal, "has_journal"},
+	{SbExtAttr, "ext_attr"},
+	{SbResizeInode, "resize_inode"},
+	{SbDirIndex, "dir_index"},
+	{SbExcludeBitmap, "snapshot_bitmap"},
+	{SbSparseV2, "sparse_super2"},
+}
+
+// String implements fmt.Stringer.String.
+func (f CompatFeatures) String() string {
+	return featuresString(f.ToInt(), compatFeatureNames)
+}
+
 // Superblock incompatible features.
 // This is not exhaustive, unused features are not listed.
 const (
@@ -261,6 +873,16 @@ const (
 	// See https://www.kernel.org/doc/html/latest/filesystems/ext4/overview.html#flexible-block-groups.
 	SbFlexBg = 0x200
 
+	// SbExtAttrInode indicates that large extended attribute values may be
+	// stored in dedicated inodes instead of the inode body or the xattr block.
+	SbExtAttrInode = 0x400
+
+	// SbCsumSeed indicates that the metadata checksum seed is stored in the
+	// superblock (sb.s_checksum_seed). This allows the UUID to be changed
+	// without rewriting all metadata checksums. Otherwise the seed is derived
+	// from the UUID.
+	SbCsumSeed = 0x2000
+
 	// SbLargeDir shows that large directory enabled. Directory htree can be 3
 	// levels deep. Directory htrees are allowed to be 2 levels deep otherwise.
 	SbLargeDir = 0x4000
@@ -270,8 +892,18 @@ const (
 
 	// SbEncrypted indicates that this fs contains encrypted inodes.
 	SbEncrypted = 0x10000
+
+	// sbKnownIncompat is the set of all incompatible features listed above.
+	sbKnownIncompat = SbDirentFileType | SbRecovery | SbJournalDev | SbMetaBG | SbExtents | SbIs64Bit | SbMMP | SbFlexBg | SbExtAttrInode | SbCsumSeed | SbLargeDir | SbInlineData | SbEncrypted
 )
 
+// UnknownIncompatBits returns the bits in the incompatible feature set f which
+// are not understood by this package. The filesystem must not be mounted if
+// this is non-zero.
+func UnknownIncompatBits(f uint32) uint32 {
+	return f &^ sbKnownIncompat
+}
+
 // IncompatFeatures represents a superblock's incompatible feature set. If the
 // kernel does not understand any of these feature, it should refuse to mount.
 type IncompatFeatures struct {
@@ -283,9 +915,14 @@ type IncompatFeatures struct {
 	Is64Bit        bool
 	MMP            bool
 	FlexBg         bool
+	ExtAttrInode   bool
+	CsumSeed       bool
 	LargeDir       bool
 	InlineData     bool
 	Encrypted      bool
+
+	// Unknown holds the set bits which are not understood by this package.
+	Unknown uint32
 }
 
 // ToInt converts superblock incompatible features back to its 32-bit rep.
@@ -316,6 +953,12 @@ func (f IncompatFeatures) ToInt() uint32 {
 	if f.FlexBg {
 		res |= SbFlexBg
 	}
+	if f.ExtAttrInode {
+		res |= SbExtAttrInode
+	}
+	if f.CsumSeed {
+		res |= SbCsumSeed
+	}
 	if f.LargeDir {
 		res |= SbLargeDir
 	}
@@ -325,6 +968,7 @@ func (f IncompatFeatures) ToInt() uint32 {
 	if f.Encrypted {
 		res |= SbEncrypted
 	}
+	res |= f.Unknown
 
 	return res
 }
@@ -341,12 +985,38 @@ func IncompatFeaturesFromInt(f uint32) IncompatFeatures {
 		Is64Bit:        f&SbIs64Bit > 0,
 		MMP:            f&SbMMP > 0,
 		FlexBg:         f&SbFlexBg > 0,
+		ExtAttrInode:   f&SbExtAttrInode > 0,
+		CsumSeed:       f&SbCsumSeed > 0,
 		LargeDir:       f&SbLargeDir > 0,
 		InlineData:     f&SbInlineData > 0,
 		Encrypted:      f&SbEncrypted > 0,
+		Unknown:        UnknownIncompatBits(f),
 	}
 }
 
+// incompatFeatureNames maps incompatible feature bits to the names used by
+// e2fsprogs, in bit order.
+var incompatFeatureNames = []featureName{
+	{SbDirentFileType, "filetype"},
+	{SbRecovery, "needs_recovery"},
+	{SbJournalDev, "journal_dev"},
+	{SbMetaBG, "meta_bg"},
+	{SbExtents, "extent"},
+	{SbIs64Bit, "64bit"},
+	{SbMMP, "mmp"},
+	{SbFlexBg, "flex_bg"},
+	{SbExtAttrInode, "ea_inode"},
+	{SbCsumSeed, "metadata_csum_seed"},
+	{SbLargeDir, "large_dir"},
+	{SbInlineData, "inline_data"},
+	{SbEncrypted, "encrypt"},
+}
+
+// String implements fmt.Stringer.String.
+func (f IncompatFeatures) String() string {
+	return featuresString(f.ToInt(), incompatFeatureNames)
+}
+
 // Superblock readonly compatible features.
 // This is not exhaustive, unused features are not listed.
 const (
@@ -391,8 +1061,22 @@ const (
 	// SbReadOnly marks this filesystem as readonly. Should refuse to mount in
 	// read/write mode.
 	SbReadOnly = 0x1000
+
+	// SbProject indicates that inodes record a project ID for project quotas.
+	SbProject = 0x2000
+
+	// sbKnownRoCompat is the set of all readonly compatible features listed
+	// above.
+	sbKnownRoCompat = SbSparse | SbLargeFile | SbHugeFile | SbGdtCsum | SbDirNlink | SbExtraIsize | SbHasSnapshot | SbQuota | SbBigalloc | SbMetadataCsum | SbReadOnly | SbProject
 )
 
+// UnknownRoCompatBits returns the bits in the readonly compatible feature set
+// f which are not understood by this package. The filesystem may only be
+// mounted readonly if this is non-zero.
+func UnknownRoCompatBits(f uint32) uint32 {
+	return f &^ sbKnownRoCompat
+}
+
 // RoCompatFeatures represents a superblock's readonly compatible feature set.
 // If the kernel does not understand any of these feature, it can still mount
 // readonly. But if the user wants to mount read/write, the kernel should
@@ -409,6 +1093,10 @@ type RoCompatFeatures struct {
 	Bigalloc     bool
 	MetadataCsum bool
 	ReadOnly     bool
+	Project      bool
+
+	// Unknown holds the set bits which are not understood by this package.
+	Unknown uint32
 }
 
 // ToInt converts superblock readonly compatible features to its 32-bit rep.
@@ -448,6 +1136,10 @@ func (f RoCompatFeatures) ToInt() uint32 {
 	if f.ReadOnly {
 		res |= SbReadOnly
 	}
+	if f.Project {
+		res |= SbProject
+	}
+	res |= f.Unknown
 
 	return res
 }
@@ -467,5 +1159,336 @@ func RoCompatFeaturesFromInt(f uint32) RoCompatFeatures {
 		Bigalloc:     f&SbBigalloc > 0,
 		MetadataCsum: f&SbMetadataCsum > 0,
 		ReadOnly:     f&SbReadOnly > 0,
+		Project:      f&SbProject > 0,
+		Unknown:      UnknownRoCompatBits(f),
+	}
+}
+
+// roCompatFeatureNames maps readonly compatible feature bits to the names used
+// by e2fsprogs, in bit order.
+var roCompatFeatureNames = []featureName{
+	{SbSparse, "sparse_super"},
+	{SbLargeFile, "large_file"},
+	{SbHugeFile, "huge_file"},
+	{SbGdtCsum, "uninit_bg"},
+	{SbDirNlink, "dir_nlink"},
+	{SbExtraIsize, "extra_isize"},
+	{SbHasSnapshot, "snapshot_bitmap"},
+	{SbQuota, "quota"},
+	{SbBigalloc, "bigalloc"},
+	{SbMetadataCsum, "metadata_csum"},
+	{SbReadOnly, "read-only"},
+	{SbProject, "project"},
+}
+
+// String implements fmt.Stringer.String.
+func (f RoCompatFeatures) String() string {
+	return featuresString(f.ToInt(), roCompatFeatureNames)
+}
+
+// Superblock default mount options.
+const (
+	// SbDefmDebug prints debugging info upon (re)mount.
+	SbDefmDebug = 0x1
+
+	// SbDefmBsdGroups makes new files take the gid of the containing directory
+	// rather than the fsgid of the creating process.
+	SbDefmBsdGroups = 0x2
+
+	// SbDefmXattrUser enables user extended attributes.
+	SbDefmXattrUser = 0x4
+
+	// SbDefmACL enables POSIX access control lists.
+	SbDefmACL = 0x8
+
+	// SbDefmUID16 disables 32-bit UIDs and GIDs.
+	SbDefmUID16 = 0x10
+
+	// SbDefmJmode is the mask for the 2-bit journal data mode field. See
+	// JournalDataMode.
+	SbDefmJmode = 0x60
+
+	// SbDefmNoBarrier disables write barriers.
+	SbDefmNoBarrier = 0x100
+
+	// SbDefmBlockValidity enables tracking of metadata blocks to check that
+	// file block mappings do not point into them.
+	SbDefmBlockValidity = 0x200
+
+	// SbDefmDiscard enables discard/TRIM support.
+	SbDefmDiscard = 0x400
+
+	// SbDefmNoDelalloc disables delayed allocation.
+	SbDefmNoDelalloc = 0x800
+
+	// sbDefmJmodeShift is the offset of the journal data mode field.
+	sbDefmJmodeShift = 5
+)
+
+// JournalDataMode is the journalling mode for file data.
+type JournalDataMode uint8
+
+// Journal data modes. These are the values of the SbDefmJmode field.
+const (
+	// JournalDataModeNone indicates that no journal data mode is specified. The
+	// kernel uses JournalDataModeOrdered in this case.
+	JournalDataModeNone JournalDataMode = 0
+
+	// JournalDataModeJournal journals all data before it is written to the
+	// main filesystem.
+	JournalDataModeJournal JournalDataMode = 1
+
+	// JournalDataModeOrdered writes out all data before its metadata is
+	// committed to the journal.
+	JournalDataModeOrdered JournalDataMode = 2
+
+	// JournalDataModeWriteback does not order data writes with respect to
+	// metadata commits.
+	JournalDataModeWriteback JournalDataMode = 3
+)
+
+// DefaultMountOpts represents a superblock's default mount options.
+type DefaultMountOpts struct {
+	Debug         bool
+	BsdGroups     bool
+	XattrUser     bool
+	ACL           bool
+	UID16         bool
+	JournalMode   JournalDataMode
+	NoBarrier     bool
+	BlockValidity bool
+	Discard       bool
+	NoDelalloc    bool
+}
+
+// ToInt converts the default mount options back to its 32-bit rep.
+func (o DefaultMountOpts) ToInt() uint32 {
+	var res uint32
+
+	if o.Debug {
+		res |= SbDefmDebug
+	}
+	if o.BsdGroups {
+		res |= SbDefmBsdGroups
+	}
+	if o.XattrUser {
+		res |= SbDefmXattrUser
+	}
+	if o.ACL {
+		res |= SbDefmACL
+	}
+	if o.UID16 {
+		res |= SbDefmUID16
+	}
+	res |= (uint32(o.JournalMode) << sbDefmJmodeShift) & SbDefmJmode
+	if o.NoBarrier {
+		res |= SbDefmNoBarrier
+	}
+	if o.BlockValidity {
+		res |= SbDefmBlockValidity
+	}
+	if o.Discard {
+		res |= SbDefmDiscard
+	}
+	if o.NoDelalloc {
+		res |= SbDefmNoDelalloc
+	}
+
+	return res
+}
+
+// DefaultMountOptsFromInt converts the integer representation of default
+// mount options to DefaultMountOpts struct.
+func DefaultMountOptsFromInt(o uint32) DefaultMountOpts {
+	return DefaultMountOpts{
+		Debug:         o&SbDefmDebug > 0,
+		BsdGroups:     o&SbDefmBsdGroups > 0,
+		XattrUser:     o&SbDefmXattrUser > 0,
+		ACL:           o&SbDefmACL > 0,
+		UID16:         o&SbDefmUID16 > 0,
+		JournalMode:   JournalDataMode((o & SbDefmJmode) >> sbDefmJmodeShift),
+		NoBarrier:     o&SbDefmNoBarrier > 0,
+		BlockValidity: o&SbDefmBlockValidity > 0,
+		Discard:       o&SbDefmDiscard > 0,
+		NoDelalloc:    o&SbDefmNoDelalloc > 0,
+	}
+}
+
+// Superblock validation limits.
+const (
+	// MinBlockSize is the smallest block size supported by ext.
+	MinBlockSize = 1024
+
+	// MaxBlockSize is the largest block size supported by ext.
+	MaxBlockSize = 65536
+
+	// MaxClusterSize is the largest cluster size supported by ext with the
+	// bigalloc feature.
+	MaxClusterSize = 1 << 30
+
+	// MinBgDescSize64Bit is the smallest block group descriptor size allowed
+	// when the 64-bit feature is set.
+	MinBgDescSize64Bit = 64
+
+	// MaxBgDescSize is the largest block group descriptor size allowed, which
+	// is also the smallest block size. Fields past the end of BlockGroup64Bit
+	// are ignored.
+	MaxBgDescSize = 1024
+
+	// MaxLogGroupsPerFlex is the largest sb.s_log_groups_per_flex allowed, for
+	// which the number of groups in a flex group still fits in 32 bits.
+	MaxLogGroupsPerFlex = 31
+)
+
+// SbErrorInfo describes an error that Linux recorded in the superblock when
+// it detected inconsistencies in the filesystem.
+type SbErrorInfo struct {
+	// Time is when the error was detected.
+	Time ktime.Time
+
+	// Inode is the number of the inode involved, or 0.
+	Inode uint32
+
+	// Block is the number of the block involved, or 0.
+	Block uint64
+
+	// Func and Line locate the kernel code that reported the error.
+	Func string
+	Line uint32
+
+	// Code is the EXT4_ERR_* code of the error, or 0 if unknown.
+	Code uint8
+}
+
+// SuperBlockError is returned by ValidateSuperBlock when a superblock field
+// holds an invalid or inconsistent value.
+type SuperBlockError struct {
+	// Field is the name of the on-disk superblock field that failed
+	// validation, e.g. "s_log_block_size".
+	Field string
+
+	// Reason describes why the field is invalid.
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *SuperBlockError) Error() string {
+	return fmt.Sprintf("invalid ext superblock: %s: %s", e.Field, e.Reason)
+}
+
+// Is returns true if target is ErrBadMagic and the superblock does not have
+// the ext magic number, for errors.Is.
+func (e *SuperBlockError) Is(target error) bool {
+	return target == ErrBadMagic && e.Field == "s_magic"
+}
+
+// isPowerOfTwo returns true if n is a non-zero power of two.
+func isPowerOfTwo(n uint64) bool {
+	return n != 0 && n&(n-1) == 0
+}
+
+// ValidateSuperBlock performs consistency checks on the superblock which must
+// hold before any other metadata is read using it. Returns a *SuperBlockError
+// identifying the first field which failed validation, or nil.
+func ValidateSuperBlock(sb SuperBlock) error {
+	if sb.Magic() != linux.EXT_SUPER_MAGIC {
+		return &SuperBlockError{Field: "s_magic", Reason: fmt.Sprintf("got %#x, want %#x", sb.Magic(), linux.EXT_SUPER_MAGIC)}
+	}
+
+	blockSize := sb.BlockSize()
+	if !isPowerOfTwo(blockSize) || blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		return &SuperBlockError{Field: "s_log_block_size", Reason: fmt.Sprintf("block size %d is not a power of two in [%d, %d]", blockSize, MinBlockSize, MaxBlockSize)}
+	}
+
+	// With bigalloc, the first data block is always 0 because allocation
+	// happens in clusters.
+	var wantFirstDataBlock uint32
+	if blockSize == MinBlockSize && !sb.ReadOnlyCompatibleFeatures().Bigalloc {
+		wantFirstDataBlock = 1
+	}
+	if sb.FirstDataBlock() != wantFirstDataBlock {
+		return &SuperBlockError{Field: "s_first_data_block", Reason: fmt.Sprintf("got %d, want %d for block size %d", sb.FirstDataBlock(), wantFirstDataBlock, blockSize)}
+	}
+
+	// The inode bitmap of a block group must fit in one block.
+	if sb.InodesPerGroup() == 0 || uint64(sb.InodesPerGroup()) > blockSize*8 {
+		return &SuperBlockError{Field: "s_inodes_per_group", Reason: fmt.Sprintf("%d not in [1, %d]", sb.InodesPerGroup(), blockSize*8)}
+	}
+
+	// Clusters are blocks unless bigalloc is enabled.
+	clusterSize := sb.ClusterSize()
+	if sb.ReadOnlyCompatibleFeatures().Bigalloc {
+		if !isPowerOfTwo(clusterSize) || clusterSize < blockSize || clusterSize > MaxClusterSize {
+			return &SuperBlockError{Field: "s_log_cluster_size", Reason: fmt.Sprintf("cluster size %d is not a power of two in [%d, %d]", clusterSize, blockSize, uint64(MaxClusterSize))}
+		}
+	} else if clusterSize != blockSize {
+		return &SuperBlockError{Field: "s_log_cluster_size", Reason: fmt.Sprintf("cluster size %d differs from block size %d without bigalloc", clusterSize, blockSize)}
+	}
+
+	// The block bitmap of a block group, which tracks clusters, must fit in one
+	// block.
+	if sb.ClustersPerGroup() == 0 || uint64(sb.ClustersPerGroup()) > blockSize*8 {
+		return &SuperBlockError{Field: "s_clusters_per_group", Reason: fmt.Sprintf("%d not in [1, %d]", sb.ClustersPerGroup(), blockSize*8)}
+	}
+	if want := uint64(sb.ClustersPerGroup()) << clusterBits(sb); uint64(sb.BlocksPerGroup()) != want {
+		return &SuperBlockError{Field: "s_blocks_per_group", Reason: fmt.Sprintf("got %d, want %d for %d clusters of %d bytes", sb.BlocksPerGroup(), want, sb.ClustersPerGroup(), clusterSize)}
+	}
+
+	// The block and inode counts must agree on the number of block groups.
+	inodesPerGroup := uint64(sb.InodesPerGroup())
+	if groups := sb.GroupsCount(); groups != (uint64(sb.InodesCount())+inodesPerGroup-1)/inodesPerGroup {
+		return &SuperBlockError{Field: "s_inodes_count", Reason: fmt.Sprintf("%d inodes do not fill %d groups of %d inodes", sb.InodesCount(), groups, inodesPerGroup)}
+	}
+
+	inodeSize := uint64(sb.InodeSize())
+	if !isPowerOfTwo(inodeSize) || inodeSize < OldInodeSize || inodeSize > blockSize {
+		return &SuperBlockError{Field: "s_inode_size", Reason: fmt.Sprintf("inode size %d is not a power of two in [%d, %d]", inodeSize, OldInodeSize, blockSize)}
+	}
+
+	if sb.IncompatibleFeatures().Is64Bit && sb.BgDescSize() < MinBgDescSize64Bit {
+		return &SuperBlockError{Field: "s_desc_size", Reason: fmt.Sprintf("got %d, want at least %d with 64-bit feature", sb.BgDescSize(), MinBgDescSize64Bit)}
+	}
+	// Like Linux, descriptors must evenly fill the descriptor blocks.
+	if descSize := uint64(sb.BgDescSize()); !isPowerOfTwo(descSize) || descSize > MaxBgDescSize {
+		return &SuperBlockError{Field: "s_desc_size", Reason: fmt.Sprintf("descriptor size %d is not a power of two of at most %d", descSize, MaxBgDescSize)}
+	}
+
+	// Like ext4_fill_flex_info, FlexGroupSize must not overflow.
+	if sb.LogGroupsPerFlex() > MaxLogGroupsPerFlex {
+		return &SuperBlockError{Field: "s_log_groups_per_flex", Reason: fmt.Sprintf("got %d, want at most %d", sb.LogGroupsPerFlex(), MaxLogGroupsPerFlex)}
+	}
+
+	return nil
+}
+
+// MarshalSuperBlock returns the SbSize byte on-disk representation of sb, a
+// superblock parsed from raw and possibly modified since. It is the inverse
+// of parsing: the bytes of raw which are past the concrete superblock struct
+// or reserved in it are preserved, and s_checksum is recomputed if the
+// superblock has metadata checksums. raw is not modified.
+func MarshalSuperBlock(sb SuperBlock, raw []byte) ([]byte, error) {
+	if len(raw) != SbSize {
+		return nil, fmt.Errorf("raw superblock is %d bytes, want %d", len(raw), SbSize)
+	}
+	out := append([]byte(nil), raw...)
+	fields := binary.Marshal(nil, binary.LittleEndian, sb)
+
+	// Reserved fields are skipped when unmarshalling but written as zeroes
+	// when marshalling, so find them by round-tripping all ones.
+	ones := make([]byte, len(fields))
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	mask := reflect.New(reflect.TypeOf(sb).Elem()).Interface()
+	binary.Unmarshal(ones, binary.LittleEndian, mask)
+	for i, m := range binary.Marshal(nil, binary.LittleEndian, mask) {
+		if m != 0 {
+			out[i] = fields[i]
+		}
+	}
+
+	if err := UpdateChecksum(out); err != nil && err != ErrNoMetadataCsum {
+		return nil, err
 	}
+	return out, nil
 }
@@ -14,39 +14,50 @@
 
 package disklayout
 
+import (
+	"fmt"
+	"strings"
+
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
 // SuperBlock32Bit implements SuperBlock and represents the 32-bit version of
-// the ext4_super_block struct in fs/ext4/ext4.h. Should be used only if
-// RevLevel = DynamicRev and 64-bit feature is disabled.
+// the ext4_super_block struct in fs/ext4/ext4.h, without the fields which
+// were added after it. DynamicRev superblocks are read as a SuperBlock64Bit
+// since those fields are used with or without the 64-bit feature.
+//
+// AlgoUsageBitmap (s_algorithm_usage_bitmap) was meant for compression, which
+// ext4 does not support, so it is reserved and has no accessor.
 type SuperBlock32Bit struct {
 	// We embed the old superblock struct here because the 32-bit version is just
 	// an extension of the old version.
 	SuperBlockOld
 
-	FirstInode         uint32
-	InodeSizeRaw       uint16
-	BlockGroupNumber   uint16
-	FeatureCompat      uint32
-	FeatureIncompat    uint32
-	FeatureRoCompat    uint32
-	UUID               [16]byte
-	VolumeName         [16]byte
-	LastMounted        [64]byte
-	AlgoUsageBitmap    uint32
-	PreallocBlocks     uint8
-	PreallocDirBlocks  uint8
-	ReservedGdtBlocks  uint16
-	JournalUUID        [16]byte
-	JournalInum        uint32
-	JournalDev         uint32
-	LastOrphan         uint32
-	HashSeed           [4]uint32
-	DefaultHashVersion uint8
-	JnlBackupType      uint8
-	BgDescSizeRaw      uint16
-	DefaultMountOpts   uint32
-	FirstMetaBg        uint32
-	MkfsTime           uint32
-	JnlBlocks          [17]uint32
+	FirstInodeRaw         uint32
+	InodeSizeRaw          uint16
+	BlockGroupNumber      uint16
+	FeatureCompat         uint32
+	FeatureIncompat       uint32
+	FeatureRoCompat       uint32
+	UUIDRaw               [16]byte
+	VolumeName            [16]byte
+	LastMountedRaw        [64]byte
+	AlgoUsageBitmap       uint32
+	PreallocBlocksRaw     uint8
+	PreallocDirBlocksRaw  uint8
+	ReservedGdtBlocksRaw  uint16
+	JournalUUIDRaw        [16]byte
+	JournalInum           uint32
+	JournalDev            uint32
+	LastOrphanRaw         uint32
+	HashSeedRaw           [4]uint32
+	DefaultHashVersionRaw uint8
+	JnlBackupType         uint8
+	BgDescSizeRaw         uint16
+	DefaultMountOpts      uint32
+	FirstMetaBg           uint32
+	MkfsTime              uint32
+	JnlBlocks             [17]uint32
 }
 
 // Compiles only if SuperBlock32Bit implements SuperBlock.
@@ -54,23 +65,218 @@ var _ SuperBlock = (*SuperBlock32Bit)(nil)
 
 // Only override methods which change based on the additional fields above.
 // Not overriding SuperBlock.BgDescSize because it would still return 32 here.
+// The additional fields are not present in OldRev superblocks, in which case
+// the SuperBlockOld defaults are returned.
+
+// FirstInode implements SuperBlock.FirstInode.
+func (sb *SuperBlock32Bit) FirstInode() uint32 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.FirstInode()
+	}
+	return sb.FirstInodeRaw
+}
 
 // InodeSize implements SuperBlock.InodeSize.
 func (sb *SuperBlock32Bit) InodeSize() uint16 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.InodeSize()
+	}
 	return sb.InodeSizeRaw
 }
 
 // CompatibleFeatures implements SuperBlock.CompatibleFeatures.
 func (sb *SuperBlock32Bit) CompatibleFeatures() CompatFeatures {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.CompatibleFeatures()
+	}
 	return CompatFeaturesFromInt(sb.FeatureCompat)
 }
 
 // IncompatibleFeatures implements SuperBlock.IncompatibleFeatures.
 func (sb *SuperBlock32Bit) IncompatibleFeatures() IncompatFeatures {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.IncompatibleFeatures()
+	}
 	return IncompatFeaturesFromInt(sb.FeatureIncompat)
 }
 
+// IsEncrypted implements SuperBlock.IsEncrypted.
+func (sb *SuperBlock32Bit) IsEncrypted() bool { return sb.IncompatibleFeatures().Encrypted }
+
 // ReadOnlyCompatibleFeatures implements SuperBlock.ReadOnlyCompatibleFeatures.
 func (sb *SuperBlock32Bit) ReadOnlyCompatibleFeatures() RoCompatFeatures {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.ReadOnlyCompatibleFeatures()
+	}
 	return RoCompatFeaturesFromInt(sb.FeatureRoCompat)
 }
+
+// HashSeed implements SuperBlock.HashSeed.
+func (sb *SuperBlock32Bit) HashSeed() [4]uint32 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.HashSeed()
+	}
+	return sb.HashSeedRaw
+}
+
+// DefaultHashVersion implements SuperBlock.DefaultHashVersion.
+func (sb *SuperBlock32Bit) DefaultHashVersion() uint8 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.DefaultHashVersion()
+	}
+	return sb.DefaultHashVersionRaw
+}
+
+// PreallocBlocks implements SuperBlock.PreallocBlocks.
+func (sb *SuperBlock32Bit) PreallocBlocks() uint8 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.PreallocBlocks()
+	}
+	return sb.PreallocBlocksRaw
+}
+
+// PreallocDirBlocks implements SuperBlock.PreallocDirBlocks.
+func (sb *SuperBlock32Bit) PreallocDirBlocks() uint8 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.PreallocDirBlocks()
+	}
+	return sb.PreallocDirBlocksRaw
+}
+
+// ReservedGdtBlocks implements SuperBlock.ReservedGdtBlocks.
+func (sb *SuperBlock32Bit) ReservedGdtBlocks() uint16 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.ReservedGdtBlocks()
+	}
+	return sb.ReservedGdtBlocksRaw
+}
+
+// FirstMetaBG implements SuperBlock.FirstMetaBG.
+func (sb *SuperBlock32Bit) FirstMetaBG() uint32 {
+	if !sb.IncompatibleFeatures().MetaBG {
+		return 0
+	}
+	return sb.FirstMetaBg
+}
+
+// BackupGroups implements SuperBlock.BackupGroups.
+func (sb *SuperBlock32Bit) BackupGroups() []uint32 {
+	if sb.CompatibleFeatures().SparseV2 {
+		// sb.s_backup_bgs is not part of this struct.
+		return nil
+	}
+	return backupGroups(sb)
+}
+
+// LastOrphan implements SuperBlock.LastOrphan.
+func (sb *SuperBlock32Bit) LastOrphan() uint32 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.LastOrphan()
+	}
+	return sb.LastOrphanRaw
+}
+
+// UUID implements SuperBlock.UUID.
+func (sb *SuperBlock32Bit) UUID() [16]byte {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.UUID()
+	}
+	return sb.UUIDRaw
+}
+
+// LastMounted implements SuperBlock.LastMounted.
+func (sb *SuperBlock32Bit) LastMounted() string {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.LastMounted()
+	}
+	return strings.ToValidUTF8(cString(sb.LastMountedRaw[:]), "\uFFFD")
+}
+
+// Label implements SuperBlock.Label.
+func (sb *SuperBlock32Bit) Label() string {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.Label()
+	}
+	return strings.ToValidUTF8(cString(sb.VolumeName[:]), "\uFFFD")
+}
+
+// SetLabel sets the volume label to label, NUL-padding the field. A label
+// filling the 16 byte field is stored without a NUL terminator, as Linux and
+// e2label do. Returns an error if label is longer than the field or holds a
+// NUL byte, or if the superblock is OldRev, which has no volume label.
+// MarshalSuperBlock writes the change back.
+func (sb *SuperBlock32Bit) SetLabel(label string) error {
+	if sb.Revision() == OldRev {
+		return fmt.Errorf("OldRev superblocks have no volume label")
+	}
+	if len(label) > len(sb.VolumeName) {
+		return fmt.Errorf("label %q is %d bytes, want at most %d", label, len(label), len(sb.VolumeName))
+	}
+	if strings.IndexByte(label, 0) >= 0 {
+		return fmt.Errorf("label %q holds a NUL byte", label)
+	}
+	sb.VolumeName = [16]byte{}
+	copy(sb.VolumeName[:], label)
+	return nil
+}
+
+// DefaultMountOptions implements SuperBlock.DefaultMountOptions.
+func (sb *SuperBlock32Bit) DefaultMountOptions() DefaultMountOpts {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.DefaultMountOptions()
+	}
+	return DefaultMountOptsFromInt(sb.DefaultMountOpts)
+}
+
+// JournalInode implements SuperBlock.JournalInode.
+func (sb *SuperBlock32Bit) JournalInode() uint32 {
+	if !sb.CompatibleFeatures().HasJournal || sb.IncompatibleFeatures().JournalDev {
+		return 0
+	}
+	return sb.JournalInum
+}
+
+// ExcludeBitmapPresent implements SuperBlock.ExcludeBitmapPresent.
+func (sb *SuperBlock32Bit) ExcludeBitmapPresent() bool {
+	return sb.CompatibleFeatures().ExcludeBitmap
+}
+
+// JournalDevice implements SuperBlock.JournalDevice.
+func (sb *SuperBlock32Bit) JournalDevice() uint32 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.JournalDevice()
+	}
+	return sb.JournalDev
+}
+
+// JournalBackupBlocks implements SuperBlock.JournalBackupBlocks.
+func (sb *SuperBlock32Bit) JournalBackupBlocks() ([17]uint32, bool) {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.JournalBackupBlocks()
+	}
+	return sb.JnlBlocks, sb.JnlBackupType == SbJnlBackupBlocks
+}
+
+// JournalUUID implements SuperBlock.JournalUUID.
+func (sb *SuperBlock32Bit) JournalUUID() [16]byte {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.JournalUUID()
+	}
+	return sb.JournalUUIDRaw
+}
+
+// CreationTime implements SuperBlock.CreationTime.
+func (sb *SuperBlock32Bit) CreationTime() ktime.Time {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.CreationTime()
+	}
+	return decodeTime(sb.MkfsTime, 0)
+}
+
+// ChecksumSeed implements SuperBlock.ChecksumSeed.
+func (sb *SuperBlock32Bit) ChecksumSeed() uint32 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlockOld.ChecksumSeed()
+	}
+	return Crc32c(^uint32(0), sb.UUIDRaw[:])
+}
@@ -14,11 +14,18 @@
 
 package disklayout
 
+import (
+	"sort"
+
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
 // SuperBlock64Bit implements SuperBlock and represents the 64-bit version of
 // the ext4_super_block struct in fs/ext4/ext4.h. This sums up to be exactly
 // 1024 bytes (smallest possible block size) and hence the superblock always
-// fits in no more than one data block. Should only be used when the 64-bit
-// feature is set.
+// fits in no more than one data block. Used for all DynamicRev superblocks:
+// only the high halves of the block counts depend on the 64-bit feature, the
+// other fields beyond the 32-bit struct are used without it too.
 type SuperBlock64Bit struct {
 	// We embed the 32-bit struct here because 64-bit version is just an extension
 	// of the 32-bit version.
@@ -31,18 +38,18 @@ type SuperBlock64Bit struct {
 	WantInodeSize           uint16
 	Flags                   uint32
 	RaidStride              uint16
-	MmpInterval             uint16
-	MmpBlock                uint64
+	MMPIntervalRaw          uint16
+	MMPBlockRaw             uint64
 	RaidStripeWidth         uint32
-	LogGroupsPerFlex        uint8
-	ChecksumType            uint8
+	LogGroupsPerFlexRaw     uint8
+	ChecksumTypeRaw         uint8
 	_                       uint16
-	KbytesWritten           uint64
+	KbytesWrittenRaw        uint64
 	SnapshotInum            uint32
-	SnapshotID              uint32
+	SnapshotIDRaw           uint32
 	SnapshotRsrvBlocksCount uint64
 	SnapshotList            uint32
-	ErrorCount              uint32
+	ErrorCountRaw           uint32
 	FirstErrorTime          uint32
 	FirstErrorInode         uint32
 	FirstErrorBlock         uint64
@@ -56,20 +63,21 @@ type SuperBlock64Bit struct {
 	MountOpts               [64]byte
 	UserQuotaInum           uint32
 	GroupQuotaInum          uint32
-	OverheadBlocks          uint32
+	OverheadClustersRaw     uint32
 	BackupBgs               [2]uint32
 	EncryptAlgos            [4]uint8
 	EncryptPwSalt           [16]uint8
 	LostFoundInode          uint32
 	ProjectQuotaInode       uint32
-	ChecksumSeed            uint32
+	ChecksumSeedRaw         uint32
 	WtimeHi                 uint8
 	MtimeHi                 uint8
 	MkfsTimeHi              uint8
 	LastCheckHi             uint8
 	FirstErrorTimeHi        uint8
 	LastErrorTimeHi         uint8
-	_                       [2]uint8
+	FirstErrorCode          uint8
+	LastErrorCode           uint8
 	Encoding                uint16
 	EncodingFlags           uint16
 	_                       [95]uint32
@@ -79,17 +87,191 @@ type SuperBlock64Bit struct {
 // Compiles only if SuperBlock64Bit implements SuperBlock.
 var _ SuperBlock = (*SuperBlock64Bit)(nil)
 
-// Only override methods which change based on the 64-bit feature.
+// Only override methods which change based on the 64-bit feature. The high
+// halves are only meaningful when the 64-bit feature is set; mke2fs does not
+// always zero them otherwise.
 
 // BlocksCount implements SuperBlock.BlocksCount.
 func (sb *SuperBlock64Bit) BlocksCount() uint64 {
+	if !sb.IncompatibleFeatures().Is64Bit {
+		return sb.SuperBlock32Bit.BlocksCount()
+	}
 	return (uint64(sb.BlocksCountHi) << 32) | uint64(sb.BlocksCountLo)
 }
 
 // FreeBlocksCount implements SuperBlock.FreeBlocksCount.
 func (sb *SuperBlock64Bit) FreeBlocksCount() uint64 {
+	if !sb.IncompatibleFeatures().Is64Bit {
+		return sb.SuperBlock32Bit.FreeBlocksCount()
+	}
 	return (uint64(sb.FreeBlocksCountHi) << 32) | uint64(sb.FreeBlocksCountLo)
 }
 
+// ReservedBlocksCount implements SuperBlock.ReservedBlocksCount.
+func (sb *SuperBlock64Bit) ReservedBlocksCount() uint64 {
+	if !sb.IncompatibleFeatures().Is64Bit {
+		return sb.SuperBlock32Bit.ReservedBlocksCount()
+	}
+	return (uint64(sb.ReservedBlocksCountHi) << 32) | uint64(sb.ReservedBlocksCountLo)
+}
+
+// GroupsCount implements SuperBlock.GroupsCount.
+func (sb *SuperBlock64Bit) GroupsCount() uint64 { return groupsCount(sb) }
+
+// ClustersCount implements SuperBlock.ClustersCount.
+func (sb *SuperBlock64Bit) ClustersCount() uint64 { return clustersCount(sb) }
+
+// BackupGroups implements SuperBlock.BackupGroups.
+func (sb *SuperBlock64Bit) BackupGroups() []uint32 {
+	if !sb.CompatibleFeatures().SparseV2 {
+		return backupGroups(sb)
+	}
+
+	var res []uint32
+	for _, g := range sb.BackupBgs {
+		if g != 0 {
+			res = append(res, g)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
 // BgDescSize implements SuperBlock.BgDescSize.
-func (sb *SuperBlock64Bit) BgDescSize() uint16 { return sb.BgDescSizeRaw }
+func (sb *SuperBlock64Bit) BgDescSize() uint16 {
+	if !sb.IncompatibleFeatures().Is64Bit {
+		return sb.SuperBlock32Bit.BgDescSize()
+	}
+	return sb.BgDescSizeRaw
+}
+
+// MinExtraIsize implements SuperBlock.MinExtraIsize.
+func (sb *SuperBlock64Bit) MinExtraIsize() uint16 { return sb.MinInodeSize }
+
+// WantExtraIsize implements SuperBlock.WantExtraIsize.
+func (sb *SuperBlock64Bit) WantExtraIsize() uint16 { return sb.WantInodeSize }
+
+// OverheadClusters implements SuperBlock.OverheadClusters.
+func (sb *SuperBlock64Bit) OverheadClusters() uint32 { return sb.OverheadClustersRaw }
+
+// MMPBlock implements SuperBlock.MMPBlock.
+func (sb *SuperBlock64Bit) MMPBlock() uint64 {
+	if !sb.IncompatibleFeatures().MMP {
+		return 0
+	}
+	return sb.MMPBlockRaw
+}
+
+// MMPUpdateInterval implements SuperBlock.MMPUpdateInterval.
+func (sb *SuperBlock64Bit) MMPUpdateInterval() uint16 {
+	if !sb.IncompatibleFeatures().MMP {
+		return 0
+	}
+	return sb.MMPIntervalRaw
+}
+
+// LogGroupsPerFlex implements SuperBlock.LogGroupsPerFlex.
+func (sb *SuperBlock64Bit) LogGroupsPerFlex() uint8 {
+	if !sb.IncompatibleFeatures().FlexBg {
+		return 0
+	}
+	return sb.LogGroupsPerFlexRaw
+}
+
+// FlexGroupSize implements SuperBlock.FlexGroupSize.
+func (sb *SuperBlock64Bit) FlexGroupSize() uint32 { return 1 << sb.LogGroupsPerFlex() }
+
+// MountTime implements SuperBlock.MountTime.
+func (sb *SuperBlock64Bit) MountTime() ktime.Time { return decodeTime(sb.Mtime, sb.MtimeHi) }
+
+// WriteTime implements SuperBlock.WriteTime.
+func (sb *SuperBlock64Bit) WriteTime() ktime.Time { return decodeTime(sb.Wtime, sb.WtimeHi) }
+
+// CreationTime implements SuperBlock.CreationTime.
+func (sb *SuperBlock64Bit) CreationTime() ktime.Time {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlock32Bit.CreationTime()
+	}
+	return decodeTime(sb.MkfsTime, sb.MkfsTimeHi)
+}
+
+// LastCheck implements SuperBlock.LastCheck.
+func (sb *SuperBlock64Bit) LastCheck() ktime.Time { return decodeTime(sb.LastCheckRaw, sb.LastCheckHi) }
+
+// KbytesWritten implements SuperBlock.KbytesWritten.
+func (sb *SuperBlock64Bit) KbytesWritten() uint64 {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlock32Bit.KbytesWritten()
+	}
+	return sb.KbytesWrittenRaw
+}
+
+// SnapshotInode implements SuperBlock.SnapshotInode.
+func (sb *SuperBlock64Bit) SnapshotInode() uint32 {
+	if !sb.ReadOnlyCompatibleFeatures().HasSnapshot {
+		return 0
+	}
+	return sb.SnapshotInum
+}
+
+// SnapshotID implements SuperBlock.SnapshotID.
+func (sb *SuperBlock64Bit) SnapshotID() uint32 {
+	if !sb.ReadOnlyCompatibleFeatures().HasSnapshot {
+		return 0
+	}
+	return sb.SnapshotIDRaw
+}
+
+// SnapshotReservedBlocks implements SuperBlock.SnapshotReservedBlocks.
+func (sb *SuperBlock64Bit) SnapshotReservedBlocks() uint64 {
+	if !sb.ReadOnlyCompatibleFeatures().HasSnapshot {
+		return 0
+	}
+	return sb.SnapshotRsrvBlocksCount
+}
+
+// ErrorCount implements SuperBlock.ErrorCount.
+func (sb *SuperBlock64Bit) ErrorCount() uint32 { return sb.ErrorCountRaw }
+
+// FirstError implements SuperBlock.FirstError.
+func (sb *SuperBlock64Bit) FirstError() SbErrorInfo {
+	return SbErrorInfo{
+		Time:  decodeTime(sb.FirstErrorTime, sb.FirstErrorTimeHi),
+		Inode: sb.FirstErrorInode,
+		Block: sb.FirstErrorBlock,
+		Func:  cString(sb.FirstErrorFunction[:]),
+		Line:  sb.FirstErrorLine,
+		Code:  sb.FirstErrorCode,
+	}
+}
+
+// LastError implements SuperBlock.LastError.
+func (sb *SuperBlock64Bit) LastError() SbErrorInfo {
+	return SbErrorInfo{
+		Time:  decodeTime(sb.LastErrorTime, sb.LastErrorTimeHi),
+		Inode: sb.LastErrorInode,
+		Block: sb.LastErrorBlock,
+		Func:  cString(sb.LastErrorFunction[:]),
+		Line:  sb.LastErrorLine,
+		Code:  sb.LastErrorCode,
+	}
+}
+
+// UnsignedDirHash implements SuperBlock.UnsignedDirHash.
+func (sb *SuperBlock64Bit) UnsignedDirHash() bool {
+	if sb.Revision() == OldRev {
+		return sb.SuperBlock32Bit.UnsignedDirHash()
+	}
+	return sb.Flags&SbUnsignedHash != 0
+}
+
+// ChecksumType implements SuperBlock.ChecksumType.
+func (sb *SuperBlock64Bit) ChecksumType() uint8 { return sb.ChecksumTypeRaw }
+
+// ChecksumSeed implements SuperBlock.ChecksumSeed.
+func (sb *SuperBlock64Bit) ChecksumSeed() uint32 {
+	if sb.IncompatibleFeatures().CsumSeed {
+		return sb.ChecksumSeedRaw
+	}
+	return sb.SuperBlock32Bit.ChecksumSeed()
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
+// SuperBlockInfo is a snapshot of the information exposed by SuperBlock as
+// plain data. Each field holds the value returned by the SuperBlock method of
+// the same name, except that UUIDs are formatted with FormatUUID, error
+// information is held as ErrorInfo, timestamps are formatted as RFC 3339 in
+// UTC and the backup of the journal inode is nil unless it is valid. It can be
+// marshalled as is, e.g. to JSON for debugging dumps.
+type SuperBlockInfo struct {
+	InodesCount                uint32
+	BlocksCount                uint64
+	FreeBlocksCount            uint64
+	ReservedBlocksCount        uint64
+	DefaultReservedUID         auth.KUID
+	DefaultReservedGID         auth.KGID
+	FreeInodesCount            uint32
+	MountCount                 uint16
+	MaxMountCount              uint16
+	MountTime                  string
+	WriteTime                  string
+	CreationTime               string
+	LastCheck                  string
+	CheckInterval              time.Duration
+	FirstDataBlock             uint32
+	BlockSize                  uint64
+	BlocksPerGroup             uint32
+	ClusterSize                uint64
+	ClustersPerGroup           uint32
+	ClustersCount              uint64
+	OverheadClusters           uint32
+	FirstInode                 uint32
+	InodeSize                  uint16
+	MinExtraIsize              uint16
+	WantExtraIsize             uint16
+	InodesPerGroup             uint32
+	GroupsCount                uint64
+	BackupGroups               []uint32
+	BgDescSize                 uint16
+	PreallocBlocks             uint8
+	PreallocDirBlocks          uint8
+	ReservedGdtBlocks          uint16
+	HashSeed                   [4]uint32
+	DefaultHashVersion         uint8
+	UnsignedDirHash            bool
+	LogGroupsPerFlex           uint8
+	FlexGroupSize              uint32
+	MMPBlock                   uint64
+	MMPUpdateInterval          uint16
+	FirstMetaBG                uint32
+	CompatibleFeatures         CompatFeatures
+	IncompatibleFeatures       IncompatFeatures
+	ReadOnlyCompatibleFeatures RoCompatFeatures
+	IsEncrypted                bool
+	Magic                      uint16
+	CreatorOS                  OSCode
+	Revision                   SbRevision
+	RevisionLevel              uint32
+	State                      SbState
+	ErrorPolicy                SbErrorPolicy
+	LastOrphan                 uint32
+	KbytesWritten              uint64
+	SnapshotInode              uint32
+	SnapshotID                 uint32
+	SnapshotReservedBlocks     uint64
+	ErrorCount                 uint32
+	FirstError                 ErrorInfo
+	LastError                  ErrorInfo
+	UUID                       string
+	LastMounted                string
+	Label                      string
+	DefaultMountOptions        DefaultMountOpts
+	JournalInode               uint32
+	ExcludeBitmapPresent       bool
+	JournalDevice              uint32
+	JournalBackupBlocks        []uint32
+	JournalUUID                string
+	ChecksumType               uint8
+	ChecksumSeed               uint32
+}
+
+// ToInfo returns a snapshot of the information exposed by sb.
+func ToInfo(sb SuperBlock) SuperBlockInfo {
+	return SuperBlockInfo{
+		InodesCount:                sb.InodesCount(),
+		BlocksCount:                sb.BlocksCount(),
+		FreeBlocksCount:            sb.FreeBlocksCount(),
+		ReservedBlocksCount:        sb.ReservedBlocksCount(),
+		DefaultReservedUID:         sb.DefaultReservedUID(),
+		DefaultReservedGID:         sb.DefaultReservedGID(),
+		FreeInodesCount:            sb.FreeInodesCount(),
+		MountCount:                 sb.MountCount(),
+		MaxMountCount:              sb.MaxMountCount(),
+		MountTime:                  formatTime(sb.MountTime()),
+		WriteTime:                  formatTime(sb.WriteTime()),
+		CreationTime:               formatTime(sb.CreationTime()),
+		LastCheck:                  formatTime(sb.LastCheck()),
+		CheckInterval:              sb.CheckInterval(),
+		FirstDataBlock:             sb.FirstDataBlock(),
+		BlockSize:                  sb.BlockSize(),
+		BlocksPerGroup:             sb.BlocksPerGroup(),
+		ClusterSize:                sb.ClusterSize(),
+		ClustersPerGroup:           sb.ClustersPerGroup(),
+		ClustersCount:              sb.ClustersCount(),
+		OverheadClusters:           sb.OverheadClusters(),
+		FirstInode:                 sb.FirstInode(),
+		InodeSize:                  sb.InodeSize(),
+		MinExtraIsize:              sb.MinExtraIsize(),
+		WantExtraIsize:             sb.WantExtraIsize(),
+		InodesPerGroup:             sb.InodesPerGroup(),
+		GroupsCount:                sb.GroupsCount(),
+		BackupGroups:               sb.BackupGroups(),
+		BgDescSize:                 sb.BgDescSize(),
+		PreallocBlocks:             sb.PreallocBlocks(),
+		PreallocDirBlocks:          sb.PreallocDirBlocks(),
+		ReservedGdtBlocks:          sb.ReservedGdtBlocks(),
+		HashSeed:                   sb.HashSeed(),
+		DefaultHashVersion:         sb.DefaultHashVersion(),
+		UnsignedDirHash:            sb.UnsignedDirHash(),
+		LogGroupsPerFlex:           sb.LogGroupsPerFlex(),
+		FlexGroupSize:              sb.FlexGroupSize(),
+		MMPBlock:                   sb.MMPBlock(),
+		MMPUpdateInterval:          sb.MMPUpdateInterval(),
+		FirstMetaBG:                sb.FirstMetaBG(),
+		CompatibleFeatures:         sb.CompatibleFeatures(),
+		IncompatibleFeatures:       sb.IncompatibleFeatures(),
+		ReadOnlyCompatibleFeatures: sb.ReadOnlyCompatibleFeatures(),
+		IsEncrypted:                sb.IsEncrypted(),
+		Magic:                      sb.Magic(),
+		CreatorOS:                  sb.CreatorOS(),
+		Revision:                   sb.Revision(),
+		RevisionLevel:              sb.RevisionLevel(),
+		State:                      sb.State(),
+		ErrorPolicy:                sb.ErrorPolicy(),
+		LastOrphan:                 sb.LastOrphan(),
+		KbytesWritten:              sb.KbytesWritten(),
+		SnapshotInode:              sb.SnapshotInode(),
+		SnapshotID:                 sb.SnapshotID(),
+		SnapshotReservedBlocks:     sb.SnapshotReservedBlocks(),
+		ErrorCount:                 sb.ErrorCount(),
+		FirstError:                 toErrorInfo(sb.FirstError()),
+		LastError:                  toErrorInfo(sb.LastError()),
+		UUID:                       FormatUUID(sb.UUID()),
+		LastMounted:                sb.LastMounted(),
+		Label:                      sb.Label(),
+		DefaultMountOptions:        sb.DefaultMountOptions(),
+		JournalInode:               sb.JournalInode(),
+		ExcludeBitmapPresent:       sb.ExcludeBitmapPresent(),
+		JournalDevice:              sb.JournalDevice(),
+		JournalBackupBlocks:        journalBackupBlocks(sb),
+		JournalUUID:                FormatUUID(sb.JournalUUID()),
+		ChecksumType:               sb.ChecksumType(),
+		ChecksumSeed:               sb.ChecksumSeed(),
+	}
+}
+
+// journalBackupBlocks returns the backup of the journal inode of sb, or nil if
+// it is not valid.
+func journalBackupBlocks(sb SuperBlock) []uint32 {
+	blocks, ok := sb.JournalBackupBlocks()
+	if !ok {
+		return nil
+	}
+	return blocks[:]
+}
+
+// ErrorInfo is SbErrorInfo as plain data, with the time formatted as RFC 3339
+// in UTC.
+type ErrorInfo struct {
+	Time  string
+	Inode uint32
+	Block uint64
+	Func  string
+	Line  uint32
+	Code  uint8
+}
+
+// toErrorInfo returns e as an ErrorInfo.
+func toErrorInfo(e SbErrorInfo) ErrorInfo {
+	return ErrorInfo{
+		Time:  formatTime(e.Time),
+		Inode: e.Inode,
+		Block: e.Block,
+		Func:  e.Func,
+		Line:  e.Line,
+		Code:  e.Code,
+	}
+}
+
+// formatTime formats t as RFC 3339 in UTC.
+func formatTime(t ktime.Time) string {
+	sec, nsec := t.Unix()
+	return time.Unix(sec, nsec).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+)
+
+// TestToInfo tests that SuperBlockInfo holds a field for each SuperBlock
+// method with the value returned by it, and that it survives a JSON round
+// trip.
+func TestToInfo(t *testing.T) {
+	sb := &SuperBlock64Bit{}
+	sb.MagicRaw = linux.EXT_SUPER_MAGIC
+	sb.RevLevel = uint32(DynamicRev)
+	sb.InodesCountRaw = 16
+	sb.BlocksCountLo = 64
+	sb.ReservedBlocksCountLo = 3
+	sb.FreeBlocksCountLo = 20
+	sb.FreeInodesCountRaw = 5
+	sb.FirstDataBlockRaw = 1
+	sb.BlocksPerGroupRaw = 8192
+	sb.ClustersPerGroupRaw = 8192
+	sb.InodesPerGroupRaw = 16
+	sb.MountCountRaw = 3
+	sb.MaxMountCountRaw = 0xffff
+	sb.StateRaw = SbCleanlyUnmounted
+	sb.LastCheckRaw = 1577836800
+	sb.Mtime = 1578009600
+	sb.Wtime = 1578096000
+	sb.MkfsTime = 1577750400
+	sb.CheckIntervalRaw = 3600
+	sb.DefResUID = 1000
+	sb.DefResGID = 100
+	sb.FirstInodeRaw = 11
+	sb.InodeSizeRaw = 256
+	sb.FeatureCompat = CompatFeatures{HasJournal: true, ExtAttr: true}.ToInt()
+	sb.FeatureIncompat = IncompatFeatures{Extents: true, Is64Bit: true, MMP: true, FlexBg: true}.ToInt()
+	sb.FeatureRoCompat = RoCompatFeatures{Sparse: true, MetadataCsum: true}.ToInt()
+	sb.UUIDRaw = testUUID
+	sb.ReservedGdtBlocksRaw = 1
+	sb.PreallocBlocksRaw = 8
+	sb.PreallocDirBlocksRaw = 2
+	copy(sb.LastMountedRaw[:], "/mnt")
+	sb.JournalInum = 8
+	sb.JnlBackupType = SbJnlBackupBlocks
+	sb.JnlBlocks[0] = 0xf30a
+	sb.JnlBlocks[16] = 1 << 20
+	sb.LastOrphanRaw = 12
+	sb.HashSeedRaw = [4]uint32{1, 2, 3, 4}
+	sb.DefaultHashVersionRaw = 1
+	sb.BgDescSizeRaw = 64
+	sb.DefaultMountOpts = DefaultMountOpts{XattrUser: true, ACL: true}.ToInt()
+	sb.Flags = SbUnsignedHash
+	sb.LogGroupsPerFlexRaw = 4
+	sb.MMPBlockRaw = 17
+	sb.MMPIntervalRaw = 5
+	sb.ChecksumTypeRaw = SbCrc32c
+	sb.KbytesWrittenRaw = 42
+	sb.OverheadClustersRaw = 38
+	sb.ErrorCountRaw = 2
+	sb.FirstErrorTime = 1577836800
+	sb.FirstErrorInode = 12
+	copy(sb.FirstErrorFunction[:], "ext4_lookup")
+	sb.LastErrorTime = 1577923200
+	sb.LastErrorBlock = 34
+	sb.LastErrorCode = 5
+
+	info := ToInfo(sb)
+	sbType := reflect.TypeOf((*SuperBlock)(nil)).Elem()
+	infoVal := reflect.ValueOf(info)
+	if got, want := infoVal.NumField(), sbType.NumMethod(); got != want {
+		t.Errorf("SuperBlockInfo has %d fields, want one per SuperBlock method (%d)", got, want)
+	}
+	for i := 0; i < sbType.NumMethod(); i++ {
+		name := sbType.Method(i).Name
+		field := infoVal.FieldByName(name)
+		if !field.IsValid() {
+			t.Errorf("SuperBlockInfo has no field %s", name)
+			continue
+		}
+
+		var want interface{}
+		switch name {
+		case "UUID":
+			want = FormatUUID(sb.UUID())
+		case "JournalUUID":
+			want = FormatUUID(sb.JournalUUID())
+		case "MountTime":
+			want = "2020-01-03T00:00:00Z"
+		case "WriteTime":
+			want = "2020-01-04T00:00:00Z"
+		case "CreationTime":
+			want = "2019-12-31T00:00:00Z"
+		case "JournalBackupBlocks":
+			blocks, _ := sb.JournalBackupBlocks()
+			want = blocks[:]
+		case "LastCheck":
+			want = "2020-01-01T00:00:00Z"
+		case "FirstError":
+			want = ErrorInfo{Time: "2020-01-01T00:00:00Z", Inode: 12, Func: "ext4_lookup"}
+		case "LastError":
+			want = ErrorInfo{Time: "2020-01-02T00:00:00Z", Block: 34, Code: 5}
+		default:
+			want = reflect.ValueOf(sb).MethodByName(name).Call(nil)[0].Interface()
+		}
+		if got := field.Interface(); !reflect.DeepEqual(got, want) {
+			t.Errorf("SuperBlockInfo.%s = %v, want %v", name, got, want)
+		}
+	}
+
+	raw, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed: %v", err)
+	}
+	var got SuperBlockInfo
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("json.Unmarshal() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("SuperBlockInfo after JSON round trip = %+v, want %+v", got, info)
+	}
+}
@@ -14,34 +14,41 @@
 
 package disklayout
 
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+)
+
 // SuperBlockOld implements SuperBlock and represents the old version of the
 // superblock struct. Should be used only if RevLevel = OldRev.
 type SuperBlockOld struct {
-	InodesCountRaw      uint32
-	BlocksCountLo       uint32
-	ReservedBlocksCount uint32
-	FreeBlocksCountLo   uint32
-	FreeInodesCountRaw  uint32
-	FirstDataBlockRaw   uint32
-	LogBlockSize        uint32
-	LogClusterSize      uint32
-	BlocksPerGroupRaw   uint32
-	ClustersPerGroupRaw uint32
-	InodesPerGroupRaw   uint32
-	Mtime               uint32
-	Wtime               uint32
-	MountCountRaw       uint16
-	MaxMountCountRaw    uint16
-	MagicRaw            uint16
-	State               uint16
-	Errors              uint16
-	MinorRevLevel       uint16
-	LastCheck           uint32
-	CheckInterval       uint32
-	CreatorOS           uint32
-	RevLevel            uint32
-	DefResUID           uint16
-	DefResGID           uint16
+	InodesCountRaw        uint32
+	BlocksCountLo         uint32
+	ReservedBlocksCountLo uint32
+	FreeBlocksCountLo     uint32
+	FreeInodesCountRaw    uint32
+	FirstDataBlockRaw     uint32
+	LogBlockSize          uint32
+	LogClusterSize        uint32
+	BlocksPerGroupRaw     uint32
+	ClustersPerGroupRaw   uint32
+	InodesPerGroupRaw     uint32
+	Mtime                 uint32
+	Wtime                 uint32
+	MountCountRaw         uint16
+	MaxMountCountRaw      uint16
+	MagicRaw              uint16
+	StateRaw              uint16
+	Errors                uint16
+	MinorRevLevel         uint16
+	LastCheckRaw          uint32
+	CheckIntervalRaw      uint32
+	CreatorOSRaw          uint32
+	RevLevel              uint32
+	DefResUID             uint16
+	DefResGID             uint16
 }
 
 // Compiles only if SuperBlockOld implements SuperBlock.
@@ -56,6 +63,15 @@ func (sb *SuperBlockOld) BlocksCount() uint64 { return uint64(sb.BlocksCountLo)
 // FreeBlocksCount implements SuperBlock.FreeBlocksCount.
 func (sb *SuperBlockOld) FreeBlocksCount() uint64 { return uint64(sb.FreeBlocksCountLo) }
 
+// ReservedBlocksCount implements SuperBlock.ReservedBlocksCount.
+func (sb *SuperBlockOld) ReservedBlocksCount() uint64 { return uint64(sb.ReservedBlocksCountLo) }
+
+// DefaultReservedUID implements SuperBlock.DefaultReservedUID.
+func (sb *SuperBlockOld) DefaultReservedUID() auth.KUID { return auth.KUID(sb.DefResUID) }
+
+// DefaultReservedGID implements SuperBlock.DefaultReservedGID.
+func (sb *SuperBlockOld) DefaultReservedGID() auth.KGID { return auth.KGID(sb.DefResGID) }
+
 // FreeInodesCount implements SuperBlock.FreeInodesCount.
 func (sb *SuperBlockOld) FreeInodesCount() uint32 { return sb.FreeInodesCountRaw }
 
@@ -65,6 +81,23 @@ func (sb *SuperBlockOld) MountCount() uint16 { return sb.MountCountRaw }
 // MaxMountCount implements SuperBlock.MaxMountCount.
 func (sb *SuperBlockOld) MaxMountCount() uint16 { return sb.MaxMountCountRaw }
 
+// MountTime implements SuperBlock.MountTime.
+func (sb *SuperBlockOld) MountTime() ktime.Time { return decodeTime(sb.Mtime, 0) }
+
+// WriteTime implements SuperBlock.WriteTime.
+func (sb *SuperBlockOld) WriteTime() ktime.Time { return decodeTime(sb.Wtime, 0) }
+
+// CreationTime implements SuperBlock.CreationTime.
+func (sb *SuperBlockOld) CreationTime() ktime.Time { return decodeTime(0, 0) }
+
+// LastCheck implements SuperBlock.LastCheck.
+func (sb *SuperBlockOld) LastCheck() ktime.Time { return decodeTime(sb.LastCheckRaw, 0) }
+
+// CheckInterval implements SuperBlock.CheckInterval.
+func (sb *SuperBlockOld) CheckInterval() time.Duration {
+	return time.Duration(sb.CheckIntervalRaw) * time.Second
+}
+
 // FirstDataBlock implements SuperBlock.FirstDataBlock.
 func (sb *SuperBlockOld) FirstDataBlock() uint32 { return sb.FirstDataBlockRaw }
 
@@ -80,26 +113,153 @@ func (sb *SuperBlockOld) ClusterSize() uint64 { return 1 << (10 + sb.LogClusterS
 // ClustersPerGroup implements SuperBlock.ClustersPerGroup.
 func (sb *SuperBlockOld) ClustersPerGroup() uint32 { return sb.ClustersPerGroupRaw }
 
+// FirstInode implements SuperBlock.FirstInode.
+func (sb *SuperBlockOld) FirstInode() uint32 { return OldFirstInode }
+
 // InodeSize implements SuperBlock.InodeSize.
 func (sb *SuperBlockOld) InodeSize() uint16 { return OldInodeSize }
 
+// MinExtraIsize implements SuperBlock.MinExtraIsize.
+func (sb *SuperBlockOld) MinExtraIsize() uint16 { return 0 }
+
+// WantExtraIsize implements SuperBlock.WantExtraIsize.
+func (sb *SuperBlockOld) WantExtraIsize() uint16 { return 0 }
+
 // InodesPerGroup implements SuperBlock.InodesPerGroup.
 func (sb *SuperBlockOld) InodesPerGroup() uint32 { return sb.InodesPerGroupRaw }
 
+// GroupsCount implements SuperBlock.GroupsCount.
+func (sb *SuperBlockOld) GroupsCount() uint64 { return groupsCount(sb) }
+
+// ClustersCount implements SuperBlock.ClustersCount.
+func (sb *SuperBlockOld) ClustersCount() uint64 { return clustersCount(sb) }
+
+// OverheadClusters implements SuperBlock.OverheadClusters.
+func (sb *SuperBlockOld) OverheadClusters() uint32 { return 0 }
+
+// BackupGroups implements SuperBlock.BackupGroups.
+func (sb *SuperBlockOld) BackupGroups() []uint32 { return backupGroups(sb) }
+
 // BgDescSize implements SuperBlock.BgDescSize.
 func (sb *SuperBlockOld) BgDescSize() uint16 { return 32 }
 
+// PreallocBlocks implements SuperBlock.PreallocBlocks.
+func (sb *SuperBlockOld) PreallocBlocks() uint8 { return 0 }
+
+// PreallocDirBlocks implements SuperBlock.PreallocDirBlocks.
+func (sb *SuperBlockOld) PreallocDirBlocks() uint8 { return 0 }
+
+// ReservedGdtBlocks implements SuperBlock.ReservedGdtBlocks.
+func (sb *SuperBlockOld) ReservedGdtBlocks() uint16 { return 0 }
+
+// HashSeed implements SuperBlock.HashSeed.
+func (sb *SuperBlockOld) HashSeed() [4]uint32 { return [4]uint32{} }
+
+// DefaultHashVersion implements SuperBlock.DefaultHashVersion.
+func (sb *SuperBlockOld) DefaultHashVersion() uint8 { return 0 }
+
+// UnsignedDirHash implements SuperBlock.UnsignedDirHash.
+func (sb *SuperBlockOld) UnsignedDirHash() bool { return false }
+
+// LogGroupsPerFlex implements SuperBlock.LogGroupsPerFlex.
+func (sb *SuperBlockOld) LogGroupsPerFlex() uint8 { return 0 }
+
+// FlexGroupSize implements SuperBlock.FlexGroupSize.
+func (sb *SuperBlockOld) FlexGroupSize() uint32 { return 1 }
+
+// MMPBlock implements SuperBlock.MMPBlock.
+func (sb *SuperBlockOld) MMPBlock() uint64 { return 0 }
+
+// MMPUpdateInterval implements SuperBlock.MMPUpdateInterval.
+func (sb *SuperBlockOld) MMPUpdateInterval() uint16 { return 0 }
+
+// FirstMetaBG implements SuperBlock.FirstMetaBG.
+func (sb *SuperBlockOld) FirstMetaBG() uint32 { return 0 }
+
 // CompatibleFeatures implements SuperBlock.CompatibleFeatures.
 func (sb *SuperBlockOld) CompatibleFeatures() CompatFeatures { return CompatFeatures{} }
 
 // IncompatibleFeatures implements SuperBlock.IncompatibleFeatures.
 func (sb *SuperBlockOld) IncompatibleFeatures() IncompatFeatures { return IncompatFeatures{} }
 
+// IsEncrypted implements SuperBlock.IsEncrypted.
+func (sb *SuperBlockOld) IsEncrypted() bool { return false }
+
 // ReadOnlyCompatibleFeatures implements SuperBlock.ReadOnlyCompatibleFeatures.
 func (sb *SuperBlockOld) ReadOnlyCompatibleFeatures() RoCompatFeatures { return RoCompatFeatures{} }
 
 // Magic implements SuperBlock.Magic.
 func (sb *SuperBlockOld) Magic() uint16 { return sb.MagicRaw }
 
+// CreatorOS implements SuperBlock.CreatorOS.
+func (sb *SuperBlockOld) CreatorOS() OSCode { return OSCode(sb.CreatorOSRaw) }
+
 // Revision implements SuperBlock.Revision.
 func (sb *SuperBlockOld) Revision() SbRevision { return SbRevision(sb.RevLevel) }
+
+// RevisionLevel implements SuperBlock.RevisionLevel.
+func (sb *SuperBlockOld) RevisionLevel() uint32 { return sb.RevLevel }
+
+// State implements SuperBlock.State.
+func (sb *SuperBlockOld) State() SbState { return SbStateFromInt(sb.StateRaw) }
+
+// ErrorPolicy implements SuperBlock.ErrorPolicy.
+func (sb *SuperBlockOld) ErrorPolicy() SbErrorPolicy { return SbErrorPolicy(sb.Errors) }
+
+// LastOrphan implements SuperBlock.LastOrphan.
+func (sb *SuperBlockOld) LastOrphan() uint32 { return 0 }
+
+// KbytesWritten implements SuperBlock.KbytesWritten.
+func (sb *SuperBlockOld) KbytesWritten() uint64 { return 0 }
+
+// SnapshotInode implements SuperBlock.SnapshotInode.
+func (sb *SuperBlockOld) SnapshotInode() uint32 { return 0 }
+
+// SnapshotID implements SuperBlock.SnapshotID.
+func (sb *SuperBlockOld) SnapshotID() uint32 { return 0 }
+
+// SnapshotReservedBlocks implements SuperBlock.SnapshotReservedBlocks.
+func (sb *SuperBlockOld) SnapshotReservedBlocks() uint64 { return 0 }
+
+// ErrorCount implements SuperBlock.ErrorCount.
+func (sb *SuperBlockOld) ErrorCount() uint32 { return 0 }
+
+// FirstError implements SuperBlock.FirstError.
+func (sb *SuperBlockOld) FirstError() SbErrorInfo { return SbErrorInfo{} }
+
+// LastError implements SuperBlock.LastError.
+func (sb *SuperBlockOld) LastError() SbErrorInfo { return SbErrorInfo{} }
+
+// UUID implements SuperBlock.UUID.
+func (sb *SuperBlockOld) UUID() [16]byte { return [16]byte{} }
+
+// LastMounted implements SuperBlock.LastMounted.
+func (sb *SuperBlockOld) LastMounted() string { return "" }
+
+// Label implements SuperBlock.Label.
+func (sb *SuperBlockOld) Label() string { return "" }
+
+// DefaultMountOptions implements SuperBlock.DefaultMountOptions.
+func (sb *SuperBlockOld) DefaultMountOptions() DefaultMountOpts { return DefaultMountOpts{} }
+
+// JournalInode implements SuperBlock.JournalInode.
+func (sb *SuperBlockOld) JournalInode() uint32 { return 0 }
+
+// ExcludeBitmapPresent implements SuperBlock.ExcludeBitmapPresent.
+func (sb *SuperBlockOld) ExcludeBitmapPresent() bool { return false }
+
+// JournalDevice implements SuperBlock.JournalDevice.
+func (sb *SuperBlockOld) JournalDevice() uint32 { return 0 }
+
+// JournalBackupBlocks implements SuperBlock.JournalBackupBlocks.
+func (sb *SuperBlockOld) JournalBackupBlocks() ([17]uint32, bool) { return [17]uint32{}, false }
+
+// JournalUUID implements SuperBlock.JournalUUID.
+func (sb *SuperBlockOld) JournalUUID() [16]byte { return [16]byte{} }
+
+// ChecksumType implements SuperBlock.ChecksumType.
+func (sb *SuperBlockOld) ChecksumType() uint8 { return 0 }
+
+// ChecksumSeed implements SuperBlock.ChecksumSeed. Old superblocks do not
+// support metadata checksums.
+func (sb *SuperBlockOld) ChecksumSeed() uint32 { return 0 }
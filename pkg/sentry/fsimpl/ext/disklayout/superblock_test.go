@@ -15,7 +15,14 @@
 package disklayout
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/time"
 )
 
 // TestSuperBlockSize tests that the superblock structs are of the correct
@@ -25,3 +32,1137 @@ func TestSuperBlockSize(t *testing.T) {
 	assertSize(t, SuperBlock32Bit{}, 336)
 	assertSize(t, SuperBlock64Bit{}, 1024)
 }
+
+// TestChecksumSeed tests that the metadata checksum seed is derived from the
+// UUID unless the SbCsumSeed feature is set.
+func TestChecksumSeed(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.UUIDRaw = testUUID
+	sb.ChecksumSeedRaw = 0xdeadbeef
+
+	if got, want := sb.ChecksumSeed(), uint32(0xf57d6eee); got != want {
+		t.Errorf("derived ChecksumSeed() = %#x, want %#x", got, want)
+	}
+
+	sb.FeatureIncompat = IncompatFeatures{CsumSeed: true}.ToInt()
+	if got, want := sb.ChecksumSeed(), uint32(0xdeadbeef); got != want {
+		t.Errorf("stored ChecksumSeed() = %#x, want %#x", got, want)
+	}
+
+	var old SuperBlockOld
+	if got := old.ChecksumSeed(); got != 0 {
+		t.Errorf("SuperBlockOld ChecksumSeed() = %#x, want 0", got)
+	}
+}
+
+// TestValidateSuperBlock tests that ValidateSuperBlock identifies the field
+// which failed validation.
+func TestValidateSuperBlock(t *testing.T) {
+	valid := func() *SuperBlock64Bit {
+		sb := &SuperBlock64Bit{}
+		sb.MagicRaw = linux.EXT_SUPER_MAGIC
+		sb.RevLevel = uint32(DynamicRev)
+		sb.FirstDataBlockRaw = 1
+		sb.BlocksCountLo = 64
+		sb.BlocksPerGroupRaw = 8192
+		sb.ClustersPerGroupRaw = 8192
+		sb.InodesCountRaw = 16
+		sb.InodesPerGroupRaw = 16
+		sb.InodeSizeRaw = 256
+		sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+		sb.BgDescSizeRaw = 64
+		return sb
+	}
+
+	for _, test := range []struct {
+		name      string
+		mutate    func(sb *SuperBlock64Bit)
+		wantField string
+	}{
+		{
+			name:   "valid",
+			mutate: func(sb *SuperBlock64Bit) {},
+		},
+		{
+			name:      "bad magic",
+			mutate:    func(sb *SuperBlock64Bit) { sb.MagicRaw = 0xdead },
+			wantField: "s_magic",
+		},
+		{
+			name:      "block size too large",
+			mutate:    func(sb *SuperBlock64Bit) { sb.LogBlockSize = 7 },
+			wantField: "s_log_block_size",
+		},
+		{
+			name:      "block size overflow",
+			mutate:    func(sb *SuperBlock64Bit) { sb.LogBlockSize = 60 },
+			wantField: "s_log_block_size",
+		},
+		{
+			name:      "first data block with 1k blocks",
+			mutate:    func(sb *SuperBlock64Bit) { sb.FirstDataBlockRaw = 0 },
+			wantField: "s_first_data_block",
+		},
+		{
+			name:      "first data block with 4k blocks",
+			mutate:    func(sb *SuperBlock64Bit) { sb.LogBlockSize = 2 },
+			wantField: "s_first_data_block",
+		},
+		{
+			name: "first data block with bigalloc",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FirstDataBlockRaw = 0
+				sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+			},
+		},
+		{
+			name:      "too many inodes per group",
+			mutate:    func(sb *SuperBlock64Bit) { sb.InodesPerGroupRaw = 1024*8 + 1 },
+			wantField: "s_inodes_per_group",
+		},
+		{
+			name:      "zero blocks per group",
+			mutate:    func(sb *SuperBlock64Bit) { sb.BlocksPerGroupRaw = 0 },
+			wantField: "s_blocks_per_group",
+		},
+		{
+			name:      "too many blocks per group",
+			mutate:    func(sb *SuperBlock64Bit) { sb.BlocksPerGroupRaw = 1024*8 + 1 },
+			wantField: "s_blocks_per_group",
+		},
+		{
+			name:      "cluster size without bigalloc",
+			mutate:    func(sb *SuperBlock64Bit) { sb.LogClusterSize = 4 },
+			wantField: "s_log_cluster_size",
+		},
+		{
+			name: "bigalloc",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FirstDataBlockRaw = 0
+				sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+				sb.LogClusterSize = 4
+				sb.BlocksPerGroupRaw = 8192 * 16
+			},
+		},
+		{
+			name: "bigalloc cluster smaller than block",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+				sb.LogBlockSize = 2
+				sb.FirstDataBlockRaw = 0
+			},
+			wantField: "s_log_cluster_size",
+		},
+		{
+			name: "bigalloc blocks per group not in clusters",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FirstDataBlockRaw = 0
+				sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+				sb.LogClusterSize = 4
+			},
+			wantField: "s_blocks_per_group",
+		},
+		{
+			name:      "too many clusters per group",
+			mutate:    func(sb *SuperBlock64Bit) { sb.ClustersPerGroupRaw = 1024*8 + 1 },
+			wantField: "s_clusters_per_group",
+		},
+		{
+			name:      "inode count disagrees with groups",
+			mutate:    func(sb *SuperBlock64Bit) { sb.InodesCountRaw = 32 },
+			wantField: "s_inodes_count",
+		},
+		{
+			name:      "inode size not power of two",
+			mutate:    func(sb *SuperBlock64Bit) { sb.InodeSizeRaw = 160 },
+			wantField: "s_inode_size",
+		},
+		{
+			name:      "inode size too small",
+			mutate:    func(sb *SuperBlock64Bit) { sb.InodeSizeRaw = 64 },
+			wantField: "s_inode_size",
+		},
+		{
+			name:      "inode size larger than block",
+			mutate:    func(sb *SuperBlock64Bit) { sb.InodeSizeRaw = 2048 },
+			wantField: "s_inode_size",
+		},
+		{
+			name:      "small descriptors with 64-bit",
+			mutate:    func(sb *SuperBlock64Bit) { sb.BgDescSizeRaw = 32 },
+			wantField: "s_desc_size",
+		},
+		{
+			name:   "large descriptors with 64-bit",
+			mutate: func(sb *SuperBlock64Bit) { sb.BgDescSizeRaw = 128 },
+		},
+		{
+			name:      "descriptor size not power of two",
+			mutate:    func(sb *SuperBlock64Bit) { sb.BgDescSizeRaw = 96 },
+			wantField: "s_desc_size",
+		},
+		{
+			name:      "descriptors too large",
+			mutate:    func(sb *SuperBlock64Bit) { sb.BgDescSizeRaw = 2048 },
+			wantField: "s_desc_size",
+		},
+		{
+			name: "largest flex groups",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FeatureIncompat = IncompatFeatures{Is64Bit: true, FlexBg: true}.ToInt()
+				sb.LogGroupsPerFlexRaw = MaxLogGroupsPerFlex
+			},
+		},
+		{
+			name: "flex groups too large",
+			mutate: func(sb *SuperBlock64Bit) {
+				sb.FeatureIncompat = IncompatFeatures{Is64Bit: true, FlexBg: true}.ToInt()
+				sb.LogGroupsPerFlexRaw = MaxLogGroupsPerFlex + 1
+			},
+			wantField: "s_log_groups_per_flex",
+		},
+		{
+			name:   "flex groups ignored without flex_bg",
+			mutate: func(sb *SuperBlock64Bit) { sb.LogGroupsPerFlexRaw = 255 },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := valid()
+			test.mutate(sb)
+			err := ValidateSuperBlock(sb)
+			if test.wantField == "" {
+				if err != nil {
+					t.Fatalf("ValidateSuperBlock() = %v, want nil", err)
+				}
+				return
+			}
+
+			sbErr, ok := err.(*SuperBlockError)
+			if !ok {
+				t.Fatalf("ValidateSuperBlock() = %v, want *SuperBlockError", err)
+			}
+			if sbErr.Field != test.wantField {
+				t.Errorf("ValidateSuperBlock() failed on field %q, want %q", sbErr.Field, test.wantField)
+			}
+		})
+	}
+}
+
+// TestGroupsCount tests that GroupsCount accounts for the first data block
+// and the last partial group.
+func TestGroupsCount(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		blocksCount    uint64
+		firstDataBlock uint32
+		blocksPerGroup uint32
+		want           uint64
+	}{
+		{name: "single partial group", blocksCount: 64, firstDataBlock: 1, blocksPerGroup: 8192, want: 1},
+		{name: "exact groups", blocksCount: 8193 * 2, firstDataBlock: 1, blocksPerGroup: 8192, want: 3},
+		{name: "exact groups excluding first block", blocksCount: 8192*2 + 1, firstDataBlock: 1, blocksPerGroup: 8192, want: 2},
+		{name: "last partial group", blocksCount: 32768*3 + 1, firstDataBlock: 0, blocksPerGroup: 32768, want: 4},
+		{name: "64-bit block count", blocksCount: 1 << 33, firstDataBlock: 0, blocksPerGroup: 32768, want: 1 << 18},
+		{name: "zero blocks per group", blocksCount: 64, firstDataBlock: 1, blocksPerGroup: 0, want: 0},
+		{name: "no blocks", blocksCount: 1, firstDataBlock: 1, blocksPerGroup: 8192, want: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.BlocksCountLo = uint32(test.blocksCount)
+			sb.BlocksCountHi = uint32(test.blocksCount >> 32)
+			sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+			sb.FirstDataBlockRaw = test.firstDataBlock
+			sb.BlocksPerGroupRaw = test.blocksPerGroup
+			if got := sb.GroupsCount(); got != test.want {
+				t.Errorf("GroupsCount() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// TestFeaturesString tests that every known feature bit has a name and that
+// names are rendered in bit order.
+func TestFeaturesString(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{
+			name: "compat",
+			got:  CompatFeaturesFromInt(0xffffffff).String(),
+			want: "dir_prealloc has_journal ext_attr resize_inode dir_index snapshot_bitmap sparse_super2",
+		},
+		{
+			name: "incompat",
+			got:  IncompatFeaturesFromInt(0xffffffff).String(),
+			want: "filetype needs_recovery journal_dev meta_bg extent 64bit mmp flex_bg ea_inode metadata_csum_seed large_dir inline_data encrypt",
+		},
+		{
+			name: "rocompat",
+			got:  RoCompatFeaturesFromInt(0xffffffff).String(),
+			want: "sparse_super large_file huge_file uninit_bg dir_nlink extra_isize snapshot_bitmap quota bigalloc metadata_csum read-only project",
+		},
+		{
+			name: "empty",
+			got:  CompatFeatures{}.String(),
+			want: "",
+		},
+		{
+			name: "partial",
+			got:  IncompatFeatures{Extents: true, Is64Bit: true}.String(),
+			want: "extent 64bit",
+		},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: String() = %q, want %q", test.name, test.got, test.want)
+		}
+	}
+}
+
+// TestUnknownFeatureBits tests that bits outside of the known feature sets are
+// reported and preserved.
+func TestUnknownFeatureBits(t *testing.T) {
+	if got, want := UnknownIncompatBits(0xffffffff), uint32(0xfffe1821); got != want {
+		t.Errorf("UnknownIncompatBits(0xffffffff) = %#x, want %#x", got, want)
+	}
+	if got, want := UnknownRoCompatBits(0xffffffff), uint32(0xffffc804); got != want {
+		t.Errorf("UnknownRoCompatBits(0xffffffff) = %#x, want %#x", got, want)
+	}
+	if got := UnknownIncompatBits(IncompatFeatures{Extents: true, Is64Bit: true}.ToInt()); got != 0 {
+		t.Errorf("UnknownIncompatBits(known) = %#x, want 0", got)
+	}
+
+	// Unknown bits must survive a round trip.
+	if got := IncompatFeaturesFromInt(0xffffffff).ToInt(); got != 0xffffffff {
+		t.Errorf("IncompatFeatures round trip = %#x, want 0xffffffff", got)
+	}
+	if got := RoCompatFeaturesFromInt(0xffffffff).ToInt(); got != 0xffffffff {
+		t.Errorf("RoCompatFeatures round trip = %#x, want 0xffffffff", got)
+	}
+}
+
+// TestBackupGroups tests that BackupGroups agrees with the sparse superblock
+// feature in use.
+func TestBackupGroups(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		groups    uint32
+		compat    CompatFeatures
+		roCompat  RoCompatFeatures
+		backupBgs [2]uint32
+		want      []uint32
+	}{
+		{
+			name:   "single group",
+			groups: 1,
+		},
+		{
+			name:   "not sparse",
+			groups: 5,
+			want:   []uint32{1, 2, 3, 4},
+		},
+		{
+			name:     "sparse",
+			groups:   100,
+			roCompat: RoCompatFeatures{Sparse: true},
+			want:     []uint32{1, 3, 5, 7, 9, 25, 27, 49, 81},
+		},
+		{
+			name:      "sparse v2",
+			groups:    100,
+			compat:    CompatFeatures{SparseV2: true},
+			roCompat:  RoCompatFeatures{Sparse: true},
+			backupBgs: [2]uint32{99, 1},
+			want:      []uint32{1, 99},
+		},
+		{
+			name:      "sparse v2 single backup",
+			groups:    100,
+			compat:    CompatFeatures{SparseV2: true},
+			backupBgs: [2]uint32{1, 0},
+			want:      []uint32{1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock64Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.BlocksPerGroupRaw = 8192
+			sb.BlocksCountLo = test.groups * 8192
+			sb.FeatureCompat = test.compat.ToInt()
+			sb.FeatureRoCompat = test.roCompat.ToInt()
+			sb.BackupBgs = test.backupBgs
+			if got := sb.BackupGroups(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("BackupGroups() = %v, want %v", got, test.want)
+			}
+
+			backups := map[uint64]bool{0: true}
+			for _, g := range test.want {
+				backups[uint64(g)] = true
+			}
+			for g := uint64(0); g < uint64(test.groups); g++ {
+				if got := GroupHasSuperBlock(&sb, g); got != backups[g] {
+					t.Errorf("GroupHasSuperBlock(%d) = %t, want %t", g, got, backups[g])
+				}
+			}
+		})
+	}
+}
+
+// TestBlockCountsHiIgnored tests that the high halves of the block counts are
+// ignored when the 64-bit feature is not set, even if they hold garbage.
+func TestBlockCountsHiIgnored(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.BlocksCountLo = 64
+	sb.FreeBlocksCountLo = 20
+	sb.ReservedBlocksCountLo = 3
+	sb.BgDescSizeRaw = 0xbeef
+	sb.BlocksCountHi = 0xdeadbeef
+	sb.FreeBlocksCountHi = 0xdeadbeef
+	sb.ReservedBlocksCountHi = 0xdeadbeef
+	raw := binary.Marshal(nil, binary.LittleEndian, sb)
+
+	for _, got := range []SuperBlock{&SuperBlock32Bit{}, &SuperBlock64Bit{}} {
+		binary.Unmarshal(raw[:binary.Size(got)], binary.LittleEndian, got)
+		if got.BlocksCount() != 64 {
+			t.Errorf("%T.BlocksCount() = %#x, want 64", got, got.BlocksCount())
+		}
+		if got.FreeBlocksCount() != 20 {
+			t.Errorf("%T.FreeBlocksCount() = %#x, want 20", got, got.FreeBlocksCount())
+		}
+		if got.ReservedBlocksCount() != 3 {
+			t.Errorf("%T.ReservedBlocksCount() = %#x, want 3", got, got.ReservedBlocksCount())
+		}
+		if got.BgDescSize() != 32 {
+			t.Errorf("%T.BgDescSize() = %d, want 32", got, got.BgDescSize())
+		}
+	}
+
+	sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+	if got, want := sb.FreeBlocksCount(), uint64(0xdeadbeef00000014); got != want {
+		t.Errorf("64-bit FreeBlocksCount() = %#x, want %#x", got, want)
+	}
+	if got, want := sb.ReservedBlocksCount(), uint64(0xdeadbeef00000003); got != want {
+		t.Errorf("64-bit ReservedBlocksCount() = %#x, want %#x", got, want)
+	}
+}
+
+// TestJournalInode tests that the journal inode is only reported for internal
+// journals.
+func TestJournalInode(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		compat   CompatFeatures
+		incompat IncompatFeatures
+		want     uint32
+	}{
+		{name: "no journal", want: 0},
+		{name: "internal journal", compat: CompatFeatures{HasJournal: true}, want: 8},
+		{name: "journal device", compat: CompatFeatures{HasJournal: true}, incompat: IncompatFeatures{JournalDev: true}, want: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock32Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			sb.FeatureCompat = test.compat.ToInt()
+			sb.FeatureIncompat = test.incompat.ToInt()
+			sb.JournalInum = 8
+			sb.JournalDev = 0x801
+			if got := sb.JournalInode(); got != test.want {
+				t.Errorf("JournalInode() = %d, want %d", got, test.want)
+			}
+			if got := sb.JournalDevice(); got != 0x801 {
+				t.Errorf("JournalDevice() = %#x, want 0x801", got)
+			}
+		})
+	}
+}
+
+// TestDefaultMountOpts tests the conversion of default mount options to and
+// from their integer representation.
+func TestDefaultMountOpts(t *testing.T) {
+	// user_xattr, acl and journal_data_ordered as set by mke2fs.
+	opts := DefaultMountOptsFromInt(0x4c)
+	want := DefaultMountOpts{XattrUser: true, ACL: true, JournalMode: JournalDataModeOrdered}
+	if opts != want {
+		t.Errorf("DefaultMountOptsFromInt(0x4c) = %+v, want %+v", opts, want)
+	}
+
+	for _, mode := range []JournalDataMode{JournalDataModeNone, JournalDataModeJournal, JournalDataModeOrdered, JournalDataModeWriteback} {
+		opts := DefaultMountOpts{Discard: true, JournalMode: mode}
+		if got := DefaultMountOptsFromInt(opts.ToInt()); got != opts {
+			t.Errorf("round trip of %+v = %+v", opts, got)
+		}
+	}
+}
+
+// TestOldRevDefaults tests that dynamic revision fields are ignored for OldRev
+// superblocks, even if they hold garbage.
+func TestOldRevDefaults(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(OldRev)
+	sb.FirstInodeRaw = 0xdead
+	sb.InodeSizeRaw = 0xbeef
+	sb.FeatureCompat = 0xffffffff
+	sb.FeatureIncompat = 0xffffffff
+	sb.FeatureRoCompat = 0xffffffff
+	sb.UUIDRaw = [16]byte{0xff}
+	raw := binary.Marshal(nil, binary.LittleEndian, sb)
+
+	for _, got := range []SuperBlock{&SuperBlockOld{}, &SuperBlock32Bit{}} {
+		binary.Unmarshal(raw[:binary.Size(got)], binary.LittleEndian, got)
+		if got.FirstInode() != OldFirstInode {
+			t.Errorf("%T.FirstInode() = %d, want %d", got, got.FirstInode(), OldFirstInode)
+		}
+		if got.InodeSize() != OldInodeSize {
+			t.Errorf("%T.InodeSize() = %d, want %d", got, got.InodeSize(), OldInodeSize)
+		}
+		if got.UUID() != [16]byte{} {
+			t.Errorf("%T.UUID() = %v, want zero", got, got.UUID())
+		}
+		if got.CompatibleFeatures() != (CompatFeatures{}) || got.IncompatibleFeatures() != (IncompatFeatures{}) || got.ReadOnlyCompatibleFeatures() != (RoCompatFeatures{}) {
+			t.Errorf("%T has features %q %q %q, want none", got, got.CompatibleFeatures(), got.IncompatibleFeatures(), got.ReadOnlyCompatibleFeatures())
+		}
+	}
+
+	sb.RevLevel = uint32(DynamicRev)
+	if got := sb.FirstInode(); got != 0xdead {
+		t.Errorf("DynamicRev FirstInode() = %#x, want 0xdead", got)
+	}
+}
+
+// TestKbytesWritten tests that the lifetime write counter is only reported by
+// superblocks which have it.
+func TestKbytesWritten(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.KbytesWrittenRaw = 0x100000001
+	if got := sb.KbytesWritten(); got != 0x100000001 {
+		t.Errorf("KbytesWritten() = %#x, want 0x100000001", got)
+	}
+
+	sb.RevLevel = uint32(OldRev)
+	if got := sb.KbytesWritten(); got != 0 {
+		t.Errorf("OldRev KbytesWritten() = %#x, want 0", got)
+	}
+
+	var sb32 SuperBlock32Bit
+	if got := sb32.KbytesWritten(); got != 0 {
+		t.Errorf("SuperBlock32Bit KbytesWritten() = %#x, want 0", got)
+	}
+}
+
+// TestSnapshot tests that the snapshot fields are read at the offsets of
+// s_snapshot_inum, s_snapshot_id and s_snapshot_r_blocks_count, and only
+// reported with SbHasSnapshot.
+func TestSnapshot(t *testing.T) {
+	raw := make([]byte, SbSize)
+	binary.LittleEndian.PutUint32(raw[0x4c:], uint32(DynamicRev))
+	binary.LittleEndian.PutUint32(raw[0x60:], SbIs64Bit)
+	binary.LittleEndian.PutUint32(raw[0x180:], 13)
+	binary.LittleEndian.PutUint32(raw[0x184:], 4)
+	binary.LittleEndian.PutUint64(raw[0x188:], 0x100000200)
+
+	var sb SuperBlock64Bit
+	binary.Unmarshal(raw, binary.LittleEndian, &sb)
+	if ino, id, rsrv := sb.SnapshotInode(), sb.SnapshotID(), sb.SnapshotReservedBlocks(); ino != 0 || id != 0 || rsrv != 0 {
+		t.Errorf("snapshot (inode, id, reserved blocks) without SbHasSnapshot = (%d, %d, %d), want zeroes", ino, id, rsrv)
+	}
+
+	binary.LittleEndian.PutUint32(raw[0x64:], SbHasSnapshot)
+	binary.Unmarshal(raw, binary.LittleEndian, &sb)
+	if ino, id, rsrv := sb.SnapshotInode(), sb.SnapshotID(), sb.SnapshotReservedBlocks(); ino != 13 || id != 4 || rsrv != 0x100000200 {
+		t.Errorf("snapshot (inode, id, reserved blocks) = (%d, %d, %#x), want (13, 4, 0x100000200)", ino, id, rsrv)
+	}
+
+	// The 32-bit superblock does not have the fields.
+	var sb32 SuperBlock32Bit
+	binary.Unmarshal(raw[:binary.Size(sb32)], binary.LittleEndian, &sb32)
+	if ino, id, rsrv := sb32.SnapshotInode(), sb32.SnapshotID(), sb32.SnapshotReservedBlocks(); ino != 0 || id != 0 || rsrv != 0 {
+		t.Errorf("SuperBlock32Bit snapshot (inode, id, reserved blocks) = (%d, %d, %d), want zeroes", ino, id, rsrv)
+	}
+}
+
+// TestLastOrphan tests that the orphan list head is surfaced along with the
+// orphan recovery state.
+func TestLastOrphan(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	if got := sb.LastOrphan(); got != 0 {
+		t.Errorf("LastOrphan() = %d, want 0", got)
+	}
+
+	sb.StateRaw = SbState{CleanlyUnmounted: true, OrphanRecovery: true}.ToInt()
+	sb.LastOrphanRaw = 12
+	if got := sb.State(); !got.OrphanRecovery || !got.CleanlyUnmounted || got.ErrorsDetected {
+		t.Errorf("State() = %+v, want CleanlyUnmounted and OrphanRecovery", got)
+	}
+	if got := sb.LastOrphan(); got != 12 {
+		t.Errorf("LastOrphan() = %d, want 12", got)
+	}
+}
+
+// TestLastMounted tests that the last mount directory ends at the first NUL
+// byte or at the end of the field and is valid UTF-8.
+func TestLastMounted(t *testing.T) {
+	long := "/" + strings.Repeat("a", 63)
+	for _, test := range []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "unset", raw: "", want: ""},
+		{name: "short", raw: "/mnt/data\x00garbage", want: "/mnt/data"},
+		{name: "full", raw: long, want: long},
+		{name: "invalid utf-8", raw: "/mnt/\xff\xfe", want: "/mnt/\ufffd"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock32Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			copy(sb.LastMountedRaw[:], test.raw)
+			if got := sb.LastMounted(); got != test.want {
+				t.Errorf("LastMounted() = %q, want %q", got, test.want)
+			}
+
+			sb.RevLevel = uint32(OldRev)
+			if got := sb.LastMounted(); got != "" {
+				t.Errorf("OldRev LastMounted() = %q, want \"\"", got)
+			}
+		})
+	}
+}
+
+// TestLabel tests setting and reading back volume labels.
+func TestLabel(t *testing.T) {
+	full := "0123456789abcdef"
+	for _, test := range []struct {
+		name    string
+		label   string
+		wantErr bool
+	}{
+		{name: "empty", label: ""},
+		{name: "short", label: "data"},
+		{name: "full", label: full},
+		{name: "too long", label: full + "x", wantErr: true},
+		{name: "nul", label: "da\x00ta", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlock32Bit{}
+			sb.RevLevel = uint32(DynamicRev)
+			copy(sb.VolumeName[:], "previous label")
+			err := sb.SetLabel(test.label)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("SetLabel(%q) succeeded, want error", test.label)
+				}
+				if got := sb.Label(); got != "previous label" {
+					t.Errorf("Label() after failed SetLabel() = %q, want %q", got, "previous label")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetLabel(%q) failed: %v", test.label, err)
+			}
+			if got := sb.Label(); got != test.label {
+				t.Errorf("Label() = %q, want %q", got, test.label)
+			}
+			var want [16]byte
+			copy(want[:], test.label)
+			if sb.VolumeName != want {
+				t.Errorf("VolumeName = %q, want %q", sb.VolumeName, want)
+			}
+		})
+	}
+
+	old := SuperBlock32Bit{}
+	if err := old.SetLabel("data"); err == nil {
+		t.Errorf("SetLabel() of OldRev superblock succeeded, want error")
+	}
+}
+
+// TestPrealloc tests that the preallocation hints are read at the offsets of
+// s_prealloc_blocks and s_prealloc_dir_blocks.
+func TestPrealloc(t *testing.T) {
+	raw := make([]byte, SbSize)
+	binary.LittleEndian.PutUint32(raw[0x4c:], uint32(DynamicRev))
+	binary.LittleEndian.PutUint32(raw[0xc8:], 0xffffffff)
+	raw[0xcc] = 8
+	raw[0xcd] = 2
+	binary.LittleEndian.PutUint16(raw[0xce:], 0x1234)
+
+	var sb SuperBlock32Bit
+	binary.Unmarshal(raw[:binary.Size(sb)], binary.LittleEndian, &sb)
+	if got := sb.PreallocBlocks(); got != 8 {
+		t.Errorf("PreallocBlocks() = %d, want 8", got)
+	}
+	if got := sb.PreallocDirBlocks(); got != 2 {
+		t.Errorf("PreallocDirBlocks() = %d, want 2", got)
+	}
+	if got := sb.ReservedGdtBlocks(); got != 0x1234 {
+		t.Errorf("ReservedGdtBlocks() = %#x, want 0x1234", got)
+	}
+
+	sb.RevLevel = uint32(OldRev)
+	if sb.PreallocBlocks() != 0 || sb.PreallocDirBlocks() != 0 {
+		t.Errorf("OldRev (PreallocBlocks(), PreallocDirBlocks()) = (%d, %d), want (0, 0)", sb.PreallocBlocks(), sb.PreallocDirBlocks())
+	}
+}
+
+// TestFormatUUID tests that UUIDs are formatted like blkid does.
+func TestFormatUUID(t *testing.T) {
+	for _, test := range []struct {
+		uuid [16]byte
+		want string
+	}{
+		{
+			uuid: testUUID,
+			want: "26f15451-fbf8-4e5c-86fd-3c43ce697738",
+		},
+		{
+			want: "00000000-0000-0000-0000-000000000000",
+		},
+	} {
+		if got := FormatUUID(test.uuid); got != test.want {
+			t.Errorf("FormatUUID(%v) = %q, want %q", test.uuid, got, test.want)
+		}
+	}
+}
+
+// TestExtVariant tests that IsExt2, IsExt3 and IsExt4 tell the variants apart
+// by their features.
+func TestExtVariant(t *testing.T) {
+	const (
+		baseCompat   = SbExtAttr | SbResizeInode | SbDirIndex
+		baseRoCompat = SbSparse | SbLargeFile
+	)
+	for _, test := range []struct {
+		name     string
+		old      bool
+		compat   uint32
+		incompat uint32
+		roCompat uint32
+		want     string
+	}{
+		{name: "old revision", old: true, want: "ext2"},
+		{name: "ext2", compat: baseCompat, incompat: SbDirentFileType, roCompat: baseRoCompat, want: "ext2"},
+		{name: "ext2 with meta_bg", compat: baseCompat, incompat: SbDirentFileType | SbMetaBG, roCompat: baseRoCompat, want: "ext2"},
+		{name: "ext3", compat: baseCompat | SbHasJournal, incompat: SbDirentFileType, roCompat: baseRoCompat, want: "ext3"},
+		{name: "ext3 needing recovery", compat: baseCompat | SbHasJournal, incompat: SbDirentFileType | SbRecovery, roCompat: baseRoCompat, want: "ext3"},
+		{
+			name:     "ext4",
+			compat:   baseCompat | SbHasJournal,
+			incompat: SbDirentFileType | SbExtents | SbIs64Bit | SbFlexBg,
+			roCompat: baseRoCompat | SbHugeFile | SbDirNlink | SbExtraIsize | SbMetadataCsum,
+			want:     "ext4",
+		},
+		{name: "ext4 without journal", compat: baseCompat, incompat: SbDirentFileType | SbExtents, roCompat: baseRoCompat, want: "ext4"},
+		{name: "ext3 with huge_file", compat: baseCompat | SbHasJournal, incompat: SbDirentFileType, roCompat: baseRoCompat | SbHugeFile, want: "ext4"},
+		{name: "ext2 with flex_bg", compat: baseCompat, incompat: SbDirentFileType | SbFlexBg, roCompat: baseRoCompat, want: "ext4"},
+		{name: "unknown feature", compat: baseCompat, incompat: SbDirentFileType | 0x80000, roCompat: baseRoCompat, want: "ext4"},
+		{name: "journal device", incompat: SbJournalDev},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := &SuperBlock32Bit{}
+			if !test.old {
+				sb.RevLevel = uint32(DynamicRev)
+			}
+			sb.FeatureCompat = test.compat
+			sb.FeatureIncompat = test.incompat
+			sb.FeatureRoCompat = test.roCompat
+			for _, variant := range []struct {
+				name string
+				fn   string
+				is   func(SuperBlock) bool
+			}{
+				{name: "ext2", fn: "IsExt2", is: IsExt2},
+				{name: "ext3", fn: "IsExt3", is: IsExt3},
+				{name: "ext4", fn: "IsExt4", is: IsExt4},
+			} {
+				if got, want := variant.is(sb), variant.name == test.want; got != want {
+					t.Errorf("%s() = %t, want %t", variant.fn, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestFsckRecommended tests the mount count and check interval based fsck
+// recommendation.
+func TestFsckRecommended(t *testing.T) {
+	now := time.FromUnix(1000000, 0)
+	for _, test := range []struct {
+		name          string
+		mounts        uint16
+		maxMounts     uint16
+		lastCheck     uint32
+		checkInterval uint32
+		want          bool
+	}{
+		{name: "fresh", mounts: 1, maxMounts: 20, lastCheck: 999999, checkInterval: 3600},
+		{name: "max mount count reached", mounts: 20, maxMounts: 20, want: true},
+		{name: "max mount count disabled", mounts: 100, maxMounts: 0},
+		{name: "max mount count negative", mounts: 100, maxMounts: 0xffff},
+		{name: "check interval exceeded", lastCheck: 1000000 - 3601, checkInterval: 3600, want: true},
+		{name: "check interval disabled", lastCheck: 0, checkInterval: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := SuperBlockOld{
+				MountCountRaw:    test.mounts,
+				MaxMountCountRaw: test.maxMounts,
+				LastCheckRaw:     test.lastCheck,
+				CheckIntervalRaw: test.checkInterval,
+			}
+			if got := FsckRecommended(&sb, now); got != test.want {
+				t.Errorf("FsckRecommended() = %t, want %t", got, test.want)
+			}
+		})
+	}
+
+	// The 64-bit superblock extends s_lastcheck with s_lastcheck_hi.
+	sb := SuperBlock64Bit{}
+	sb.LastCheckRaw = 1
+	sb.LastCheckHi = 1
+	if got, want := sb.LastCheck(), time.FromUnix(1<<32|1, 0); got != want {
+		t.Errorf("LastCheck() = %v, want %v", got, want)
+	}
+}
+
+// TestTimestamps tests that superblock timestamps decode to the recorded
+// second, extended by the high bits of the 64-bit superblock.
+func TestTimestamps(t *testing.T) {
+	const sec = 1577836800 // 2020-01-01T00:00:00Z.
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.Mtime = sec
+	sb.Wtime = sec
+	sb.MkfsTime = sec
+	sb.LastCheckRaw = sec
+	sb.FirstErrorTime = sec
+	sb.LastErrorTime = sec
+
+	for _, test := range []struct {
+		name string
+		get  func() time.Time
+	}{
+		{name: "MountTime", get: sb.MountTime},
+		{name: "WriteTime", get: sb.WriteTime},
+		{name: "CreationTime", get: sb.CreationTime},
+		{name: "LastCheck", get: sb.LastCheck},
+		{name: "FirstError", get: func() time.Time { return sb.FirstError().Time }},
+		{name: "LastError", get: func() time.Time { return sb.LastError().Time }},
+	} {
+		if got, want := test.get(), time.FromUnix(sec, 0); got != want {
+			t.Errorf("%s() = %v, want %v", test.name, got, want)
+		}
+		if got, want := formatTime(test.get()), "2020-01-01T00:00:00Z"; got != want {
+			t.Errorf("%s() formats as %q, want %q", test.name, got, want)
+		}
+	}
+
+	sb.MtimeHi = 1
+	sb.WtimeHi = 2
+	sb.MkfsTimeHi = 3
+	sb.FirstErrorTimeHi = 4
+	sb.LastErrorTimeHi = 5
+	for _, test := range []struct {
+		name string
+		got  time.Time
+		hi   int64
+	}{
+		{name: "MountTime", got: sb.MountTime(), hi: 1},
+		{name: "WriteTime", got: sb.WriteTime(), hi: 2},
+		{name: "CreationTime", got: sb.CreationTime(), hi: 3},
+		{name: "FirstError", got: sb.FirstError().Time, hi: 4},
+		{name: "LastError", got: sb.LastError().Time, hi: 5},
+	} {
+		if want := time.FromUnix(test.hi<<32|sec, 0); test.got != want {
+			t.Errorf("%s() with high bits = %v, want %v", test.name, test.got, want)
+		}
+	}
+
+	// The 32-bit superblock has no high bits.
+	sb32 := sb.SuperBlock32Bit
+	if got, want := sb32.MountTime(), time.FromUnix(sec, 0); got != want {
+		t.Errorf("32-bit MountTime() = %v, want %v", got, want)
+	}
+	// Old superblocks do not record their creation time.
+	if got, want := sb.SuperBlockOld.CreationTime(), time.FromUnix(0, 0); got != want {
+		t.Errorf("old CreationTime() = %v, want %v", got, want)
+	}
+}
+
+// TestFirstMetaBG tests that s_first_meta_bg is only reported with the meta_bg
+// feature.
+func TestFirstMetaBG(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FirstMetaBg = 4
+	if got := sb.FirstMetaBG(); got != 0 {
+		t.Errorf("FirstMetaBG() without meta_bg = %d, want 0", got)
+	}
+
+	sb.FeatureIncompat = IncompatFeatures{MetaBG: true}.ToInt()
+	raw := binary.Marshal(nil, binary.LittleEndian, sb)
+	var got SuperBlock32Bit
+	binary.Unmarshal(raw, binary.LittleEndian, &got)
+	if got.FirstMetaBG() != 4 {
+		t.Errorf("FirstMetaBG() = %d, want 4", got.FirstMetaBG())
+	}
+}
+
+// TestFlexGroupSize tests the flex group size with and without flex_bg.
+func TestFlexGroupSize(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.LogGroupsPerFlexRaw = 4
+	if got := sb.FlexGroupSize(); got != 1 {
+		t.Errorf("FlexGroupSize() without flex_bg = %d, want 1", got)
+	}
+
+	sb.FeatureIncompat = IncompatFeatures{FlexBg: true}.ToInt()
+	if got := sb.LogGroupsPerFlex(); got != 4 {
+		t.Errorf("LogGroupsPerFlex() = %d, want 4", got)
+	}
+	if got := sb.FlexGroupSize(); got != 16 {
+		t.Errorf("FlexGroupSize() = %d, want 16", got)
+	}
+}
+
+// TestHashSeed tests the htree hash accessors.
+func TestHashSeed(t *testing.T) {
+	sb := SuperBlock32Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.HashSeedRaw = [4]uint32{1, 2, 3, 4}
+	sb.DefaultHashVersionRaw = 1
+	if got, want := sb.HashSeed(), [4]uint32{1, 2, 3, 4}; got != want {
+		t.Errorf("HashSeed() = %v, want %v", got, want)
+	}
+	if got := sb.DefaultHashVersion(); got != 1 {
+		t.Errorf("DefaultHashVersion() = %d, want 1", got)
+	}
+
+	sb.RevLevel = uint32(OldRev)
+	if got := sb.HashSeed(); got != [4]uint32{} {
+		t.Errorf("OldRev HashSeed() = %v, want zero", got)
+	}
+}
+
+// TestOSCodeString tests the rendering of known and unknown creator OS codes.
+func TestOSCodeString(t *testing.T) {
+	for code, want := range map[OSCode]string{
+		OSLinux:   "Linux",
+		OSHurd:    "Hurd",
+		OSMasix:   "Masix",
+		OSFreeBSD: "FreeBSD",
+		OSLites:   "Lites",
+		99:        "Unknown(99)",
+	} {
+		if got := code.String(); got != want {
+			t.Errorf("OSCode(%d).String() = %q, want %q", uint32(code), got, want)
+		}
+	}
+
+	sb := SuperBlockOld{CreatorOSRaw: 3}
+	if got := sb.CreatorOS(); got != OSFreeBSD {
+		t.Errorf("CreatorOS() = %v, want %v", got, OSFreeBSD)
+	}
+}
+
+// TestErrorPolicy tests the names of the error behaviors.
+func TestErrorPolicy(t *testing.T) {
+	for policy, name := range map[SbErrorPolicy]string{
+		SbErrorsContinue:        "continue",
+		SbErrorsRemountReadOnly: "remount-ro",
+		SbErrorsPanic:           "panic",
+	} {
+		if got := policy.String(); got != name {
+			t.Errorf("SbErrorPolicy(%d).String() = %q, want %q", uint16(policy), got, name)
+		}
+		if got, err := ParseErrorPolicy(name); err != nil || got != policy {
+			t.Errorf("ParseErrorPolicy(%q) = (%v, %v), want (%v, nil)", name, got, err, policy)
+		}
+	}
+
+	if got, want := SbErrorsUnset.String(), "unset"; got != want {
+		t.Errorf("SbErrorsUnset.String() = %q, want %q", got, want)
+	}
+	if got, want := SbErrorPolicy(7).String(), "Unknown(7)"; got != want {
+		t.Errorf("SbErrorPolicy(7).String() = %q, want %q", got, want)
+	}
+	for _, name := range []string{"", "unset", "Unknown(7)", "remount_ro", "Panic"} {
+		if got, err := ParseErrorPolicy(name); err == nil {
+			t.Errorf("ParseErrorPolicy(%q) = %v, want error", name, got)
+		}
+	}
+
+	sb := SuperBlockOld{Errors: 2}
+	if got := sb.ErrorPolicy(); got != SbErrorsRemountReadOnly {
+		t.Errorf("ErrorPolicy() = %v, want %v", got, SbErrorsRemountReadOnly)
+	}
+}
+
+// TestClusters tests block and cluster conversions of a bigalloc filesystem
+// with 1k blocks and 16k clusters (s_log_cluster_size = 4).
+func TestClusters(t *testing.T) {
+	sb := &SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureRoCompat = RoCompatFeatures{Bigalloc: true}.ToInt()
+	sb.LogClusterSize = 4
+	sb.BlocksCountLo = 1000
+
+	if got := sb.ClusterSize(); got != 16384 {
+		t.Errorf("ClusterSize() = %d, want 16384", got)
+	}
+	// The last cluster is partial.
+	if got := sb.ClustersCount(); got != 63 {
+		t.Errorf("ClustersCount() = %d, want 63", got)
+	}
+	for _, test := range []struct {
+		blk     uint64
+		cluster uint64
+		first   uint64
+	}{
+		{blk: 0, cluster: 0, first: 0},
+		{blk: 15, cluster: 0, first: 0},
+		{blk: 16, cluster: 1, first: 16},
+		{blk: 999, cluster: 62, first: 992},
+	} {
+		if got := BlockToCluster(sb, test.blk); got != test.cluster {
+			t.Errorf("BlockToCluster(%d) = %d, want %d", test.blk, got, test.cluster)
+		}
+		if got := ClusterToBlock(sb, test.cluster); got != test.first {
+			t.Errorf("ClusterToBlock(%d) = %d, want %d", test.cluster, got, test.first)
+		}
+	}
+
+	// Without bigalloc, clusters are blocks.
+	sb.FeatureRoCompat = 0
+	sb.LogClusterSize = 0
+	if got := sb.ClustersCount(); got != 1000 {
+		t.Errorf("ClustersCount() without bigalloc = %d, want 1000", got)
+	}
+	if got := BlockToCluster(sb, 999); got != 999 {
+		t.Errorf("BlockToCluster(999) without bigalloc = %d, want 999", got)
+	}
+	if got := ClusterToBlock(sb, 999); got != 999 {
+		t.Errorf("ClusterToBlock(999) without bigalloc = %d, want 999", got)
+	}
+}
+
+// TestErrorInfo tests that the error information recorded by Linux is parsed
+// from its offsets in the on-disk superblock.
+func TestErrorInfo(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureIncompat = IncompatFeatures{Is64Bit: true}.ToInt()
+	raw := binary.Marshal(nil, binary.LittleEndian, &sb)
+
+	le := binary.LittleEndian
+	le.PutUint32(raw[0x194:], 3)           // s_error_count
+	le.PutUint32(raw[0x198:], 0x5e0be100)  // s_first_error_time
+	le.PutUint32(raw[0x19c:], 12)          // s_first_error_ino
+	le.PutUint64(raw[0x1a0:], 0x100000022) // s_first_error_block
+	copy(raw[0x1a8:], "ext4_lookup")       // s_first_error_func
+	le.PutUint32(raw[0x1c8:], 1701)        // s_first_error_line
+	le.PutUint32(raw[0x1cc:], 0x5e0d3280)  // s_last_error_time
+	le.PutUint32(raw[0x1d0:], 13)          // s_last_error_ino
+	le.PutUint32(raw[0x1d4:], 274)         // s_last_error_line
+	le.PutUint64(raw[0x1d8:], 35)          // s_last_error_block
+	copy(raw[0x1e0:], "ext4_iget")         // s_last_error_func
+	raw[0x279] = 1                         // s_last_error_time_hi
+	raw[0x27a] = 5                         // s_first_error_errcode
+	raw[0x27b] = 4                         // s_last_error_errcode
+
+	var got SuperBlock64Bit
+	binary.Unmarshal(raw, binary.LittleEndian, &got)
+	if got.ErrorCount() != 3 {
+		t.Errorf("ErrorCount() = %d, want 3", got.ErrorCount())
+	}
+	if want := (SbErrorInfo{
+		Time:  time.FromUnix(0x5e0be100, 0),
+		Inode: 12,
+		Block: 0x100000022,
+		Func:  "ext4_lookup",
+		Line:  1701,
+		Code:  5,
+	}); got.FirstError() != want {
+		t.Errorf("FirstError() = %+v, want %+v", got.FirstError(), want)
+	}
+	if want := (SbErrorInfo{
+		Time:  time.FromUnix(1<<32|0x5e0d3280, 0),
+		Inode: 13,
+		Block: 35,
+		Func:  "ext4_iget",
+		Line:  274,
+		Code:  4,
+	}); got.LastError() != want {
+		t.Errorf("LastError() = %+v, want %+v", got.LastError(), want)
+	}
+
+	var sb32 SuperBlock32Bit
+	if sb32.ErrorCount() != 0 || sb32.FirstError() != (SbErrorInfo{}) || sb32.LastError() != (SbErrorInfo{}) {
+		t.Errorf("SuperBlock32Bit error information = (%d, %+v, %+v), want zero values", sb32.ErrorCount(), sb32.FirstError(), sb32.LastError())
+	}
+}
+
+// TestMarshalSuperBlock tests that marshalling a modified superblock only
+// changes the modified fields and the checksum, preserving reserved bytes and
+// the bytes past the struct.
+func TestMarshalSuperBlock(t *testing.T) {
+	sb := SuperBlock64Bit{}
+	sb.RevLevel = uint32(DynamicRev)
+	sb.FeatureRoCompat = RoCompatFeatures{MetadataCsum: true}.ToInt()
+	sb.ChecksumTypeRaw = SbCrc32c
+	sb.BlocksCountLo = 64
+	raw := binary.Marshal(nil, binary.LittleEndian, sb)
+	// Fill s_reserved, which has no field.
+	for i := 0x27c; i < sbChecksumOff; i++ {
+		raw[i] = byte(i)
+	}
+	if err := UpdateChecksum(raw); err != nil {
+		t.Fatalf("UpdateChecksum() failed: %v", err)
+	}
+
+	var parsed SuperBlock64Bit
+	binary.Unmarshal(raw, binary.LittleEndian, &parsed)
+	got, err := MarshalSuperBlock(&parsed, raw)
+	if err != nil {
+		t.Fatalf("MarshalSuperBlock() failed: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Errorf("MarshalSuperBlock() of unmodified superblock differs from its raw superblock")
+	}
+
+	copy(parsed.VolumeName[:], "label")
+	got, err = MarshalSuperBlock(&parsed, raw)
+	if err != nil {
+		t.Fatalf("MarshalSuperBlock() failed: %v", err)
+	}
+	if ok, err := VerifyChecksum(got); !ok || err != nil {
+		t.Errorf("VerifyChecksum() of modified superblock = (%t, %v), want (true, nil)", ok, err)
+	}
+	for i := range raw {
+		// s_volume_name is at 0x78.
+		if modified := (i >= 0x78 && i < 0x78+len("label")) || i >= sbChecksumOff; modified != (got[i] != raw[i]) {
+			t.Errorf("byte %#x = %#x, original %#x", i, got[i], raw[i])
+		}
+	}
+
+	// The bytes past the old superblock struct are preserved, but for the
+	// checksum.
+	var old SuperBlockOld
+	binary.Unmarshal(raw[:binary.Size(old)], binary.LittleEndian, &old)
+	old.MaxMountCountRaw = 20
+	if got, err = MarshalSuperBlock(&old, raw); err != nil {
+		t.Fatalf("MarshalSuperBlock() of old superblock failed: %v", err)
+	}
+	if !bytes.Equal(got[binary.Size(old):sbChecksumOff], raw[binary.Size(old):sbChecksumOff]) {
+		t.Errorf("MarshalSuperBlock() of old superblock modified the bytes past it")
+	}
+
+	if _, err := MarshalSuperBlock(&parsed, raw[:SbSize-1]); err == nil {
+		t.Errorf("MarshalSuperBlock() of short raw superblock succeeded, want error")
+	}
+}
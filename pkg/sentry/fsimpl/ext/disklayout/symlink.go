@@ -0,0 +1,99 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+)
+
+// MaxFastSymlinkLen is the length of the longest symlink target which can be
+// stored in i_block.
+const MaxFastSymlinkLen = 59
+
+// ErrEncryptedSymlink is returned when the target of an encrypted symlink is
+// requested. The stored target is ciphertext.
+var ErrEncryptedSymlink = errors.New("ext symlink is encrypted")
+
+// isFastSymlink returns true if the symlink inode in stores its target in
+// i_block. Like Linux, this is the case if no blocks other than an extended
+// attribute block are allocated to it. Since the size of the attribute block
+// is not known here, symlinks with one are taken to be fast if their target
+// fits in i_block.
+func isFastSymlink(in Inode) bool {
+	if in.Flags().Inline {
+		return false
+	}
+	if in.BlocksCount() == 0 {
+		return true
+	}
+	return in.FileACL() != 0 && in.Size() <= MaxFastSymlinkLen && !in.Flags().Encrypt
+}
+
+// SymlinkTarget returns the target of the symlink inode in. Fast symlink
+// targets are read from i_block. Slow symlink targets are read from the
+// inode's data blocks through readBlock, which must read the inode's logical
+// (not physical) blocks. The target ends at the inode size or the first NUL
+// byte, whichever comes first. Like in Linux, targets of slow symlinks must be
+// shorter than PATH_MAX.
+//
+// Targets of inline data symlinks are stored in the inode's extended
+// attributes and must be read with InlineData instead. Returns
+// ErrEncryptedSymlink for encrypted symlinks.
+func SymlinkTarget(in Inode, readBlock BlockReader) (string, error) {
+	if in.Flags().Encrypt {
+		return "", ErrEncryptedSymlink
+	}
+	if in.Flags().Inline {
+		return "", errors.New("ext symlink target is stored as inline data")
+	}
+
+	size := in.Size()
+	var target []byte
+	if isFastSymlink(in) {
+		if size > MaxFastSymlinkLen {
+			return "", fmt.Errorf("fast symlink of %d bytes does not fit in i_block", size)
+		}
+		target = in.Data()[:size]
+	} else {
+		// The size is checked before allocating the target, since it was read
+		// from disk.
+		if size >= linux.PATH_MAX {
+			return "", fmt.Errorf("slow symlink of %d bytes is not shorter than PATH_MAX", size)
+		}
+		target = make([]byte, 0, size)
+		for blk := uint64(0); uint64(len(target)) < size; blk++ {
+			buf, err := readBlock(blk)
+			if err != nil {
+				return "", err
+			}
+			if len(buf) == 0 {
+				return "", fmt.Errorf("empty symlink block %d", blk)
+			}
+			if rem := size - uint64(len(target)); uint64(len(buf)) > rem {
+				buf = buf[:rem]
+			}
+			target = append(target, buf...)
+		}
+	}
+
+	if i := bytes.IndexByte(target, 0); i >= 0 {
+		target = target[:i]
+	}
+	return string(target), nil
+}
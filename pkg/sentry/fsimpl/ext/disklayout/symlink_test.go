@@ -0,0 +1,113 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+)
+
+// symlinkBlocks returns a BlockReader serving target from blocks of blkSize
+// bytes padded with zeros.
+func symlinkBlocks(target string, blkSize int) BlockReader {
+	return func(blk uint64) ([]byte, error) {
+		buf := make([]byte, blkSize)
+		if off := int(blk) * blkSize; off < len(target) {
+			copy(buf, target[off:])
+		}
+		return buf, nil
+	}
+}
+
+// noBlocks is a BlockReader for fast symlinks, which must not read blocks.
+func noBlocks(blk uint64) ([]byte, error) {
+	return nil, errors.New("fast symlink read a block")
+}
+
+// TestSymlinkTarget tests reading fast and slow symlink targets.
+func TestSymlinkTarget(t *testing.T) {
+	fast := "/usr/lib/libfoo.so.1"
+	slow := strings.Repeat("0123456789/", 18) + "ab"
+	for _, test := range []struct {
+		name      string
+		target    string
+		size      uint64
+		blocks    uint32
+		fileACL   uint32
+		readBlock BlockReader
+		want      string
+		wantFast  bool
+	}{
+		{name: "fast", target: fast, size: 20, readBlock: noBlocks, want: fast, wantFast: true},
+		{name: "fast with xattr block", target: fast, size: 20, blocks: 2, fileACL: 100, readBlock: noBlocks, want: fast, wantFast: true},
+		{name: "fast with NUL", target: "abc\x00def", size: 7, readBlock: noBlocks, want: "abc", wantFast: true},
+		{name: "slow", size: 200, blocks: 2, readBlock: symlinkBlocks(slow, 1024), want: slow},
+		{name: "slow over several blocks", size: 200, blocks: 2, readBlock: symlinkBlocks(slow, 64), want: slow},
+		{name: "slow with xattr block", size: 200, blocks: 4, fileACL: 100, readBlock: symlinkBlocks(slow, 1024), want: slow},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			in := &InodeNew{}
+			in.ModeRaw = uint16(linux.ModeSymlink | 0777)
+			in.SizeLo = uint32(test.size)
+			in.BlocksCountLo = test.blocks
+			in.FileACLLo = test.fileACL
+			copy(in.DataRaw[:], test.target)
+			got, err := SymlinkTarget(in, test.readBlock)
+			if err != nil {
+				t.Fatalf("SymlinkTarget failed: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SymlinkTarget = %q, want %q", got, test.want)
+			}
+			if got := in.IsFastSymlink(); got != test.wantFast {
+				t.Errorf("IsFastSymlink() = %t, want %t", got, test.wantFast)
+			}
+		})
+	}
+}
+
+// TestSymlinkTargetErrors tests symlinks whose target cannot be read.
+func TestSymlinkTargetErrors(t *testing.T) {
+	in := &InodeNew{}
+	in.SizeLo = 20
+	in.FlagsRaw = InEncrypt
+	if _, err := SymlinkTarget(in, noBlocks); err != ErrEncryptedSymlink {
+		t.Errorf("SymlinkTarget of encrypted symlink = %v, want %v", err, ErrEncryptedSymlink)
+	}
+
+	// A fast symlink can not be longer than i_block.
+	in.FlagsRaw = 0
+	in.SizeLo = MaxFastSymlinkLen + 1
+	if _, err := SymlinkTarget(in, noBlocks); err == nil {
+		t.Errorf("SymlinkTarget of oversized fast symlink succeeded, want error")
+	}
+
+	// Errors reading a slow symlink's blocks are returned.
+	in.BlocksCountLo = 2
+	if _, err := SymlinkTarget(in, noBlocks); err == nil {
+		t.Errorf("SymlinkTarget with failing reads succeeded, want error")
+	}
+
+	// Slow symlinks must be shorter than PATH_MAX.
+	for _, size := range []uint32{linux.PATH_MAX, 0xffffffff} {
+		in.SizeLo = size
+		if _, err := SymlinkTarget(in, symlinkBlocks("/target", 1024)); err == nil {
+			t.Errorf("SymlinkTarget of %d byte slow symlink succeeded, want error", size)
+		}
+	}
+}
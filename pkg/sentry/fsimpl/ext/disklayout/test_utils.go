@@ -21,6 +21,10 @@ import (
 	"gvisor.dev/gvisor/pkg/binary"
 )
 
+// testUUID is the UUID the test filesystems are created with (mke2fs -U
+// 26f15451-fbf8-4e5c-86fd-3c43ce697738).
+var testUUID = [16]byte{0x26, 0xf1, 0x54, 0x51, 0xfb, 0xf8, 0x4e, 0x5c, 0x86, 0xfd, 0x3c, 0x43, 0xce, 0x69, 0x77, 0x38}
+
 func assertSize(t *testing.T, v interface{}, want uintptr) {
 	t.Helper()
 
@@ -0,0 +1,229 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// Extended attributes are stored as a list of ext4_xattr_entry structs,
+// terminated by 4 zero bytes, and a separate area holding their values. They
+// are either stored in the inode body after the extra inode fields, or in a
+// dedicated block.
+//
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/attributes.html.
+
+const (
+	// XattrMagic is the magic number at the start of the in-inode extended
+	// attribute area and of xattr blocks.
+	XattrMagic = 0xea020000
+
+	// XattrEntrySize is the size of an XattrEntry without its name.
+	XattrEntrySize = 16
+
+	// XattrBlockHeaderSize is the size of XattrBlockHeader. The entries of an
+	// xattr block follow it.
+	XattrBlockHeaderSize = 32
+
+	// xattrBlockChecksumOff is the offset of h_checksum in XattrBlockHeader.
+	xattrBlockChecksumOff = 16
+)
+
+// Extended attribute name indices. Each selects the prefix of the names of
+// the attributes which use it.
+const (
+	XattrIndexUser            = 1
+	XattrIndexPosixACLAccess  = 2
+	XattrIndexPosixACLDefault = 3
+	XattrIndexTrusted         = 4
+	XattrIndexSecurity        = 6
+	XattrIndexSystem          = 7
+	XattrIndexRichACL         = 8
+	XattrIndexHurd            = 10
+)
+
+// xattrPrefixes maps name indices to name prefixes. The POSIX ACL and richacl
+// indices name a single attribute, so their stored names are empty.
+var xattrPrefixes = map[uint8]string{
+	XattrIndexUser:            "user.",
+	XattrIndexPosixACLAccess:  "system.posix_acl_access",
+	XattrIndexPosixACLDefault: "system.posix_acl_default",
+	XattrIndexTrusted:         "trusted.",
+	XattrIndexSecurity:        "security.",
+	XattrIndexSystem:          "system.",
+	XattrIndexRichACL:         "system.richacl",
+	XattrIndexHurd:            "gnu.",
+}
+
+// XattrEntry represents the ext4_xattr_entry struct. Each entry is followed
+// by its NameLength byte name padded to 4 bytes.
+type XattrEntry struct {
+	NameLength  uint8
+	NameIndex   uint8
+	ValueOffset uint16
+	ValueInode  uint32
+	ValueSize   uint32
+	Hash        uint32
+}
+
+// XattrBlockHeader represents the ext4_xattr_header struct at the start of
+// an xattr block. The entries grow down from the header while the values
+// grow up from the end of the block.
+type XattrBlockHeader struct {
+	Magic    uint32
+	RefCount uint32
+	Blocks   uint32
+	Hash     uint32
+	Checksum uint32
+	_        [3]uint32
+}
+
+// Xattr is a decoded extended attribute.
+type Xattr struct {
+	// NameIndex is the on-disk name index.
+	NameIndex uint8
+
+	// Name is the full name of the attribute including the prefix selected by
+	// NameIndex, e.g. "user.foo".
+	Name string
+
+	// Value is the attribute value. It aliases the buffer it was parsed from.
+	// It is nil if ValueInode is set.
+	Value []byte
+
+	// ValueInode is the number of the inode whose data is the value of this
+	// attribute, or 0 if the value is stored with the entry. Only used with
+	// the SbExtAttrInode feature.
+	ValueInode uint32
+}
+
+// parseXattrEntries parses the xattr entries starting at entriesOff in buf.
+// Value offsets are relative to the start of buf and values must lie after
+// the entries. Like Linux, attributes with unknown name indices are skipped.
+func parseXattrEntries(buf []byte, entriesOff int) ([]Xattr, error) {
+	type value struct{ start, end int }
+	var xattrs []Xattr
+	var values []value
+	off := entriesOff
+	for {
+		if off+4 > len(buf) {
+			return nil, fmt.Errorf("xattr entries at %d are not terminated within %d bytes", entriesOff, len(buf))
+		}
+		if binary.LittleEndian.Uint32(buf[off:]) == 0 {
+			break
+		}
+		if off+XattrEntrySize > len(buf) {
+			return nil, fmt.Errorf("xattr entry at %d overflows %d bytes", off, len(buf))
+		}
+		var entry XattrEntry
+		binary.Unmarshal(buf[off:off+XattrEntrySize], binary.LittleEndian, &entry)
+		nameEnd := off + XattrEntrySize + int(entry.NameLength)
+		if nameEnd > len(buf) {
+			return nil, fmt.Errorf("xattr name at %d overflows %d bytes", off, len(buf))
+		}
+		name := string(buf[off+XattrEntrySize : nameEnd])
+		off = (nameEnd + 3) &^ 3
+
+		// Values stored in inodes have their size set but no local storage.
+		start := int(entry.ValueOffset)
+		end := start
+		if entry.ValueInode == 0 {
+			end += int(entry.ValueSize)
+		}
+		if end > len(buf) {
+			return nil, fmt.Errorf("xattr %q value at %d overflows %d bytes", name, start, len(buf))
+		}
+
+		prefix, ok := xattrPrefixes[entry.NameIndex]
+		if !ok {
+			continue
+		}
+		xattrs = append(xattrs, Xattr{NameIndex: entry.NameIndex, Name: prefix + name, ValueInode: entry.ValueInode})
+		values = append(values, value{start, end})
+	}
+
+	// The values follow the terminator of the entries.
+	for i, v := range values {
+		if v.end == v.start {
+			continue
+		}
+		if v.start < off+4 {
+			return nil, fmt.Errorf("xattr %q value at %d overlaps the entries", xattrs[i].Name, v.start)
+		}
+		xattrs[i].Value = buf[v.start:v.end]
+	}
+	return xattrs, nil
+}
+
+// ParseInodeXattrs parses the extended attributes stored in the inode body of
+// inodeRaw, the on-disk inode record of inodeSize bytes (sb.InodeSize()) whose
+// i_extra_isize is extraIsize. The attribute area follows the extra inode
+// fields and holds no attributes unless it starts with XattrMagic. Value
+// offsets are relative to the first entry following the magic.
+func ParseInodeXattrs(inodeRaw []byte, inodeSize uint16, extraIsize uint16) ([]Xattr, error) {
+	if int(inodeSize) > len(inodeRaw) {
+		return nil, fmt.Errorf("inode record is %d bytes, want %d", len(inodeRaw), inodeSize)
+	}
+	start := OldInodeSize + int(extraIsize)
+	if start > int(inodeSize) {
+		return nil, fmt.Errorf("extra inode size %d overflows the %d byte inode", extraIsize, inodeSize)
+	}
+	if start+4 > int(inodeSize) || binary.LittleEndian.Uint32(inodeRaw[start:]) != XattrMagic {
+		return nil, nil
+	}
+	return parseXattrEntries(inodeRaw[start+4:inodeSize], 0)
+}
+
+// InodeXattr looks up the extended attribute with the given name index and
+// name (without the prefix) in the in-inode xattr area of raw, the full
+// on-disk record of inode in. The second return value is false if there is
+// no such attribute.
+func InodeXattr(raw []byte, in Inode, nameIndex uint8, name string) ([]byte, bool, error) {
+	xattrs, err := ParseInodeXattrs(raw, uint16(len(raw)), in.InodeSize()-OldInodeSize)
+	if err != nil {
+		return nil, false, err
+	}
+	full := xattrPrefixes[nameIndex] + name
+	for _, x := range xattrs {
+		if x.NameIndex == nameIndex && x.Name == full {
+			if x.ValueInode != 0 {
+				return nil, false, newDiskErrorf(ErrUnsupportedFeature, "xattr %q has its value stored in inode %d, which is not supported", full, x.ValueInode)
+			}
+			return x.Value, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// ParseXattrBlock parses the extended attributes stored in block, the xattr
+// block referred to by Inode.FileACL. Value offsets are relative to the start
+// of the block. Attributes whose value is stored in another inode have
+// ValueInode set instead of Value.
+func ParseXattrBlock(block []byte) ([]Xattr, error) {
+	if len(block) < XattrBlockHeaderSize {
+		return nil, fmt.Errorf("xattr block is only %d bytes", len(block))
+	}
+	var hdr XattrBlockHeader
+	binary.Unmarshal(block[:XattrBlockHeaderSize], binary.LittleEndian, &hdr)
+	if hdr.Magic != XattrMagic {
+		return nil, newDiskErrorf(ErrBadMagic, "xattr block has magic %#x, want %#x", hdr.Magic, XattrMagic)
+	}
+	if hdr.Blocks != 1 {
+		return nil, newDiskErrorf(ErrCorrupt, "xattr block spans %d blocks, want 1", hdr.Blocks)
+	}
+	return parseXattrEntries(block, XattrBlockHeaderSize)
+}
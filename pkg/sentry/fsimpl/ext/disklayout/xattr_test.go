@@ -0,0 +1,223 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disklayout
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// xattrInodeRecord returns the 256 byte record of an inline data file with a
+// user.foo="bar" xattr as created by mke2fs -I 256 -O inline_data -d. Only the
+// extra inode size and the xattr area are kept.
+func xattrInodeRecord() []byte {
+	raw := make([]byte, 256)
+	binary.LittleEndian.PutUint16(raw[OldInodeSize:], 32)
+	copy(raw[160:], []byte{
+		0x00, 0x00, 0x02, 0xea, 0x04, 0x07, 0x5c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x64, 0x61, 0x74, 0x61, 0x03, 0x01, 0x58, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x66, 0x6f, 0x6f, 0x00,
+	})
+	copy(raw[252:], "bar")
+	return raw
+}
+
+// TestParseInodeXattrs tests parsing in-inode xattrs created by mke2fs.
+func TestParseInodeXattrs(t *testing.T) {
+	xattrs, err := ParseInodeXattrs(xattrInodeRecord(), 256, 32)
+	if err != nil {
+		t.Fatalf("ParseInodeXattrs failed: %v", err)
+	}
+	want := []struct {
+		index uint8
+		name  string
+		value string
+	}{
+		{XattrIndexSystem, "system.data", ""},
+		{XattrIndexUser, "user.foo", "bar"},
+	}
+	if len(xattrs) != len(want) {
+		t.Fatalf("ParseInodeXattrs returned %d xattrs, want %d", len(xattrs), len(want))
+	}
+	for i, x := range xattrs {
+		if x.NameIndex != want[i].index || x.Name != want[i].name || string(x.Value) != want[i].value {
+			t.Errorf("xattr %d = (%d, %q, %q), want (%d, %q, %q)", i, x.NameIndex, x.Name, x.Value, want[i].index, want[i].name, want[i].value)
+		}
+	}
+
+	// Values stored in other inodes are referenced but not read.
+	raw := xattrInodeRecord()
+	raw[188] = 13
+	xattrs, err = ParseInodeXattrs(raw, 256, 32)
+	if err != nil || len(xattrs) != 2 || xattrs[1].ValueInode != 13 || xattrs[1].Value != nil {
+		t.Errorf("ParseInodeXattrs with value inode = (%+v, %v), want user.foo in inode 13", xattrs, err)
+	}
+
+	// Without room for the magic or without the magic, there are no xattrs.
+	if xattrs, err := ParseInodeXattrs(xattrInodeRecord(), 256, 256-OldInodeSize); xattrs != nil || err != nil {
+		t.Errorf("ParseInodeXattrs without room = (%v, %v), want (nil, nil)", xattrs, err)
+	}
+	if xattrs, err := ParseInodeXattrs(xattrInodeRecord(), 256, 36); xattrs != nil || err != nil {
+		t.Errorf("ParseInodeXattrs without magic = (%v, %v), want (nil, nil)", xattrs, err)
+	}
+}
+
+// TestParseInodeXattrsNames tests that name indices map to prefixes.
+func TestParseInodeXattrsNames(t *testing.T) {
+	for _, test := range []struct {
+		index uint8
+		name  string
+		want  string
+	}{
+		{XattrIndexUser, "foo", "user.foo"},
+		{XattrIndexPosixACLAccess, "", "system.posix_acl_access"},
+		{XattrIndexPosixACLDefault, "", "system.posix_acl_default"},
+		{XattrIndexTrusted, "overlay.opaque", "trusted.overlay.opaque"},
+		{XattrIndexSecurity, "selinux", "security.selinux"},
+		{XattrIndexSystem, "data", "system.data"},
+	} {
+		raw := xattrInodeRecord()
+		raw[165] = test.index
+		raw[164] = uint8(len(test.name))
+		copy(raw[180:184], make([]byte, 4))
+		copy(raw[180:], test.name)
+		// Drop the second entry so that long names do not clobber it.
+		copy(raw[180+(len(test.name)+3)&^3:], make([]byte, 4))
+
+		xattrs, err := ParseInodeXattrs(raw, 256, 32)
+		if err != nil || len(xattrs) != 1 || xattrs[0].Name != test.want {
+			t.Errorf("index %d name %q: ParseInodeXattrs = (%+v, %v), want name %q", test.index, test.name, xattrs, err, test.want)
+		}
+	}
+
+	// Unknown name indices are skipped.
+	raw := xattrInodeRecord()
+	raw[165] = 5
+	xattrs, err := ParseInodeXattrs(raw, 256, 32)
+	if err != nil || len(xattrs) != 1 || xattrs[0].Name != "user.foo" {
+		t.Errorf("ParseInodeXattrs with unknown index = (%+v, %v), want only user.foo", xattrs, err)
+	}
+}
+
+// TestParseInodeXattrsErrors tests that entries and values must stay within
+// the inode.
+func TestParseInodeXattrsErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(raw []byte)
+	}{
+		{name: "name past inode", corrupt: func(raw []byte) { raw[184] = 0xff }},
+		{name: "value past inode", corrupt: func(raw []byte) { raw[192] = 5 }},
+		{name: "value overlaps entries", corrupt: func(raw []byte) { raw[186] = 4 }},
+		{name: "unterminated entries", corrupt: func(raw []byte) {
+			// Nameless user xattrs with empty values up to the end.
+			copy(raw[164:], make([]byte, 256-164))
+			for off := 164; off < 256; off += XattrEntrySize {
+				raw[off+1] = XattrIndexUser
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			raw := xattrInodeRecord()
+			test.corrupt(raw)
+			if _, err := ParseInodeXattrs(raw, 256, 32); err == nil {
+				t.Errorf("ParseInodeXattrs succeeded, want error")
+			}
+		})
+	}
+
+	if _, err := ParseInodeXattrs(xattrInodeRecord(), 512, 32); err == nil {
+		t.Errorf("ParseInodeXattrs of short record succeeded, want error")
+	}
+	if _, err := ParseInodeXattrs(xattrInodeRecord(), 256, 256); err == nil {
+		t.Errorf("ParseInodeXattrs with oversized extra inode size succeeded, want error")
+	}
+}
+
+// xattrBlock returns xattr block 1203 of a file with user.foo="bar" and
+// user.big set to 50 'v' bytes as created by mke2fs -I 128 -O
+// metadata_csum,ea_inode -d with 1K blocks.
+func xattrBlock() []byte {
+	block := make([]byte, 1024)
+	copy(block, []byte{
+		0x00, 0x00, 0x02, 0xea, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x6c, 0xd5, 0x55, 0xeb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x01, 0xcc, 0x03, 0x00, 0x00, 0x00, 0x00, 0x32, 0x00, 0x00, 0x00, 0x77, 0x76, 0x47, 0x85,
+		0x62, 0x69, 0x67, 0x00, 0x03, 0x01, 0xc8, 0x03, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
+		0x63, 0x61, 0xfd, 0x95, 0x66, 0x6f, 0x6f, 0x00,
+	})
+	copy(block[0x3c8:], "bar")
+	copy(block[0x3cc:], bytes.Repeat([]byte{'v'}, 50))
+	return block
+}
+
+// TestParseXattrBlock tests parsing xattr blocks created by mke2fs.
+func TestParseXattrBlock(t *testing.T) {
+	xattrs, err := ParseXattrBlock(xattrBlock())
+	if err != nil {
+		t.Fatalf("ParseXattrBlock failed: %v", err)
+	}
+	if len(xattrs) != 2 {
+		t.Fatalf("ParseXattrBlock returned %d xattrs, want 2", len(xattrs))
+	}
+	if x := xattrs[0]; x.Name != "user.big" || string(x.Value) != strings.Repeat("v", 50) {
+		t.Errorf("xattr 0 = (%q, %q), want user.big", x.Name, x.Value)
+	}
+	if x := xattrs[1]; x.Name != "user.foo" || string(x.Value) != "bar" {
+		t.Errorf(`xattr 1 = (%q, %q), want ("user.foo", "bar")`, x.Name, x.Value)
+	}
+
+	// With ea_inode, a 2000 byte value is stored in inode 14 instead.
+	block := make([]byte, 1024)
+	copy(block, []byte{
+		0x00, 0x00, 0x02, 0xea, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x70, 0xd6, 0x95, 0x6c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x04, 0x01, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00, 0xd0, 0x07, 0x00, 0x00, 0x76, 0x90, 0x56, 0xba,
+		0x68, 0x75, 0x67, 0x65,
+	})
+	xattrs, err = ParseXattrBlock(block)
+	if err != nil || len(xattrs) != 1 {
+		t.Fatalf("ParseXattrBlock with value inode = (%+v, %v), want 1 xattr", xattrs, err)
+	}
+	if x := xattrs[0]; x.Name != "user.huge" || x.ValueInode != 14 || x.Value != nil {
+		t.Errorf("xattr = %+v, want user.huge in inode 14", x)
+	}
+}
+
+// TestParseXattrBlockErrors tests that malformed xattr blocks are rejected.
+func TestParseXattrBlockErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(block []byte) []byte
+	}{
+		{name: "short", corrupt: func(block []byte) []byte { return block[:XattrBlockHeaderSize-1] }},
+		{name: "bad magic", corrupt: func(block []byte) []byte { block[0] = 1; return block }},
+		{name: "multiple blocks", corrupt: func(block []byte) []byte { block[8] = 2; return block }},
+		{name: "value past block", corrupt: func(block []byte) []byte { block[0x22] = 0xf0; return block }},
+		{name: "value overlaps header", corrupt: func(block []byte) []byte {
+			binary.LittleEndian.PutUint16(block[0x22:], 0x10)
+			return block
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseXattrBlock(test.corrupt(xattrBlock())); err == nil {
+				t.Errorf("ParseXattrBlock succeeded, want error")
+			}
+		})
+	}
+}
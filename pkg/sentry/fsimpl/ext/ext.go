@@ -19,13 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"time"
 
-	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/fd"
 	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
 	"gvisor.dev/gvisor/pkg/syserror"
 )
@@ -63,32 +65,85 @@ func getDeviceFd(source string, opts vfs.GetFilesystemOptions) (io.ReaderAt, err
 	return fd.NewReadWriter(devFd), nil
 }
 
-// isCompatible checks if the superblock has feature sets which are compatible.
-// We only need to check the superblock incompatible feature set since we are
-// mounting readonly. We will also need to check readonly compatible feature
-// set when mounting for read/write.
-func isCompatible(sb disklayout.SuperBlock) bool {
-	// Please note that what is being checked is limited based on the fact that we
-	// are mounting readonly and that we are not journaling. When mounting
-	// read/write or with a journal, this must be reevaluated.
+// metadataCacheBlocks is the mount option setting the number of metadata
+// blocks cached by the filesystem. 0 disables the cache.
+const metadataCacheBlocks = "metadata_cache_blocks"
+
+// metadataCacheBlocksOption returns the number of metadata blocks to cache as
+// set by the mount options data, or DefaultMetadataCacheBlocks if they do not
+// set it. Returns EINVAL if the number is invalid.
+func metadataCacheBlocksOption(data string) (int, error) {
+	mopts := vfs.GenericParseMountOptions(data)
+	str, ok := mopts[metadataCacheBlocks]
+	if !ok {
+		return DefaultMetadataCacheBlocks, nil
+	}
+	cacheBlocks, err := strconv.Atoi(str)
+	if err != nil || cacheBlocks < 0 {
+		log.Warningf("ext fs: invalid %s=%s", metadataCacheBlocks, str)
+		return 0, syserror.EINVAL
+	}
+	return cacheBlocks, nil
+}
+
+// MountVerdict is the way a filesystem can be mounted, as determined by
+// CheckMountable.
+type MountVerdict int
+
+const (
+	// MountRW indicates that the filesystem can be mounted read/write.
+	MountRW MountVerdict = iota
+
+	// MountRO indicates that the filesystem can only be mounted readonly.
+	MountRO
+
+	// Refuse indicates that the filesystem cannot be mounted.
+	Refuse
+)
+
+// String implements fmt.Stringer.String.
+func (v MountVerdict) String() string {
+	switch v {
+	case MountRW:
+		return "read/write"
+	case MountRO:
+		return "readonly"
+	case Refuse:
+		return "refused"
+	default:
+		return fmt.Sprintf("MountVerdict(%d)", int(v))
+	}
+}
+
+// CheckMountable decides how the filesystem described by sb can be mounted
+// given whether the caller wants write access, following the feature checks
+// of Linux's ext4_feature_set_ok. Filesystems with incompatible features that
+// are unknown or unsupported cannot be mounted at all, while readonly
+// compatible features that are unknown, or the readonly feature, only prevent
+// writes. Filesystems with encrypted inodes can be mounted, but the contents
+// of those inodes cannot be read (see ErrEncrypted). The returned error
+// explains why the filesystem is refused and is nil otherwise.
+func CheckMountable(sb disklayout.SuperBlock, wantWrite bool) (MountVerdict, error) {
 	incompatFeatures := sb.IncompatibleFeatures()
-	if incompatFeatures.MetaBG {
-		log.Warningf("ext fs: meta block groups are not supported")
-		return false
+	if incompatFeatures.Unknown != 0 {
+		return Refuse, fmt.Errorf("unknown incompatible features %#x", incompatFeatures.Unknown)
 	}
-	if incompatFeatures.MMP {
-		log.Warningf("ext fs: multiple mount protection is not supported")
-		return false
+	// The filesystem is inconsistent until the journal is replayed (see
+	// ReplayJournal), which readMetadata does before calling this.
+	if incompatFeatures.Recovery {
+		return Refuse, errors.New("filesystem needs journal recovery and its journal was not replayed")
 	}
-	if incompatFeatures.Encrypted {
-		log.Warningf("ext fs: encrypted inodes not supported")
-		return false
+	// Like Linux, bigalloc is only supported with extents since block maps
+	// cannot express cluster allocation.
+	roCompatFeatures := sb.ReadOnlyCompatibleFeatures()
+	if roCompatFeatures.Bigalloc && !incompatFeatures.Extents {
+		return Refuse, errors.New("bigalloc is not supported without extents")
 	}
-	if incompatFeatures.InlineData {
-		log.Warningf("ext fs: inline files not supported")
-		return false
+
+	if !wantWrite || roCompatFeatures.ReadOnly || roCompatFeatures.Unknown != 0 {
+		return MountRO, nil
 	}
-	return true
+	return MountRW, nil
 }
 
 // GetFilesystem implements vfs.FilesystemType.GetFilesystem.
@@ -101,27 +156,25 @@ func (FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.VirtualFile
 	if err != nil {
 		return nil, nil, err
 	}
-
-	fs := filesystem{dev: dev, inodeCache: make(map[uint32]*inode)}
-	fs.vfsfs.Init(vfsObj, &fs)
-	fs.sb, err = readSuperBlock(dev)
+	cacheBlocks, err := metadataCacheBlocksOption(opts.Data)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if fs.sb.Magic() != linux.EXT_SUPER_MAGIC {
-		// mount(2) specifies that EINVAL should be returned if the superblock is
-		// invalid.
-		return nil, nil, syserror.EINVAL
+	fs := filesystem{dev: dev, inodeCache: make(map[uint32]*inode), cacheBlocks: cacheBlocks}
+	fs.vfsfs.Init(vfsObj, &fs)
+	if err := fs.readMetadata(); err != nil {
+		return nil, nil, err
 	}
 
-	// Refuse to mount if the filesystem is incompatible.
-	if !isCompatible(fs.sb) {
-		return nil, nil, syserror.EINVAL
+	var now ktime.Time
+	if clk := ktime.RealtimeClockFromContext(ctx); clk != nil {
+		now = clk.Now()
+		if disklayout.FsckRecommended(fs.sb, now) {
+			log.Infof("ext fs: maximal mount count or check interval reached, running e2fsck is recommended")
+		}
 	}
-
-	fs.bgs, err = readBlockGroups(dev, fs.sb)
-	if err != nil {
+	if err := fs.checkMMP(now); err != nil {
 		return nil, nil, err
 	}
 
@@ -133,3 +186,98 @@ func (FilesystemType) GetFilesystem(ctx context.Context, vfsObj *vfs.VirtualFile
 
 	return &fs.vfsfs, &newDentry(rootInode).vfsd, nil
 }
+
+// minMMPCheckInterval is the minimum interval at which Linux checks that the
+// MMP block was updated (EXT4_MMP_MIN_CHECK_INTERVAL).
+const minMMPCheckInterval = 5 * time.Second
+
+// checkMMP warns if the MMP block of fs indicates that another node is using
+// the filesystem at time now. The filesystem can still be used since it is
+// only read. now is zero if no clock is available, in which case the MMP
+// block is only validated. Returns EINVAL if the MMP block is invalid.
+func (fs *filesystem) checkMMP(now ktime.Time) error {
+	if !fs.sb.IncompatibleFeatures().MMP {
+		return nil
+	}
+	mmp, err := readMMPBlock(fs.dev, fs.sb)
+	if err != nil {
+		return err
+	}
+	if now.IsZero() {
+		log.Infof("ext fs: no realtime clock, cannot tell whether the filesystem is in use by another node")
+		return nil
+	}
+
+	// Like Linux, give the other node twice its check interval (plus a second,
+	// but no more than a minute extra) to update the MMP block before deeming
+	// it gone.
+	interval := time.Duration(fs.sb.MMPUpdateInterval()) * time.Second
+	if interval < minMMPCheckInterval {
+		interval = minMMPCheckInterval
+	}
+	if ci := mmp.CheckInterval(); ci > interval {
+		interval = ci
+	}
+	wait := 2*interval + time.Second
+	if max := interval + time.Minute; wait > max {
+		wait = max
+	}
+	if !mmp.CheckStale(now, wait) {
+		log.Warningf("ext fs: filesystem may be in use by node %q through device %q (MMP sequence %#x)", mmp.NodeName(), mmp.DeviceName(), mmp.Seq)
+	}
+	return nil
+}
+
+// readMetadata reads the superblock and the block group descriptors of fs.dev
+// into fs, replaying the journal first if the filesystem needs recovery.
+// Returns EINVAL if the superblock is invalid or describes an incompatible
+// filesystem, if a block group descriptor is invalid or if the journal cannot
+// be replayed.
+func (fs *filesystem) readMetadata() error {
+	var err error
+	fs.sb, err = readSuperBlock(fs.dev)
+	if err != nil {
+		return err
+	}
+	fs.sb = cacheChecksumSeed(fs.sb)
+
+	if err := disklayout.ValidateSuperBlock(fs.sb); err != nil {
+		// mount(2) specifies that EINVAL should be returned if the superblock is
+		// invalid.
+		log.Warningf("ext fs: %v", err)
+		return syserror.EINVAL
+	}
+
+	// The filesystem was not cleanly unmounted and is only consistent once its
+	// journal is replayed. The journal inode is found through the group
+	// descriptors.
+	if fs.sb.IncompatibleFeatures().Recovery {
+		if err := fs.loadGroupDescriptors(); err != nil {
+			return err
+		}
+		if err := fs.replayJournal(NewBlockDevice(fs.dev, fs.sb.BlockSize(), 0)); err != nil {
+			return err
+		}
+	}
+
+	// Refuse to mount if the filesystem is incompatible. Only readonly mounts
+	// are supported.
+	if verdict, err := CheckMountable(fs.sb, false /* wantWrite */); verdict == Refuse {
+		log.Warningf("ext fs: %v", err)
+		return syserror.EINVAL
+	}
+	return fs.loadGroupDescriptors()
+}
+
+// loadGroupDescriptors reads the block group descriptors of fs.sb from fs.dev
+// into fs. Returns EINVAL if a block group descriptor is invalid.
+func (fs *filesystem) loadGroupDescriptors() error {
+	var err error
+	fs.blocks = NewBlockDevice(fs.dev, fs.sb.BlockSize(), fs.cacheBlocks)
+	fs.bgs, err = LoadGroupDescriptors(fs.sb, fs.blocks)
+	if bgErr, ok := err.(*GroupDescriptorError); ok {
+		log.Warningf("ext fs: %v", bgErr)
+		return syserror.EINVAL
+	}
+	return err
+}
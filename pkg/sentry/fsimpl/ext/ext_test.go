@@ -15,16 +15,22 @@
 package ext
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"sort"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/fspath"
 	"gvisor.dev/gvisor/pkg/sentry/contexttest"
@@ -42,11 +48,30 @@ const (
 )
 
 var (
-	ext2ImagePath = path.Join(assetsDir, "tiny.ext2")
-	ext3ImagePath = path.Join(assetsDir, "tiny.ext3")
-	ext4ImagePath = path.Join(assetsDir, "tiny.ext4")
+	ext2ImagePath       = path.Join(assetsDir, "tiny.ext2")
+	ext3ImagePath       = path.Join(assetsDir, "tiny.ext3")
+	ext4ImagePath       = path.Join(assetsDir, "tiny.ext4")
+	linksImagePath      = path.Join(assetsDir, "links.ext4")
+	bigallocImagePath   = path.Join(assetsDir, "bigalloc.ext4")
+	mmpImagePath        = path.Join(assetsDir, "mmp.ext4")
+	mmp32ImagePath      = path.Join(assetsDir, "mmp32.ext4")
+	metaBGImagePath     = path.Join(assetsDir, "metabg.ext4")
+	encryptedImagePath  = path.Join(assetsDir, "encrypted.ext4")
+	journalImagePath    = path.Join(assetsDir, "journal.ext4")
+	resizeImagePath     = path.Join(assetsDir, "resize.ext4")
+	csumSeedImagePath   = path.Join(assetsDir, "csumseed.ext4")
+	flexBGImagePath     = path.Join(assetsDir, "flexbg.ext4")
+	uninitBGImagePath   = path.Join(assetsDir, "uninitbg.ext4")
+	noFileTypeImagePath = path.Join(assetsDir, "nofiletype.ext4")
+	fragmentedImagePath = path.Join(assetsDir, "fragmented.ext4")
+	excludeImagePath    = path.Join(assetsDir, "exclude.ext4")
+	rev0ImagePath       = path.Join(assetsDir, "rev0.ext2")
 )
 
+// testUUID is the UUID the assets are created with (mke2fs -U
+// 26f15451-fbf8-4e5c-86fd-3c43ce697738), which their journals share.
+var testUUID = [16]byte{0x26, 0xf1, 0x54, 0x51, 0xfb, 0xf8, 0x4e, 0x5c, 0x86, 0xfd, 0x3c, 0x43, 0xce, 0x69, 0x77, 0x38}
+
 // setUp opens imagePath as an ext Filesystem and returns all necessary
 // elements required to run tests. If error is non-nil, it also returns a tear
 // down function which must be called after the test is run for clean up.
@@ -90,6 +115,33 @@ func setUp(t *testing.T, imagePath string) (context.Context, *vfs.VirtualFilesys
 	return ctx, vfsObj, &root, tearDown, nil
 }
 
+// readImageData returns the contents of the image at imagePath, which tests
+// may modify.
+func readImageData(tb testing.TB, imagePath string) []byte {
+	tb.Helper()
+	localImagePath, err := testutil.FindFile(imagePath)
+	if err != nil {
+		tb.Fatalf("failed to open local image at path %s: %v", imagePath, err)
+	}
+	data, err := ioutil.ReadFile(localImagePath)
+	if err != nil {
+		tb.Fatalf("failed to read image: %v", err)
+	}
+	return data
+}
+
+// readImage opens imagePath as a Filesystem reading the image from the
+// returned slice, which tests may modify.
+func readImage(tb testing.TB, imagePath string) (*Filesystem, []byte) {
+	tb.Helper()
+	data := readImageData(tb, imagePath)
+	fs, err := NewFilesystem(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatalf("NewFilesystem failed: %v", err)
+	}
+	return fs, data
+}
+
 // TODO(b/134676337): Test vfs.FilesystemImpl.ReadlinkAt and
 // vfs.FilesystemImpl.StatFSAt which are not implemented in
 // vfs.VirtualFilesystem yet.
@@ -598,6 +650,32 @@ func TestIterDirents(t *testing.T) {
 	}
 }
 
+// TestIterDirentsEncrypted tests that the entries of encrypted directories
+// are not returned and that the error is translated to ENOKEY.
+func TestIterDirentsEncrypted(t *testing.T) {
+	ctx, vfsfs, root, tearDown, err := setUp(t, encryptedImagePath)
+	if err != nil {
+		t.Fatalf("setUp failed: %v", err)
+	}
+	defer tearDown()
+
+	fd, err := vfsfs.OpenAt(
+		ctx,
+		auth.CredentialsFromContext(ctx),
+		&vfs.PathOperation{Root: *root, Start: *root, Path: fspath.Parse("/secret")},
+		&vfs.OpenOptions{},
+	)
+	if err != nil {
+		t.Fatalf("vfsfs.OpenAt failed: %v", err)
+	}
+	if err := fd.IterDirents(ctx, &iterDirentsCb{}); err != ErrEncrypted {
+		t.Errorf("IterDirents() of encrypted directory = %v, want %v", err, ErrEncrypted)
+	}
+	if errno, ok := syserror.TranslateError(ErrEncrypted); !ok || errno != syscall.ENOKEY {
+		t.Errorf("TranslateError(ErrEncrypted) = (%v, %t), want (%v, true)", errno, ok, syscall.ENOKEY)
+	}
+}
+
 // TestRootDir tests that the root directory inode is correctly initialized and
 // returned from setUp.
 func TestRootDir(t *testing.T) {
@@ -719,6 +797,8 @@ func TestFilesystemInit(t *testing.T) {
 		image   string
 		wantSb  sb
 		wantBgs []bg
+		// wantFeatures is the feature list as printed by dumpe2fs.
+		wantFeatures string
 	}
 
 	tests := []fsInitTest{
@@ -769,6 +849,7 @@ func TestFilesystemInit(t *testing.T) {
 					},
 				},
 			},
+			wantFeatures: "ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum",
 		},
 		{
 			name:  "ext3 filesystem init",
@@ -810,6 +891,7 @@ func TestFilesystemInit(t *testing.T) {
 					},
 				},
 			},
+			wantFeatures: "ext_attr resize_inode dir_index filetype sparse_super large_file",
 		},
 		{
 			name:  "ext2 filesystem init",
@@ -851,6 +933,7 @@ func TestFilesystemInit(t *testing.T) {
 					},
 				},
 			},
+			wantFeatures: "ext_attr resize_inode dir_index filetype sparse_super large_file",
 		},
 	}
 
@@ -906,6 +989,22 @@ func TestFilesystemInit(t *testing.T) {
 				t.Errorf("superblock mismatch (-want +got):\n%s", diff)
 			}
 
+			// The block-derived group count must agree with the inode-derived one.
+			inodesPerGroup := uint64(fs.sb.InodesPerGroup())
+			if got, want := fs.sb.GroupsCount(), (uint64(fs.sb.InodesCount())+inodesPerGroup-1)/inodesPerGroup; got != want {
+				t.Errorf("GroupsCount() = %d, want %d from inode count", got, want)
+			}
+
+			var gotFeatures []string
+			for _, f := range []fmt.Stringer{fs.sb.CompatibleFeatures(), fs.sb.IncompatibleFeatures(), fs.sb.ReadOnlyCompatibleFeatures()} {
+				if str := f.String(); str != "" {
+					gotFeatures = append(gotFeatures, str)
+				}
+			}
+			if got := strings.Join(gotFeatures, " "); got != test.wantFeatures {
+				t.Errorf("features = %q, want %q", got, test.wantFeatures)
+			}
+
 			if diff := cmp.Diff(gotBgs, test.wantBgs); diff != "" {
 				t.Errorf("block group descriptors mismatch (-want +got):\n%s", diff)
 			}
@@ -920,3 +1019,918 @@ func TestFilesystemInit(t *testing.T) {
 		})
 	}
 }
+
+// TestCheckMountable tests that filesystems with unknown or unsupported
+// incompatible features are refused while unknown readonly compatible features
+// and the readonly feature only prevent read/write mounts.
+func TestCheckMountable(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		incompat  uint32
+		roCompat  uint32
+		wantWrite bool
+		want      MountVerdict
+	}{
+		{
+			name:     "known features",
+			incompat: disklayout.IncompatFeatures{DirentFileType: true, Extents: true}.ToInt(),
+			want:     MountRO,
+		},
+		{
+			name:      "known features read/write",
+			incompat:  disklayout.IncompatFeatures{DirentFileType: true, Extents: true}.ToInt(),
+			wantWrite: true,
+			want:      MountRW,
+		},
+		{
+			name:     "inline data",
+			incompat: disklayout.IncompatFeatures{Extents: true, InlineData: true}.ToInt(),
+			want:     MountRO,
+		},
+		{
+			name:     "multiple mount protection",
+			incompat: disklayout.IncompatFeatures{Extents: true, MMP: true}.ToInt(),
+			want:     MountRO,
+		},
+		{
+			name:     "meta block groups",
+			incompat: disklayout.IncompatFeatures{Extents: true, MetaBG: true}.ToInt(),
+			want:     MountRO,
+		},
+		{
+			name:     "unknown incompat feature",
+			incompat: disklayout.IncompatFeatures{DirentFileType: true}.ToInt() | 0x80000000,
+			want:     Refuse,
+		},
+		{
+			name:     "encrypted",
+			incompat: disklayout.IncompatFeatures{Extents: true, Encrypted: true}.ToInt(),
+			want:     MountRO,
+		},
+		{
+			name:     "needs recovery",
+			incompat: disklayout.IncompatFeatures{Extents: true, Recovery: true}.ToInt(),
+			want:     Refuse,
+		},
+		{
+			name:     "bigalloc without extents",
+			roCompat: disklayout.RoCompatFeatures{Bigalloc: true}.ToInt(),
+			want:     Refuse,
+		},
+		{
+			name:     "unknown rocompat feature",
+			roCompat: 0x80000000,
+			want:     MountRO,
+		},
+		{
+			name:      "unknown rocompat feature read/write",
+			roCompat:  0x80000000,
+			wantWrite: true,
+			want:      MountRO,
+		},
+		{
+			name:      "readonly feature read/write",
+			roCompat:  disklayout.RoCompatFeatures{ReadOnly: true}.ToInt(),
+			wantWrite: true,
+			want:      MountRO,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := &disklayout.SuperBlock64Bit{}
+			sb.RevLevel = uint32(disklayout.DynamicRev)
+			sb.FeatureIncompat = test.incompat
+			sb.FeatureRoCompat = test.roCompat
+			got, err := CheckMountable(sb, test.wantWrite)
+			if got != test.want {
+				t.Errorf("CheckMountable(%t) = %v, want %v", test.wantWrite, got, test.want)
+			}
+			if (err != nil) != (got == Refuse) {
+				t.Errorf("CheckMountable(%t) = (%v, %v), want an error only when refused", test.wantWrite, got, err)
+			}
+		})
+	}
+}
+
+// TestSuperBlockChecksum tests that a superblock with a bad checksum is
+// refused.
+func TestSuperBlockChecksum(t *testing.T) {
+	image := readImageData(t, ext4ImagePath)
+
+	if _, err := readSuperBlock(bytes.NewReader(image)); err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+
+	// Flip a bit in s_free_inodes_count.
+	image[disklayout.SbOffset+0x10] ^= 0x1
+	if _, err := readSuperBlock(bytes.NewReader(image)); err != syserror.EINVAL {
+		t.Errorf("readSuperBlock() of corrupted superblock = %v, want %v", err, syserror.EINVAL)
+	}
+}
+
+// TestMarshalSuperBlock tests that marshalling a parsed superblock gives back
+// its raw superblock, and that a modified superblock is read back.
+func TestMarshalSuperBlock(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath, bigallocImagePath, metaBGImagePath, csumSeedImagePath} {
+		t.Run(image, func(t *testing.T) {
+			_, data := readImage(t, image)
+			raw := data[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]
+			sb := parseSuperBlock(raw)
+			got, err := disklayout.MarshalSuperBlock(sb, raw)
+			if err != nil {
+				t.Fatalf("MarshalSuperBlock() failed: %v", err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Fatalf("MarshalSuperBlock() differs from the raw superblock")
+			}
+
+			var sb32 *disklayout.SuperBlock32Bit
+			switch sb := sb.(type) {
+			case *disklayout.SuperBlock64Bit:
+				sb32 = &sb.SuperBlock32Bit
+			case *disklayout.SuperBlock32Bit:
+				sb32 = sb
+			default:
+				t.Fatalf("unexpected superblock type %T", sb)
+			}
+			sb32.LastMountedRaw = [64]byte{}
+			copy(sb32.LastMountedRaw[:], "/mnt/image")
+			if got, err = disklayout.MarshalSuperBlock(sb, raw); err != nil {
+				t.Fatalf("MarshalSuperBlock() of modified superblock failed: %v", err)
+			}
+			copy(raw, got)
+			// readSuperBlock validates the superblock and its checksum.
+			modified, err := readSuperBlock(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("readSuperBlock() of modified superblock failed: %v", err)
+			}
+			if got := modified.LastMounted(); got != "/mnt/image" {
+				t.Errorf("LastMounted() = %q, want %q", got, "/mnt/image")
+			}
+		})
+	}
+}
+
+// TestSnapshotSuperBlock tests that the snapshot fields of superblocks without
+// the 64-bit feature are read, as the ext3 snapshot patches set them.
+func TestSnapshotSuperBlock(t *testing.T) {
+	_, data := readImage(t, ext3ImagePath)
+	raw := data[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]
+	sb, err := readSuperBlock(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	if sb.IncompatibleFeatures().Is64Bit {
+		t.Fatalf("image has the 64-bit feature")
+	}
+	roCompat := sb.ReadOnlyCompatibleFeatures()
+	roCompat.HasSnapshot = true
+	binary.LittleEndian.PutUint32(raw[0x64:], roCompat.ToInt())
+	binary.LittleEndian.PutUint32(raw[0x180:], 13)
+	binary.LittleEndian.PutUint32(raw[0x184:], 4)
+	binary.LittleEndian.PutUint64(raw[0x188:], 200)
+
+	if sb, err = readSuperBlock(bytes.NewReader(data)); err != nil {
+		t.Fatalf("readSuperBlock() of snapshot superblock failed: %v", err)
+	}
+	if ino, id, rsrv := sb.SnapshotInode(), sb.SnapshotID(), sb.SnapshotReservedBlocks(); ino != 13 || id != 4 || rsrv != 200 {
+		t.Errorf("snapshot (inode, id, reserved blocks) = (%d, %d, %d), want (13, 4, 200)", ino, id, rsrv)
+	}
+}
+
+// TestSuperBlock32BitImages tests that the superblock fields past the 32-bit
+// struct are read from images without the 64-bit feature.
+func TestSuperBlock32BitImages(t *testing.T) {
+	sb, err := readSuperBlock(bytes.NewReader(readImageData(t, csumSeedImagePath)))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	if sb.IncompatibleFeatures().Is64Bit {
+		t.Fatalf("%s has the 64-bit feature", csumSeedImagePath)
+	}
+	// Values reported by dumpe2fs.
+	for _, test := range []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{name: "MinExtraIsize", got: uint64(sb.MinExtraIsize()), want: 32},
+		{name: "WantExtraIsize", got: uint64(sb.WantExtraIsize()), want: 32},
+		{name: "ChecksumType", got: uint64(sb.ChecksumType()), want: disklayout.SbCrc32c},
+		{name: "KbytesWritten", got: sb.KbytesWritten(), want: 23},
+		{name: "LogGroupsPerFlex", got: uint64(sb.LogGroupsPerFlex()), want: 4},
+		{name: "FlexGroupSize", got: uint64(sb.FlexGroupSize()), want: 16},
+		{name: "OverheadClusters", got: uint64(sb.OverheadClusters()), want: 9},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s() = %d, want %d", test.name, test.got, test.want)
+		}
+	}
+
+	// tiny.ext3 records neither errors nor unsigned hashes, so set them.
+	data := readImageData(t, ext3ImagePath)
+	raw := data[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]
+	compat := disklayout.CompatFeaturesFromInt(binary.LittleEndian.Uint32(raw[0x5c:]))
+	compat.SparseV2 = true
+	binary.LittleEndian.PutUint32(raw[0x5c:], compat.ToInt())
+	binary.LittleEndian.PutUint32(raw[0x160:], disklayout.SbUnsignedHash) // s_flags
+	binary.LittleEndian.PutUint32(raw[0x194:], 2)                         // s_error_count
+	binary.LittleEndian.PutUint32(raw[0x19c:], 12)                        // s_first_error_ino
+	copy(raw[0x1a8:], "ext4_lookup")                                      // s_first_error_func
+	binary.LittleEndian.PutUint32(raw[0x1c8:], 1701)                      // s_first_error_line
+	binary.LittleEndian.PutUint32(raw[0x250:], 1)                         // s_backup_bgs[1]
+	raw[0x27a] = 5                                                        // s_first_error_errcode
+	if sb, err = readSuperBlock(bytes.NewReader(data)); err != nil {
+		t.Fatalf("readSuperBlock() of modified superblock failed: %v", err)
+	}
+	if sb.IncompatibleFeatures().Is64Bit {
+		t.Fatalf("%s has the 64-bit feature", ext3ImagePath)
+	}
+	if got := sb.KbytesWritten(); got != 25 {
+		t.Errorf("KbytesWritten() = %d, want 25", got)
+	}
+	if !sb.UnsignedDirHash() {
+		t.Errorf("UnsignedDirHash() = false, want true")
+	}
+	if got := sb.ErrorCount(); got != 2 {
+		t.Errorf("ErrorCount() = %d, want 2", got)
+	}
+	if got := sb.FirstError(); got.Inode != 12 || got.Func != "ext4_lookup" || got.Line != 1701 || got.Code != 5 {
+		t.Errorf("FirstError() = %+v, want inode 12 in ext4_lookup:1701 with code 5", got)
+	}
+	if got := sb.BackupGroups(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("BackupGroups() = %v, want [1]", got)
+	}
+}
+
+// TestRev0SuperBlock tests that the dynamic revision fields of a GOOD_OLD_REV
+// superblock are defaulted, even if they hold garbage.
+func TestRev0SuperBlock(t *testing.T) {
+	fs, data := readImage(t, rev0ImagePath)
+	f, err := fs.Open("/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello rev 0\n" {
+		t.Errorf("ReadAll = (%q, %v), want (%q, nil)", got, err, "hello rev 0\n")
+	}
+
+	// mke2fs writes s_first_ino and s_inode_size even for GOOD_OLD_REV.
+	raw := data[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]
+	binary.LittleEndian.PutUint32(raw[0x54:], 0xdead) // s_first_ino
+	binary.LittleEndian.PutUint16(raw[0x58:], 0xbeef) // s_inode_size
+	sb, err := readSuperBlock(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	var sb64 disklayout.SuperBlock64Bit
+	binary.Unmarshal(raw[:binary.Size(sb64)], binary.LittleEndian, &sb64)
+	for _, sb := range []disklayout.SuperBlock{sb, &sb64} {
+		if got := sb.RevisionLevel(); got != uint32(disklayout.OldRev) {
+			t.Errorf("%T.RevisionLevel() = %d, want %d", sb, got, disklayout.OldRev)
+		}
+		if got := sb.FirstInode(); got != disklayout.OldFirstInode {
+			t.Errorf("%T.FirstInode() = %d, want %d", sb, got, disklayout.OldFirstInode)
+		}
+		if got := sb.InodeSize(); got != disklayout.OldInodeSize {
+			t.Errorf("%T.InodeSize() = %d, want %d", sb, got, disklayout.OldInodeSize)
+		}
+	}
+}
+
+// TestChecksumSeedCached tests that the checksum seed of a filesystem is
+// computed once when its superblock is read.
+func TestChecksumSeedCached(t *testing.T) {
+	fs, data := readImage(t, ext4ImagePath)
+	sb, err := readSuperBlock(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	want := sb.ChecksumSeed()
+	seeded, ok := fs.fs.sb.(*seededSuperBlock)
+	if !ok {
+		t.Fatalf("filesystem superblock is a %T, want *seededSuperBlock", fs.fs.sb)
+	}
+	if got := seeded.ChecksumSeed(); got != want {
+		t.Errorf("ChecksumSeed() = %#x, want %#x", got, want)
+	}
+
+	// The seed is not derived from the UUID again, so the group descriptors
+	// still verify.
+	seeded.SuperBlock.(*disklayout.SuperBlock64Bit).UUIDRaw[0] ^= 0xff
+	if got := fs.fs.sb.ChecksumSeed(); got != want {
+		t.Errorf("ChecksumSeed() after changing the UUID = %#x, want %#x", got, want)
+	}
+	if _, err := LoadGroupDescriptors(fs.fs.sb, fs.fs.blocks); err != nil {
+		t.Errorf("LoadGroupDescriptors() after changing the UUID failed: %v", err)
+	}
+}
+
+// TestOpenSuperBlock tests that the backup superblocks are used if the primary
+// superblock is corrupted.
+func TestOpenSuperBlock(t *testing.T) {
+	ext4 := readImageData(t, ext4ImagePath)
+	want, err := readSuperBlock(bytes.NewReader(ext4))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	sb, usedBackup, err := OpenSuperBlock(NewBlockDevice(bytes.NewReader(ext4), want.BlockSize(), 0))
+	if err != nil || usedBackup || sb.UUID() != want.UUID() {
+		t.Errorf("OpenSuperBlock() = (%v, %t, %v), want primary superblock", sb, usedBackup, err)
+	}
+
+	// The image has a single block group, so place a copy of its superblock
+	// where mke2fs would put the backup of block group 1 and zero the primary.
+	const backupBlock = 1 + 8*1024
+	image := make([]byte, (backupBlock+1)*1024)
+	copy(image, ext4)
+	copy(image[backupBlock*1024:], ext4[disklayout.SbOffset:disklayout.SbOffset+disklayout.SbSize])
+	for i := disklayout.SbOffset; i < disklayout.SbOffset+disklayout.SbSize; i++ {
+		image[i] = 0
+	}
+	sb, usedBackup, err = OpenSuperBlock(NewBlockDevice(bytes.NewReader(image), want.BlockSize(), 0))
+	if err != nil || !usedBackup || sb.UUID() != want.UUID() {
+		t.Errorf("OpenSuperBlock() with zeroed primary = (%v, %t, %v), want backup superblock", sb, usedBackup, err)
+	}
+
+	// Without backups, OpenSuperBlock fails.
+	if _, _, err := OpenSuperBlock(NewBlockDevice(bytes.NewReader(image[:backupBlock*1024]), want.BlockSize(), 0)); err != syserror.EINVAL {
+		t.Errorf("OpenSuperBlock() without backups = %v, want %v", err, syserror.EINVAL)
+	}
+
+	// The backups of filesystems which do not use the default geometry are
+	// found if only the checksum of the primary superblock is wrong.
+	metaBG := readImageData(t, metaBGImagePath)
+	metaBG[disklayout.SbOffset+0x10] ^= 0x1
+	sb, usedBackup, err = OpenSuperBlock(NewBlockDevice(bytes.NewReader(metaBG), 1024, 0))
+	if err != nil || !usedBackup || sb.BlocksPerGroup() != 256 {
+		t.Errorf("OpenSuperBlock() with corrupted primary = (%v, %t, %v), want backup superblock", sb, usedBackup, err)
+	}
+}
+
+// TestBlockGroupChecksum tests that a block group descriptor with a bad
+// checksum is refused.
+func TestBlockGroupChecksum(t *testing.T) {
+	image := readImageData(t, ext4ImagePath)
+
+	sb, err := readSuperBlock(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	if _, err := LoadGroupDescriptors(sb, NewBlockDevice(bytes.NewReader(image), sb.BlockSize(), 0)); err != nil {
+		t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+	}
+
+	// Flip a bit in bg_free_blocks_count_lo of group 0. The descriptors are
+	// still returned along with the group which failed verification.
+	image[int64(sb.FirstDataBlock()+1)*int64(sb.BlockSize())+0xc] ^= 0x1
+	bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(bytes.NewReader(image), sb.BlockSize(), 0))
+	bgErr, ok := err.(*GroupDescriptorError)
+	if !ok {
+		t.Fatalf("LoadGroupDescriptors() with corrupted descriptor = %v, want *GroupDescriptorError", err)
+	}
+	if _, ok := bgErr.Errs[0]; !ok || len(bgErr.Errs) != 1 {
+		t.Errorf("GroupDescriptorError.Errs = %v, want only group 0", bgErr.Errs)
+	}
+	if !errors.Is(bgErr.Errs[0], disklayout.ErrChecksumMismatch) {
+		t.Errorf("GroupDescriptorError.Errs[0] = %v, want %v", bgErr.Errs[0], disklayout.ErrChecksumMismatch)
+	}
+	if diskErr, ok := bgErr.Errs[0].(*disklayout.DiskError); !ok || diskErr.Group != 0 {
+		t.Errorf("GroupDescriptorError.Errs[0] = %#v, want *disklayout.DiskError with Group 0", bgErr.Errs[0])
+	}
+	if uint64(len(bgs)) != sb.GroupsCount() {
+		t.Errorf("LoadGroupDescriptors() returned %d descriptors, want %d", len(bgs), sb.GroupsCount())
+	}
+
+	fs := filesystem{dev: bytes.NewReader(image)}
+	if err := fs.readMetadata(); err != syserror.EINVAL {
+		t.Errorf("readMetadata() with corrupted descriptor = %v, want %v", err, syserror.EINVAL)
+	}
+}
+
+// TestResizeInode tests that the reserved GDT blocks of group 0 and of the
+// groups holding backups are found through the resize inode, and that they
+// are marked as used in the block bitmaps.
+func TestResizeInode(t *testing.T) {
+	fs, _ := readImage(t, resizeImagePath)
+	sb := fs.fs.sb
+	in, err := newInode(&fs.fs, disklayout.ResizeInode)
+	if err != nil {
+		t.Fatalf("newInode(%d) failed: %v", disklayout.ResizeInode, err)
+	}
+	r, err := disklayout.NewResizeInodeReader(sb, in.diskInode, fs.fs.blocks.ReadBlock)
+	if err != nil {
+		t.Fatalf("NewResizeInodeReader failed: %v", err)
+	}
+	got, err := r.ReservedGdtBlocks()
+	if err != nil {
+		t.Fatalf("ReservedGdtBlocks failed: %v", err)
+	}
+	// The group descriptors of the 5 groups take one block in groups 0, 1 and
+	// 3, and are followed by 3 reserved blocks.
+	want := []disklayout.ReservedGdtBlock{
+		{Primary: 3, Backups: []uint64{259, 771}},
+		{Primary: 4, Backups: []uint64{260, 772}},
+		{Primary: 5, Backups: []uint64{261, 773}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReservedGdtBlocks() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, gdt := range got {
+		for _, blk := range append([]uint64{gdt.Primary}, gdt.Backups...) {
+			group := (blk - uint64(sb.FirstDataBlock())) / uint64(sb.BlocksPerGroup())
+			bg := fs.fs.bgs[group]
+			if bg.Flags().BlockUninit {
+				// The bitmap of the group is not initialized.
+				continue
+			}
+			bitmap, err := readBlockBitmap(fs.fs.dev, sb, uint32(group), bg)
+			if err != nil {
+				t.Fatalf("readBlockBitmap(%d) failed: %v", group, err)
+			}
+			if !bitmap.Test(uint32(blk - uint64(sb.FirstDataBlock()) - group*uint64(sb.BlocksPerGroup()))) {
+				t.Errorf("reserved GDT block %d is free in the bitmap of group %d", blk, group)
+			}
+		}
+	}
+
+	// The reserved blocks must be where the resize inode says they are.
+	dind, err := fs.fs.blocks.ReadBlock(uint64(binary.LittleEndian.Uint32(in.diskInode.Data()[(disklayout.NumDirectBlocks+1)*4:])))
+	if err != nil {
+		t.Fatalf("ReadBlock(doubly indirect block) failed: %v", err)
+	}
+	bad := append([]byte(nil), dind...)
+	binary.LittleEndian.PutUint32(bad[8:], 42)
+	r, err = disklayout.NewResizeInodeReader(sb, in.diskInode, func(blk uint64) ([]byte, error) {
+		if data, err := fs.fs.blocks.ReadBlock(blk); err != nil || !bytes.Equal(data, dind) {
+			return data, err
+		}
+		return bad, nil
+	})
+	if err != nil {
+		t.Fatalf("NewResizeInodeReader failed: %v", err)
+	}
+	if _, err := r.ReservedGdtBlocks(); err == nil {
+		t.Errorf("ReservedGdtBlocks() with a misplaced reserved block succeeded, want error")
+	}
+}
+
+// TestLoadGroupDescriptorsMetaBG tests that the descriptors of a filesystem
+// with meta block groups are found in each meta block group.
+func TestLoadGroupDescriptorsMetaBG(t *testing.T) {
+	dev := bytes.NewReader(readImageData(t, metaBGImagePath))
+	sb, err := readSuperBlock(dev)
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+	if err != nil {
+		t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+	}
+
+	// The image has 4 groups per meta block group, so the descriptor of the
+	// last group is stored in that group. The locations were obtained with
+	// dumpe2fs.
+	if len(bgs) != 5 {
+		t.Fatalf("LoadGroupDescriptors() returned %d descriptors, want 5", len(bgs))
+	}
+	for i, bg := range bgs {
+		if got, want := bg.BlockBitmap(), uint64(3+i); got != want {
+			t.Errorf("group %d: BlockBitmap() = %d, want %d", i, got, want)
+		}
+		if got, want := bg.InodeBitmap(), uint64(8+i); got != want {
+			t.Errorf("group %d: InodeBitmap() = %d, want %d", i, got, want)
+		}
+		if got, want := bg.InodeTable(), uint64(13+2*i); got != want {
+			t.Errorf("group %d: InodeTable() = %d, want %d", i, got, want)
+		}
+	}
+}
+
+// TestLoadGroupDescriptorsDescSize tests that 64-bit descriptors are read in
+// entries of sb.BgDescSize() bytes, combining the low and high halves of their
+// fields and ignoring the fields past the end of BlockGroup64Bit.
+func TestLoadGroupDescriptorsDescSize(t *testing.T) {
+	for _, descSize := range []uint16{64, 128} {
+		t.Run(fmt.Sprintf("%d bytes", descSize), func(t *testing.T) {
+			var sb disklayout.SuperBlock64Bit
+			sb.RevLevel = uint32(disklayout.DynamicRev)
+			sb.FirstDataBlockRaw = 1
+			sb.BlocksCountLo = 1 + 2*8192 + 100
+			sb.BlocksPerGroupRaw = 8192
+			sb.FeatureIncompat = disklayout.IncompatFeatures{Is64Bit: true}.ToInt()
+			sb.BgDescSizeRaw = descSize
+
+			// The descriptors are in block 2, after the superblock.
+			image := make([]byte, 3*1024)
+			for i := 0; i < 3; i++ {
+				raw := image[2*1024+i*int(descSize):][:descSize]
+				for j := 64; j < len(raw); j++ {
+					raw[j] = 0xff
+				}
+				binary.LittleEndian.PutUint32(raw[0x0:], uint32(10+i)) // bg_block_bitmap_lo
+				binary.LittleEndian.PutUint32(raw[0x4:], uint32(20+i)) // bg_inode_bitmap_lo
+				binary.LittleEndian.PutUint32(raw[0x8:], uint32(30+i)) // bg_inode_table_lo
+				binary.LittleEndian.PutUint32(raw[0x20:], uint32(1+i)) // bg_block_bitmap_hi
+				binary.LittleEndian.PutUint32(raw[0x24:], uint32(2+i)) // bg_inode_bitmap_hi
+				binary.LittleEndian.PutUint32(raw[0x28:], uint32(3+i)) // bg_inode_table_hi
+			}
+			bgs, err := LoadGroupDescriptors(&sb, NewBlockDevice(bytes.NewReader(image), sb.BlockSize(), 0))
+			if err != nil {
+				t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+			}
+			if len(bgs) != 3 {
+				t.Fatalf("LoadGroupDescriptors() returned %d descriptors, want 3", len(bgs))
+			}
+			for i, bg := range bgs {
+				if got, want := bg.BlockBitmap(), uint64(1+i)<<32|uint64(10+i); got != want {
+					t.Errorf("group %d: BlockBitmap() = %#x, want %#x", i, got, want)
+				}
+				if got, want := bg.InodeBitmap(), uint64(2+i)<<32|uint64(20+i); got != want {
+					t.Errorf("group %d: InodeBitmap() = %#x, want %#x", i, got, want)
+				}
+				if got, want := bg.InodeTable(), uint64(3+i)<<32|uint64(30+i); got != want {
+					t.Errorf("group %d: InodeTable() = %#x, want %#x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestWalkDir tests that WalkDir reports the entries of a directory in
+// on-disk order, skipping deleted ones, and stops when asked to.
+func TestWalkDir(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, data := readImage(t, image)
+			root, err := ResolvePath(fs, "/")
+			if err != nil {
+				t.Fatalf("ResolvePath(/) failed: %v", err)
+			}
+			file, err := ResolvePath(fs, "/bigfile.txt")
+			if err != nil {
+				t.Fatalf("ResolvePath(/bigfile.txt) failed: %v", err)
+			}
+
+			// Delete /file.txt by zeroing the inode number of its dirent,
+			// which has a name length of 8 and a file type of 1.
+			off := bytes.Index(data, []byte("\x08\x01file.txt"))
+			if off < 0 {
+				t.Fatalf("dirent of /file.txt not found")
+			}
+			copy(data[off-6:], []byte{0, 0, 0, 0})
+			dev := NewBlockDevice(bytes.NewReader(data), fs.fs.sb.BlockSize(), 0)
+
+			var names []string
+			if err := WalkDir(root, fs.fs.sb, dev, func(d disklayout.Dirent) error {
+				names = append(names, d.FileName())
+				return nil
+			}); err != nil {
+				t.Fatalf("WalkDir failed: %v", err)
+			}
+			if diff := cmp.Diff([]string{".", "..", "lost+found", "symlink.txt", "bigfile.txt"}, names); diff != "" {
+				t.Errorf("WalkDir walked unexpected entries, diff:\n%s", diff)
+			}
+
+			names = nil
+			if err := WalkDir(root, fs.fs.sb, dev, func(d disklayout.Dirent) error {
+				if names = append(names, d.FileName()); len(names) == 2 {
+					return ErrStopWalk
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("WalkDir stopped early failed: %v", err)
+			}
+			if diff := cmp.Diff([]string{".", ".."}, names); diff != "" {
+				t.Errorf("WalkDir stopped early walked unexpected entries, diff:\n%s", diff)
+			}
+
+			if err := WalkDir(file, fs.fs.sb, dev, func(disklayout.Dirent) error { return nil }); err != syserror.ENOTDIR {
+				t.Errorf("WalkDir(/bigfile.txt) = %v, want %v", err, syserror.ENOTDIR)
+			}
+		})
+	}
+}
+
+// TestWalkDirChecked tests that WalkDirChecked reports entries pointing past
+// the inodes of the filesystem.
+func TestWalkDirChecked(t *testing.T) {
+	fs, data := readImage(t, ext4ImagePath)
+	root, err := ResolvePath(fs, "/")
+	if err != nil {
+		t.Fatalf("ResolvePath(/) failed: %v", err)
+	}
+
+	// Point the dirent of /file.txt at inode 0xffffffff.
+	off := bytes.Index(data, []byte("\x08\x01file.txt"))
+	if off < 0 {
+		t.Fatalf("dirent of /file.txt not found")
+	}
+	copy(data[off-6:], []byte{0xff, 0xff, 0xff, 0xff})
+	dev := NewBlockDevice(bytes.NewReader(data), fs.fs.sb.BlockSize(), 0)
+
+	var names, badNames []string
+	fn := func(d disklayout.Dirent) error {
+		names = append(names, d.FileName())
+		return nil
+	}
+	if err := WalkDirChecked(root, fs.fs.sb, dev, fn, func(d disklayout.Dirent, err error) error {
+		if !errors.Is(err, disklayout.ErrInodeOutOfRange) {
+			t.Errorf("entry %q: got error %v, want %v", d.FileName(), err, disklayout.ErrInodeOutOfRange)
+		}
+		badNames = append(badNames, d.FileName())
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkDirChecked failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{".", "..", "lost+found", "symlink.txt", "bigfile.txt"}, names); diff != "" {
+		t.Errorf("WalkDirChecked walked unexpected entries, diff:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"file.txt"}, badNames); diff != "" {
+		t.Errorf("WalkDirChecked reported unexpected entries, diff:\n%s", diff)
+	}
+
+	if err := WalkDirChecked(root, fs.fs.sb, dev, fn, nil); err != syserror.EIO {
+		t.Errorf("WalkDirChecked() without bad = %v, want %v", err, syserror.EIO)
+	}
+}
+
+// TestReservedBlocks tests that the blocks reserved for root are read from the
+// superblock and not reported as available by statfs.
+func TestReservedBlocks(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath} {
+		t.Run(image, func(t *testing.T) {
+			dev := bytes.NewReader(readImageData(t, image))
+			sb, err := readSuperBlock(dev)
+			if err != nil {
+				t.Fatalf("readSuperBlock() failed: %v", err)
+			}
+
+			// The images were made with the mke2fs default of 5% reserved
+			// for root.
+			if got, want := sb.ReservedBlocksCount(), sb.BlocksCount()*5/100; got != want {
+				t.Errorf("ReservedBlocksCount() = %d, want %d", got, want)
+			}
+			if uid, gid := sb.DefaultReservedUID(), sb.DefaultReservedGID(); uid != auth.RootKUID || gid != auth.RootKGID {
+				t.Errorf("DefaultReservedUID(), DefaultReservedGID() = %d, %d, want %d, %d", uid, gid, auth.RootKUID, auth.RootKGID)
+			}
+
+			bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+			if err != nil {
+				t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+			}
+			if stats := disklayout.FreeSpaceStats(sb, bgs); stats.Discrepancy != nil {
+				t.Errorf("FreeSpaceStats() reported discrepancy: %v", stats.Discrepancy)
+			}
+
+			var stat linux.Statfs
+			fs := filesystem{sb: sb, bgs: bgs}
+			fs.statTo(&stat)
+			if got, want := stat.BlocksAvailable, sb.FreeBlocksCount()-sb.ReservedBlocksCount(); got != want {
+				t.Errorf("Statfs.BlocksAvailable = %d, want %d", got, want)
+			}
+			if got, want := stat.FilesFree, uint64(sb.FreeInodesCount()); got != want {
+				t.Errorf("Statfs.FilesFree = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestComputeOverhead tests that the computed metadata overhead matches the
+// one recorded by mke2fs.
+func TestComputeOverhead(t *testing.T) {
+	for _, image := range []string{linksImagePath, bigallocImagePath, metaBGImagePath, excludeImagePath} {
+		t.Run(image, func(t *testing.T) {
+			dev := bytes.NewReader(readImageData(t, image))
+			sb, err := readSuperBlock(dev)
+			if err != nil {
+				t.Fatalf("readSuperBlock() failed: %v", err)
+			}
+			bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+			if err != nil {
+				t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+			}
+
+			want := uint64(sb.OverheadClusters())
+			if want == 0 {
+				t.Fatalf("image has no recorded overhead")
+			}
+			// The images have no journal.
+			if got := disklayout.ComputeOverhead(sb, bgs, 0); got != want {
+				t.Errorf("ComputeOverhead() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestExcludeBitmap tests that exclude bitmaps are read and that their blocks
+// are accounted for as metadata rather than free blocks.
+func TestExcludeBitmap(t *testing.T) {
+	data := readImageData(t, excludeImagePath)
+	dev := bytes.NewReader(data)
+	sb, err := readSuperBlock(dev)
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	if !sb.ExcludeBitmapPresent() {
+		t.Fatalf("image has no exclude bitmaps")
+	}
+	bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+	if err != nil {
+		t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+	}
+
+	blockBitmap, err := readBlockBitmap(dev, sb, 0, bgs[0])
+	if err != nil {
+		t.Fatalf("readBlockBitmap(0) failed: %v", err)
+	}
+	if got, want := blockBitmap.CountFree(), bgs[0].FreeBlocksCount(); got != want {
+		t.Errorf("group 0 has %d free blocks in bitmap, want %d", got, want)
+	}
+	for i, want := range []uint32{4, 1} {
+		bitmap, err := readExcludeBitmap(dev, sb, bgs[i])
+		if err != nil {
+			t.Fatalf("readExcludeBitmap(%d) failed: %v", i, err)
+		}
+		if got := sb.ClustersPerGroup() - bitmap.CountFree(); got != want {
+			t.Errorf("group %d excludes %d blocks, want %d", i, got, want)
+		}
+		// Both exclude bitmaps are in group 0.
+		blk := bgs[i].ExclusionBitmap()
+		if !blockBitmap.Test(uint32(blk - uint64(sb.FirstDataBlock()))) {
+			t.Errorf("exclude bitmap of group %d in block %d is not marked in use", i, blk)
+		}
+	}
+
+	// Without the exclude bitmaps, the overhead would be less than the
+	// recorded one which accounts for them.
+	noExclude := *sb.(*disklayout.SuperBlock64Bit)
+	noExclude.FeatureCompat &^= disklayout.SbExcludeBitmap
+	if got, want := disklayout.ComputeOverhead(&noExclude, bgs, 0), uint64(sb.OverheadClusters())-uint64(len(bgs)); got != want {
+		t.Errorf("ComputeOverhead() without exclude bitmaps = %d, want %d", got, want)
+	}
+	if _, err := readExcludeBitmap(dev, &noExclude, bgs[0]); err != syserror.ENOENT {
+		t.Errorf("readExcludeBitmap() without exclude bitmaps = %v, want %v", err, syserror.ENOENT)
+	}
+}
+
+// TestReadBitmaps tests that the block and inode bitmaps agree with the free
+// counts in the block group descriptors and their checksums, and that
+// uninitialized groups are reported as free without reading the on-disk
+// bitmaps.
+func TestReadBitmaps(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath, linksImagePath, bigallocImagePath} {
+		t.Run(image, func(t *testing.T) {
+			data := readImageData(t, image)
+			dev := bytes.NewReader(data)
+			sb, err := readSuperBlock(dev)
+			if err != nil {
+				t.Fatalf("readSuperBlock() failed: %v", err)
+			}
+			bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+			if err != nil {
+				t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+			}
+
+			for i, bg := range bgs {
+				blockBitmap, err := readBlockBitmap(dev, sb, uint32(i), bg)
+				if err != nil {
+					t.Fatalf("readBlockBitmap(%d) failed: %v", i, err)
+				}
+				if got, want := blockBitmap.CountFree(), bg.FreeBlocksCount(); got != want {
+					t.Errorf("group %d has %d free blocks in bitmap, want %d", i, got, want)
+				}
+
+				inodeBitmap, err := readInodeBitmap(dev, sb, uint32(i), bg)
+				if err != nil {
+					t.Fatalf("readInodeBitmap(%d) failed: %v", i, err)
+				}
+				if got, want := inodeBitmap.CountFree(), bg.FreeInodesCount(); got != want {
+					t.Errorf("group %d has %d free inodes in bitmap, want %d", i, got, want)
+				}
+			}
+
+			// With metadata_csum, a bitmap not matching its checksum is
+			// rejected.
+			if sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+				data[bgs[0].InodeBitmap()*sb.BlockSize()] ^= 0x80
+				if _, err := readInodeBitmap(dev, sb, 0, bgs[0]); err != syserror.EIO {
+					t.Errorf("readInodeBitmap() of corrupted bitmap = %v, want %v", err, syserror.EIO)
+				}
+				data[bgs[0].BlockBitmap()*sb.BlockSize()] ^= 0x80
+				if _, err := readBlockBitmap(dev, sb, 0, bgs[0]); err != syserror.EIO {
+					t.Errorf("readBlockBitmap() of corrupted bitmap = %v, want %v", err, syserror.EIO)
+				}
+			}
+
+			// Mark group 0 uninitialized while its on-disk bitmaps claim that
+			// everything is in use.
+			bg := &disklayout.BlockGroup32Bit{
+				BlockBitmapLo: uint32(bgs[0].BlockBitmap()),
+				InodeBitmapLo: uint32(bgs[0].InodeBitmap()),
+				InodeTableLo:  uint32(bgs[0].InodeTable()),
+				FlagsRaw:      disklayout.BgBlockUninit | disklayout.BgInodeUninit,
+			}
+			for _, blk := range []uint64{bgs[0].BlockBitmap(), bgs[0].InodeBitmap()} {
+				for j := uint64(0); j < sb.BlockSize(); j++ {
+					data[blk*sb.BlockSize()+j] = 0xff
+				}
+			}
+
+			blockBitmap, err := readBlockBitmap(dev, sb, 0, bg)
+			if err != nil {
+				t.Fatalf("readBlockBitmap() of uninitialized group failed: %v", err)
+			}
+			// Only the group's metadata and the clusters past the end of the
+			// filesystem are marked. The images have a single group, so its
+			// metadata is the filesystem overhead without the journal, minus
+			// the clusters before the first data block.
+			groupClusters := uint32(sb.ClustersCount() - disklayout.BlockToCluster(sb, uint64(sb.FirstDataBlock())))
+			metaClusters := uint32(disklayout.ComputeOverhead(sb, []disklayout.BlockGroup{bg}, 0) - disklayout.BlockToCluster(sb, uint64(sb.FirstDataBlock())))
+			if got, want := blockBitmap.CountFree(), groupClusters-metaClusters; got != want {
+				t.Errorf("uninitialized group has %d free clusters, want %d", got, want)
+			}
+			for c := groupClusters; c < blockBitmap.Len(); c++ {
+				if !blockBitmap.Test(c) {
+					t.Errorf("cluster %d past the end of the filesystem is free", c)
+				}
+			}
+			for _, blk := range []uint64{uint64(sb.FirstDataBlock()), bg.BlockBitmap(), bg.InodeBitmap(), bg.InodeTable()} {
+				if c := uint32(disklayout.BlockToCluster(sb, blk) - disklayout.BlockToCluster(sb, uint64(sb.FirstDataBlock()))); !blockBitmap.Test(c) {
+					t.Errorf("metadata block %d of uninitialized group is free", blk)
+				}
+			}
+
+			inodeBitmap, err := readInodeBitmap(dev, sb, 0, bg)
+			if err != nil {
+				t.Fatalf("readInodeBitmap() of uninitialized group failed: %v", err)
+			}
+			if got := inodeBitmap.CountFree(); got != sb.InodesPerGroup() {
+				t.Errorf("uninitialized group has %d free inodes, want %d", got, sb.InodesPerGroup())
+			}
+		})
+	}
+}
+
+// TestReadBitmapsGdtCsum tests that the bitmaps of a filesystem with gdt_csum
+// but not metadata_csum, whose bitmap checksum fields are zero, are read
+// without verifying checksums.
+func TestReadBitmapsGdtCsum(t *testing.T) {
+	data := readImageData(t, uninitBGImagePath)
+	dev := bytes.NewReader(data)
+	sb, err := readSuperBlock(dev)
+	if err != nil {
+		t.Fatalf("readSuperBlock() failed: %v", err)
+	}
+	if roCompat := sb.ReadOnlyCompatibleFeatures(); !roCompat.GdtCsum || roCompat.MetadataCsum {
+		t.Fatalf("image has ro_compat features %+v, want gdt_csum without metadata_csum", roCompat)
+	}
+	if got := disklayout.BitmapChecksumMode(sb); got != disklayout.BitmapCsumNone {
+		t.Errorf("BitmapChecksumMode() = %d, want BitmapCsumNone", got)
+	}
+	bgs, err := LoadGroupDescriptors(sb, NewBlockDevice(dev, sb.BlockSize(), 0))
+	if err != nil {
+		t.Fatalf("LoadGroupDescriptors() failed: %v", err)
+	}
+
+	// Group 1 holds a superblock backup but its block bitmap is
+	// uninitialized: the synthesized bitmap must mark the backup like the
+	// blocks holding the metadata of other groups.
+	if !bgs[1].Flags().BlockUninit || !disklayout.GroupHasSuperBlock(sb, 1) {
+		t.Fatalf("group 1 has flags %+v and superblock backup %t, want BlockUninit with a backup", bgs[1].Flags(), disklayout.GroupHasSuperBlock(sb, 1))
+	}
+	for i, bg := range bgs {
+		blockBitmap, err := readBlockBitmap(dev, sb, uint32(i), bg)
+		if err != nil {
+			t.Fatalf("readBlockBitmap(%d) failed: %v", i, err)
+		}
+		if got, want := blockBitmap.CountFree(), bg.FreeBlocksCount(); got != want {
+			t.Errorf("group %d (flags %+v) has %d free blocks in bitmap, want %d", i, bg.Flags(), got, want)
+		}
+		if start, n := disklayout.GroupBaseMetaBlocks(sb, uint64(i)); i > 0 && n > 0 {
+			groupStart := uint64(sb.FirstDataBlock()) + uint64(i)*uint64(sb.BlocksPerGroup())
+			for blk := start; blk < start+n; blk++ {
+				if !blockBitmap.Test(uint32(blk - groupStart)) {
+					t.Errorf("superblock or group descriptor block %d is free in the bitmap of group %d", blk, i)
+				}
+			}
+		}
+		inodeBitmap, err := readInodeBitmap(dev, sb, uint32(i), bg)
+		if err != nil {
+			t.Fatalf("readInodeBitmap(%d) failed: %v", i, err)
+		}
+		if got, want := inodeBitmap.CountFree(), bg.FreeInodesCount(); got != want {
+			t.Errorf("group %d has %d free inodes in bitmap, want %d", i, got, want)
+		}
+	}
+
+	// Verifying the crc32c of the bitmaps against the zero checksum fields
+	// would fail.
+	bitmap, err := readBitmap(dev, sb, bgs[0].InodeBitmap(), sb.InodesPerGroup())
+	if err != nil {
+		t.Fatalf("readBitmap() failed: %v", err)
+	}
+	if csum := disklayout.Crc32c(sb.ChecksumSeed(), bitmap); bgs[0].InodeBitmapChecksum() == csum || bgs[0].InodeBitmapChecksum() != 0 {
+		t.Errorf("group 0 inode bitmap checksum field = %#x, want 0 not matching crc32c %#x", bgs[0].InodeBitmapChecksum(), csum)
+	}
+}
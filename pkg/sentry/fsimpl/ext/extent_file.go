@@ -15,10 +15,11 @@
 package ext
 
 import (
+	"fmt"
 	"io"
-	"sort"
+	"strings"
 
-	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/syserror"
 )
@@ -55,36 +56,19 @@ func newExtentFile(regFile regularFile) (*extentFile, error) {
 //
 // Precondition: inode flag InExtents must be set.
 func (f *extentFile) buildExtTree() error {
-	rootNodeData := f.regFile.inode.diskInode.Data()
-
-	binary.Unmarshal(rootNodeData[:disklayout.ExtentHeaderSize], binary.LittleEndian, &f.root.Header)
-
-	// Root node can not have more than 4 entries: 60 bytes = 1 header + 4 entries.
-	if f.root.Header.NumEntries > 4 {
+	root, err := disklayout.ParseExtentNode(f.regFile.inode.diskInode.Data())
+	if err != nil {
 		// read(2) specifies that EINVAL should be returned if the file is unsuitable
 		// for reading.
+		log.Warningf("ext fs: inode %d: %v", f.regFile.inode.inodeNum, err)
 		return syserror.EINVAL
 	}
-
-	f.root.Entries = make([]disklayout.ExtentEntryPair, f.root.Header.NumEntries)
-	for i, off := uint16(0), disklayout.ExtentEntrySize; i < f.root.Header.NumEntries; i, off = i+1, off+disklayout.ExtentEntrySize {
-		var curEntry disklayout.ExtentEntry
-		if f.root.Header.Height == 0 {
-			// Leaf node.
-			curEntry = &disklayout.Extent{}
-		} else {
-			// Internal node.
-			curEntry = &disklayout.ExtentIdx{}
-		}
-		binary.Unmarshal(rootNodeData[off:off+disklayout.ExtentEntrySize], binary.LittleEndian, curEntry)
-		f.root.Entries[i].Entry = curEntry
-	}
+	f.root = *root
 
 	// If this node is internal, perform DFS.
 	if f.root.Header.Height > 0 {
-		for i := uint16(0); i < f.root.Header.NumEntries; i++ {
-			var err error
-			if f.root.Entries[i].Node, err = f.buildExtTreeFromDisk(f.root.Entries[i].Entry); err != nil {
+		for i := range f.root.Entries {
+			if f.root.Entries[i].Node, err = f.buildExtTreeFromDisk(&f.root, f.root.Entries[i].Entry); err != nil {
 				return err
 			}
 		}
@@ -95,143 +79,220 @@ func (f *extentFile) buildExtTree() error {
 
 // buildExtTreeFromDisk reads the extent tree nodes from disk and recursively
 // builds the tree. Performs a simple DFS. It returns the ExtentNode pointed to
-// by the ExtentEntry.
-func (f *extentFile) buildExtTreeFromDisk(entry disklayout.ExtentEntry) (*disklayout.ExtentNode, error) {
-	var header disklayout.ExtentHeader
-	off := entry.PhysicalBlock() * f.regFile.inode.blkSize
-	err := readFromDisk(f.regFile.inode.fs.dev, int64(off), &header)
+// by the ExtentEntry of parent, which must be exactly one level below parent.
+func (f *extentFile) buildExtTreeFromDisk(parent *disklayout.ExtentNode, entry disklayout.ExtentEntry) (*disklayout.ExtentNode, error) {
+	buf, err := f.readBlock(entry.PhysicalBlock())
 	if err != nil {
 		return nil, err
 	}
 
-	entries := make([]disklayout.ExtentEntryPair, header.NumEntries)
-	for i, off := uint16(0), off+disklayout.ExtentEntrySize; i < header.NumEntries; i, off = i+1, off+disklayout.ExtentEntrySize {
-		var curEntry disklayout.ExtentEntry
-		if header.Height == 0 {
-			// Leaf node.
-			curEntry = &disklayout.Extent{}
-		} else {
-			// Internal node.
-			curEntry = &disklayout.ExtentIdx{}
-		}
-
-		err := readFromDisk(f.regFile.inode.fs.dev, int64(off), curEntry)
-		if err != nil {
-			return nil, err
-		}
-		entries[i].Entry = curEntry
+	node, err := disklayout.ParseExtentNode(buf)
+	if err == nil && node.Header.Height != parent.Header.Height-1 {
+		// Checking the height also stops index nodes pointing at themselves
+		// or their ancestors from recursing forever.
+		err = &disklayout.ExtentNodeError{Reason: fmt.Sprintf("height %d under node of height %d", node.Header.Height, parent.Header.Height)}
+	}
+	if err != nil {
+		log.Warningf("ext fs: inode %d: extent node at block %d: %v", f.regFile.inode.inodeNum, entry.PhysicalBlock(), err)
+		return nil, syserror.EINVAL
 	}
 
 	// If this node is internal, perform DFS.
-	if header.Height > 0 {
-		for i := uint16(0); i < header.NumEntries; i++ {
-			var err error
-			entries[i].Node, err = f.buildExtTreeFromDisk(entries[i].Entry)
+	if node.Header.Height > 0 {
+		for i := range node.Entries {
+			node.Entries[i].Node, err = f.buildExtTreeFromDisk(node, node.Entries[i].Entry)
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	return &disklayout.ExtentNode{header, entries}, nil
+	return node, nil
 }
 
-// ReadAt implements io.ReaderAt.ReadAt.
-func (f *extentFile) ReadAt(dst []byte, off int64) (int, error) {
-	if len(dst) == 0 {
-		return 0, nil
-	}
-
-	if off < 0 {
-		return 0, syserror.EINVAL
-	}
-
-	if uint64(off) >= f.regFile.inode.diskInode.Size() {
-		return 0, io.EOF
+// readBlock implements disklayout.BlockReader. It is only used to read
+// extent tree nodes, so it also verifies the node's tail checksum if the
+// filesystem has metadata checksums.
+func (f *extentFile) readBlock(phyBlk uint64) ([]byte, error) {
+	in := &f.regFile.inode
+	buf, err := in.fs.blocks.ReadBlock(phyBlk)
+	if err != nil {
+		return nil, err
 	}
 
-	n, err := f.read(&f.root, uint64(off), dst)
-	if n < len(dst) && err == nil {
-		err = io.EOF
+	switch ok, err := disklayout.VerifyExtentChecksum(in.fs.sb, in.inodeNum, in.diskInode, buf); {
+	case err == disklayout.ErrNoMetadataCsum:
+	case err != nil:
+		log.Warningf("ext fs: inode %d: extent node at block %d: %v", in.inodeNum, phyBlk, err)
+		return nil, syserror.EIO
+	case !ok:
+		log.Warningf("ext fs: inode %d: extent node at block %d checksum mismatch", in.inodeNum, phyBlk)
+		return nil, syserror.EIO
 	}
-	return n, err
+	return buf, nil
 }
 
-// read is the recursive step of extentFile.ReadAt which traverses the extent
-// tree from the node passed and reads file data.
-func (f *extentFile) read(node *disklayout.ExtentNode, off uint64, dst []byte) (int, error) {
-	// Perform a binary search for the node covering bytes starting at r.fileOff.
-	// A highly fragmented filesystem can have upto 340 entries and so linear
-	// search should be avoided. Finds the first entry which does not cover the
-	// file block we want and subtracts 1 to get the desired index.
-	fileBlk := uint32(off / f.regFile.inode.blkSize)
-	n := len(node.Entries)
-	found := sort.Search(n, func(i int) bool {
-		return node.Entries[i].Entry.FileBlock() > fileBlk
-	}) - 1
-
-	// We should be in this recursive step only if the data we want exists under
-	// the current node.
-	if found < 0 {
-		panic("searching for a file block in an extent entry which does not cover it")
-	}
-
-	read := 0
-	toRead := len(dst)
-	var curR int
-	var err error
-	for i := found; i < n && read < toRead; i++ {
-		if node.Header.Height == 0 {
-			curR, err = f.readFromExtent(node.Entries[i].Entry.(*disklayout.Extent), off, dst[read:])
-		} else {
-			curR, err = f.read(node.Entries[i].Node, off, dst[read:])
+// ReadAt implements io.ReaderAt.ReadAt. Each run of blocks stored by an
+// extent is read from the device at once.
+func (f *extentFile) ReadAt(dst []byte, off int64) (int, error) {
+	var r *disklayout.SequentialReader
+	return f.regFile.readMapped(dst, off, func(fileBlk uint64) (uint64, uint64, bool, error) {
+		if r == nil {
+			r = disklayout.NewSequentialReader(&f.root, f.readBlock, fileBlk)
 		}
-
-		read += curR
-		off += uint64(curR)
+		run, err := r.Next()
 		if err != nil {
-			return read, err
+			return 0, 0, false, f.mapError(err)
 		}
+		// Uninitialized extents are reported as unmapped so that they read as
+		// zeros.
+		return run.Physical, run.Length, run.Found && !run.Unwritten, nil
+	})
+}
+
+// mapBlock maps a file block through the extent tree. Blocks in uninitialized
+// extents are reported as unmapped so that they read as zeros.
+func (f *extentFile) mapBlock(fileBlk uint64) (uint64, bool, error) {
+	phyBlk, unwritten, found, err := disklayout.MapBlock(&f.root, f.readBlock, fileBlk)
+	if err != nil {
+		return 0, false, f.mapError(err)
 	}
+	return phyBlk, found && !unwritten, nil
+}
 
-	return read, nil
+// mapError converts an error from mapping file blocks through the extent tree
+// to the error returned to users. Malformed extent nodes are reported as EIO.
+func (f *extentFile) mapError(err error) error {
+	if _, ok := err.(*disklayout.ExtentNodeError); ok {
+		log.Warningf("ext fs: inode %d: %v", f.regFile.inode.inodeNum, err)
+		return syserror.EIO
+	}
+	return err
 }
 
-// readFromExtent reads file data from the extent. It takes advantage of the
-// sequential nature of extents and reads file data from multiple blocks in one
-// call.
-//
-// A non-nil error indicates that this is a partial read and there is probably
-// more to read from this extent. The caller should propagate the error upward
-// and not move to the next extent in the tree.
+// DumpExtentTree writes the extent tree of inode to w for debugging, in the
+// format of the "ex" command of debugfs: each entry is printed on a line
+// holding its level out of the height of the tree, its position in its node,
+// the range of file blocks it covers, the physical block of its child node for
+// index entries or the range of physical blocks it maps for extents, its
+// length in blocks and "Uninit" for uninitialized extents. Like in debugfs, the
+// length of an extent is followed by a space even without flags. Unlike
+// debugfs, the header of each node is printed before its entries, along with
+// its location: "i_block" for the root or the physical block holding it.
 //
-// A subsequent call to extentReader.Read should continue reading from where we
-// left off as expected.
-func (f *extentFile) readFromExtent(ex *disklayout.Extent, off uint64, dst []byte) (int, error) {
-	curFileBlk := uint32(off / f.regFile.inode.blkSize)
-	exFirstFileBlk := ex.FileBlock()
-	exLastFileBlk := exFirstFileBlk + uint32(ex.Length) // This is exclusive.
+// Like in debugfs, index entries cover the file blocks up to the next entry of
+// their node, or up to the end of their parent's range, which is the end of
+// the file for the root. Nodes which cannot be parsed or whose height is not
+// one below their parent's are reported in place of their entries, so that
+// the rest of the tree is still printed. The ends of the ranges of an empty
+// extent, which Linux rejects, are left blank rather than wrapping around like
+// in debugfs. Returns EINVAL if inode does not use extents, as well as the
+// errors of dev and w.
+func DumpExtentTree(inode disklayout.Inode, sb disklayout.SuperBlock, dev BlockDevice, w io.Writer) error {
+	if !inode.Flags().Extents {
+		return syserror.EINVAL
+	}
+	blkSize := sb.BlockSize()
+	fileBlocks := (disklayout.InodeFileSize(sb, inode) + blkSize - 1) / blkSize
+	d := extentDumper{
+		dev:           dev,
+		logicalWidth:  dumpWidth(fileBlocks),
+		physicalWidth: dumpWidth(sb.BlocksCount()),
+	}
+	fmt.Fprintf(&d.out, "Level Entries %*s %*s Length Flags\n", 2*d.logicalWidth+3, "Logical", 2*d.physicalWidth+3, "Physical")
 
-	// We should be in this recursive step only if the data we want exists under
-	// the current extent.
-	if curFileBlk < exFirstFileBlk || exLastFileBlk <= curFileBlk {
-		panic("searching for a file block in an extent which does not cover it")
+	var err error
+	if root, parseErr := disklayout.ParseExtentNode(inode.Data()); parseErr != nil {
+		fmt.Fprintf(&d.out, "i_block: %v\n", parseErr)
+	} else {
+		d.height = root.Header.Height
+		err = d.dumpNode("i_block", root, 0, fileBlocks)
+	}
+	if _, writeErr := io.WriteString(w, d.out.String()); err == nil {
+		err = writeErr
 	}
+	return err
+}
+
+// dumpWidth returns the width of n in decimal, which is at least 5 like the
+// columns of debugfs.
+func dumpWidth(n uint64) int {
+	if w := len(fmt.Sprint(n)); w > 5 {
+		return w
+	}
+	return 5
+}
 
-	curPhyBlk := uint64(curFileBlk-exFirstFileBlk) + ex.PhysicalBlock()
-	readStart := curPhyBlk*f.regFile.inode.blkSize + (off % f.regFile.inode.blkSize)
+// extentDumper implements DumpExtentTree.
+type extentDumper struct {
+	dev           BlockDevice
+	logicalWidth  int
+	physicalWidth int
 
-	endPhyBlk := ex.PhysicalBlock() + uint64(ex.Length)
-	extentEnd := endPhyBlk * f.regFile.inode.blkSize // This is exclusive.
+	// height is the height of the root node.
+	height uint16
 
-	toRead := int(extentEnd - readStart)
-	if len(dst) < toRead {
-		toRead = len(dst)
-	}
+	// out holds the output.
+	out strings.Builder
+}
 
-	n, _ := f.regFile.inode.fs.dev.ReadAt(dst[:toRead], int64(readStart))
-	if n < toRead {
-		return n, syserror.EIO
+// dumpNode prints node, stored at loc and level levels below the root, and its
+// children. Its entries cover the file blocks before end.
+func (d *extentDumper) dumpNode(loc string, node *disklayout.ExtentNode, level uint16, end uint64) error {
+	h := node.Header
+	fmt.Fprintf(&d.out, "%s: eh_magic %#x eh_entries %d eh_max %d eh_depth %d\n", loc, h.Magic, h.NumEntries, h.MaxEntries, h.Height)
+	for i, ep := range node.Entries {
+		fileBlk := uint64(ep.Entry.FileBlock())
+		if h.Height == 0 {
+			ex := ep.Entry.(*disklayout.Extent)
+			length := uint64(ex.ActualLength())
+			flags := ""
+			if ex.Uninitialized() {
+				flags = "Uninit"
+			}
+			logicalEnd, physicalEnd := "", ""
+			if length > 0 {
+				logicalEnd = fmt.Sprint(fileBlk + length - 1)
+				physicalEnd = fmt.Sprint(ex.PhysicalBlock() + length - 1)
+			}
+			fmt.Fprintf(&d.out, "%2d/%2d %3d/%3d %*d - %*s %*d - %*s %6d %s\n",
+				level, d.height, i+1, len(node.Entries),
+				d.logicalWidth, fileBlk, d.logicalWidth, logicalEnd,
+				d.physicalWidth, ex.PhysicalBlock(), d.physicalWidth, physicalEnd,
+				length, flags)
+			continue
+		}
+
+		entryEnd := end
+		if i+1 < len(node.Entries) {
+			entryEnd = uint64(node.Entries[i+1].Entry.FileBlock())
+		}
+		// Like debugfs, the length is truncated to 32 bits.
+		length := uint32(entryEnd - fileBlk)
+		phyBlk := ep.Entry.PhysicalBlock()
+		fmt.Fprintf(&d.out, "%2d/%2d %3d/%3d %*d - %*d %*d%*s %6d\n",
+			level, d.height, i+1, len(node.Entries),
+			d.logicalWidth, fileBlk, d.logicalWidth, fileBlk+uint64(length-1),
+			d.physicalWidth, phyBlk, d.physicalWidth+3, "",
+			length)
+
+		childLoc := fmt.Sprintf("block %d", phyBlk)
+		buf, err := d.dev.ReadBlock(phyBlk)
+		if err != nil {
+			return err
+		}
+		child, err := disklayout.ParseExtentNode(buf)
+		if err != nil {
+			fmt.Fprintf(&d.out, "%s: %v\n", childLoc, err)
+			continue
+		}
+		if child.Header.Height != h.Height-1 {
+			fmt.Fprintf(&d.out, "%s: height %d under node of height %d\n", childLoc, child.Header.Height, h.Height)
+			continue
+		}
+		if err := d.dumpNode(childLoc, child, level+1, entryEnd); err != nil {
+			return err
+		}
 	}
-	return n, nil
+	return nil
 }
@@ -16,6 +16,8 @@ package ext
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
@@ -23,6 +25,7 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"gvisor.dev/gvisor/pkg/binary"
 	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+	"gvisor.dev/gvisor/pkg/syserror"
 )
 
 const (
@@ -33,14 +36,14 @@ const (
 
 // The tree described below looks like:
 //
-//            0.{Head}[Idx][Idx]
-//                     /     \
-//                    /       \
-//      1.{Head}[Ext][Ext]  2.{Head}[Idx]
-//               /    |               \
-//           [Phy]  [Phy, Phy]    3.{Head}[Ext]
-//                                          |
-//                                    [Phy, Phy, Phy]
+//                 0.{Head}[Idx][Idx]
+//                          /     \
+//                         /       \
+//            1.{Head}[Idx]       2.{Head}[Idx]
+//                     |                    \
+//           4.{Head}[Ext][Ext]        3.{Head}[Ext]
+//                    /    |                     |
+//                [Phy]  [Phy, Phy]        [Phy, Phy, Phy]
 //
 // Legend:
 //   - Head = ExtentHeader
@@ -49,7 +52,8 @@ const (
 //   - Phy  = Physical Block
 //
 // Please note that ext4 might not construct extent trees looking like this.
-// This is purely for testing the tree traversal logic.
+// This is purely for testing the tree traversal logic. The tree is balanced
+// though, as extent tree nodes must be exactly one level below their parent.
 var (
 	node3 = &disklayout.ExtentNode{
 		Header: disklayout.ExtentHeader{
@@ -88,7 +92,7 @@ var (
 		},
 	}
 
-	node1 = &disklayout.ExtentNode{
+	node4 = &disklayout.ExtentNode{
 		Header: disklayout.ExtentHeader{
 			Magic:      disklayout.ExtentMagic,
 			NumEntries: 2,
@@ -115,6 +119,24 @@ var (
 		},
 	}
 
+	node1 = &disklayout.ExtentNode{
+		Header: disklayout.ExtentHeader{
+			Magic:      disklayout.ExtentMagic,
+			NumEntries: 1,
+			MaxEntries: 4,
+			Height:     1,
+		},
+		Entries: []disklayout.ExtentEntryPair{
+			{
+				Entry: &disklayout.ExtentIdx{
+					FirstFileBlock: 0,
+					ChildBlockLo:   9,
+				},
+				Node: node4,
+			},
+		},
+	}
+
 	node0 = &disklayout.ExtentNode{
 		Header: disklayout.ExtentHeader{
 			Magic:      disklayout.ExtentMagic,
@@ -170,6 +192,117 @@ func TestBuildExtentTree(t *testing.T) {
 	}
 }
 
+// TestBuildExtentTreeBadHeight tests that building an extent tree fails with
+// EINVAL if a child node is not exactly one level below its parent, including
+// index nodes which point to themselves.
+func TestBuildExtentTreeBadHeight(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		height      uint16
+		childBlock  uint32
+		childHeight uint16
+	}{
+		{name: "self", height: 1, childBlock: 1},
+		{name: "same height", height: 1, childBlock: 2, childHeight: 1},
+		{name: "higher", height: 1, childBlock: 2, childHeight: 2},
+		{name: "skipped level", height: 0, childBlock: 2},
+	} {
+		mockDisk := make([]byte, 4*mockExtentBlkSize)
+		mockFile := regularFile{
+			inode: inode{
+				fs: &filesystem{
+					dev:    bytes.NewReader(mockDisk),
+					blocks: NewBlockDevice(bytes.NewReader(mockDisk), mockExtentBlkSize, 0),
+					sb:     &disklayout.SuperBlock64Bit{},
+				},
+				diskInode: &disklayout.InodeNew{},
+				blkSize:   mockExtentBlkSize,
+			},
+		}
+		// The root of height 2 points at a node of height in block 1, whose
+		// only entry points at a node of childHeight in childBlock.
+		idxNode := func(height uint16, child uint32) []byte {
+			b := binary.Marshal(nil, binary.LittleEndian, disklayout.ExtentHeader{
+				Magic:      disklayout.ExtentMagic,
+				NumEntries: 1,
+				MaxEntries: 4,
+				Height:     height,
+			})
+			return binary.Marshal(b, binary.LittleEndian, disklayout.ExtentIdx{ChildBlockLo: child})
+		}
+		copy(mockFile.inode.diskInode.Data(), idxNode(2, 1))
+		copy(mockDisk[mockExtentBlkSize:], idxNode(test.height, test.childBlock))
+		if test.childBlock != 1 {
+			copy(mockDisk[2*mockExtentBlkSize:], idxNode(test.childHeight, 3))
+		}
+
+		if _, err := newExtentFile(mockFile); err != syserror.EINVAL {
+			t.Errorf("%s: newExtentFile() = %v, want %v", test.name, err, syserror.EINVAL)
+		}
+	}
+}
+
+// TestExtentHoles tests that holes and uninitialized extents in an extent file
+// read as zeros and that reads stop at the file size.
+func TestExtentHoles(t *testing.T) {
+	mockDisk := make([]byte, 6*mockExtentBlkSize)
+	rand.Read(mockDisk)
+	// The file ends 10 bytes into file block 3.
+	size := 3*mockExtentBlkSize + 10
+	regFile := regularFile{
+		inode: inode{
+			fs: &filesystem{
+				dev:    bytes.NewReader(mockDisk),
+				blocks: NewBlockDevice(bytes.NewReader(mockDisk), mockExtentBlkSize, 0),
+				sb:     &disklayout.SuperBlock64Bit{},
+			},
+			diskInode: &disklayout.InodeNew{
+				InodeOld: disklayout.InodeOld{
+					SizeLo: uint32(size),
+				},
+			},
+			blkSize: mockExtentBlkSize,
+		},
+	}
+	// File block 0 is a hole, file block 1 holds data and file blocks 2 and 3
+	// are in an uninitialized extent.
+	root := binary.Marshal(nil, binary.LittleEndian, disklayout.ExtentHeader{
+		Magic:      disklayout.ExtentMagic,
+		NumEntries: 2,
+		MaxEntries: 4,
+	})
+	root = binary.Marshal(root, binary.LittleEndian, disklayout.Extent{
+		FirstFileBlock: 1,
+		Length:         1,
+		StartBlockLo:   2,
+	})
+	root = binary.Marshal(root, binary.LittleEndian, disklayout.Extent{
+		FirstFileBlock: 2,
+		Length:         disklayout.ExtentMaxInitLength + 2,
+		StartBlockLo:   3,
+	})
+	copy(regFile.inode.diskInode.Data(), root)
+	mockFile, err := newExtentFile(regFile)
+	if err != nil {
+		t.Fatalf("newExtentFile failed: %v", err)
+	}
+
+	want := make([]byte, size)
+	copy(want[mockExtentBlkSize:], mockDisk[2*mockExtentBlkSize:3*mockExtentBlkSize])
+	got := make([]byte, 5*mockExtentBlkSize)
+	n, err := mockFile.ReadAt(got, 0)
+	if n != len(want) || err != io.EOF {
+		t.Fatalf("ReadAt = (%d, %v), want (%d, %v)", n, err, len(want), io.EOF)
+	}
+	if diff := cmp.Diff(got[:n], want); diff != "" {
+		t.Errorf("file data mismatched (-want +got):\n%s", diff)
+	}
+
+	if n, err := mockFile.ReadAt(got, int64(size)); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the file size = (%d, %v), want (0, %v)", n, err, io.EOF)
+	}
+}
+
 // extentTreeSetUp writes the passed extent tree to a mock disk as an extent
 // tree. It also constucts a mock extent file with the same tree built in it.
 // It also writes random data file data and returns it.
@@ -181,7 +314,9 @@ func extentTreeSetUp(t *testing.T, root *disklayout.ExtentNode) (*extentFile, []
 		regFile: regularFile{
 			inode: inode{
 				fs: &filesystem{
-					dev: bytes.NewReader(mockDisk),
+					dev:    bytes.NewReader(mockDisk),
+					blocks: NewBlockDevice(bytes.NewReader(mockDisk), mockExtentBlkSize, 0),
+					sb:     &disklayout.SuperBlock64Bit{},
 				},
 				diskInode: &disklayout.InodeNew{
 					InodeOld: disklayout.InodeOld{
@@ -265,3 +400,170 @@ func getNumPhyBlks(node *disklayout.ExtentNode) uint32 {
 	}
 	return res
 }
+
+// newContiguousExtentFile returns an extent file of fileSize bytes stored in a
+// single extent starting at block 1 of dev, which must hold blkSize+fileSize
+// bytes.
+func newContiguousExtentFile(b *testing.B, dev io.ReaderAt, blkSize, fileSize uint32) *extentFile {
+	regFile := regularFile{
+		inode: inode{
+			fs: &filesystem{
+				dev:    dev,
+				blocks: NewBlockDevice(dev, uint64(blkSize), 0),
+				sb:     &disklayout.SuperBlock64Bit{},
+			},
+			diskInode: &disklayout.InodeNew{
+				InodeOld: disklayout.InodeOld{
+					SizeLo: fileSize,
+				},
+			},
+			blkSize: uint64(blkSize),
+		},
+	}
+	root := binary.Marshal(nil, binary.LittleEndian, disklayout.ExtentHeader{
+		Magic:      disklayout.ExtentMagic,
+		NumEntries: 1,
+		MaxEntries: 4,
+	})
+	root = binary.Marshal(root, binary.LittleEndian, disklayout.Extent{
+		Length:       uint16(fileSize / blkSize),
+		StartBlockLo: 1,
+	})
+	copy(regFile.inode.diskInode.Data(), root)
+	file, err := newExtentFile(regFile)
+	if err != nil {
+		b.Fatalf("newExtentFile failed: %v", err)
+	}
+	return file
+}
+
+// BenchmarkExtentRead compares reading a 100MiB file stored in a single extent
+// block by block and run by run.
+func BenchmarkExtentRead(b *testing.B) {
+	const (
+		blkSize  = 4096
+		fileSize = 100 << 20
+	)
+	mockFile := newContiguousExtentFile(b, bytes.NewReader(make([]byte, blkSize+fileSize)), blkSize, fileSize)
+
+	buf := make([]byte, 1<<20)
+	for _, bm := range []struct {
+		name   string
+		readAt func(dst []byte, off int64) (int, error)
+	}{
+		{
+			name: "PerBlock",
+			readAt: func(dst []byte, off int64) (int, error) {
+				return mockFile.regFile.readMapped(dst, off, mapBlockRuns(mockFile.mapBlock))
+			},
+		},
+		{
+			name:   "Runs",
+			readAt: mockFile.ReadAt,
+		},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(fileSize)
+			for i := 0; i < b.N; i++ {
+				for off := int64(0); off < fileSize; off += int64(len(buf)) {
+					if _, err := bm.readAt(buf, off); err != nil && err != io.EOF {
+						b.Fatalf("ReadAt(%d) failed: %v", off, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDumpExtentTree tests the extent trees printed by DumpExtentTree against
+// the output of the debugfs "ex" command.
+func TestDumpExtentTree(t *testing.T) {
+	// Extent lines end with a space when they have no flags, so the expected
+	// output is spelled out with explicit newlines.
+	for _, test := range []struct {
+		name  string
+		image string
+		path  string
+		// patch, if set, modifies the inode before dumping its tree.
+		patch func(data []byte)
+		want  string
+	}{
+		{
+			// The extent tree of the root directory fits in i_block.
+			name:  "root",
+			image: flexBGImagePath,
+			path:  "/",
+			want: "Level Entries       Logical      Physical Length Flags\n" +
+				"i_block: eh_magic 0xf30a eh_entries 3 eh_max 4 eh_depth 0\n" +
+				" 0/ 0   1/  3     0 -     0    99 -    99      1 \n" +
+				" 0/ 0   2/  3     1 -     1   192 -   192      1 \n" +
+				" 0/ 0   3/  3     2 -     2   279 -   279      1 \n",
+		},
+		{
+			// The ends of the ranges of an empty extent are left blank.
+			name:  "empty extent",
+			image: flexBGImagePath,
+			path:  "/",
+			patch: func(data []byte) {
+				// ee_len of the first extent, after the node header and ee_block.
+				binary.LittleEndian.PutUint16(data[16:], 0)
+			},
+			want: "Level Entries       Logical      Physical Length Flags\n" +
+				"i_block: eh_magic 0xf30a eh_entries 3 eh_max 4 eh_depth 0\n" +
+				" 0/ 0   1/  3     0 -          99 -            0 \n" +
+				" 0/ 0   2/  3     1 -     1   192 -   192      1 \n" +
+				" 0/ 0   3/  3     2 -     2   279 -   279      1 \n",
+		},
+		{
+			// The index entry only covers the blocks up to the end of the file,
+			// while the uninitialized extents are past it.
+			name:  "sparse",
+			image: fragmentedImagePath,
+			path:  "/sparse",
+			want: "Level Entries       Logical      Physical Length Flags\n" +
+				"i_block: eh_magic 0xf30a eh_entries 1 eh_max 4 eh_depth 1\n" +
+				" 0/ 1   1/  1     0 -    14    23             15\n" +
+				"block 23: eh_magic 0xf30a eh_entries 10 eh_max 84 eh_depth 0\n" +
+				" 1/ 1   1/ 10     0 -     0    17 -    17      1 \n" +
+				" 1/ 1   2/ 10     2 -     2    18 -    18      1 \n" +
+				" 1/ 1   3/ 10     4 -     4    20 -    20      1 \n" +
+				" 1/ 1   4/ 10     6 -     6    21 -    21      1 \n" +
+				" 1/ 1   5/ 10     8 -     8    22 -    22      1 \n" +
+				" 1/ 1   6/ 10    10 -    10    24 -    24      1 \n" +
+				" 1/ 1   7/ 10    12 -    12    25 -    25      1 \n" +
+				" 1/ 1   8/ 10    14 -    14    26 -    26      1 \n" +
+				" 1/ 1   9/ 10    20 -    22    32 -    34      3 Uninit\n" +
+				" 1/ 1  10/ 10    23 -    23    39 -    39      1 Uninit\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs, closeImage := openImage(t, test.image)
+			defer closeImage()
+			in, err := ResolvePath(fs, test.path)
+			if err != nil {
+				t.Fatalf("ResolvePath(%q) failed: %v", test.path, err)
+			}
+			if test.patch != nil {
+				test.patch(in.Data())
+			}
+			var b bytes.Buffer
+			if err := DumpExtentTree(in, fs.fs.sb, fs.fs.blocks, &b); err != nil {
+				t.Fatalf("DumpExtentTree failed: %v", err)
+			}
+			if diff := cmp.Diff(test.want, b.String()); diff != "" {
+				t.Errorf("DumpExtentTree() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Block mapped files have no extent tree.
+	fs, closeImage := openImage(t, ext2ImagePath)
+	defer closeImage()
+	in, err := ResolvePath(fs, "/file.txt")
+	if err != nil {
+		t.Fatalf("ResolvePath(/file.txt) failed: %v", err)
+	}
+	if err := DumpExtentTree(in, fs.fs.sb, fs.fs.blocks, ioutil.Discard); err != syserror.EINVAL {
+		t.Errorf("DumpExtentTree() of block mapped file = %v, want %v", err, syserror.EINVAL)
+	}
+}
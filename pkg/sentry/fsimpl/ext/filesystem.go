@@ -17,6 +17,7 @@ package ext
 import (
 	"errors"
 	"io"
+	"syscall"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
@@ -33,8 +34,18 @@ var (
 	// using the in-memory dirent and added to the dentry tree. Usually indicates
 	// the need to lock filesystem.mu for writing.
 	errResolveDirent = errors.New("resolve path component using dirent")
+
+	// ErrEncrypted is returned instead of the contents of encrypted files, the
+	// entries of encrypted directories and the targets of encrypted symlinks,
+	// which would be ciphertext since encryption keys are not supported. Like
+	// Linux without the key, it is translated to ENOKEY.
+	ErrEncrypted = errors.New("ext fs: encrypted inode, key not available")
 )
 
+func init() {
+	syserror.AddErrorTranslation(ErrEncrypted, syscall.ENOKEY)
+}
+
 // filesystem implements vfs.FilesystemImpl.
 type filesystem struct {
 	vfsfs vfs.Filesystem
@@ -49,6 +60,14 @@ type filesystem struct {
 	// requests in the optimal order (taking locality into consideration).
 	dev io.ReaderAt
 
+	// blocks reads metadata blocks from dev and caches them. Immutable after
+	// initialization.
+	blocks BlockDevice
+
+	// cacheBlocks is the number of metadata blocks cached by blocks, or 0 if
+	// none are. Immutable.
+	cacheBlocks int
+
 	// inodeCache maps absolute inode numbers to the corresponding Inode struct.
 	// Inodes should be removed from this once their reference count hits 0.
 	//
@@ -245,11 +264,14 @@ func (fs *filesystem) getOrCreateInodeLocked(inodeNum uint32) (*inode, error) {
 func (fs *filesystem) statTo(stat *linux.Statfs) {
 	stat.Type = uint64(fs.sb.Magic())
 	stat.BlockSize = int64(fs.sb.BlockSize())
-	stat.Blocks = fs.sb.BlocksCount()
-	stat.BlocksFree = fs.sb.FreeBlocksCount()
-	stat.BlocksAvailable = fs.sb.FreeBlocksCount()
-	stat.Files = uint64(fs.sb.InodesCount())
-	stat.FilesFree = uint64(fs.sb.FreeInodesCount())
+	// Like Linux, sum the free counts of the groups and report the blocks
+	// available to unprivileged users.
+	stats := disklayout.FreeSpaceStats(fs.sb, fs.bgs)
+	stat.Blocks = stats.TotalBlocks
+	stat.BlocksFree = stats.FreeBlocks
+	stat.BlocksAvailable = stats.AvailableBlocks
+	stat.Files = stats.TotalInodes
+	stat.FilesFree = stats.FreeInodes
 	stat.NameLength = disklayout.MaxFileName
 	stat.FragmentSize = int64(fs.sb.BlockSize())
 	// TODO(b/134676337): Set Statfs.Flags and Statfs.FSID.
@@ -309,7 +331,7 @@ func (fs *filesystem) ReadlinkAt(ctx context.Context, rp *vfs.ResolvingPath) (st
 	if !ok {
 		return "", syserror.EINVAL
 	}
-	return symlink.target, nil
+	return symlink.readTarget()
 }
 
 // StatAt implements vfs.FilesystemImpl.StatAt.
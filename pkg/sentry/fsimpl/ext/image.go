@@ -0,0 +1,541 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// Filesystem provides read access to the files of an ext filesystem image
+// without going through the sentry VFS. Paths are resolved directly against
+// the on-disk directories.
+//
+// Filesystem does not cache inodes; every Open reads the inodes along the path
+// from the image. It is safe for concurrent use.
+type Filesystem struct {
+	// fs holds the superblock and block group descriptors of the image. Its
+	// vfsfs, mu and inodeCache are unused.
+	fs filesystem
+}
+
+// FilesystemOptions holds the options of NewFilesystemWithOptions.
+type FilesystemOptions struct {
+	// MetadataCacheBlocks is the number of metadata blocks to cache. No blocks
+	// are cached if it is 0.
+	MetadataCacheBlocks int
+}
+
+// NewFilesystem returns a Filesystem for the ext filesystem image on dev. It
+// reads and validates the superblock and block group descriptors. Returns
+// EINVAL if the image is not a compatible ext filesystem. Like mounting, the
+// journal is replayed in memory if the image needs recovery (see
+// ReplayJournal) and this logs a warning if multiple mount protection
+// indicates that another node is using the filesystem.
+//
+// Up to DefaultMetadataCacheBlocks metadata blocks are cached.
+func NewFilesystem(dev io.ReaderAt) (*Filesystem, error) {
+	return NewFilesystemWithOptions(dev, FilesystemOptions{MetadataCacheBlocks: DefaultMetadataCacheBlocks})
+}
+
+// NewFilesystemWithOptions is NewFilesystem with options. Returns EINVAL if
+// opts.MetadataCacheBlocks is negative.
+func NewFilesystemWithOptions(dev io.ReaderAt, opts FilesystemOptions) (*Filesystem, error) {
+	if opts.MetadataCacheBlocks < 0 {
+		log.Warningf("ext fs: negative metadata cache size %d", opts.MetadataCacheBlocks)
+		return nil, syserror.EINVAL
+	}
+	f := &Filesystem{fs: filesystem{dev: dev, cacheBlocks: opts.MetadataCacheBlocks}}
+	if err := f.fs.readMetadata(); err != nil {
+		return nil, err
+	}
+	// Filesystem is used outside of the sentry, so the host time is the
+	// current time.
+	if err := f.fs.checkMMP(ktime.FromNanoseconds(time.Now().UnixNano())); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// File is a regular file opened with Filesystem.Open. Its data is read directly
+// from the image through the file's extent tree or block map; holes read as
+// zeros. By default, each read only reads the requested data from the image;
+// see Hint for reading files sequentially.
+type File struct {
+	*io.SectionReader
+
+	inode *inode
+
+	// ra is the io.ReaderAt read by SectionReader.
+	ra *readAhead
+}
+
+// newFile returns a File reading regFile.
+func newFile(regFile *regularFile) *File {
+	ra := &readAhead{
+		file: regFile.impl,
+		size: int64(regFile.inode.diskInode.Size()),
+	}
+	return &File{
+		SectionReader: io.NewSectionReader(ra, 0, ra.size),
+		inode:         &regFile.inode,
+		ra:            ra,
+	}
+}
+
+// Inode returns the on-disk inode of the file.
+func (f *File) Inode() disklayout.Inode {
+	return f.inode.diskInode
+}
+
+// ReadHint declares how a File will be read. See File.Hint.
+type ReadHint int
+
+const (
+	// WillReadRandomly is the default hint. Each read only reads the requested
+	// data from the image.
+	WillReadRandomly ReadHint = iota
+
+	// WillReadSequentially declares that the file will be read in order, for
+	// example to copy it. Reads then also read up to readAheadSize bytes past
+	// the requested data, which the following reads are served from. In
+	// extent files, each run of contiguous blocks is read from the image at
+	// once.
+	WillReadSequentially
+)
+
+// readAheadSize is the number of bytes read at once from files hinted with
+// WillReadSequentially. It is the default read_ahead_kb of Linux block
+// devices.
+const readAheadSize = 128 << 10
+
+// Hint declares how f will be read. The hint is advisory: it only changes how
+// the file data is read from the image, never the data read. While
+// WillReadSequentially is in effect, reads of f are serialized.
+func (f *File) Hint(hint ReadHint) {
+	f.ra.mu.Lock()
+	defer f.ra.mu.Unlock()
+	f.ra.sequential = hint == WillReadSequentially
+	if !f.ra.sequential {
+		f.ra.buf = nil
+	}
+}
+
+// readAhead implements io.ReaderAt over the data of a regular file, reading
+// ahead of the requested data if the file is read sequentially.
+type readAhead struct {
+	// file reads the file data. Immutable.
+	file io.ReaderAt
+
+	// size is the file size. Immutable.
+	size int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// sequential is true if the file is hinted with WillReadSequentially.
+	sequential bool
+
+	// buf holds the file data at off which was read ahead.
+	buf []byte
+	off int64
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (r *readAhead) ReadAt(dst []byte, off int64) (int, error) {
+	r.mu.Lock()
+	if !r.sequential {
+		r.mu.Unlock()
+		return r.file.ReadAt(dst, off)
+	}
+	defer r.mu.Unlock()
+
+	read := 0
+	for read < len(dst) {
+		cur := off + int64(read)
+		if cur < r.off || cur >= r.off+int64(len(r.buf)) {
+			// Reads at least as large as the read-ahead gain nothing from
+			// going through buf.
+			if len(dst)-read >= readAheadSize || cur >= r.size {
+				n, err := r.file.ReadAt(dst[read:], cur)
+				return read + n, err
+			}
+			if err := r.fill(cur); err != nil {
+				return read, err
+			}
+		}
+		read += copy(dst[read:], r.buf[cur-r.off:])
+	}
+	return read, nil
+}
+
+// fill reads up to readAheadSize bytes of the file at off into buf.
+//
+// Preconditions: r.mu must be locked. off < r.size.
+func (r *readAhead) fill(off int64) error {
+	n := int64(readAheadSize)
+	if rem := r.size - off; rem < n {
+		n = rem
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, readAheadSize)
+	}
+	buf := r.buf[:cap(r.buf)][:n]
+	if read, err := r.file.ReadAt(buf, off); int64(read) < n {
+		r.buf = r.buf[:0]
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.buf, r.off = buf, off
+	return nil
+}
+
+// Open opens the regular file at path, which is resolved like ResolvePath
+// does. Returns EISDIR if path is a directory, ENOTDIR if it names a regular
+// file with a trailing slash and ErrEncrypted if the file is encrypted.
+func (f *Filesystem) Open(path string) (*File, error) {
+	in, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	switch impl := in.impl.(type) {
+	case *regularFile:
+		// Like Linux, a trailing slash requires a directory.
+		if strings.HasSuffix(path, "/") {
+			return nil, syserror.ENOTDIR
+		}
+		if in.diskInode.IsEncrypted() {
+			return nil, ErrEncrypted
+		}
+		return newFile(impl), nil
+	case *directory:
+		return nil, syserror.EISDIR
+	default:
+		return nil, syserror.EINVAL
+	}
+}
+
+// JournalSuperBlock reads the superblock of the internal journal of the image,
+// located through the journal inode of the filesystem superblock. Returns
+// ENOENT if the image has no internal journal and EINVAL if the journal
+// superblock is invalid.
+func (f *Filesystem) JournalSuperBlock() (*disklayout.JournalSuperBlock, error) {
+	return f.fs.readJournalSuperBlock()
+}
+
+// ReplayJournal replays the internal journal of fs in memory if it needs
+// recovery; dev must hold the blocks of the image. The blocks logged by the
+// committed transactions of the journal are read from memory from then on,
+// while the image itself is not modified. NewFilesystem already replays the
+// journal of images which need recovery, so this does nothing for the
+// Filesystems it returns. It must not be called concurrently with other
+// methods of fs. Returns EINVAL if the journal is invalid or has unsupported
+// features.
+func ReplayJournal(fs *Filesystem, dev BlockDevice) error {
+	if err := fs.fs.replayJournal(dev); err != nil {
+		return err
+	}
+	return fs.fs.loadGroupDescriptors()
+}
+
+// DirEntry is a directory entry returned by Filesystem.ReadDir.
+type DirEntry struct {
+	// Name is the name of the entry. If Encrypted is set, it is the raw
+	// ciphertext of the name, which may hold any byte.
+	Name string
+
+	// Inode is the inode number of the entry.
+	Inode uint32
+
+	// Encrypted is true if Name is encrypted.
+	Encrypted bool
+}
+
+// ReadDir returns the entries of the directory at path, which is resolved like
+// ResolvePath does, in on-disk order. Returns ENOTDIR if path is not a
+// directory.
+//
+// Unlike reading the directory through the sentry VFS, which fails with
+// ErrEncrypted, the entries of encrypted directories are returned with their
+// encrypted names. The "." and ".." entries, which are never encrypted, are
+// included.
+func (f *Filesystem) ReadDir(path string) ([]DirEntry, error) {
+	in, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := in.impl.(*directory)
+	if !ok {
+		return nil, syserror.ENOTDIR
+	}
+
+	var entries []DirEntry
+	// dir was just read from disk, so childList holds no directoryFD
+	// iterators.
+	for child := dir.childList.Front(); child != nil; child = child.Next() {
+		name := child.diskDirent.FileName()
+		entries = append(entries, DirEntry{
+			Name:      name,
+			Inode:     child.diskDirent.Inode(),
+			Encrypted: in.diskInode.IsEncrypted() && name != "." && name != "..",
+		})
+	}
+	return entries, nil
+}
+
+// ListRoot returns the entries of the root directory of fs, as walked by
+// WalkDir: in on-disk order, including "." and ".." but not deleted entries
+// or the ext4_dir_entry_tail of each block. Returns EIO if the root inode
+// does not match its checksum and ENOTDIR if it is not a directory.
+func ListRoot(fs *Filesystem) ([]disklayout.Dirent, error) {
+	root, _, err := readDiskInode(&fs.fs, disklayout.RootDirInode)
+	if err != nil {
+		return nil, err
+	}
+	var dirents []disklayout.Dirent
+	if err := WalkDir(root, fs.fs.sb, fs.fs.blocks, func(d disklayout.Dirent) error {
+		dirents = append(dirents, d)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return dirents, nil
+}
+
+// ResolvePath returns the inode at path in fs. path is resolved from the root
+// directory; relative paths are treated as absolute. Each component is looked
+// up in its parent directory, where "." and ".." are stored like any other
+// name. Symlinks, including the last path component, are followed: relative
+// targets are resolved from the directory holding the symlink and absolute
+// targets from the root directory.
+//
+// Since images may be malicious, resolution is bounded. Returns
+// syserror.ELOOP if more than linux.MaxSymlinkTraversals symlinks are
+// followed and syserror.ENAMETOOLONG if path or a symlink target is longer
+// than linux.PATH_MAX or the path left to resolve grows to more components
+// than a path of that length can hold. Returns syserror.ENOENT if a component
+// does not exist, syserror.ENOTDIR if a non-final component is not a
+// directory and ErrEncrypted if an encrypted symlink would be followed.
+func ResolvePath(fs *Filesystem, path string) (disklayout.Inode, error) {
+	in, err := fs.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return in.diskInode, nil
+}
+
+// ForEachInodeOptions holds the options of ForEachInodeWithOptions.
+type ForEachInodeOptions struct {
+	// SkipReserved skips the reserved inodes holding filesystem metadata,
+	// like the journal inode: those before sb.FirstInode() but the root
+	// directory. See disklayout.ReservedInode.
+	SkipReserved bool
+}
+
+// ForEachInode calls fn for each inode of fs marked as allocated in the inode
+// bitmaps, in increasing inode number order. The walk stops at the first error
+// returned by fn, which ForEachInode returns.
+//
+// The inodes before sb.FirstInode() are reserved and always marked as
+// allocated, so they are all reported. This includes the root directory and
+// journal inodes but also the ones which are unused, like the bad blocks inode.
+// Groups with BgInodeUninit set are skipped without reading their bitmap and,
+// if the group descriptors have checksums, so are the inodes of a group past
+// its bg_itable_unused trailing unused ones. Returns EIO if a bitmap or inode
+// cannot be read or does not match its checksum.
+func ForEachInode(fs *Filesystem, fn func(ino uint32, inode disklayout.Inode) error) error {
+	return ForEachInodeWithOptions(fs, ForEachInodeOptions{}, fn)
+}
+
+// ForEachInodeWithOptions is ForEachInode with options. With opts.SkipReserved
+// set, the reserved inodes but the root directory are not reported.
+func ForEachInodeWithOptions(fs *Filesystem, opts ForEachInodeOptions, fn func(ino uint32, inode disklayout.Inode) error) error {
+	sb := fs.fs.sb
+	roCompat := sb.ReadOnlyCompatibleFeatures()
+	hasCsum := roCompat.MetadataCsum || roCompat.GdtCsum
+	perGroup := sb.InodesPerGroup()
+	for bgNum, bg := range fs.fs.bgs {
+		if bg.Flags().InodeUninit {
+			continue
+		}
+		bitmap, err := readInodeBitmap(fs.fs.dev, sb, uint32(bgNum), bg)
+		if err != nil {
+			return err
+		}
+		used := perGroup
+		if hasCsum && bg.UnusedInodeCount() <= perGroup {
+			used -= bg.UnusedInodeCount()
+		}
+		for i := uint32(0); i < used; i++ {
+			if !bitmap.Test(i) {
+				continue
+			}
+			ino := uint32(bgNum)*perGroup + i + 1
+			if ino > sb.InodesCount() {
+				return nil
+			}
+			if opts.SkipReserved && ino != disklayout.RootDirInode && ino < sb.FirstInode() {
+				continue
+			}
+			in, _, err := readDiskInode(&fs.fs, ino)
+			if err != nil {
+				return err
+			}
+			if err := fn(ino, in); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preloadBatchSize is the maximum number of bytes of inode table read at once
+// by PreloadInodes.
+const preloadBatchSize = 64 << 10
+
+// PreloadInodes reads the inodes inos of fs and returns them by inode number.
+// It is meant for reading many inodes at once, like the children of a large
+// directory whose entries do not record their file type: the inodes are sorted
+// by inode number, which is their on-disk order within each group, and each
+// run of them in the inode table of a group is read from the image at once, up
+// to preloadBatchSize bytes including the unrequested inodes in between. Runs
+// never span groups since consecutive inode tables are not necessarily
+// adjacent. Returns EIO if an inode number is invalid or an inode cannot be
+// read or does not match its checksum.
+func PreloadInodes(fs *Filesystem, inos []uint32) (map[uint32]disklayout.Inode, error) {
+	sb := fs.fs.sb
+	sorted := append([]uint32(nil), inos...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	perGroup := sb.InodesPerGroup()
+	recordSize := int64(sb.InodeSize())
+
+	inodes := make(map[uint32]disklayout.Inode, len(sorted))
+	for i := 0; i < len(sorted); {
+		first := sorted[i]
+		start, err := disklayout.InodeOffset(sb, fs.fs.bgs, first)
+		if err != nil {
+			log.Warningf("ext fs: %v", err)
+			return nil, syserror.EIO
+		}
+		// InodeOffset validated first, so the inodes of its group are valid.
+		group := (first - 1) / perGroup
+		end := i + 1
+		for end < len(sorted) && (sorted[end]-1)/perGroup == group && int64(sorted[end]-first+1)*recordSize <= preloadBatchSize {
+			end++
+		}
+
+		buf := make([]byte, int64(sorted[end-1]-first+1)*recordSize)
+		if n, _ := fs.fs.dev.ReadAt(buf, start); n < len(buf) {
+			return nil, syserror.EIO
+		}
+		for _, ino := range sorted[i:end] {
+			if _, ok := inodes[ino]; ok {
+				continue
+			}
+			in, _, err := decodeDiskInode(&fs.fs, ino, buf[int64(ino-first)*recordSize:])
+			if err != nil {
+				return nil, err
+			}
+			inodes[ino] = in
+		}
+		i = end
+	}
+	return inodes, nil
+}
+
+// maxResolveDepth is the maximum number of path components left to resolve at
+// any point of ResolvePath. It is the number of components in the longest
+// path, "a/a/.../a", which fits in linux.PATH_MAX bytes.
+const maxResolveDepth = linux.PATH_MAX / 2
+
+// resolve implements ResolvePath.
+func (f *Filesystem) resolve(path string) (*inode, error) {
+	if len(path) >= linux.PATH_MAX {
+		return nil, syserror.ENAMETOOLONG
+	}
+	root, err := newInode(&f.fs, disklayout.RootDirInode)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := root
+	parts := splitPath(path)
+	symlinks := 0
+	for len(parts) > 0 {
+		dir, ok := cur.impl.(*directory)
+		if !ok {
+			return nil, syserror.ENOTDIR
+		}
+		child, ok := dir.childMap[parts[0]]
+		if !ok {
+			return nil, syserror.ENOENT
+		}
+		parts = parts[1:]
+
+		next, err := newInode(&f.fs, child.diskDirent.Inode())
+		if err != nil {
+			return nil, err
+		}
+		if link, ok := next.impl.(*symlink); ok {
+			if symlinks++; symlinks > linux.MaxSymlinkTraversals {
+				return nil, syserror.ELOOP
+			}
+			target, err := link.readTarget()
+			if err != nil {
+				return nil, err
+			}
+			if len(target) >= linux.PATH_MAX {
+				return nil, syserror.ENAMETOOLONG
+			}
+			if target == "" {
+				return nil, syserror.ENOENT
+			}
+			// Relative targets are resolved from the directory holding the
+			// symlink, so it stays cur.
+			if target[0] == '/' {
+				cur = root
+			}
+			parts = append(splitPath(target), parts...)
+			if len(parts) > maxResolveDepth {
+				return nil, syserror.ENAMETOOLONG
+			}
+			continue
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// splitPath splits path into its components, dropping empty ones.
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
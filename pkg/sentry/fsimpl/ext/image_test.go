@@ -0,0 +1,726 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+	ktime "gvisor.dev/gvisor/pkg/sentry/kernel/time"
+	"gvisor.dev/gvisor/pkg/syserror"
+	"gvisor.dev/gvisor/runsc/testutil"
+)
+
+// openImage opens imagePath as a Filesystem. The returned function closes the
+// image.
+func openImage(t *testing.T, imagePath string) (*Filesystem, func()) {
+	localImagePath, err := testutil.FindFile(imagePath)
+	if err != nil {
+		t.Fatalf("failed to open local image at path %s: %v", imagePath, err)
+	}
+	f, err := os.Open(localImagePath)
+	if err != nil {
+		t.Fatalf("os.Open failed: %v", err)
+	}
+	fs, err := NewFilesystem(f)
+	if err != nil {
+		f.Close()
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	return fs, func() { f.Close() }
+}
+
+// TestFilesystemOpen tests reading files opened with Filesystem.Open.
+func TestFilesystemOpen(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath} {
+		for _, test := range []struct {
+			path  string
+			asset string
+		}{
+			{path: "/file.txt", asset: "file.txt"},
+			{path: "file.txt", asset: "file.txt"},
+			{path: "/symlink.txt", asset: "file.txt"},
+			{path: "/lost+found/../bigfile.txt", asset: "bigfile.txt"},
+		} {
+			t.Run(image+test.path, func(t *testing.T) {
+				fs, closeImage := openImage(t, image)
+				defer closeImage()
+
+				localFile, err := testutil.FindFile(path.Join(assetsDir, test.asset))
+				if err != nil {
+					t.Fatalf("testutil.FindFile failed for %s: %v", test.asset, err)
+				}
+				want, err := ioutil.ReadFile(localFile)
+				if err != nil {
+					t.Fatalf("ioutil.ReadFile failed: %v", err)
+				}
+
+				f, err := fs.Open(test.path)
+				if err != nil {
+					t.Fatalf("Open(%q) failed: %v", test.path, err)
+				}
+				if f.Size() != int64(f.Inode().Size()) {
+					t.Errorf("Size() = %d, want %d", f.Size(), f.Inode().Size())
+				}
+				got, err := ioutil.ReadAll(f)
+				if err != nil {
+					t.Fatalf("ReadAll failed: %v", err)
+				}
+				// bigfile.txt in the images has one more trailing newline
+				// than the asset.
+				if int64(len(got)) != f.Size() || !bytes.HasPrefix(got, want) {
+					t.Errorf("read %d bytes not matching %s (%d bytes)", len(got), test.asset, len(want))
+				}
+
+				// Seek and ReadAt see the same data.
+				if _, err := f.Seek(1, io.SeekStart); err != nil {
+					t.Fatalf("Seek failed: %v", err)
+				}
+				buf := make([]byte, 4)
+				if n, err := f.Read(buf); n != len(buf) || err != nil || !bytes.Equal(buf, want[1:5]) {
+					t.Errorf("Read after Seek = (%q, %v), want %q", buf[:n], err, want[1:5])
+				}
+				if n, err := f.ReadAt(buf, 2); n != len(buf) || err != nil || !bytes.Equal(buf, want[2:6]) {
+					t.Errorf("ReadAt(2) = (%q, %v), want %q", buf[:n], err, want[2:6])
+				}
+			})
+		}
+	}
+}
+
+// TestFileHint tests that files read the same data with and without
+// WillReadSequentially, however they are read.
+func TestFileHint(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, closeImage := openImage(t, image)
+			defer closeImage()
+
+			f, err := fs.Open("/bigfile.txt")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			want, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+
+			f.Hint(WillReadSequentially)
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			var got []byte
+			buf := make([]byte, 1000)
+			for {
+				n, err := f.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("sequential reads read %d bytes not matching the %d bytes of ReadAll", len(got), len(want))
+			}
+
+			// Reads behind and across the read-ahead are still correct.
+			for _, off := range []int64{5000, 10, int64(len(want)) - 100} {
+				n, err := f.ReadAt(buf[:200], off)
+				end := off + int64(n)
+				if wantN := int64(len(want)) - off; wantN < 200 {
+					if n != int(wantN) || err != io.EOF {
+						t.Errorf("ReadAt(%d) = (%d, %v), want (%d, EOF)", off, n, err, wantN)
+					}
+				} else if n != 200 || err != nil {
+					t.Errorf("ReadAt(%d) = (%d, %v), want (200, nil)", off, n, err)
+				}
+				if !bytes.Equal(buf[:n], want[off:end]) {
+					t.Errorf("ReadAt(%d) read data not matching ReadAll", off)
+				}
+			}
+
+			f.Hint(WillReadRandomly)
+			if n, err := f.ReadAt(buf[:200], 3000); n != 200 || err != nil || !bytes.Equal(buf[:n], want[3000:3200]) {
+				t.Errorf("ReadAt(3000) after WillReadRandomly = (%d, %v), want 200 bytes of ReadAll", n, err)
+			}
+		})
+	}
+}
+
+// TestListRoot tests that ListRoot returns the top-level entries of an image.
+func TestListRoot(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, closeImage := openImage(t, image)
+			defer closeImage()
+
+			dirents, err := ListRoot(fs)
+			if err != nil {
+				t.Fatalf("ListRoot failed: %v", err)
+			}
+			var names []string
+			for _, d := range dirents {
+				names = append(names, d.FileName())
+			}
+			if want := []string{".", "..", "lost+found", "file.txt", "symlink.txt", "bigfile.txt"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("ListRoot() = %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+// openCountingImage opens imagePath as a Filesystem reading the image from
+// memory through the returned countingReader.
+func openCountingImage(tb testing.TB, imagePath string) (*Filesystem, *countingReader) {
+	image := readImageData(tb, imagePath)
+	dev := &countingReader{r: bytes.NewReader(image)}
+	fs, err := NewFilesystem(dev)
+	if err != nil {
+		tb.Fatalf("NewFilesystem failed: %v", err)
+	}
+	return fs, dev
+}
+
+// dirInodes returns the inode numbers of the entries of the directory at path.
+func dirInodes(tb testing.TB, fs *Filesystem, path string) []uint32 {
+	entries, err := fs.ReadDir(path)
+	if err != nil {
+		tb.Fatalf("ReadDir(%q) failed: %v", path, err)
+	}
+	var inos []uint32
+	for _, e := range entries {
+		inos = append(inos, e.Inode)
+	}
+	return inos
+}
+
+// TestPreloadInodes tests that PreloadInodes reads the children of a directory
+// spanning three groups like readDiskInode does, with one device read per
+// group.
+func TestPreloadInodes(t *testing.T) {
+	fs, dev := openCountingImage(t, noFileTypeImagePath)
+	if fs.fs.sb.IncompatibleFeatures().DirentFileType {
+		t.Fatalf("image has the filetype feature")
+	}
+	inos := dirInodes(t, fs, "/dir")
+	if len(inos) != 1002 {
+		t.Fatalf("/dir has %d entries, want 1002", len(inos))
+	}
+
+	atomic.StoreInt64(&dev.reads, 0)
+	inodes, err := PreloadInodes(fs, inos)
+	if err != nil {
+		t.Fatalf("PreloadInodes failed: %v", err)
+	}
+	if got := atomic.LoadInt64(&dev.reads); got != 3 {
+		t.Errorf("PreloadInodes read the device %d times, want 3", got)
+	}
+	if len(inodes) != len(inos) {
+		t.Errorf("PreloadInodes returned %d inodes, want %d", len(inodes), len(inos))
+	}
+	for _, ino := range inos {
+		want, _, err := readDiskInode(&fs.fs, ino)
+		if err != nil {
+			t.Fatalf("readDiskInode(%d) failed: %v", ino, err)
+		}
+		if !reflect.DeepEqual(inodes[ino], want) {
+			t.Errorf("PreloadInodes()[%d] = %+v, want %+v", ino, inodes[ino], want)
+		}
+	}
+
+	for _, ino := range []uint32{0, fs.fs.sb.InodesCount() + 1} {
+		if _, err := PreloadInodes(fs, []uint32{12, ino}); err != syserror.EIO {
+			t.Errorf("PreloadInodes(%d) = %v, want %v", ino, err, syserror.EIO)
+		}
+	}
+}
+
+// TestFilesystemOpenErrors tests that Filesystem.Open fails for paths which
+// are not regular files.
+func TestFilesystemOpenErrors(t *testing.T) {
+	fs, closeImage := openImage(t, ext4ImagePath)
+	defer closeImage()
+
+	for _, test := range []struct {
+		path string
+		want error
+	}{
+		{path: "/", want: syserror.EISDIR},
+		{path: "/lost+found", want: syserror.EISDIR},
+		{path: "/nonexistent", want: syserror.ENOENT},
+		{path: "/file.txt/file.txt", want: syserror.ENOTDIR},
+		{path: "/symlink.txt/", want: syserror.ENOTDIR},
+	} {
+		if _, err := fs.Open(test.path); err != test.want {
+			t.Errorf("Open(%q) = %v, want %v", test.path, err, test.want)
+		}
+	}
+}
+
+// TestResolvePath tests symlink and nested path resolution on links.ext4.
+func TestResolvePath(t *testing.T) {
+	fs, closeImage := openImage(t, linksImagePath)
+	defer closeImage()
+
+	deep := strings.Repeat("/d", 64)
+	for _, test := range []struct {
+		path string
+		// size is the size of the resolved file. It tells file.txt (7 bytes)
+		// and the deeply nested file.txt (5 bytes) apart.
+		size uint64
+		want error
+	}{
+		{path: "/file.txt", size: 7},
+		{path: "/abs", size: 7},
+		{path: "/dir/up", size: 7},
+		{path: "/dir/dot", size: 7},
+		{path: "dir/../dir/./up", size: 7},
+		{path: "/../../abs", size: 7},
+		{path: "/chain1", size: 7},
+		{path: deep + "/file.txt", size: 5},
+		{path: deep + strings.Repeat("/..", 64) + "/abs", size: 7},
+		{path: "/chain0", want: syserror.ELOOP},
+		{path: "/loop1", want: syserror.ELOOP},
+		{path: "/self", want: syserror.ELOOP},
+		{path: "/dangling", want: syserror.ENOENT},
+		{path: deep + "/d", want: syserror.ENOENT},
+		{path: "/dir/up/file.txt", want: syserror.ENOTDIR},
+		{path: strings.Repeat("/.", linux.PATH_MAX/2), want: syserror.ENAMETOOLONG},
+	} {
+		in, err := ResolvePath(fs, test.path)
+		if err != test.want {
+			t.Errorf("ResolvePath(%q) = %v, want %v", test.path, err, test.want)
+			continue
+		}
+		if err == nil && in.Size() != test.size {
+			t.Errorf("ResolvePath(%q) resolved to a %d byte file, want %d bytes", test.path, in.Size(), test.size)
+		}
+	}
+
+	if in, err := ResolvePath(fs, "/"); err != nil || in.Mode().FileType() != linux.ModeDirectory {
+		t.Errorf("ResolvePath(/) = (%v, %v), want the root directory", in, err)
+	}
+}
+
+// TestFilesystemOpenBigalloc tests reading a file from a bigalloc filesystem
+// with 1k blocks, whose group descriptors do not follow the first data block.
+func TestFilesystemOpenBigalloc(t *testing.T) {
+	fs, closeImage := openImage(t, bigallocImagePath)
+	defer closeImage()
+
+	f, err := fs.Open("/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello bigalloc\n" {
+		t.Errorf("ReadAll = (%q, %v), want (%q, nil)", got, err, "hello bigalloc\n")
+	}
+}
+
+// TestFilesystemOpenMetaBG tests that files of a filesystem with meta block
+// groups can be read.
+func TestFilesystemOpenMetaBG(t *testing.T) {
+	fs, closeImage := openImage(t, metaBGImagePath)
+	defer closeImage()
+
+	f, err := fs.Open("/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello meta_bg\n" {
+		t.Errorf("ReadAll = (%q, %v), want (%q, nil)", got, err, "hello meta_bg\n")
+	}
+}
+
+// TestFilesystemCsumSeed tests that the metadata checksums of a filesystem
+// with the metadata_csum_seed feature are verified with the stored seed after
+// its UUID was changed.
+func TestFilesystemCsumSeed(t *testing.T) {
+	fs, closeImage := openImage(t, csumSeedImagePath)
+	defer closeImage()
+
+	sb := fs.fs.sb
+	uuid := sb.UUID()
+	if got, derived := sb.ChecksumSeed(), disklayout.Crc32c(^uint32(0), uuid[:]); got == derived {
+		t.Fatalf("ChecksumSeed() = %#x, want the stored seed, not the one derived from the UUID", got)
+	}
+
+	// Reading the files verifies the checksums of the group descriptors,
+	// inodes, extent trees and directory blocks along their paths.
+	for path, want := range map[string]string{
+		"/file.txt":       "hello csum seed\n",
+		"/dir/nested.txt": "nested\n",
+	} {
+		f, err := fs.Open(path)
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", path, err)
+		}
+		if got, err := ioutil.ReadAll(f); err != nil || string(got) != want {
+			t.Errorf("ReadAll(%q) = (%q, %v), want (%q, nil)", path, got, err, want)
+		}
+	}
+	// Walking all inodes also verifies the inode bitmaps.
+	if err := ForEachInode(fs, func(uint32, disklayout.Inode) error { return nil }); err != nil {
+		t.Errorf("ForEachInode failed: %v", err)
+	}
+}
+
+// TestFilesystemFlexBG tests that the inodes of all groups of a flex group are
+// found in the inode tables packed in its first group.
+func TestFilesystemFlexBG(t *testing.T) {
+	fs, closeImage := openImage(t, flexBGImagePath)
+	defer closeImage()
+
+	sb, bgs := fs.fs.sb, fs.fs.bgs
+	if got := sb.FlexGroupSize(); got != 16 || len(bgs) != 16 {
+		t.Fatalf("FlexGroupSize() = %d with %d groups, want 16 with 16 groups", got, len(bgs))
+	}
+	tableBlocks := uint64(sb.InodesPerGroup()) * uint64(sb.InodeSize()) / sb.BlockSize()
+	group0End := uint64(sb.FirstDataBlock()) + uint64(sb.BlocksPerGroup())
+	for g, bg := range bgs {
+		if bg.InodeTable()+tableBlocks > group0End {
+			t.Errorf("group %d: inode table at %d, want it in group 0 (before block %d)", g, bg.InodeTable(), group0End)
+		}
+	}
+
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	groups := make(map[uint32]bool)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, "f") {
+			continue
+		}
+		g := (e.Inode - 1) / sb.InodesPerGroup()
+		groups[g] = true
+		off, err := disklayout.InodeOffset(sb, bgs, e.Inode)
+		if err != nil {
+			t.Fatalf("InodeOffset(%d) failed: %v", e.Inode, err)
+		}
+		if blk := uint64(off) / sb.BlockSize(); blk < bgs[g].InodeTable() || blk >= bgs[g].InodeTable()+tableBlocks {
+			t.Errorf("InodeOffset(%d) = %#x in block %d, want it in the inode table of group %d", e.Inode, off, blk, g)
+		}
+
+		f, err := fs.Open(e.Name)
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", e.Name, err)
+		}
+		if got, err := ioutil.ReadAll(f); err != nil || string(got) != e.Name+"\n" {
+			t.Errorf("ReadAll(%q) = (%q, %v), want (%q, nil)", e.Name, got, err, e.Name+"\n")
+		}
+	}
+	for g := uint32(1); g < 16; g++ {
+		if !groups[g] {
+			t.Errorf("no file has an inode in group %d", g)
+		}
+	}
+}
+
+// TestFilesystemEncrypted tests that the contents of encrypted inodes are not
+// returned as plaintext, while the raw names in encrypted directories can be
+// listed.
+func TestFilesystemEncrypted(t *testing.T) {
+	fs, closeImage := openImage(t, encryptedImagePath)
+	defer closeImage()
+
+	if !fs.fs.sb.IsEncrypted() {
+		t.Errorf("IsEncrypted() = false, want true")
+	}
+	f, err := fs.Open("/plain.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello plain\n" {
+		t.Errorf("ReadAll = (%q, %v), want (%q, nil)", got, err, "hello plain\n")
+	}
+	if _, err := fs.Open("/secret/file.txt"); err != ErrEncrypted {
+		t.Errorf("Open() of encrypted file = %v, want %v", err, ErrEncrypted)
+	}
+	if _, err := ResolvePath(fs, "/secret/link"); err != ErrEncrypted {
+		t.Errorf("ResolvePath() of encrypted symlink = %v, want %v", err, ErrEncrypted)
+	}
+
+	for _, test := range []struct {
+		path string
+		want map[string]bool
+	}{
+		{
+			path: "/",
+			want: map[string]bool{".": false, "..": false, "lost+found": false, "plain.txt": false, "secret": false},
+		},
+		{
+			path: "/secret",
+			want: map[string]bool{".": false, "..": false, "file.txt": true, "link": true},
+		},
+	} {
+		entries, err := fs.ReadDir(test.path)
+		if err != nil {
+			t.Fatalf("ReadDir(%q) failed: %v", test.path, err)
+		}
+		got := make(map[string]bool)
+		for _, e := range entries {
+			got[e.Name] = e.Encrypted
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ReadDir(%q) = %v, want names and Encrypted flags %v", test.path, entries, test.want)
+		}
+	}
+	if _, err := fs.ReadDir("/plain.txt"); err != syserror.ENOTDIR {
+		t.Errorf("ReadDir() of regular file = %v, want %v", err, syserror.ENOTDIR)
+	}
+}
+
+// TestFilesystemOpenMMP tests that images with multiple mount protection can
+// be opened, with or without the 64-bit feature, and that invalid MMP blocks
+// are refused.
+func TestFilesystemOpenMMP(t *testing.T) {
+	for _, image := range []string{mmpImagePath, mmp32ImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, closeImage := openImage(t, image)
+			defer closeImage()
+			f, err := fs.Open("/file.txt")
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello mmp\n" {
+				t.Errorf("ReadAll = (%q, %v), want (%q, nil)", got, err, "hello mmp\n")
+			}
+			if got, want := fs.fs.sb.MMPBlock(), uint64(17); got != want {
+				t.Errorf("MMPBlock() = %d, want %d", got, want)
+			}
+
+			_, _, _, tearDown, err := setUp(t, image)
+			if err != nil {
+				t.Fatalf("setUp failed: %v", err)
+			}
+			tearDown()
+
+			data := readImageData(t, image)
+			mmpOff := int64(fs.fs.sb.MMPBlock() * fs.fs.sb.BlockSize())
+			for _, test := range []struct {
+				name string
+				off  int64
+			}{
+				{name: "bad magic", off: mmpOff},
+				{name: "bad checksum", off: mmpOff + 4},
+			} {
+				corrupted := append([]byte(nil), data...)
+				corrupted[test.off]++
+				if _, err := NewFilesystem(bytes.NewReader(corrupted)); err != syserror.EINVAL {
+					t.Errorf("%s: NewFilesystem() = %v, want %v", test.name, err, syserror.EINVAL)
+				}
+				// The MMP block is still validated without a clock.
+				noClock := filesystem{dev: bytes.NewReader(corrupted), sb: fs.fs.sb}
+				if err := noClock.checkMMP(ktime.ZeroTime); err != syserror.EINVAL {
+					t.Errorf("%s: checkMMP() without a clock = %v, want %v", test.name, err, syserror.EINVAL)
+				}
+			}
+			if err := fs.fs.checkMMP(ktime.ZeroTime); err != nil {
+				t.Errorf("checkMMP() without a clock failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestFilesystemJournalSuperBlock tests that the superblock of the internal
+// journal is read from the journal inode.
+func TestFilesystemJournalSuperBlock(t *testing.T) {
+	fs, closeImage := openImage(t, journalImagePath)
+	defer closeImage()
+
+	j, err := fs.JournalSuperBlock()
+	if err != nil {
+		t.Fatalf("JournalSuperBlock failed: %v", err)
+	}
+	if got := j.Sequence(); got != 1 {
+		t.Errorf("Sequence() = %d, want 1", got)
+	}
+	if got := j.Start(); got != 0 {
+		t.Errorf("Start() = %d, want 0", got)
+	}
+	if got := j.MaxLen(); got != 1024 {
+		t.Errorf("MaxLen() = %d, want 1024", got)
+	}
+	if f := j.IncompatibleFeatures(); !f.Is64Bit || !f.CsumV3 || f.AsyncCommit {
+		t.Errorf("IncompatibleFeatures() = %+v, want 64bit and csum_v3", f)
+	}
+
+	noJournal, closeNoJournal := openImage(t, ext4ImagePath)
+	defer closeNoJournal()
+	if _, err := noJournal.JournalSuperBlock(); err != syserror.ENOENT {
+		t.Errorf("JournalSuperBlock() without a journal = %v, want %v", err, syserror.ENOENT)
+	}
+}
+
+// TestForEachInode tests that ForEachInode reports every allocated inode,
+// including the reserved ones unless they are skipped.
+func TestForEachInode(t *testing.T) {
+	for _, image := range []string{ext2ImagePath, ext3ImagePath, ext4ImagePath, metaBGImagePath, journalImagePath, resizeImagePath, flexBGImagePath} {
+		t.Run(image, func(t *testing.T) {
+			fs, closeImage := openImage(t, image)
+			defer closeImage()
+
+			var count, last uint32
+			seen := make(map[uint32]bool)
+			if err := ForEachInode(fs, func(ino uint32, inode disklayout.Inode) error {
+				if ino <= last {
+					t.Errorf("inode %d reported after inode %d", ino, last)
+				}
+				last = ino
+				count++
+				seen[ino] = true
+				return nil
+			}); err != nil {
+				t.Fatalf("ForEachInode failed: %v", err)
+			}
+
+			sb := fs.fs.sb
+			if want := sb.InodesCount() - sb.FreeInodesCount(); count != want {
+				t.Errorf("ForEachInode reported %d inodes, want %d", count, want)
+			}
+			for ino := uint32(1); ino < sb.FirstInode(); ino++ {
+				if !seen[ino] {
+					t.Errorf("reserved inode %d not reported", ino)
+				}
+			}
+			if jnl := sb.JournalInode(); jnl != 0 && !seen[jnl] {
+				t.Errorf("journal inode %d not reported", jnl)
+			}
+
+			// Only the root directory is reported of the reserved inodes when
+			// skipping them, and the other inodes are still reported.
+			var reserved []uint32
+			if err := ForEachInodeWithOptions(fs, ForEachInodeOptions{SkipReserved: true}, func(ino uint32, inode disklayout.Inode) error {
+				if ino < sb.FirstInode() {
+					reserved = append(reserved, ino)
+				}
+				delete(seen, ino)
+				return nil
+			}); err != nil {
+				t.Fatalf("ForEachInodeWithOptions() skipping reserved inodes failed: %v", err)
+			}
+			if len(reserved) != 1 || reserved[0] != disklayout.RootDirInode {
+				t.Errorf("ForEachInodeWithOptions() skipping reserved inodes reported reserved inodes %v, want only %d", reserved, disklayout.RootDirInode)
+			}
+			if got, want := uint32(len(seen)), sb.FirstInode()-2; got != want {
+				t.Errorf("ForEachInodeWithOptions() skipping reserved inodes skipped %d inodes, want %d", got, want)
+			}
+			if _, ok := seen[sb.FirstInode()]; ok {
+				t.Errorf("first non-reserved inode %d skipped", sb.FirstInode())
+			}
+		})
+	}
+
+	// Errors returned by the callback stop the walk.
+	fs, closeImage := openImage(t, ext4ImagePath)
+	defer closeImage()
+	calls := 0
+	if err := ForEachInode(fs, func(uint32, disklayout.Inode) error {
+		calls++
+		return syserror.EINTR
+	}); err != syserror.EINTR || calls != 1 {
+		t.Errorf("ForEachInode() with a failing callback = %v after %d calls, want %v after 1 call", err, calls, syserror.EINTR)
+	}
+}
+
+// BenchmarkFileHint copies a 100MiB file in 4KiB reads with and without
+// WillReadSequentially and reports the resulting number of device reads per
+// copy.
+func BenchmarkFileHint(b *testing.B) {
+	const (
+		blkSize  = 4096
+		fileSize = 100 << 20
+	)
+	dev := &countingReader{r: bytes.NewReader(make([]byte, blkSize+fileSize))}
+	regFile := &newContiguousExtentFile(b, dev, blkSize, fileSize).regFile
+
+	buf := make([]byte, 4096)
+	for _, hint := range []struct {
+		name string
+		hint ReadHint
+	}{
+		{name: "WillReadRandomly", hint: WillReadRandomly},
+		{name: "WillReadSequentially", hint: WillReadSequentially},
+	} {
+		b.Run(hint.name, func(b *testing.B) {
+			b.SetBytes(fileSize)
+			atomic.StoreInt64(&dev.reads, 0)
+			for i := 0; i < b.N; i++ {
+				f := newFile(regFile)
+				f.Hint(hint.hint)
+				// Hide ioutil.Discard's io.ReaderFrom so that buf is used.
+				if _, err := io.CopyBuffer(struct{ io.Writer }{ioutil.Discard}, f, buf); err != nil {
+					b.Fatalf("copy failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&dev.reads))/float64(b.N), "devreads/op")
+		})
+	}
+}
+
+// BenchmarkPreloadInodes reads the inodes of the 1000 children of a directory
+// one by one, through a fresh inode table block cache, and with PreloadInodes,
+// and reports the resulting number of device reads per directory.
+func BenchmarkPreloadInodes(b *testing.B) {
+	fs, dev := openCountingImage(b, noFileTypeImagePath)
+	inos := dirInodes(b, fs, "/dir")
+
+	for _, bm := range []struct {
+		name string
+		read func() error
+	}{
+		{
+			name: "OneByOne",
+			read: func() error {
+				fs.fs.blocks = NewBlockDevice(fs.fs.dev, fs.fs.sb.BlockSize(), fs.fs.cacheBlocks)
+				for _, ino := range inos {
+					if _, _, err := readDiskInode(&fs.fs, ino); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "Preload",
+			read: func() error {
+				_, err := PreloadInodes(fs, inos)
+				return err
+			},
+		},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			atomic.StoreInt64(&dev.reads, 0)
+			for i := 0; i < b.N; i++ {
+				if err := bm.read(); err != nil {
+					b.Fatalf("reading inodes failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&dev.reads))/float64(b.N), "devreads/op")
+		})
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
@@ -54,6 +56,10 @@ type inode struct {
 	// diskInode gives us access to the inode struct on disk. Immutable.
 	diskInode disklayout.Inode
 
+	// inlineData holds the file data if the InInline flag is set. It is stored
+	// in the inode record itself. Immutable.
+	inlineData []byte
+
 	// This is immutable. The first field of the implementations must have inode
 	// as the first field to ensure temporality.
 	impl interface{}
@@ -92,35 +98,35 @@ func (in *inode) decRef() {
 // newInode is the inode constructor. Reads the inode off disk. Identifies
 // inodes based on the absolute inode number on disk.
 func newInode(fs *filesystem, inodeNum uint32) (*inode, error) {
-	if inodeNum == 0 {
-		panic("inode number 0 on ext filesystems is not possible")
-	}
-
-	inodeRecordSize := fs.sb.InodeSize()
-	var diskInode disklayout.Inode
-	if inodeRecordSize == disklayout.OldInodeSize {
-		diskInode = &disklayout.InodeOld{}
-	} else {
-		diskInode = &disklayout.InodeNew{}
-	}
-
-	// Calculate where the inode is actually placed.
-	inodesPerGrp := fs.sb.InodesPerGroup()
-	blkSize := fs.sb.BlockSize()
-	inodeTableOff := fs.bgs[getBGNum(inodeNum, inodesPerGrp)].InodeTable() * blkSize
-	inodeOff := inodeTableOff + uint64(uint32(inodeRecordSize)*getBGOff(inodeNum, inodesPerGrp))
-
-	if err := readFromDisk(fs.dev, int64(inodeOff), diskInode); err != nil {
+	diskInode, raw, err := readDiskInode(fs, inodeNum)
+	if err != nil {
 		return nil, err
 	}
+	return newInodeFromDisk(fs, inodeNum, diskInode, raw)
+}
 
+// newInodeFromDisk builds the inode inodeNum from its on-disk inode and record
+// raw, as read by readDiskInode.
+func newInodeFromDisk(fs *filesystem, inodeNum uint32, diskInode disklayout.Inode, raw []byte) (*inode, error) {
 	// Build the inode based on its type.
+	var err error
 	inode := inode{
 		fs:        fs,
 		inodeNum:  inodeNum,
-		blkSize:   blkSize,
+		blkSize:   fs.sb.BlockSize(),
 		diskInode: diskInode,
 	}
+	if diskInode.Flags().Inline {
+		if inode.inlineData, err = disklayout.InlineData(raw, diskInode); err != nil {
+			log.Warningf("ext fs: inode %d: %v", inodeNum, err)
+			return nil, syserror.EIO
+		}
+		if uint64(len(inode.inlineData)) < diskInode.Size() {
+			log.Warningf("ext fs: inode %d: %d bytes of inline data for a %d byte file", inodeNum, len(inode.inlineData), diskInode.Size())
+			return nil, syserror.EIO
+		}
+		inode.inlineData = inode.inlineData[:diskInode.Size()]
+	}
 
 	switch diskInode.Mode().FileType() {
 	case linux.ModeSymlink:
@@ -147,6 +153,63 @@ func newInode(fs *filesystem, inodeNum uint32) (*inode, error) {
 	}
 }
 
+// readDiskInode reads inode inodeNum off disk. It returns the inode along with
+// its whole on-disk record, which may hold extended attributes past the inode
+// struct. Returns EIO if the inode does not match its checksum.
+func readDiskInode(fs *filesystem, inodeNum uint32) (disklayout.Inode, []byte, error) {
+	if inodeNum == 0 {
+		panic("inode number 0 on ext filesystems is not possible")
+	}
+
+	// Calculate where the inode is actually placed.
+	blkSize := fs.sb.BlockSize()
+	inodeOff, err := disklayout.InodeOffset(fs.sb, fs.bgs, inodeNum)
+	if err != nil {
+		log.Warningf("ext fs: %v", err)
+		return nil, nil, syserror.EIO
+	}
+
+	// Read the whole inode record as it may hold extended attributes past the
+	// inode struct. Inode records never straddle blocks, and inode table
+	// blocks are cached as neighbouring inodes are often read together.
+	block, err := fs.blocks.ReadBlock(uint64(inodeOff) / blkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeDiskInode(fs, inodeNum, block[uint64(inodeOff)%blkSize:])
+}
+
+// decodeDiskInode decodes inode inodeNum from record, which starts with its
+// on-disk inode record, and verifies its checksum like readDiskInode does. The
+// returned record is a copy.
+func decodeDiskInode(fs *filesystem, inodeNum uint32, record []byte) (disklayout.Inode, []byte, error) {
+	inodeRecordSize := fs.sb.InodeSize()
+	var diskInode disklayout.Inode
+	if inodeRecordSize == disklayout.OldInodeSize {
+		diskInode = &disklayout.InodeOld{}
+	} else {
+		diskInode = &disklayout.InodeNew{}
+	}
+
+	raw := make([]byte, inodeRecordSize)
+	if structSize := binary.Size(diskInode); uint64(len(raw)) < uint64(structSize) {
+		raw = make([]byte, structSize)
+	}
+	copy(raw, record)
+	binary.Unmarshal(raw[:binary.Size(diskInode)], binary.LittleEndian, diskInode)
+	raw = raw[:inodeRecordSize]
+	switch ok, err := diskInode.VerifyChecksum(fs.sb, inodeNum, raw); {
+	case err == disklayout.ErrNoMetadataCsum:
+	case err != nil:
+		log.Warningf("ext fs: inode %d: %v", inodeNum, err)
+		return nil, nil, syserror.EIO
+	case !ok:
+		log.Warningf("ext fs: inode %d checksum mismatch", inodeNum)
+		return nil, nil, syserror.EIO
+	}
+	return diskInode, raw, nil
+}
+
 // open creates and returns a file description for the dentry passed in.
 func (in *inode) open(rp *vfs.ResolvingPath, vfsd *vfs.Dentry, opts *vfs.OpenOptions) (*vfs.FileDescription, error) {
 	ats := vfs.AccessTypesForOpenFlags(opts)
@@ -156,6 +219,10 @@ func (in *inode) open(rp *vfs.ResolvingPath, vfsd *vfs.Dentry, opts *vfs.OpenOpt
 	mnt := rp.Mount()
 	switch in.impl.(type) {
 	case *regularFile:
+		// Like Linux, encrypted files cannot be opened without their key.
+		if in.diskInode.IsEncrypted() {
+			return nil, ErrEncrypted
+		}
 		var fd regularFileFD
 		if err := fd.vfsfd.Init(&fd, opts.Flags, mnt, vfsd, &vfs.FileDescriptionOptions{}); err != nil {
 			return nil, err
@@ -186,35 +253,26 @@ func (in *inode) open(rp *vfs.ResolvingPath, vfsd *vfs.Dentry, opts *vfs.OpenOpt
 }
 
 func (in *inode) checkPermissions(creds *auth.Credentials, ats vfs.AccessTypes) error {
-	return vfs.GenericCheckPermissions(creds, ats, in.isDir(), uint16(in.diskInode.Mode()), in.diskInode.UID(), in.diskInode.GID())
+	uid, gid := disklayout.InodeOwner(in.fs.sb, in.diskInode)
+	return vfs.GenericCheckPermissions(creds, ats, in.isDir(), uint16(in.diskInode.Mode()), uid, gid)
 }
 
 // statTo writes the statx fields to the output parameter.
 func (in *inode) statTo(stat *linux.Statx) {
 	stat.Mask = linux.STATX_TYPE | linux.STATX_MODE | linux.STATX_NLINK |
 		linux.STATX_UID | linux.STATX_GID | linux.STATX_INO | linux.STATX_SIZE |
-		linux.STATX_ATIME | linux.STATX_CTIME | linux.STATX_MTIME
+		linux.STATX_ATIME | linux.STATX_CTIME | linux.STATX_MTIME |
+		linux.STATX_BLOCKS
 	stat.Blksize = uint32(in.blkSize)
 	stat.Mode = uint16(in.diskInode.Mode())
 	stat.Nlink = uint32(in.diskInode.LinksCount())
-	stat.UID = uint32(in.diskInode.UID())
-	stat.GID = uint32(in.diskInode.GID())
+	uid, gid := disklayout.InodeOwner(in.fs.sb, in.diskInode)
+	stat.UID = uint32(uid)
+	stat.GID = uint32(gid)
 	stat.Ino = uint64(in.inodeNum)
-	stat.Size = in.diskInode.Size()
+	stat.Size = disklayout.InodeFileSize(in.fs.sb, in.diskInode)
 	stat.Atime = in.diskInode.AccessTime().StatxTimestamp()
 	stat.Ctime = in.diskInode.ChangeTime().StatxTimestamp()
 	stat.Mtime = in.diskInode.ModificationTime().StatxTimestamp()
-	// TODO(b/134676337): Set stat.Blocks which is the number of 512 byte blocks
-	// (including metadata blocks) required to represent this file.
-}
-
-// getBGNum returns the block group number that a given inode belongs to.
-func getBGNum(inodeNum uint32, inodesPerGrp uint32) uint32 {
-	return (inodeNum - 1) / inodesPerGrp
-}
-
-// getBGOff returns the offset at which the given inode lives in the block
-// group's inode table, i.e. the index of the inode in the inode table.
-func getBGOff(inodeNum uint32, inodesPerGrp uint32) uint32 {
-	return (inodeNum - 1) % inodesPerGrp
+	stat.Blocks = disklayout.InodeBlocks(in.fs.sb, in.diskInode)
 }
@@ -0,0 +1,369 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"io"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// journal reads the internal journal of a filesystem, which is stored in the
+// inode sb.JournalInode().
+type journal struct {
+	// sb is the journal superblock.
+	sb *disklayout.JournalSuperBlock
+
+	// file reads the journal inode.
+	file io.ReaderAt
+
+	// blkSize is the journal block size, which is the filesystem block size.
+	blkSize uint64
+}
+
+// openJournal opens the internal journal of fs and reads its superblock. If
+// the journal inode cannot be read, it is rebuilt from its backup in the
+// superblock if there is one. Returns ENOENT if fs has no internal journal and
+// EINVAL if the journal inode or superblock is invalid.
+func (fs *filesystem) openJournal() (*journal, error) {
+	if !fs.sb.CompatibleFeatures().HasJournal || fs.sb.JournalInode() == 0 {
+		return nil, syserror.ENOENT
+	}
+
+	in, err := newInode(fs, fs.sb.JournalInode())
+	if err != nil {
+		backup, ok := fs.sb.JournalBackupBlocks()
+		if !ok {
+			return nil, err
+		}
+		log.Warningf("ext fs: cannot read journal inode %d, using its backup in the superblock", fs.sb.JournalInode())
+		if in, err = fs.journalInodeFromBackup(backup); err != nil {
+			return nil, err
+		}
+	}
+	regFile, ok := in.impl.(*regularFile)
+	if !ok {
+		log.Warningf("ext fs: journal inode %d is not a regular file", fs.sb.JournalInode())
+		return nil, syserror.EINVAL
+	}
+	j := &journal{file: regFile.impl, blkSize: fs.sb.BlockSize()}
+
+	raw, err := j.readBlock(0)
+	if err != nil {
+		log.Warningf("ext fs: journal inode %d is smaller than a block", fs.sb.JournalInode())
+		return nil, syserror.EINVAL
+	}
+	j.sb, err = disklayout.ParseJournalSuperBlock(raw)
+	if err != nil {
+		log.Warningf("ext fs: %v", err)
+		return nil, syserror.EINVAL
+	}
+	if ok, err := disklayout.VerifyJournalBlockChecksum(j.sb, raw); err != nil && err != disklayout.ErrNoJournalCsum {
+		log.Warningf("ext fs: cannot verify journal superblock checksum: %v", err)
+		return nil, syserror.EINVAL
+	} else if err == nil && !ok {
+		log.Warningf("ext fs: journal superblock checksum mismatch")
+		return nil, syserror.EINVAL
+	}
+	if uint64(j.sb.BlockSize()) != j.blkSize {
+		log.Warningf("ext fs: journal block size %d does not match filesystem block size %d", j.sb.BlockSize(), j.blkSize)
+		return nil, syserror.EINVAL
+	}
+	if uint64(j.sb.MaxLen())*j.blkSize > in.diskInode.Size() {
+		log.Warningf("ext fs: journal of %d blocks does not fit in journal inode of %d bytes", j.sb.MaxLen(), in.diskInode.Size())
+		return nil, syserror.EINVAL
+	}
+	return j, nil
+}
+
+// journalInodeFromBackup rebuilds the journal inode from backup, as returned
+// by disklayout.SuperBlock.JournalBackupBlocks. Like e2fsck, the inode is a
+// regular file using extents if its i_block array starts with an extent
+// header, and block maps otherwise. Since the generation of the journal inode
+// is not backed up, it is assumed to be 0, which is what mke2fs creates.
+func (fs *filesystem) journalInodeFromBackup(backup [17]uint32) (*inode, error) {
+	old := disklayout.InodeOld{
+		ModeRaw:       uint16(linux.ModeRegular | 0600),
+		LinksCountRaw: 1,
+		SizeHi:        backup[15],
+		SizeLo:        backup[16],
+	}
+	for i, word := range backup[:len(old.DataRaw)/4] {
+		binary.LittleEndian.PutUint32(old.DataRaw[i*4:], word)
+	}
+	if _, err := disklayout.ParseExtentNode(old.DataRaw[:]); err == nil {
+		old.FlagsRaw = disklayout.InExtents
+	}
+
+	var diskInode disklayout.Inode = &old
+	if fs.sb.InodeSize() != disklayout.OldInodeSize {
+		diskInode = &disklayout.InodeNew{InodeOld: old}
+	}
+	return newInodeFromDisk(fs, fs.sb.JournalInode(), diskInode, nil)
+}
+
+// readJournalSuperBlock reads the superblock in the first block of the
+// internal journal of fs. See openJournal.
+func (fs *filesystem) readJournalSuperBlock() (*disklayout.JournalSuperBlock, error) {
+	j, err := fs.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	return j.sb, nil
+}
+
+// readBlock returns the contents of journal block blk in a new buffer. Returns
+// EIO if the block cannot be read in full.
+func (j *journal) readBlock(blk uint32) ([]byte, error) {
+	data := make([]byte, j.blkSize)
+	if n, _ := j.file.ReadAt(data, int64(blk)*int64(j.blkSize)); n < len(data) {
+		return nil, syserror.EIO
+	}
+	return data, nil
+}
+
+// next returns the log block following blk. The log wraps around from the end
+// of the journal to its first log block.
+func (j *journal) next(blk uint32) uint32 {
+	blk++
+	if blk >= j.sb.MaxLen() {
+		blk = j.sb.First()
+	}
+	return blk
+}
+
+// tidGT returns true if transaction sequence number a is after b, taking
+// wrap-around into account (tid_gt in Linux).
+func tidGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// journalWrite is a filesystem block logged by a transaction.
+type journalWrite struct {
+	// seq is the sequence number of the transaction.
+	seq uint32
+
+	// target is the filesystem block number.
+	target uint64
+
+	// data is the new contents of target.
+	data []byte
+}
+
+// replay scans the log from its start and returns the new contents of the
+// filesystem blocks logged by committed transactions, keyed by block number.
+// Like Linux's jbd2_journal_recover, the scan stops at the first block which
+// does not continue the log, so the blocks of the last transaction are
+// dropped unless it was committed. If the journal has checksums, the scan
+// also stops at the first transaction with a descriptor, revoke or commit
+// block or a logged block that does not match its checksum, which was torn
+// while it was written. Blocks revoked by a committed transaction are not
+// replayed from that transaction or earlier ones. Returns EINVAL if a
+// committed transaction logs a block past fsBlocks.
+func (j *journal) replay(fsBlocks uint64) (map[uint64][]byte, error) {
+	blocks := make(map[uint64][]byte)
+	if j.sb.Start() == 0 {
+		return blocks, nil
+	}
+	if j.sb.Start() < j.sb.First() || j.sb.Start() >= j.sb.MaxLen() {
+		log.Warningf("ext fs: journal log starts at block %d outside of [%d, %d)", j.sb.Start(), j.sb.First(), j.sb.MaxLen())
+		return nil, syserror.EINVAL
+	}
+
+	var (
+		// committed maps logged blocks to their last committed write.
+		committed      = make(map[uint64]journalWrite)
+		pending        []journalWrite
+		pendingRevokes []uint64
+		// revoked maps revoked blocks to the last transaction revoking them.
+		revoked = make(map[uint64]uint32)
+	)
+	blk, seq := j.sb.Start(), j.sb.Sequence()
+	// Each log block is visited at most once so that malicious journals cannot
+	// make the scan loop.
+	logLen := j.sb.MaxLen() - j.sb.First()
+scan:
+	for visited := uint32(0); visited < logLen; visited++ {
+		raw, err := j.readBlock(blk)
+		if err != nil {
+			return nil, err
+		}
+		hdr := disklayout.ParseJournalHeader(raw)
+		if hdr.Magic != disklayout.JournalMagic || hdr.Sequence != seq {
+			break
+		}
+		if ok, err := disklayout.VerifyJournalBlockChecksum(j.sb, raw); err == nil && !ok {
+			log.Warningf("ext fs: journal block %d of transaction %d does not match its checksum", blk, seq)
+			break
+		}
+		blk = j.next(blk)
+
+		switch hdr.BlockType {
+		case disklayout.JournalDescriptorBlockType:
+			tags, err := disklayout.ParseJournalDescriptor(j.sb, raw)
+			if err != nil {
+				log.Warningf("ext fs: %v", err)
+				break scan
+			}
+			for _, tag := range tags {
+				if visited++; visited >= logLen {
+					break scan
+				}
+				data, err := j.readBlock(blk)
+				if err != nil {
+					return nil, err
+				}
+				if ok, err := disklayout.VerifyJournalTagChecksum(j.sb, tag, seq, data); err == nil && !ok {
+					log.Warningf("ext fs: journal block %d logging block %d in transaction %d does not match its checksum", blk, tag.BlockNum, seq)
+					break scan
+				}
+				if tag.Flags&disklayout.JournalFlagEscape != 0 {
+					binary.BigEndian.PutUint32(data, disklayout.JournalMagic)
+				}
+				pending = append(pending, journalWrite{seq: seq, target: tag.BlockNum, data: data})
+				blk = j.next(blk)
+			}
+		case disklayout.JournalRevokeBlockType:
+			revokes, err := disklayout.ParseJournalRevoke(j.sb, raw)
+			if err != nil {
+				log.Warningf("ext fs: %v", err)
+				break scan
+			}
+			pendingRevokes = append(pendingRevokes, revokes...)
+		case disklayout.JournalCommitBlockType:
+			for _, w := range pending {
+				committed[w.target] = w
+			}
+			for _, target := range pendingRevokes {
+				if last, ok := revoked[target]; !ok || tidGT(seq, last) {
+					revoked[target] = seq
+				}
+			}
+			pending, pendingRevokes = nil, nil
+			seq++
+		default:
+			break scan
+		}
+	}
+
+	for _, w := range committed {
+		if last, ok := revoked[w.target]; ok && !tidGT(w.seq, last) {
+			continue
+		}
+		if w.target >= fsBlocks {
+			log.Warningf("ext fs: journal transaction %d logs block %d past the end of the filesystem", w.seq, w.target)
+			return nil, syserror.EINVAL
+		}
+		blocks[w.target] = w.data
+	}
+	return blocks, nil
+}
+
+// replayedDevice is an io.ReaderAt reading a device whose journal was replayed
+// in memory: the replayed blocks are read from memory and all others from the
+// device.
+type replayedDevice struct {
+	// dev is the underlying device. Immutable.
+	dev BlockDevice
+
+	// blocks maps block numbers to their replayed contents. Immutable.
+	blocks map[uint64][]byte
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (d *replayedDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syserror.EINVAL
+	}
+	blkSize := d.dev.BlockSize()
+	read := 0
+	for read < len(p) {
+		cur := uint64(off) + uint64(read)
+		data, ok := d.blocks[cur/blkSize]
+		if !ok {
+			var err error
+			if data, err = d.dev.ReadBlock(cur / blkSize); err != nil {
+				return read, err
+			}
+		}
+		read += copy(p[read:], data[cur%blkSize:])
+	}
+	return read, nil
+}
+
+// sbIncompatOff is the offset of sb.s_feature_incompat in the superblock.
+const sbIncompatOff = 0x60
+
+// replayJournal replays the internal journal of fs in memory if fs needs
+// recovery: the blocks of dev, which holds the filesystem, are replaced by
+// their contents in the committed transactions of the log, and fs reads its
+// blocks from the result. Like Linux after recovery, the superblock no longer
+// has the Recovery feature. The group descriptors of fs are used to find the
+// journal and must be reloaded afterwards.
+func (fs *filesystem) replayJournal(dev BlockDevice) error {
+	if !fs.sb.IncompatibleFeatures().Recovery {
+		return nil
+	}
+	j, err := fs.openJournal()
+	if err != nil {
+		if err == syserror.ENOENT {
+			log.Warningf("ext fs: filesystem needs recovery but has no internal journal")
+			return syserror.EINVAL
+		}
+		return err
+	}
+	if f := j.sb.IncompatibleFeatures(); f.Unknown != 0 || f.FastCommit {
+		log.Warningf("ext fs: cannot replay journal with incompatible features %#x", f.ToInt())
+		return syserror.EINVAL
+	}
+
+	blocks, err := j.replay(fs.sb.BlocksCount())
+	if err != nil {
+		return err
+	}
+	replayed := &replayedDevice{dev: dev, blocks: blocks}
+
+	// Clear the Recovery feature in the superblock, which was possibly
+	// replayed too.
+	sbBlk := uint64(disklayout.SbOffset) / dev.BlockSize()
+	sbOff := uint64(disklayout.SbOffset) % dev.BlockSize()
+	data := make([]byte, dev.BlockSize())
+	if _, err := replayed.ReadAt(data, int64(sbBlk*dev.BlockSize())); err != nil {
+		return err
+	}
+	raw := data[sbOff : sbOff+disklayout.SbSize]
+	binary.LittleEndian.PutUint32(raw[sbIncompatOff:], binary.LittleEndian.Uint32(raw[sbIncompatOff:])&^disklayout.SbRecovery)
+	if err := disklayout.UpdateChecksum(raw); err != nil && err != disklayout.ErrNoMetadataCsum {
+		log.Warningf("ext fs: %v", err)
+		return syserror.EINVAL
+	}
+	blocks[sbBlk] = data
+
+	fs.dev = replayed
+	fs.sb, err = readSuperBlock(fs.dev)
+	if err != nil {
+		return err
+	}
+	fs.sb = cacheChecksumSeed(fs.sb)
+	if err := disklayout.ValidateSuperBlock(fs.sb); err != nil {
+		log.Warningf("ext fs: replayed superblock: %v", err)
+		return syserror.EINVAL
+	}
+	return nil
+}
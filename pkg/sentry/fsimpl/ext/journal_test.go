@@ -0,0 +1,389 @@
+// Copyright 2019 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
+)
+
+const (
+	// journalFileBlock is the block holding the data of /file.txt in
+	// assets/journal.ext4.
+	journalFileBlock = 1046
+
+	// journalFreeBlock is the first free block of assets/journal.ext4.
+	journalFreeBlock = 1047
+
+	// journalBlockSize is the block size of assets/journal.ext4.
+	journalBlockSize = 1024
+
+	// sbJnlBackupTypeOff is the offset of sb.s_jnl_backup_type in the
+	// superblock.
+	sbJnlBackupTypeOff = 0xfd
+)
+
+// journalCsumSeed is the seed of the checksums of the journal of
+// assets/journal.ext4.
+var journalCsumSeed = disklayout.Crc32c(^uint32(0), testUUID[:])
+
+// journalBlock returns a journal block of the given type and sequence number
+// followed by contents, with the checksum of the journal of
+// assets/journal.ext4, which has the 64bit and csum_v3 features.
+func journalBlock(blockType, seq uint32, contents []byte) []byte {
+	block := make([]byte, journalBlockSize)
+	binary.BigEndian.PutUint32(block[0:], disklayout.JournalMagic)
+	binary.BigEndian.PutUint32(block[4:], blockType)
+	binary.BigEndian.PutUint32(block[8:], seq)
+	copy(block[disklayout.JournalHeaderSize:], contents)
+
+	csumOff := journalBlockSize - disklayout.JournalBlockTailSize
+	if blockType == disklayout.JournalCommitBlockType {
+		csumOff = 0x10
+	}
+	binary.BigEndian.PutUint32(block[csumOff:], disklayout.Crc32c(journalCsumSeed, block))
+	return block
+}
+
+// loggedBlock is a filesystem block logged by a transaction built by
+// journalTransaction.
+type loggedBlock struct {
+	// target is the filesystem block number.
+	target uint64
+
+	// data is the start of the logged block. If escaped is set, its first 4
+	// bytes are replaced by JournalMagic during replay.
+	data    string
+	escaped bool
+}
+
+// journalTransaction returns the blocks of transaction seq in the log of
+// assets/journal.ext4: a revoke block if revoked is not empty, a descriptor
+// block followed by the logged blocks and, if commit is set, a commit block.
+func journalTransaction(seq uint32, revoked []uint64, logged []loggedBlock, commit bool) [][]byte {
+	var blocks [][]byte
+	if len(revoked) > 0 {
+		records := make([]byte, 4+8*len(revoked))
+		binary.BigEndian.PutUint32(records, uint32(disklayout.JournalHeaderSize+len(records)))
+		for i, blk := range revoked {
+			binary.BigEndian.PutUint64(records[4+8*i:], blk)
+		}
+		blocks = append(blocks, journalBlock(disklayout.JournalRevokeBlockType, seq, records))
+	}
+
+	var tags []byte
+	var data [][]byte
+	for i, l := range logged {
+		block := make([]byte, journalBlockSize)
+		copy(block, l.data)
+		data = append(data, block)
+
+		var flags uint32
+		if i > 0 {
+			flags |= disklayout.JournalFlagSameUUID
+		}
+		if i == len(logged)-1 {
+			flags |= disklayout.JournalFlagLastTag
+		}
+		if l.escaped {
+			flags |= disklayout.JournalFlagEscape
+		}
+		var tag [16]byte
+		binary.BigEndian.PutUint32(tag[0:], uint32(l.target))
+		binary.BigEndian.PutUint32(tag[4:], flags)
+		binary.BigEndian.PutUint32(tag[8:], uint32(l.target>>32))
+		var seqBuf [4]byte
+		binary.BigEndian.PutUint32(seqBuf[:], seq)
+		binary.BigEndian.PutUint32(tag[12:], disklayout.Crc32c(disklayout.Crc32c(journalCsumSeed, seqBuf[:]), block))
+		tags = append(tags, tag[:]...)
+		if i == 0 {
+			tags = append(tags, testUUID[:]...)
+		}
+	}
+	blocks = append(blocks, journalBlock(disklayout.JournalDescriptorBlockType, seq, tags))
+	blocks = append(blocks, data...)
+
+	if commit {
+		blocks = append(blocks, journalBlock(disklayout.JournalCommitBlockType, seq, nil))
+	}
+	return blocks
+}
+
+// recoveryImage returns the contents of assets/journal.ext4 with log, which
+// starts with transaction 1, written to the blocks of its journal following
+// the journal superblock. The filesystem needs recovery.
+func recoveryImage(t *testing.T, log [][]byte) []byte {
+	t.Helper()
+	image := readImageData(t, journalImagePath)
+
+	fs, err := NewFilesystem(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	in, err := newInode(&fs.fs, fs.fs.sb.JournalInode())
+	if err != nil {
+		t.Fatalf("newInode(%d) failed: %v", fs.fs.sb.JournalInode(), err)
+	}
+	journalFile := in.impl.(*regularFile).impl.(*extentFile)
+	writeJournalBlock := func(blk uint64, data []byte) {
+		t.Helper()
+		phyBlk, mapped, err := journalFile.mapBlock(blk)
+		if err != nil || !mapped {
+			t.Fatalf("mapBlock(%d) = (%d, %t, %v), want mapped block", blk, phyBlk, mapped, err)
+		}
+		copy(image[phyBlk*journalBlockSize:], data)
+	}
+
+	jsb := make([]byte, journalBlockSize)
+	if _, err := journalFile.ReadAt(jsb, 0); err != nil {
+		t.Fatalf("failed to read journal superblock: %v", err)
+	}
+	// Start the log with transaction 1 in block 1.
+	binary.BigEndian.PutUint32(jsb[0x18:], 1)
+	binary.BigEndian.PutUint32(jsb[0x1c:], 1)
+	binary.BigEndian.PutUint32(jsb[0xfc:], 0)
+	binary.BigEndian.PutUint32(jsb[0xfc:], disklayout.Crc32c(^uint32(0), jsb))
+	writeJournalBlock(0, jsb)
+	for i, data := range log {
+		writeJournalBlock(uint64(i+1), data)
+	}
+
+	raw := image[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]
+	binary.LittleEndian.PutUint32(raw[sbIncompatOff:], binary.LittleEndian.Uint32(raw[sbIncompatOff:])|disklayout.SbRecovery)
+	if err := disklayout.UpdateChecksum(raw); err != nil {
+		t.Fatalf("UpdateChecksum failed: %v", err)
+	}
+	return image
+}
+
+// replayTestLog returns the log used by the replay tests. Transaction 1 is
+// committed: it revokes revokedBlk, overwrites /file.txt, logs escapedBlk
+// which starts with JournalMagic and revokedBlk. Transaction 2 overwrites
+// /file.txt again but is not committed.
+func replayTestLog() [][]byte {
+	log := journalTransaction(1, []uint64{revokedBlk}, []loggedBlock{
+		{target: journalFileBlock, data: "hello replay!\n"},
+		{target: escapedBlk, data: "\x00\x00\x00\x00escaped", escaped: true},
+		{target: revokedBlk, data: "revoked"},
+	}, true /* commit */)
+	return append(log, journalTransaction(2, nil, []loggedBlock{
+		{target: journalFileBlock, data: "hello lost!!!\n"},
+	}, false /* commit */)...)
+}
+
+const (
+	// escapedBlk and revokedBlk are logged by replayTestLog.
+	escapedBlk = journalFreeBlock
+	revokedBlk = journalFreeBlock + 1
+)
+
+// readReplayedFile returns the contents of /file.txt in the image after its
+// journal was replayed.
+func readReplayedFile(t *testing.T, image []byte) (*Filesystem, string) {
+	t.Helper()
+	fs, err := NewFilesystem(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	if fs.fs.sb.IncompatibleFeatures().Recovery {
+		t.Errorf("filesystem still needs recovery after replay")
+	}
+	f, err := fs.Open("/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return fs, string(got)
+}
+
+// TestReplayJournal tests that the committed transaction of a journal is
+// replayed when the filesystem is opened, while the uncommitted transaction
+// following it is dropped.
+func TestReplayJournal(t *testing.T) {
+	image := recoveryImage(t, replayTestLog())
+	fs, got := readReplayedFile(t, image)
+	if want := "hello replay!\n"; got != want {
+		t.Errorf("/file.txt = %q, want %q", got, want)
+	}
+
+	data := make([]byte, journalBlockSize)
+	if _, err := fs.fs.dev.ReadAt(data, escapedBlk*journalBlockSize); err != nil {
+		t.Fatalf("ReadAt(escaped block) failed: %v", err)
+	}
+	want := make([]byte, journalBlockSize)
+	binary.BigEndian.PutUint32(want, disklayout.JournalMagic)
+	copy(want[4:], "escaped")
+	if !bytes.Equal(data, want) {
+		t.Errorf("escaped block starts with %q, want %q", data[:16], want[:16])
+	}
+	if _, err := fs.fs.dev.ReadAt(data, revokedBlk*journalBlockSize); err != nil {
+		t.Fatalf("ReadAt(revoked block) failed: %v", err)
+	}
+	if want := image[revokedBlk*journalBlockSize : (revokedBlk+1)*journalBlockSize]; !bytes.Equal(data, want) {
+		t.Errorf("revoked block was replayed: starts with %q", data[:16])
+	}
+
+	// The journal was already replayed.
+	if err := ReplayJournal(fs, NewBlockDevice(bytes.NewReader(image), journalBlockSize, 0)); err != nil {
+		t.Errorf("ReplayJournal failed: %v", err)
+	}
+}
+
+// TestReplayJournalRelogged tests that the last committed contents of a block
+// logged by several transactions are replayed, unless they are revoked.
+func TestReplayJournalRelogged(t *testing.T) {
+	log := journalTransaction(1, nil, []loggedBlock{
+		{target: journalFileBlock, data: "hello first!!\n"},
+		{target: revokedBlk, data: "revoked first"},
+	}, true /* commit */)
+	log = append(log, journalTransaction(2, nil, []loggedBlock{
+		{target: journalFileBlock, data: "hello second!\n"},
+		{target: revokedBlk, data: "revoked second"},
+	}, true /* commit */)...)
+	log = append(log, journalTransaction(3, []uint64{revokedBlk}, []loggedBlock{
+		{target: escapedBlk, data: "unrelated"},
+	}, true /* commit */)...)
+	image := recoveryImage(t, log)
+	fs, got := readReplayedFile(t, image)
+	if want := "hello second!\n"; got != want {
+		t.Errorf("/file.txt = %q, want %q", got, want)
+	}
+
+	data := make([]byte, journalBlockSize)
+	if _, err := fs.fs.dev.ReadAt(data, revokedBlk*journalBlockSize); err != nil {
+		t.Fatalf("ReadAt(revoked block) failed: %v", err)
+	}
+	if want := image[revokedBlk*journalBlockSize : (revokedBlk+1)*journalBlockSize]; !bytes.Equal(data, want) {
+		t.Errorf("revoked block was replayed: starts with %q", data[:16])
+	}
+}
+
+// TestReplayJournalChecksums tests that replay stops at a transaction with a
+// block that does not match its checksum.
+func TestReplayJournalChecksums(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// corruptBlk is the index of the corrupted block in replayTestLog.
+		corruptBlk int
+	}{
+		{name: "revoke block", corruptBlk: 0},
+		{name: "descriptor block", corruptBlk: 1},
+		{name: "data block", corruptBlk: 2},
+		{name: "commit block", corruptBlk: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			log := replayTestLog()
+			log[test.corruptBlk][journalBlockSize/2]++
+			if _, got := readReplayedFile(t, recoveryImage(t, log)); got != "hello journal\n" {
+				t.Errorf("/file.txt = %q, want %q", got, "hello journal\n")
+			}
+		})
+	}
+
+	// Only the corrupted transaction and those after it are dropped.
+	log := replayTestLog()
+	log[7][journalBlockSize/2]++
+	log = append(log[:7], journalBlock(disklayout.JournalCommitBlockType, 2, nil))
+	if _, got := readReplayedFile(t, recoveryImage(t, log)); got != "hello replay!\n" {
+		t.Errorf("/file.txt = %q, want %q", got, "hello replay!\n")
+	}
+}
+
+// corruptJournalInode flips a byte of the journal inode of image, a copy of
+// assets/journal.ext4, so that it does not match its checksum anymore.
+func corruptJournalInode(t *testing.T, image []byte) {
+	t.Helper()
+	fs, err := NewFilesystem(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	off, err := disklayout.InodeOffset(fs.fs.sb, fs.fs.bgs, fs.fs.sb.JournalInode())
+	if err != nil {
+		t.Fatalf("InodeOffset failed: %v", err)
+	}
+	// Flip a bit of i_atime.
+	image[off+0x8] ^= 1
+}
+
+// TestJournalBackup tests that the journal is found through the backup of the
+// journal inode in the superblock if the journal inode cannot be read.
+func TestJournalBackup(t *testing.T) {
+	fs, image := readImage(t, journalImagePath)
+
+	// The backup matches the journal inode.
+	backup, ok := fs.fs.sb.JournalBackupBlocks()
+	if !ok {
+		t.Fatalf("JournalBackupBlocks() is not valid")
+	}
+	diskInode, _, err := readDiskInode(&fs.fs, fs.fs.sb.JournalInode())
+	if err != nil {
+		t.Fatalf("readDiskInode failed: %v", err)
+	}
+	data := diskInode.Data()
+	for i := 0; i < 15; i++ {
+		if got, want := backup[i], binary.LittleEndian.Uint32(data[i*4:]); got != want {
+			t.Errorf("JournalBackupBlocks()[%d] = %#x, want %#x", i, got, want)
+		}
+	}
+	if got, want := uint64(backup[15])<<32|uint64(backup[16]), diskInode.Size(); got != want {
+		t.Errorf("size in JournalBackupBlocks() = %d, want %d", got, want)
+	}
+
+	corruptJournalInode(t, image)
+	fs, err = NewFilesystem(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	if _, _, err := readDiskInode(&fs.fs, fs.fs.sb.JournalInode()); err == nil {
+		t.Fatalf("readDiskInode of corrupted journal inode succeeded")
+	}
+	j, err := fs.JournalSuperBlock()
+	if err != nil {
+		t.Fatalf("JournalSuperBlock with corrupted journal inode failed: %v", err)
+	}
+	if got := j.MaxLen(); got != 1024 {
+		t.Errorf("MaxLen() = %d, want 1024", got)
+	}
+
+	// The journal cannot be found without the backup.
+	image[disklayout.SbOffset+sbJnlBackupTypeOff] = 0
+	if err := disklayout.UpdateChecksum(image[disklayout.SbOffset : disklayout.SbOffset+disklayout.SbSize]); err != nil {
+		t.Fatalf("UpdateChecksum failed: %v", err)
+	}
+	fs, err = NewFilesystem(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewFilesystem failed: %v", err)
+	}
+	if _, err := fs.JournalSuperBlock(); err == nil {
+		t.Errorf("JournalSuperBlock without backup succeeded, want error")
+	}
+}
+
+// TestReplayJournalBackup tests that a journal found through the backup of the
+// journal inode is replayed.
+func TestReplayJournalBackup(t *testing.T) {
+	image := recoveryImage(t, replayTestLog())
+	corruptJournalInode(t, image)
+	if _, got := readReplayedFile(t, image); got != "hello replay!\n" {
+		t.Errorf("/file.txt = %q, want %q", got, "hello replay!\n")
+	}
+}
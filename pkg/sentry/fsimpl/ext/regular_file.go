@@ -15,11 +15,13 @@
 package ext
 
 import (
+	"bytes"
 	"io"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/safemem"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/sentry/memmap"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
 	"gvisor.dev/gvisor/pkg/sync"
@@ -50,6 +52,13 @@ func newRegularFile(inode inode) (*regularFile, error) {
 
 	inodeFlags := inode.diskInode.Flags()
 
+	if inodeFlags.Inline {
+		// The file data lives in the inode itself.
+		regFile.impl = bytes.NewReader(inode.inlineData)
+		regFile.inode.impl = &regFile
+		return &regFile, nil
+	}
+
 	if inodeFlags.Extents {
 		file, err := newExtentFile(regFile)
 		if err != nil {
@@ -73,6 +82,74 @@ func (in *inode) isRegular() bool {
 	return ok
 }
 
+// mapRunFunc maps a run of consecutive file blocks starting at fileBlk. The
+// run is blocks long, which must be at least 1, and is either stored in
+// consecutive physical blocks starting at phyBlk or, if mapped is false, in a
+// hole.
+type mapRunFunc func(fileBlk uint64) (phyBlk, blocks uint64, mapped bool, err error)
+
+// mapBlockRuns returns a mapRunFunc mapping runs of a single block with
+// mapBlock.
+func mapBlockRuns(mapBlock func(fileBlk uint64) (phyBlk uint64, mapped bool, err error)) mapRunFunc {
+	return func(fileBlk uint64) (uint64, uint64, bool, error) {
+		phyBlk, mapped, err := mapBlock(fileBlk)
+		return phyBlk, 1, mapped, err
+	}
+}
+
+// readMapped implements io.ReaderAt.ReadAt for files whose file blocks are
+// mapped to physical blocks by mapRun. It reads run by run, calling mapRun with
+// the first block of dst and then with the block following each run; runs
+// which are not mapped (holes) read as zeros.
+func (f *regularFile) readMapped(dst []byte, off int64, mapRun mapRunFunc) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+
+	if off < 0 {
+		return 0, syserror.EINVAL
+	}
+
+	size := disklayout.InodeFileSize(f.inode.fs.sb, f.inode.diskInode)
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+	var err error
+	if uint64(len(dst)) > size-uint64(off) {
+		dst = dst[:size-uint64(off)]
+		err = io.EOF
+	}
+
+	blkSize := f.inode.blkSize
+	read := 0
+	for read < len(dst) {
+		cur := uint64(off) + uint64(read)
+		blkOff := cur % blkSize
+
+		phyBlk, blocks, mapped, mapErr := mapRun(cur / blkSize)
+		if mapErr != nil {
+			return read, mapErr
+		}
+		toRead := uint64(len(dst) - read)
+		if blocks <= toRead/blkSize+1 {
+			if runLen := blocks*blkSize - blkOff; runLen < toRead {
+				toRead = runLen
+			}
+		}
+		buf := dst[read : read+int(toRead)]
+
+		if !mapped {
+			for i := range buf {
+				buf[i] = 0
+			}
+		} else if n, _ := f.inode.fs.dev.ReadAt(buf, int64(phyBlk*blkSize+blkOff)); n < len(buf) {
+			return read + n, syserror.EIO
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
 // directoryFD represents a directory file description. It implements
 // vfs.FileDescriptionImpl.
 type regularFileFD struct {
@@ -16,6 +16,8 @@ package ext
 
 import (
 	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/sentry/memmap"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
 	"gvisor.dev/gvisor/pkg/syserror"
@@ -31,32 +33,57 @@ type symlink struct {
 // newSymlink is the symlink constructor. It reads out the symlink target from
 // the inode (however it might have been stored).
 func newSymlink(inode inode) (*symlink, error) {
-	var file *symlink
-	var link []byte
+	// Encrypted targets cannot be decoded, see readTarget.
+	if inode.diskInode.IsEncrypted() {
+		file := &symlink{inode: inode}
+		file.inode.impl = file
+		return file, nil
+	}
+	if inode.diskInode.Flags().Inline {
+		file := &symlink{inode: inode, target: string(inode.inlineData)}
+		file.inode.impl = file
+		return file, nil
+	}
 
 	// If the symlink target is lesser than 60 bytes, its stores in inode.Data().
-	// Otherwise either extents or block maps will be used to store the link.
-	size := inode.diskInode.Size()
-	if size < 60 {
-		link = inode.diskInode.Data()[:size]
-	} else {
-		// Create a regular file out of this inode and read out the target.
-		regFile, err := newRegularFile(inode)
-		if err != nil {
-			return nil, err
+	// Otherwise either extents or block maps will be used to store the link, in
+	// which case the target is read out like a regular file.
+	var regFile *regularFile
+	readBlock := func(blk uint64) ([]byte, error) {
+		if regFile == nil {
+			var err error
+			if regFile, err = newRegularFile(inode); err != nil {
+				return nil, err
+			}
 		}
-
-		link = make([]byte, size)
-		if n, err := regFile.impl.ReadAt(link, 0); uint64(n) < size {
+		buf := make([]byte, inode.blkSize)
+		n, err := regFile.impl.ReadAt(buf, int64(blk*inode.blkSize))
+		if n == 0 {
 			return nil, err
 		}
+		return buf[:n], nil
 	}
 
-	file = &symlink{inode: inode, target: string(link)}
+	target, err := disklayout.SymlinkTarget(inode.diskInode, readBlock)
+	if err != nil {
+		log.Warningf("ext fs: inode %d: %v", inode.inodeNum, err)
+		return nil, syserror.EIO
+	}
+
+	file := &symlink{inode: inode, target: target}
 	file.inode.impl = file
 	return file, nil
 }
 
+// readTarget returns the symlink target. Returns ErrEncrypted if the target is
+// encrypted.
+func (s *symlink) readTarget() (string, error) {
+	if s.inode.diskInode.IsEncrypted() {
+		return "", ErrEncrypted
+	}
+	return s.target, nil
+}
+
 func (in *inode) isSymlink() bool {
 	_, ok := in.impl.(*symlink)
 	return ok
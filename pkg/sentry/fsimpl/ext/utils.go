@@ -15,9 +15,14 @@
 package ext
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sentry/fsimpl/ext/disklayout"
 	"gvisor.dev/gvisor/pkg/syserror"
 )
@@ -37,8 +42,36 @@ func readFromDisk(dev io.ReaderAt, abOff int64, v interface{}) error {
 
 // readSuperBlock reads the SuperBlock from block group 0 in the underlying
 // device. There are three versions of the superblock. This function identifies
-// and returns the correct version.
+// and returns the correct version. The superblock checksum is verified if the
+// filesystem has metadata checksums.
 func readSuperBlock(dev io.ReaderAt) (disklayout.SuperBlock, error) {
+	sb, err := readSuperBlockUnverified(dev)
+	if err != nil {
+		return nil, err
+	}
+	if !sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		return sb, nil
+	}
+
+	raw := make([]byte, disklayout.SbSize)
+	if read, _ := dev.ReadAt(raw, disklayout.SbOffset); read < len(raw) {
+		return nil, syserror.EIO
+	}
+	ok, err := disklayout.VerifyChecksum(raw)
+	if err != nil {
+		log.Warningf("ext fs: cannot verify superblock checksum: %v", err)
+		return nil, syserror.EINVAL
+	}
+	if !ok {
+		log.Warningf("ext fs: superblock checksum mismatch")
+		return nil, syserror.EINVAL
+	}
+	return sb, nil
+}
+
+// readSuperBlockUnverified identifies and reads the correct version of the
+// superblock without verifying its checksum.
+func readSuperBlockUnverified(dev io.ReaderAt) (disklayout.SuperBlock, error) {
 	var sb disklayout.SuperBlock = &disklayout.SuperBlockOld{}
 	if err := readFromDisk(dev, disklayout.SbOffset, sb); err != nil {
 		return nil, err
@@ -47,48 +80,457 @@ func readSuperBlock(dev io.ReaderAt) (disklayout.SuperBlock, error) {
 		return sb, nil
 	}
 
-	sb = &disklayout.SuperBlock32Bit{}
+	// The fields beyond the 32-bit struct are used with or without the 64-bit
+	// feature, which only enables the high halves of the block counts.
+	sb = &disklayout.SuperBlock64Bit{}
 	if err := readFromDisk(dev, disklayout.SbOffset, sb); err != nil {
 		return nil, err
 	}
-	if !sb.IncompatibleFeatures().Is64Bit {
-		return sb, nil
+	return sb, nil
+}
+
+// parseSuperBlock identifies and parses the correct version of the raw
+// superblock, which must be SbSize bytes.
+func parseSuperBlock(raw []byte) disklayout.SuperBlock {
+	var sb disklayout.SuperBlock = &disklayout.SuperBlockOld{}
+	binary.Unmarshal(raw[:binary.Size(sb)], binary.LittleEndian, sb)
+	if sb.Revision() == disklayout.OldRev {
+		return sb
 	}
 
 	sb = &disklayout.SuperBlock64Bit{}
-	if err := readFromDisk(dev, disklayout.SbOffset, sb); err != nil {
+	binary.Unmarshal(raw[:binary.Size(sb)], binary.LittleEndian, sb)
+	return sb
+}
+
+// seededSuperBlock is a superblock whose checksum seed was computed once,
+// since it seeds the checksum of every group descriptor, inode, bitmap and
+// directory block.
+type seededSuperBlock struct {
+	disklayout.SuperBlock
+	seed uint32
+}
+
+// ChecksumSeed implements disklayout.SuperBlock.ChecksumSeed.
+func (sb *seededSuperBlock) ChecksumSeed() uint32 { return sb.seed }
+
+// cacheChecksumSeed returns sb with its checksum seed computed once.
+func cacheChecksumSeed(sb disklayout.SuperBlock) disklayout.SuperBlock {
+	if sb, ok := sb.(*seededSuperBlock); ok {
+		return sb
+	}
+	return &seededSuperBlock{SuperBlock: sb, seed: sb.ChecksumSeed()}
+}
+
+// readSuperBlockCopy reads the copy of the superblock at byte offset off of
+// dev, and returns it if it is valid and matches its checksum.
+func readSuperBlockCopy(dev BlockDevice, off uint64) (disklayout.SuperBlock, error) {
+	blk, err := dev.ReadBlock(off / dev.BlockSize())
+	if err != nil {
 		return nil, err
 	}
+	raw := blk[off%dev.BlockSize():][:disklayout.SbSize]
+	sb := parseSuperBlock(raw)
+	if err := disklayout.ValidateSuperBlock(sb); err != nil {
+		return sb, err
+	}
+	if ok, err := disklayout.VerifyChecksum(raw); err == nil && !ok {
+		e := disklayout.NewDiskError(disklayout.ErrChecksumMismatch, "superblock checksum mismatch")
+		e.Offset = int64(off)
+		return sb, e
+	} else if err != nil && err != disklayout.ErrNoMetadataCsum {
+		return sb, err
+	}
+	if sb.BlockSize() != dev.BlockSize() {
+		return sb, fmt.Errorf("superblock has block size %d, want %d", sb.BlockSize(), dev.BlockSize())
+	}
 	return sb, nil
 }
 
-// blockGroupsCount returns the number of block groups in the ext fs.
-func blockGroupsCount(sb disklayout.SuperBlock) uint64 {
-	blocksCount := sb.BlocksCount()
-	blocksPerGroup := uint64(sb.BlocksPerGroup())
+// OpenSuperBlock reads the superblock of the filesystem on dev. Like e2fsck
+// -b, the backup copies are tried in turn if the primary superblock is invalid
+// or does not match its checksum, in which case usedBackup is true. The
+// backups are located with the geometry of the primary superblock if only its
+// checksum is wrong, and with the default geometry of mke2fs otherwise, which
+// places the first backup in block group 1 with 8 * dev.BlockSize() blocks per
+// group. Returns EINVAL if no valid copy is found.
+//
+// Unlike Linux, which only uses a backup superblock if asked to with the sb
+// mount option, mounting does not fall back to the backups.
+func OpenSuperBlock(dev BlockDevice) (sb disklayout.SuperBlock, usedBackup bool, err error) {
+	bs := dev.BlockSize()
+	primary, err := readSuperBlockCopy(dev, disklayout.SbOffset)
+	if err == nil {
+		return primary, false, nil
+	}
+	if err == syserror.EIO {
+		return nil, false, err
+	}
+	log.Warningf("ext fs: primary superblock: %v", err)
+
+	// Each backup is at the start of its block group.
+	var firstDataBlock uint64
+	if bs == disklayout.MinBlockSize {
+		firstDataBlock = 1
+	}
+	backups := []uint64{firstDataBlock + 8*bs}
+	if disklayout.ValidateSuperBlock(primary) == nil && primary.BlockSize() == bs {
+		for _, g := range primary.BackupGroups() {
+			backups = append(backups, uint64(primary.FirstDataBlock())+uint64(g)*uint64(primary.BlocksPerGroup()))
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i] < backups[j] })
 
-	// Round up the result. float64 can compromise precision so do it manually.
-	return (blocksCount + blocksPerGroup - 1) / blocksPerGroup
+	for i, blk := range backups {
+		if i > 0 && blk == backups[i-1] {
+			continue
+		}
+		sb, err := readSuperBlockCopy(dev, blk*bs)
+		if err == syserror.EIO {
+			// This and the following backups are past the end of dev.
+			break
+		}
+		if err != nil {
+			continue
+		}
+		// Ignore copies which do not start a block group of their own geometry.
+		if first := uint64(sb.FirstDataBlock()); blk <= first || (blk-first)%uint64(sb.BlocksPerGroup()) != 0 {
+			continue
+		}
+		log.Infof("ext fs: using backup superblock at block %d", blk)
+		return sb, true, nil
+	}
+	return nil, false, syserror.EINVAL
 }
 
-// readBlockGroups reads the block group descriptor table from block group 0 in
-// the underlying device.
-func readBlockGroups(dev io.ReaderAt, sb disklayout.SuperBlock) ([]disklayout.BlockGroup, error) {
-	bgCount := blockGroupsCount(sb)
+// GroupDescriptorError is returned by LoadGroupDescriptors if the descriptors
+// of some block groups could not be verified.
+type GroupDescriptorError struct {
+	// Errs maps the numbers of the rejected block groups to the reason.
+	Errs map[uint32]error
+}
+
+// Error implements error.Error.
+func (e *GroupDescriptorError) Error() string {
+	groups := make([]uint32, 0, len(e.Errs))
+	for g := range e.Errs {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid block group descriptors", len(groups))
+	for _, g := range groups {
+		fmt.Fprintf(&b, "; block group %d: %v", g, e.Errs[g])
+	}
+	return b.String()
+}
+
+// LoadGroupDescriptors reads the block group descriptor table of the
+// filesystem described by sb from dev, in both the contiguous and the meta
+// block group layouts. See disklayout.GroupDescriptorLocation.
+//
+// Descriptor checksums are verified if the filesystem has them. The
+// descriptors of all groups are returned even if some do not match their
+// checksum, in which case a *GroupDescriptorError listing those groups is
+// returned along with them. Other errors are returned without descriptors.
+// LoadGroupDescriptors keeps no state of its own, so it may be called
+// concurrently as long as dev permits concurrent reads.
+func LoadGroupDescriptors(sb disklayout.SuperBlock, dev BlockDevice) ([]disklayout.BlockGroup, error) {
+	bgCount := sb.GroupsCount()
 	bgdSize := uint64(sb.BgDescSize())
-	is64Bit := sb.IncompatibleFeatures().Is64Bit
+	descPerBlock := sb.BlockSize() / bgdSize
 	bgds := make([]disklayout.BlockGroup, bgCount)
+	roCompat := sb.ReadOnlyCompatibleFeatures()
+	hasCsum := roCompat.MetadataCsum || roCompat.GdtCsum
+	var errs map[uint32]error
 
-	for i, off := uint64(0), uint64(sb.FirstDataBlock()+1)*sb.BlockSize(); i < bgCount; i, off = i+1, off+bgdSize {
-		if is64Bit {
-			bgds[i] = &disklayout.BlockGroup64Bit{}
-		} else {
-			bgds[i] = &disklayout.BlockGroup32Bit{}
+	for nr := uint64(0); nr*descPerBlock < bgCount; nr++ {
+		blkNum, _ := disklayout.GroupDescriptorLocation(sb, uint32(nr*descPerBlock))
+		blk, err := dev.ReadBlock(blkNum)
+		if err != nil {
+			return nil, err
 		}
+		for i := nr * descPerBlock; i < (nr+1)*descPerBlock && i < bgCount; i++ {
+			raw := blk[(i%descPerBlock)*bgdSize:][:bgdSize]
+			if hasCsum {
+				if ok, err := disklayout.VerifyBlockGroupChecksum(sb, uint32(i), raw); err != nil || !ok {
+					if err == nil {
+						e := disklayout.NewDiskError(disklayout.ErrChecksumMismatch, "checksum mismatch")
+						e.Group = int64(i)
+						e.Offset = int64(blkNum*sb.BlockSize() + (i%descPerBlock)*bgdSize)
+						err = e
+					}
+					if errs == nil {
+						errs = make(map[uint32]error)
+					}
+					errs[uint32(i)] = err
+				}
+			}
 
-		if err := readFromDisk(dev, int64(off), bgds[i]); err != nil {
-			return nil, err
+			bgds[i] = disklayout.NewBlockGroup(sb)
+			binary.Unmarshal(raw[:binary.Size(bgds[i])], binary.LittleEndian, bgds[i])
 		}
 	}
+	if errs != nil {
+		return bgds, &GroupDescriptorError{Errs: errs}
+	}
 	return bgds, nil
 }
+
+// readBitmap reads the bitmap of size bits stored in block blk. The bitmap
+// always fits in one block.
+func readBitmap(dev io.ReaderAt, sb disklayout.SuperBlock, blk uint64, bits uint32) (disklayout.Bitmap, error) {
+	if uint64(bits) > sb.BlockSize()*8 {
+		return nil, syserror.EIO
+	}
+	bitmap := make(disklayout.Bitmap, (bits+7)/8)
+	if read, _ := dev.ReadAt(bitmap, int64(blk*sb.BlockSize())); read < len(bitmap) {
+		return nil, syserror.EIO
+	}
+	return bitmap, nil
+}
+
+// readBlockBitmap returns the block bitmap of block group bgNum. Each bit
+// tracks one cluster (which is one block unless bigalloc is enabled). Returns
+// EIO if the bitmap does not match its checksum; only metadata_csum
+// filesystems have bitmap checksums (see disklayout.BitmapChecksumMode).
+//
+// If the group has BgBlockUninit set, the on-disk bitmap may be stale and is
+// not read. It is synthesized instead like ext4_init_block_bitmap does: only
+// the group's superblock and group descriptor copies, its bitmaps and inode
+// table (when they are located in the group) and the bits past the end of the
+// filesystem in the last group are marked in use.
+func readBlockBitmap(dev io.ReaderAt, sb disklayout.SuperBlock, bgNum uint32, bg disklayout.BlockGroup) (disklayout.Bitmap, error) {
+	bits := sb.ClustersPerGroup()
+	if !bg.Flags().BlockUninit {
+		bitmap, err := readBitmap(dev, sb, bg.BlockBitmap(), bits)
+		if err != nil {
+			return nil, err
+		}
+		if disklayout.BitmapChecksumMode(sb) == disklayout.BitmapCsumCrc32cTail {
+			if ok, _ := disklayout.VerifyBlockBitmapChecksum(sb, bg, bitmap); !ok {
+				log.Warningf("ext fs: block group %d: block bitmap checksum mismatch", bgNum)
+				return nil, syserror.EIO
+			}
+		}
+		return bitmap, nil
+	}
+
+	bitmap := make(disklayout.Bitmap, (bits+7)/8)
+	groupStart := uint64(sb.FirstDataBlock()) + uint64(bgNum)*uint64(sb.BlocksPerGroup())
+	groupEnd := groupStart + uint64(sb.BlocksPerGroup())
+	markBlocks := func(start, n uint64) {
+		for blk := start; blk < start+n; blk++ {
+			if blk >= groupStart && blk < groupEnd {
+				c := disklayout.BlockToCluster(sb, blk) - disklayout.BlockToCluster(sb, groupStart)
+				bitmap[c/8] |= 1 << (c % 8)
+			}
+		}
+	}
+	markBlocks(disklayout.GroupBaseMetaBlocks(sb, uint64(bgNum)))
+	markBlocks(bg.BlockBitmap(), 1)
+	markBlocks(bg.InodeBitmap(), 1)
+	markBlocks(bg.InodeTable(), disklayout.InodeTableBlocks(sb))
+	if groupEnd > sb.BlocksCount() {
+		// Mark the clusters after the one holding the last block.
+		last := disklayout.BlockToCluster(sb, sb.BlocksCount()-1) - disklayout.BlockToCluster(sb, groupStart)
+		for c := last + 1; c < uint64(bits); c++ {
+			bitmap[c/8] |= 1 << (c % 8)
+		}
+	}
+	return bitmap, nil
+}
+
+// readInodeBitmap returns the inode bitmap of block group bgNum. If the group
+// has BgInodeUninit set, none of its inodes are in use and an all-free bitmap
+// is returned without reading the on-disk bitmap. Returns EIO if the bitmap
+// does not match its checksum.
+func readInodeBitmap(dev io.ReaderAt, sb disklayout.SuperBlock, bgNum uint32, bg disklayout.BlockGroup) (disklayout.Bitmap, error) {
+	bits := sb.InodesPerGroup()
+	if bg.Flags().InodeUninit {
+		return make(disklayout.Bitmap, (bits+7)/8), nil
+	}
+	bitmap, err := readBitmap(dev, sb, bg.InodeBitmap(), bits)
+	if err != nil {
+		return nil, err
+	}
+	if disklayout.BitmapChecksumMode(sb) == disklayout.BitmapCsumCrc32cTail {
+		if ok, _ := disklayout.VerifyInodeBitmapChecksum(sb, bg, bitmap); !ok {
+			log.Warningf("ext fs: block group %d: inode bitmap checksum mismatch", bgNum)
+			return nil, syserror.EIO
+		}
+	}
+	return bitmap, nil
+}
+
+// readExcludeBitmap returns the snapshot exclude bitmap of the block group
+// bg of a filesystem with disklayout.SbExcludeBitmap, which marks the
+// clusters of the group excluded from snapshots like the block bitmap marks
+// the ones in use. Exclude bitmaps have no checksum. Returns ENOENT if the
+// filesystem has no exclude bitmaps.
+//
+// If the group has BgBlockUninit set, the exclude bitmap has not been written
+// either and an all-clear bitmap is returned without reading it.
+func readExcludeBitmap(dev io.ReaderAt, sb disklayout.SuperBlock, bg disklayout.BlockGroup) (disklayout.Bitmap, error) {
+	if !sb.ExcludeBitmapPresent() {
+		return nil, syserror.ENOENT
+	}
+	bits := sb.ClustersPerGroup()
+	if bg.Flags().BlockUninit {
+		return make(disklayout.Bitmap, (bits+7)/8), nil
+	}
+	return readBitmap(dev, sb, bg.ExclusionBitmap(), bits)
+}
+
+// readMMPBlock reads the MMP block of a filesystem with the SbMMP feature.
+// Returns EINVAL if the MMP block is invalid or does not match its checksum.
+func readMMPBlock(dev io.ReaderAt, sb disklayout.SuperBlock) (*disklayout.MMPBlock, error) {
+	blk := sb.MMPBlock()
+	if blk < uint64(sb.FirstDataBlock()) || blk >= sb.BlocksCount() {
+		log.Warningf("ext fs: invalid MMP block %d", blk)
+		return nil, syserror.EINVAL
+	}
+
+	raw := make([]byte, disklayout.MMPSize)
+	if read, _ := dev.ReadAt(raw, int64(blk*sb.BlockSize())); read < len(raw) {
+		return nil, syserror.EIO
+	}
+	mmp, err := disklayout.ParseMMPBlock(raw)
+	if err != nil {
+		log.Warningf("ext fs: %v", err)
+		return nil, syserror.EINVAL
+	}
+	if ok, err := disklayout.VerifyMMPChecksum(sb, raw); err == nil && !ok {
+		log.Warningf("ext fs: MMP block checksum mismatch")
+		return nil, syserror.EINVAL
+	}
+	return mmp, nil
+}
+
+// ErrStopWalk may be returned by the callback of WalkDir to stop the walk
+// early. WalkDir then returns nil.
+var ErrStopWalk = errors.New("ext fs: stop directory walk")
+
+// WalkDir calls fn for each entry of the directory inode dir of the filesystem
+// described by sb, in on-disk order, reading its blocks from dev. Unused
+// entries, which include deleted entries and the ext4_dir_entry_tail holding
+// the checksum of each block, are skipped. The walk stops at the first error
+// returned by fn, which WalkDir returns unless it is ErrStopWalk. The
+// disklayout.Dirent.Type of entries is disklayout.DirentTypeUnknown unless
+// the filesystem has the SbDirentFileType feature;
+// disklayout.DirentTypeFromMode gives it from the mode of the entry's inode.
+//
+// Since the inode number of dir is not known, the checksums of its extent tree
+// and directory blocks are not verified, and the "." entry of inline data
+// directories, which is not stored on disk, is not reported. The entries of
+// inline data directories stored in extended attributes past i_block cannot
+// be read from dir either, so WalkDir returns EOPNOTSUPP for them. Returns
+// ENOTDIR if dir is not a directory and EIO if its blocks are invalid.
+func WalkDir(dir disklayout.Inode, sb disklayout.SuperBlock, dev BlockDevice, fn func(disklayout.Dirent) error) error {
+	if !dir.IsDir() {
+		return syserror.ENOTDIR
+	}
+	hasFileType := sb.IncompatibleFeatures().DirentFileType
+	walk := func(dirents []disklayout.Dirent) error {
+		for _, d := range dirents {
+			if err := fn(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if dir.Flags().Inline {
+		if dir.Size() > disklayout.MinInlineDataSize {
+			return syserror.EOPNOTSUPP
+		}
+		var dirents []disklayout.Dirent
+		if dirents, err = disklayout.ParseInlineDir(0, dir.Data(), hasFileType); err != nil {
+			log.Warningf("ext fs: %v", err)
+			return syserror.EIO
+		}
+		// Drop the synthesized "." entry.
+		err = walk(dirents[1:])
+	} else {
+		err = walkDirBlocks(dir, sb, dev, hasFileType, walk)
+	}
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
+
+// WalkDirChecked is like WalkDir, except that the inode number of each entry
+// is first checked with disklayout.CheckDirentInode. Entries which fail the
+// check are passed to bad along with the error instead of being passed to fn,
+// and the walk stops at the first error returned by bad like it does for fn.
+// If bad is nil, WalkDirChecked returns EIO at the first such entry.
+func WalkDirChecked(dir disklayout.Inode, sb disklayout.SuperBlock, dev BlockDevice, fn func(disklayout.Dirent) error, bad func(disklayout.Dirent, error) error) error {
+	return WalkDir(dir, sb, dev, func(d disklayout.Dirent) error {
+		err := disklayout.CheckDirentInode(sb, d.Inode())
+		if err == nil {
+			return fn(d)
+		}
+		if bad == nil {
+			log.Warningf("ext fs: directory entry %q: %v", d.FileName(), err)
+			return syserror.EIO
+		}
+		return bad(d, err)
+	})
+}
+
+// walkDirBlocks calls walk with the dirents of each block of the linear or
+// hash tree directory dir. See WalkDir.
+func walkDirBlocks(dir disklayout.Inode, sb disklayout.SuperBlock, dev BlockDevice, hasFileType bool, walk func([]disklayout.Dirent) error) error {
+	var mapBlock func(fileBlk uint64) (uint64, bool, error)
+	if dir.Flags().Extents {
+		root, err := disklayout.ParseExtentNode(dir.Data())
+		if err != nil {
+			log.Warningf("ext fs: %v", err)
+			return syserror.EIO
+		}
+		mapBlock = func(fileBlk uint64) (uint64, bool, error) {
+			phyBlk, unwritten, found, err := disklayout.MapBlock(root, dev.ReadBlock, fileBlk)
+			return phyBlk, found && !unwritten, err
+		}
+	} else {
+		mapBlock = disklayout.NewIndirectMapper(dir.Data(), sb.BlockSize(), dev.ReadBlock).MapBlock
+	}
+
+	blkSize := sb.BlockSize()
+	size := disklayout.InodeFileSize(sb, dir)
+	for off := uint64(0); off < size; off += blkSize {
+		fileBlk := off / blkSize
+		phyBlk, mapped, err := mapBlock(fileBlk)
+		if err != nil {
+			if _, ok := err.(*disklayout.ExtentNodeError); ok {
+				log.Warningf("ext fs: %v", err)
+				return syserror.EIO
+			}
+			return err
+		}
+		if !mapped || phyBlk >= sb.BlocksCount() {
+			// Like Linux, holes in directories are corruption.
+			log.Warningf("ext fs: directory block %d is not mapped to a valid block", fileBlk)
+			return syserror.EIO
+		}
+		block, err := dev.ReadBlock(phyBlk)
+		if err != nil {
+			return err
+		}
+		if toRead := size - off; toRead < blkSize {
+			block = block[:toRead]
+		}
+		dirents, err := disklayout.ParseDirBlock(block, hasFileType)
+		if err != nil {
+			log.Warningf("ext fs: directory block %d: %v", fileBlk, err)
+			return syserror.EIO
+		}
+		if err := walk(dirents); err != nil {
+			return err
+		}
+	}
+	return nil
+}